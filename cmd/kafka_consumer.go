@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/signal"
+	"syscall"
+
+	"github.com/airbrake/gobrake/v5"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/server/monitoring"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+)
+
+// startKafkaConsumer runs the consume-kafka mode: the records of the kafka_consumer topics are dispatched with the
+// records routing until SIGTERM or SIGINT is received, then the producers are flushed before the offsets are committed
+func startKafkaConsumer(conf *config.Config, airbrakeNotifier *gobrake.Notifier, logger *logrus.Logger) error {
+	if errs := conf.Validate(); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if conf.KafkaConsumer == nil {
+		return errors.New("expected kafka_consumer to be configured")
+	}
+	logger.ActivityLog("starting_kafka_consumer", nil)
+
+	airbrakeHandler := airbrake.NewAirbrakeHandlerWithOptions(airbrakeNotifier, conf.AirbrakeOptions())
+	var statusServer *monitoring.StatusServer
+	if conf.StatusPort > 0 {
+		statusServer = monitoring.StartStatusServer(conf, logger, airbrakeHandler)
+	}
+	if conf.Monitoring != nil {
+		monitoring.StartServerMetrics(conf, logger, streaming.NewSocketRegistry())
+	}
+
+	dispatchers, producerRules, err := conf.ConfigureProducers(airbrakeHandler, logger)
+	if err != nil {
+		return err
+	}
+	if statusServer != nil {
+		statusServer.SetProducers(dispatchers, conf.ReadinessDispatchers())
+	}
+	consumer, err := conf.NewKafkaConsumer(logger)
+	if err != nil {
+		return err
+	}
+	router := conf.NewRouter(producerRules)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	// the offsets are stored once the records are acked, instead of acking a vehicle
+	err = consumer.Run(ctx, router.DispatchWithErrors, conf.RequiredAcks, conf.AckChan)
+
+	conf.CloseDispatchPool()
+	closeProducers(dispatchers, logger)
+	if closeErr := consumer.Close(); closeErr != nil {
+		logger.ErrorLog("kafka_consumer_close_error", closeErr, nil)
+	}
+	logger.ActivityLog("stopped_kafka_consumer", nil)
+	return err
+}
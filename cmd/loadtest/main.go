@@ -0,0 +1,75 @@
+// Command loadtest simulates vehicles streaming V records to a fleet-telemetry server and prints the throughput
+// and ack latency. The client certificate must be issued to a vehicle by a CA the server trusts.
+//
+//	loadtest -url wss://localhost:4443 -cert vehicle.crt -key vehicle.key [-ca server_ca.crt] [-clients 100 -rate 10 -duration 1m -fields 20]
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/test/loadtest"
+)
+
+func main() {
+	url := flag.String("url", "wss://localhost:4443", "url of the fleet-telemetry server")
+	certFile := flag.String("cert", "", "client certificate of the simulated vehicles")
+	keyFile := flag.String("key", "", "key of the client certificate")
+	caFile := flag.String("ca", "", "CA of the server certificate, the system CAs are used when empty")
+	clients := flag.Int("clients", 10, "number of simulated vehicles")
+	rate := flag.Float64("rate", 10, "records sent per second by each vehicle")
+	duration := flag.Duration("duration", time.Minute, "how long records are sent")
+	fields := flag.Int("fields", 10, "number of fields of each record")
+	flag.Parse()
+
+	tlsConfig, err := clientTLSConfig(*certFile, *keyFile, *caFile)
+	if err != nil {
+		fail(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	summary, err := loadtest.Run(ctx, loadtest.Config{
+		URL:       *url,
+		TLSConfig: tlsConfig,
+		Clients:   *clients,
+		Rate:      *rate,
+		Duration:  *duration,
+		Fields:    *fields,
+	})
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(summary)
+}
+
+func clientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't properly load cert pair (%s, %s): %w", certFile, keyFile, err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("ca not properly loaded: %s", caFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
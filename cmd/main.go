@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	_ "go.uber.org/automaxprocs"
 
@@ -12,6 +20,8 @@ import (
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
 	"github.com/teslamotors/fleet-telemetry/server/monitoring"
 	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+	"github.com/teslamotors/fleet-telemetry/tracing"
 )
 
 func main() {
@@ -23,6 +33,10 @@ func main() {
 		panic(fmt.Sprintf("error=load_service_config value=\"%s\"", err.Error()))
 	}
 
+	if flag.Arg(0) == "validate-config" {
+		os.Exit(validateConfig(config))
+	}
+
 	if config.Monitoring != nil && config.Monitoring.ProfilingPath != "" {
 		if config.Monitoring.ProfilerFile, err = os.Create(config.Monitoring.ProfilingPath); err != nil {
 			logger.ErrorLog("profiling_file_error", err, nil)
@@ -35,6 +49,16 @@ func main() {
 		}()
 	}
 
+	shutdownTracing, err := tracing.Init(config.Tracing)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.ErrorLog("tracing_shutdown_error", err, nil)
+		}
+	}()
+
 	airbrakeNotifier, _, err := config.CreateAirbrakeNotifier(logger)
 	if err != nil {
 		panic(err)
@@ -47,17 +71,47 @@ func main() {
 			}
 		}()
 	}
-	panic(startServer(config, airbrakeNotifier, logger))
+	if flag.Arg(0) == "consume-kafka" {
+		if err := startKafkaConsumer(config, airbrakeNotifier, logger); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if err := startServer(config, airbrakeNotifier, logger); !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+}
+
+// validateConfig prints every problem of the config, without connecting to the datastores,
+// and returns the exit code of the validate-config command
+func validateConfig(conf *config.Config) int {
+	errs := conf.Validate()
+	if _, err := streaming.LoadVINFilter(conf.VINAllowlist, conf.VINDenylist); err != nil {
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("config ok")
+	return 0
 }
 
 func startServer(config *config.Config, airbrakeNotifier *gobrake.Notifier, logger *logrus.Logger) (err error) {
+	// the checks of validate-config, the server refuses to start with a config it reports problems for
+	if errs := config.Validate(); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
 	logger.ActivityLog("starting_server", nil)
 	registry := streaming.NewSocketRegistry()
 
-	airbrakeHandler := airbrake.NewAirbrakeHandler(airbrakeNotifier)
+	airbrakeHandler := airbrake.NewAirbrakeHandlerWithOptions(airbrakeNotifier, config.AirbrakeOptions())
 
+	var statusServer *monitoring.StatusServer
 	if config.StatusPort > 0 {
-		monitoring.StartStatusServer(config, logger, airbrakeHandler)
+		statusServer = monitoring.StartStatusServer(config, logger, airbrakeHandler)
 	}
 	if config.Monitoring != nil {
 		monitoring.StartServerMetrics(config, logger, registry)
@@ -67,16 +121,48 @@ func startServer(config *config.Config, airbrakeNotifier *gobrake.Notifier, logg
 	if err != nil {
 		return err
 	}
-	server, _, err := streaming.InitServer(config, airbrakeHandler, producerRules, logger, registry)
+	if statusServer != nil {
+		statusServer.SetProducers(dispatchers, config.ReadinessDispatchers())
+	}
+	server, socketServer, err := streaming.InitServer(config, airbrakeHandler, producerRules, logger, registry)
 	if err != nil {
 		return err
 	}
+	if config.DebugVIN != nil {
+		monitoring.RegisterDebugVIN(config, socketServer.RecentRecords(), logger)
+	}
+	go reloadOnSighup(config, socketServer, dispatchers, logger)
+	drained := make(chan struct{})
+	go drainOnSigterm(config, server, socketServer, dispatchers, drained, logger)
+
+	if config.Backpressure != nil {
+		backpressureMonitor, err := streaming.NewBackpressureMonitor(config, dispatchers, registry, logger)
+		if err != nil {
+			return err
+		}
+		backpressureMonitor.Start()
+	}
 
 	if server.TLSConfig, err = config.ExtractServiceTLSConfig(logger); err != nil {
 		return err
 	}
+	if config.GRPC != nil && config.GRPC.Enabled {
+		if err = serveGRPC(config, socketServer, server.TLSConfig, logger); err != nil {
+			return err
+		}
+	}
 
 	err = server.ListenAndServeTLS(config.TLS.ServerCert, config.TLS.ServerKey)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-drained
+	}
+	config.CloseDispatchPool()
+	closeProducers(dispatchers, logger)
+	logger.ActivityLog("stopped_server", nil)
+	return err
+}
+
+func closeProducers(dispatchers map[telemetry.Dispatcher]telemetry.Producer, logger *logrus.Logger) {
 	for dispatcher, producer := range dispatchers {
 		logger.ActivityLog("attempting_to_close", logrus.LogInfo{"dispatcher": dispatcher})
 		// We don't care if this fails. If it does, we'll just continue on.
@@ -84,6 +170,56 @@ func startServer(config *config.Config, airbrakeNotifier *gobrake.Notifier, logg
 			logger.ErrorLog("producer_close_error", dispatcherCloseErr, logrus.LogInfo{"dispatcher": dispatcher})
 		}
 	}
-	logger.ActivityLog("stopped_server", nil)
-	return err
+}
+
+// serveGRPC starts the gRPC ingest endpoint on its own port, it is stopped when the socket server drains
+func serveGRPC(conf *config.Config, socketServer *streaming.Server, tlsConfig *tls.Config, logger *logrus.Logger) error {
+	grpcServer, err := socketServer.NewGRPCServer(conf, tlsConfig)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%v:%v", conf.Host, conf.GRPC.Port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			logger.ErrorLog("grpc_server_error", err, nil)
+		}
+	}()
+	logger.ActivityLog("grpc_server_started", logrus.LogInfo{"port": conf.GRPC.Port})
+	return nil
+}
+
+// drainOnSigterm stops accepting connections and drains the in flight records when receiving SIGTERM or SIGINT,
+// drained is closed once the producers can be closed
+func drainOnSigterm(conf *config.Config, server *http.Server, socketServer *streaming.Server, dispatchers map[telemetry.Dispatcher]telemetry.Producer, drained chan struct{}, logger *logrus.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	defer close(drained)
+
+	logger.ActivityLog("shutdown_requested", logrus.LogInfo{"drain_timeout_ms": conf.DrainTimeout().Milliseconds()})
+	ctx, cancel := context.WithTimeout(context.Background(), conf.DrainTimeout())
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.ErrorLog("server_shutdown_error", err, nil)
+	}
+	socketServer.Drain(ctx, dispatchers)
+}
+
+// reloadOnSighup reloads the dispatch rules and rate limits from the config file when receiving SIGHUP
+func reloadOnSighup(conf *config.Config, server *streaming.Server, dispatchers map[telemetry.Dispatcher]telemetry.Producer, logger *logrus.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		logger.ActivityLog("config_reload_requested", nil)
+		newConfig, err := conf.Reload()
+		if err == nil {
+			err = server.Reload(conf, newConfig, dispatchers)
+		}
+		if err != nil {
+			logger.ErrorLog("config_reload_error", err, nil)
+		}
+	}
 }
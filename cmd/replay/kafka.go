@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+)
+
+const (
+	// kafkaTimeoutMs bounds the metadata and offset queries
+	kafkaTimeoutMs = 10000
+	// kafkaIdleTimeout stops the replay when no message is received before the end of the range is reached
+	kafkaIdleTimeout = 30 * time.Second
+)
+
+// kafkaRange selects the messages of a topic to replay, offsets and times are per partition and the end is excluded
+type kafkaRange struct {
+	topic       string
+	startOffset int64
+	endOffset   int64
+	startTime   string
+	endTime     string
+}
+
+func kafkaRangeFlags() *kafkaRange {
+	r := &kafkaRange{}
+	flag.StringVar(&r.topic, "kafka-topic", "", "replay the records of this kafka topic instead of files, using the kafka config")
+	flag.Int64Var(&r.startOffset, "start-offset", -1, "first offset replayed in each partition, defaults to the oldest message")
+	flag.Int64Var(&r.endOffset, "end-offset", -1, "offset at which the replay of each partition stops, defaults to the latest message")
+	flag.StringVar(&r.startTime, "start-time", "", "replay the messages produced from this RFC3339 time")
+	flag.StringVar(&r.endTime, "end-time", "", "replay the messages produced before this RFC3339 time")
+	return r
+}
+
+// replayKafka assigns the partitions of the topic from the start of the range and produces their messages until the end of the range
+func (r *replayer) replayKafka(conf *config.Config, kafkaRange *kafkaRange, logger *logrus.Logger) error {
+	if conf.Kafka == nil {
+		return errors.New("expected Kafka to be configured")
+	}
+	consumerConfig := confluent.ConfigMap{}
+	for key, value := range *conf.Kafka {
+		// go properties are specific to producers or consumers
+		if !strings.HasPrefix(key, "go.") {
+			consumerConfig[key] = value
+		}
+	}
+	consumerConfig["group.id"] = "fleet-telemetry-replay"
+	consumerConfig["enable.auto.commit"] = false
+
+	consumer, err := confluent.NewConsumer(&consumerConfig)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	assignments, ends, err := kafkaRange.partitions(consumer)
+	if err != nil {
+		return err
+	}
+	if err := consumer.Assign(assignments); err != nil {
+		return err
+	}
+
+	replayed, failed, skipped := 0, 0, 0
+	defer func() {
+		logger.ActivityLog("replay_kafka_done", logrus.LogInfo{"topic": kafkaRange.topic, "replayed": replayed, "failed": failed, "skipped": skipped})
+	}()
+	for len(ends) > 0 {
+		message, err := consumer.ReadMessage(kafkaIdleTimeout)
+		if err != nil {
+			var kafkaErr confluent.Error
+			if errors.As(err, &kafkaErr) && kafkaErr.IsTimeout() {
+				return fmt.Errorf("no message received for %s, %d partitions did not reach the end of the range", kafkaIdleTimeout, len(ends))
+			}
+			return err
+		}
+
+		partition := message.TopicPartition.Partition
+		end, ok := ends[partition]
+		if !ok || int64(message.TopicPartition.Offset) >= end {
+			continue
+		}
+		if int64(message.TopicPartition.Offset) >= end-1 {
+			delete(ends, partition)
+		}
+
+		record, err := kafka.RecordFromMessage(message)
+		if err != nil {
+			skipped++
+			logger.ErrorLog("replay_kafka_message_error", err, logrus.LogInfo{"partition": partition, "offset": message.TopicPartition.Offset})
+			continue
+		}
+		recordReplayed, recordFailed := r.produce(record)
+		replayed += recordReplayed
+		failed += recordFailed
+	}
+	return nil
+}
+
+// partitions returns the start offset of each partition to replay and the offset at which it ends
+func (k *kafkaRange) partitions(consumer *confluent.Consumer) ([]confluent.TopicPartition, map[int32]int64, error) {
+	metadata, err := consumer.GetMetadata(&k.topic, false, kafkaTimeoutMs)
+	if err != nil {
+		return nil, nil, err
+	}
+	topicMetadata, ok := metadata.Topics[k.topic]
+	if !ok || topicMetadata.Error.Code() != confluent.ErrNoError {
+		return nil, nil, fmt.Errorf("kafka topic %s not found: %v", k.topic, topicMetadata.Error)
+	}
+
+	var assignments []confluent.TopicPartition
+	ends := make(map[int32]int64)
+	for _, partitionMetadata := range topicMetadata.Partitions {
+		partition := partitionMetadata.ID
+		low, high, err := consumer.QueryWatermarkOffsets(k.topic, partition, kafkaTimeoutMs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		start := max(low, k.startOffset)
+		if k.startTime != "" {
+			if start, err = offsetForTime(consumer, k.topic, partition, k.startTime, high); err != nil {
+				return nil, nil, err
+			}
+		}
+		end := high
+		if k.endOffset >= 0 {
+			end = min(high, k.endOffset)
+		}
+		if k.endTime != "" {
+			if end, err = offsetForTime(consumer, k.topic, partition, k.endTime, high); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if start < end {
+			assignments = append(assignments, confluent.TopicPartition{Topic: &k.topic, Partition: partition, Offset: confluent.Offset(start)})
+			ends[partition] = end
+		}
+	}
+	return assignments, ends, nil
+}
+
+// offsetForTime returns the offset of the first message produced at or after value, or high if there is none
+func offsetForTime(consumer *confluent.Consumer, topic string, partition int32, value string, high int64) (int64, error) {
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	offsets, err := consumer.OffsetsForTimes([]confluent.TopicPartition{{Topic: &topic, Partition: partition, Offset: confluent.Offset(timestamp.UnixMilli())}}, kafkaTimeoutMs)
+	if err != nil {
+		return 0, err
+	}
+	if len(offsets) == 0 || offsets[0].Offset < 0 {
+		return high, nil
+	}
+	return int64(offsets[0].Offset), nil
+}
@@ -0,0 +1,170 @@
+// Command replay produces records again, from the files written by the file datastore or from a kafka topic.
+// It uses the same configuration file as the server, the replayed source should not be configured as a
+// dispatcher of the replayed record types.
+//
+//	replay -config config.json [-dispatcher kafka] [-rate 100] [-dry-run] [-dir /var/lib/fleet-telemetry | file...]
+//	replay -config config.json -kafka-topic tesla_V [-start-offset 0 -end-offset 1000 | -start-time 2024-01-01T00:00:00Z -end-time 2024-01-02T00:00:00Z] [-dispatcher pubsub]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/datastore/file"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// flushTimeout is how long buffered records are waited for before the producers are closed
+const flushTimeout = 30 * time.Second
+
+func main() {
+	dir := flag.String("dir", "", "directory of record files to replay, files passed as arguments are replayed otherwise")
+	dispatcher := flag.String("dispatcher", "", "only replay to this dispatcher, defaults to the dispatchers of each record type")
+	recordsPerSecond := flag.Float64("rate", 0, "max records replayed per second, unlimited when 0")
+	dryRun := flag.Bool("dry-run", false, "count the records per type without producing them")
+	kafkaRange := kafkaRangeFlags()
+
+	conf, logger, err := config.LoadApplicationConfiguration()
+	if err != nil {
+		panic(fmt.Sprintf("error=load_service_config value=\"%s\"", err.Error()))
+	}
+
+	r := &replayer{counts: make(map[string]int), dryRun: *dryRun}
+	if *recordsPerSecond > 0 {
+		r.limiter = rate.NewLimiter(rate.Limit(*recordsPerSecond), 1)
+	}
+
+	var producers map[telemetry.Dispatcher]telemetry.Producer
+	if !r.dryRun {
+		var producerRules map[string][]telemetry.Producer
+		producers, producerRules, err = conf.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), logger)
+		if err != nil {
+			panic(err)
+		}
+		// there is no vehicle to ack replayed records to
+		go func() {
+			for range conf.AckChan {
+			}
+		}()
+
+		r.targets = func(txType string) []telemetry.Producer { return producerRules[txType] }
+		if *dispatcher != "" {
+			producer, ok := producers[telemetry.Dispatcher(*dispatcher)]
+			if !ok {
+				panic(fmt.Sprintf("dispatcher %s is not configured", *dispatcher))
+			}
+			targets := []telemetry.Producer{producer}
+			r.targets = func(string) []telemetry.Producer { return targets }
+		}
+	}
+
+	if kafkaRange.topic != "" {
+		if err := r.replayKafka(conf, kafkaRange, logger); err != nil {
+			logger.ErrorLog("replay_kafka_error", err, logrus.LogInfo{"topic": kafkaRange.topic})
+		}
+	} else {
+		files := flag.Args()
+		if *dir != "" {
+			if files, err = file.ListFiles(*dir); err != nil {
+				panic(err)
+			}
+		}
+		r.replayAll(files, logger)
+	}
+
+	if r.dryRun {
+		logger.ActivityLog("replay_dry_run_done", logrus.LogInfo{"records": r.counts})
+		return
+	}
+	flush(producers)
+	for name, producer := range producers {
+		if err := producer.Close(); err != nil {
+			logger.ErrorLog("producer_close_error", err, logrus.LogInfo{"dispatcher": name})
+		}
+	}
+}
+
+// replayer produces the records read from a source to their targets
+type replayer struct {
+	targets func(txType string) []telemetry.Producer
+	limiter *rate.Limiter
+	dryRun  bool
+	counts  map[string]int
+}
+
+// produce waits for the throttle and sends the record to its targets, dry runs only count it
+func (r *replayer) produce(record *telemetry.Record) (replayed int, failed int) {
+	if r.dryRun {
+		r.counts[record.TxType]++
+		return 1, 0
+	}
+	if r.limiter != nil {
+		_ = r.limiter.Wait(context.Background())
+	}
+	for _, producer := range r.targets(record.TxType) {
+		if err := producer.Produce(record); err != nil {
+			failed++
+			continue
+		}
+		replayed++
+	}
+	return replayed, failed
+}
+
+func (r *replayer) replayAll(files []string, logger *logrus.Logger) {
+	for _, path := range files {
+		replayed, failed, err := r.replay(path)
+		logInfo := logrus.LogInfo{"file": path, "replayed": replayed, "failed": failed}
+		if err != nil {
+			logger.ErrorLog("replay_file_error", err, logInfo)
+			continue
+		}
+		logger.ActivityLog("replay_file_done", logInfo)
+	}
+}
+
+// replay produces every record of the file to its targets, it stops at the first unreadable record.
+// Compressed files are decompressed, including the protobuf objects of the s3 datastore
+func (r *replayer) replay(path string) (replayed int, failed int, err error) {
+	reader, err := file.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer reader.Close()
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return replayed, failed, nil
+		}
+		if err != nil {
+			return replayed, failed, err
+		}
+		recordReplayed, recordFailed := r.produce(record)
+		replayed += recordReplayed
+		failed += recordFailed
+	}
+}
+
+// flush waits for the producers buffering records to send them
+func flush(producers map[telemetry.Dispatcher]telemetry.Producer) {
+	deadline := time.Now().Add(flushTimeout)
+	for _, producer := range producers {
+		queueSizer, ok := producer.(telemetry.QueueSizer)
+		if !ok {
+			continue
+		}
+		for queueSizer.QueueSize() > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
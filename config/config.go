@@ -8,7 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,19 +21,31 @@ import (
 	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	githublogrus "github.com/sirupsen/logrus"
 
+	"github.com/teslamotors/fleet-telemetry/datastore/failover"
+	"github.com/teslamotors/fleet-telemetry/datastore/file"
 	"github.com/teslamotors/fleet-telemetry/datastore/googlepubsub"
 	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
 	"github.com/teslamotors/fleet-telemetry/datastore/kinesis"
+	"github.com/teslamotors/fleet-telemetry/datastore/nats"
+	"github.com/teslamotors/fleet-telemetry/datastore/null"
+	"github.com/teslamotors/fleet-telemetry/datastore/proxy"
+	"github.com/teslamotors/fleet-telemetry/datastore/redis"
+	"github.com/teslamotors/fleet-telemetry/datastore/s3"
 	"github.com/teslamotors/fleet-telemetry/datastore/simple"
+	"github.com/teslamotors/fleet-telemetry/datastore/tee"
 	"github.com/teslamotors/fleet-telemetry/datastore/zmq"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/metrics"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
+	"github.com/teslamotors/fleet-telemetry/tracing"
 )
 
 const (
 	airbrakeProjectKeyEnv = "AIRBRAKE_PROJECT_KEY"
+
+	// unroutedRecordName stands for the record types of the records sent to the unrouted default route
+	unroutedRecordName = "unrouted"
 )
 
 // Config object for server
@@ -44,6 +59,10 @@ type Config struct {
 	// Status Port is used to check whether service is live or not
 	StatusPort int `json:"status_port,omitempty"`
 
+	// ReadinessDatastores are the datastores whose connectivity is checked by the /ready endpoint of the status port,
+	// defaults to the reliable ack sources and the datastores with required_for_ack
+	ReadinessDatastores []telemetry.Dispatcher `json:"readiness_datastores,omitempty"`
+
 	// TLS contains certificates & CA info for the webserver
 	TLS *TLS `json:"tls,omitempty"`
 
@@ -53,6 +72,35 @@ type Config struct {
 	// RateLimit is a configuration for the ratelimit
 	RateLimit *RateLimit `json:"rate_limit,omitempty"`
 
+	// Keepalive sends websocket pings to vehicles and closes connections which stop answering
+	Keepalive *Keepalive `json:"keepalive,omitempty"`
+
+	// IdleTimeout closes the connections of vehicles which send no message for this many milliseconds, pongs
+	// don't count as messages. Disabled when not set
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+
+	// MaxConnectionLifetime closes connections open for this many milliseconds, minus up to 10% of jitter, with
+	// the close code 1012 so vehicles reconnect. Disabled when not set
+	MaxConnectionLifetime int `json:"max_connection_lifetime,omitempty"`
+
+	// VINConnectionLimit caps the number of connections open at the same time by each vin, it is disabled by default
+	VINConnectionLimit *VINConnectionLimit `json:"vin_connection_limit,omitempty"`
+
+	// TrustedProxyHeader is the header in which the load balancer in front of the server appends the vehicle address,
+	// ex.: X-Forwarded-For. The address of the connection is used when not set
+	TrustedProxyHeader string `json:"trusted_proxy_header,omitempty"`
+
+	// ShutdownDrainTimeout is the max time in milliseconds to wait for in flight records to be written and acked
+	// when shutting down, defaults to 20s
+	ShutdownDrainTimeout int `json:"shutdown_drain_timeout,omitempty"`
+
+	// MaxMessageBytes closes connections sending websocket messages larger than this size, unlimited if not set
+	MaxMessageBytes int64 `json:"max_message_bytes,omitempty"`
+
+	// SocketWriteTimeout is the time in milliseconds a vehicle has to read the messages sent to it before being
+	// disconnected, defaults to 10s
+	SocketWriteTimeout int `json:"socket_write_timeout,omitempty"`
+
 	// ReliableAckSources is a mapping of record types to a dispatcher that will be used for reliable ack
 	ReliableAckSources map[string]telemetry.Dispatcher `json:"reliable_ack_sources,omitempty"`
 
@@ -61,6 +109,17 @@ type Config struct {
 	// we extract the "topic" key as the default topic for the producer
 	Kafka *confluent.ConfigMap `json:"kafka,omitempty"`
 
+	// KafkaProducer configures producer behavior which is not covered by librdkafka properties
+	KafkaProducer *kafka.Config `json:"kafka_producer,omitempty"`
+
+	// KafkaConsumer configures the topics and consumer group of the consume-kafka run mode, which dispatches
+	// the records of kafka topics to the other datastores instead of serving vehicles
+	KafkaConsumer *kafka.ConsumerConfig `json:"kafka_consumer,omitempty"`
+
+	// KafkaInstances are kafka clusters in addition to the kafka one, records are routed to an instance by its name,
+	// ex.: {"kafka_next": {"kafka": {"bootstrap.servers": "next:9092"}}} to write to a new cluster with the tee
+	KafkaInstances map[telemetry.Dispatcher]*KafkaInstance `json:"kafka_instances,omitempty"`
+
 	// Kinesis is a configuration for AWS Kinesis
 	Kinesis *Kinesis `json:"kinesis,omitempty"`
 
@@ -70,12 +129,40 @@ type Config struct {
 	// ZMQ configures a zeromq socket
 	ZMQ *zmq.Config `json:"zmq,omitempty"`
 
+	// File configures rotating record files on the local disk
+	File *file.Config `json:"file,omitempty"`
+
+	// Redis configures a redis streams producer
+	Redis *redis.Config `json:"redis,omitempty"`
+
+	// NATS configures a nats or jetstream producer
+	NATS *nats.Config `json:"nats,omitempty"`
+
+	// S3 archives records into gzipped objects
+	S3 *s3.Config `json:"s3,omitempty"`
+
+	// Tee duplicates the records routed to the tee datastore to two other datastores, for migrations
+	Tee *tee.Config `json:"tee,omitempty"`
+
+	// Failover writes the records routed to the failover datastore to a primary datastore, and to a standby while
+	// the primary fails
+	Failover *failover.Config `json:"failover,omitempty"`
+
 	// Namespace defines a prefix for the kafka/pubsub topic
 	Namespace string `json:"namespace,omitempty"`
 
 	// Monitoring defines information for metrics
 	Monitoring *metrics.MonitoringConfig `json:"monitoring,omitempty"`
 
+	// DebugVIN serves the last records of a vin on the profiler port, it is disabled by default
+	DebugVIN *DebugVIN `json:"debug_vin,omitempty"`
+
+	// MetadataLookup resolves metadata attached to the records of a vehicle when it connects, disabled when nil
+	MetadataLookup *MetadataLookup `json:"metadata_lookup,omitempty"`
+
+	// Tracing exports OpenTelemetry spans of the ingest pipeline, disabled when nil
+	Tracing *tracing.Config `json:"tracing,omitempty"`
+
 	// LoggerConfig configures the simple logger
 	LoggerConfig *simple.Config `json:"logger,omitempty"`
 
@@ -85,12 +172,78 @@ type Config struct {
 	// JSONLogEnable if true log in json format
 	JSONLogEnable bool `json:"json_log_enable,omitempty"`
 
+	// RecordLogSampleRate is the fraction, between 0 and 1, of the records logged with the outcome of each datastore
+	// they were produced to, disabled when 0
+	RecordLogSampleRate float64 `json:"record_log_sample_rate,omitempty"`
+
 	// Records is a mapping of topics (records type) to a reference dispatch implementation (i,e: kafka)
 	Records map[string][]telemetry.Dispatcher `json:"records,omitempty"`
 
+	// UnroutedPolicy applies to records whose type is not in Records: drop, drop+metric (default), error or default-route
+	UnroutedPolicy telemetry.UnroutedPolicy `json:"unrouted_policy,omitempty"`
+
+	// UnroutedDefaultRoute is the datastore receiving the records without dispatch rule with the default-route policy
+	UnroutedDefaultRoute telemetry.Dispatcher `json:"unrouted_default_route,omitempty"`
+
 	// TransmitDecodedRecords if true decodes proto message before dispatching it to supported datastores
 	TransmitDecodedRecords bool `json:"transmit_decoded_records,omitempty"`
 
+	// JSONEnumsAsStrings renders enums of json payloads with their proto names, defaults to true. Set to false
+	// for consumers expecting enum numbers
+	JSONEnumsAsStrings *bool `json:"json_enums_as_strings,omitempty"`
+
+	// MaxDecompressedSize is the maximum size in bytes of gzip compressed payloads once decompressed, defaults to 1mb
+	MaxDecompressedSize int `json:"max_decompressed_size,omitempty"`
+
+	// CompressionEnabled negotiates permessage-deflate with vehicles advertising support for it
+	CompressionEnabled bool `json:"compression_enabled,omitempty"`
+
+	// CompressionLevel is the deflate level of messages written to vehicles, from 1 (fastest, default) to 9 (smallest)
+	CompressionLevel int `json:"compression_level,omitempty"`
+
+	// EnforceVINCertMatch rejects records whose device id or payload vin differs from the vin of the client certificate,
+	// disable for fleets sharing certificates
+	EnforceVINCertMatch bool `json:"enforce_vin_cert_match,omitempty"`
+
+	// VINAllowlist is a file of the vins records are accepted from, every vin is accepted when empty.
+	// The file is read again on config reload
+	VINAllowlist string `json:"vin_allowlist_file,omitempty"`
+
+	// VINDenylist is a file of the vins whose records are dropped, it takes precedence over the allowlist.
+	// The file is read again on config reload
+	VINDenylist string `json:"vin_denylist_file,omitempty"`
+
+	// ValidatePayloads counts records which fail to decode to the message of their record type and applies InvalidPayloadAction
+	ValidatePayloads bool `json:"validate_payloads,omitempty"`
+
+	// InvalidPayloadAction is applied to records failing validation: nack (default) or close
+	InvalidPayloadAction InvalidPayloadAction `json:"invalid_payload_action,omitempty"`
+
+	// Datastores contains options applied to records before they are produced to a given dispatcher
+	Datastores map[telemetry.Dispatcher]*telemetry.DatastoreConfig `json:"datastores,omitempty"`
+
+	// Backpressure asks vehicles to pause while the datastore queues are saturated
+	Backpressure *Backpressure `json:"backpressure,omitempty"`
+
+	// DeadLetter configures a datastore receiving records which failed to be produced
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+
+	// Dedup drops records received again within a time window, it is disabled by default
+	Dedup *Dedup `json:"dedup,omitempty"`
+
+	// InboundQueue dispatches the records of each connection from a bounded queue, decoupling reads from dispatching
+	InboundQueue *InboundQueue `json:"inbound_queue,omitempty"`
+
+	// UnorderedDispatch produces records from a pool of workers instead of the connection goroutine, so a slow
+	// datastore doesn't delay the next records. Records are only kept in order for datastores with order_by_vin
+	UnorderedDispatch bool `json:"unordered_dispatch,omitempty"`
+
+	// DispatchWorkers is the number of workers of the UnorderedDispatch pool, defaults to telemetry.DefaultDispatchWorkers
+	DispatchWorkers int `json:"dispatch_workers,omitempty"`
+
+	// GRPC serves a gRPC ingest endpoint on its own port, with the mTLS settings of the websocket server
+	GRPC *GRPC `json:"grpc,omitempty"`
+
 	// MetricCollector collects metrics for the application
 	MetricCollector metrics.MetricCollector
 
@@ -99,8 +252,27 @@ type Config struct {
 
 	// Airbrake config
 	Airbrake *Airbrake
+
+	// configFilePath is the file the config was loaded from, read again on reload
+	configFilePath string
+
+	// dispatchPool produces the records when UnorderedDispatch is enabled, it outlives reloads
+	dispatchPool *telemetry.DispatchPool
+
+	// unroutedRoute are the producers of UnroutedDefaultRoute, set with the dispatch rules
+	unroutedRoute []telemetry.Producer
 }
 
+// InvalidPayloadAction is how the server responds to records whose payload cannot be decoded
+type InvalidPayloadAction string
+
+const (
+	// InvalidPayloadNack responds to the vehicle with an error
+	InvalidPayloadNack InvalidPayloadAction = "nack"
+	// InvalidPayloadClose closes the connection of the vehicle
+	InvalidPayloadClose InvalidPayloadAction = "close"
+)
+
 // Airbrake config
 type Airbrake struct {
 	Host        string `json:"host"`
@@ -108,6 +280,15 @@ type Airbrake struct {
 	Environment string `json:"environment"`
 	ProjectID   int64  `json:"project_id"`
 
+	// SampleRate reports 1 in SampleRate occurrences of each error type
+	SampleRate int `json:"sample_rate,omitempty"`
+
+	// RateLimit is the max number of notices sent per error type within RateLimitWindow
+	RateLimit int `json:"rate_limit,omitempty"`
+
+	// RateLimitWindow is the rate limit window in seconds, defaults to 60
+	RateLimitWindow int `json:"rate_limit_window,omitempty"`
+
 	TLS *TLS `json:"tls" yaml:"tls"`
 }
 
@@ -124,6 +305,339 @@ type RateLimit struct {
 
 	// MessageIntervalTimeSecond is the rate limit time interval as a duration in second
 	MessageIntervalTimeSecond time.Duration
+
+	// PerVIN rate limits messages per vehicle across its connections, on top of the limit above
+	PerVIN *PerVINRateLimit `json:"per_vin,omitempty"`
+
+	// CloseOnExceeded closes the connection with the rate_limited close reason the first time the message limit
+	// is exceeded, instead of dropping the messages above it. Requires Enabled
+	CloseOnExceeded bool `json:"close_on_exceeded,omitempty"`
+}
+
+// Keepalive config for the websocket pings sent to vehicles to detect dead connections
+type Keepalive struct {
+	// PingInterval is the time in milliseconds between two pings, keepalive is disabled if not set
+	PingInterval int `json:"ping_interval,omitempty"`
+
+	// PongTimeout is the time in milliseconds a vehicle has to answer a ping before being disconnected, defaults to PingInterval
+	PongTimeout int `json:"pong_timeout,omitempty"`
+}
+
+// PerVINRateLimit config for the token bucket of each vehicle
+type PerVINRateLimit struct {
+	// Limit is the number of messages per second refilled in the bucket
+	Limit float64 `json:"limit,omitempty"`
+
+	// Burst is the size of the bucket
+	Burst int `json:"burst,omitempty"`
+
+	// ThrottleHint sends an error response for dropped messages instead of ignoring them
+	ThrottleHint bool `json:"throttle_hint,omitempty"`
+}
+
+// Backpressure config, queue sizes are the total of records buffered by the producers (kafka, aggregated kinesis)
+type Backpressure struct {
+	// HighWater is the queue size above which vehicles are asked to pause
+	HighWater int `json:"high_water,omitempty"`
+
+	// LowWater is the queue size below which vehicles are asked to resume
+	LowWater int `json:"low_water,omitempty"`
+}
+
+// Dedup config of the cache of the records recently received
+type Dedup struct {
+	// Window is the time in milliseconds during which a record received again is dropped
+	Window int `json:"window"`
+
+	// CacheSize is the max number of records remembered, the oldest are forgotten first. Defaults to 100000
+	CacheSize int `json:"cache_size,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (d *Dedup) Validate() error {
+	if d.Window < 1 {
+		return fmt.Errorf("dedup window must be positive, got %d", d.Window)
+	}
+	if d.CacheSize < 0 {
+		return fmt.Errorf("invalid dedup cache_size: %d", d.CacheSize)
+	}
+	return nil
+}
+
+// DebugVIN config of the /debug/vin/{vin} endpoint, returning the last records received from a vin to troubleshoot it
+// without consuming the datastores
+type DebugVIN struct {
+	// Token authenticates the requests, which send it as "Authorization: Bearer <token>"
+	Token string `json:"token"`
+
+	// Records is the number of records kept per vin, defaults to 10
+	Records int `json:"records,omitempty"`
+
+	// MaxVINs is the max number of vins whose records are kept, the vins which sent no record for the longest time
+	// are forgotten first. Defaults to 1000
+	MaxVINs int `json:"max_vins,omitempty"`
+
+	// RedactFields lists the keys whose values are hidden in the records returned, ex.: ["Location", "DestinationName"].
+	// They are matched against the keys of the json records and the keys of the data of V records
+	RedactFields []string `json:"redact_fields,omitempty"`
+}
+
+// DefaultMetadataLookupTimeout is the max time of a metadata lookup when the config doesn't set it
+const DefaultMetadataLookupTimeout = time.Second
+
+const (
+	// DefaultMetadataCacheTTL is the time the metadata of a vin is reused when the config doesn't set it
+	DefaultMetadataCacheTTL = time.Minute
+
+	// DefaultMaxConcurrentMetadataLookups bounds the lookups in flight when the config doesn't set it
+	DefaultMaxConcurrentMetadataLookups = 64
+)
+
+// MetadataLookup requests metadata of a vehicle, such as its fleet or owner, from an http service when it connects.
+// The metadata is kept for the lifetime of the connection and added to the metadata of its records
+type MetadataLookup struct {
+	// URL is requested with GET, {vin} is replaced with the vin, ex.: https://fleet-api/vehicles/{vin}/tags.
+	// The service responds with a json object of string values
+	URL string `json:"url"`
+
+	// Timeout is the max time in milliseconds of the lookup, defaults to 1000. Vehicles are accepted without
+	// metadata when the lookup fails or times out
+	Timeout int `json:"timeout,omitempty"`
+
+	// Headers are sent with the requests, ex.: {"Authorization": "Bearer ..."}
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// CacheTTL is the time in milliseconds the metadata of a vin is reused for the next connections of the vehicle,
+	// defaults to 60000, so vehicles reconnecting at once don't flood the service
+	CacheTTL int `json:"cache_ttl,omitempty"`
+
+	// MaxConcurrentLookups bounds the lookups in flight, defaults to 64. Vehicles connecting while the limit is
+	// reached wait up to the timeout for a lookup, then are accepted without metadata
+	MaxConcurrentLookups int `json:"max_concurrent_lookups,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (m *MetadataLookup) Validate() error {
+	lookupURL, err := url.Parse(m.URL)
+	if err != nil || (lookupURL.Scheme != "http" && lookupURL.Scheme != "https") || lookupURL.Host == "" {
+		return fmt.Errorf("invalid metadata_lookup url: %q", m.URL)
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("metadata_lookup timeout must be positive, got %d", m.Timeout)
+	}
+	if m.CacheTTL < 0 {
+		return fmt.Errorf("metadata_lookup cache_ttl must be positive, got %d", m.CacheTTL)
+	}
+	if m.MaxConcurrentLookups < 0 {
+		return fmt.Errorf("metadata_lookup max_concurrent_lookups must be positive, got %d", m.MaxConcurrentLookups)
+	}
+	return nil
+}
+
+// TimeoutDuration returns the max time of a lookup
+func (m *MetadataLookup) TimeoutDuration() time.Duration {
+	if m.Timeout == 0 {
+		return DefaultMetadataLookupTimeout
+	}
+	return time.Duration(m.Timeout) * time.Millisecond
+}
+
+// CacheTTLDuration returns the time the metadata of a vin is reused
+func (m *MetadataLookup) CacheTTLDuration() time.Duration {
+	if m.CacheTTL == 0 {
+		return DefaultMetadataCacheTTL
+	}
+	return time.Duration(m.CacheTTL) * time.Millisecond
+}
+
+// MaxLookups returns the max number of lookups in flight
+func (m *MetadataLookup) MaxLookups() int {
+	if m.MaxConcurrentLookups == 0 {
+		return DefaultMaxConcurrentMetadataLookups
+	}
+	return m.MaxConcurrentLookups
+}
+
+// minDebugVINTokenLength rejects tokens short enough to be guessed
+const minDebugVINTokenLength = 16
+
+// Validate returns an error if the config contains unsupported values
+func (d *DebugVIN) Validate() error {
+	if len(d.Token) < minDebugVINTokenLength {
+		return fmt.Errorf("debug_vin token must have at least %d characters", minDebugVINTokenLength)
+	}
+	if d.Records < 0 {
+		return fmt.Errorf("debug_vin records must be positive, got %d", d.Records)
+	}
+	if d.MaxVINs < 0 {
+		return fmt.Errorf("debug_vin max_vins must be positive, got %d", d.MaxVINs)
+	}
+	return nil
+}
+
+// RecordsPerVIN returns the number of records kept per vin
+func (d *DebugVIN) RecordsPerVIN() int {
+	if d.Records == 0 {
+		return 10
+	}
+	return d.Records
+}
+
+// MaxTrackedVINs returns the max number of vins whose records are kept
+func (d *DebugVIN) MaxTrackedVINs() int {
+	if d.MaxVINs == 0 {
+		return 1000
+	}
+	return d.MaxVINs
+}
+
+// DuplicateVINPolicy is applied to the connections of a vin which reached its max connections
+type DuplicateVINPolicy string
+
+const (
+	// DuplicateVINCloseOldest closes the oldest connection of the vin to make room for the new one
+	DuplicateVINCloseOldest DuplicateVINPolicy = "close_oldest"
+	// DuplicateVINReject refuses the new connection
+	DuplicateVINReject DuplicateVINPolicy = "reject"
+)
+
+// VINConnectionLimit config of the max connections of a vin, a vehicle reconnecting before its previous
+// connection timed out would otherwise stream from two sessions
+type VINConnectionLimit struct {
+	// MaxConnections is the max number of connections of a vin, defaults to 1
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// Policy is applied to new connections of a vin at its max connections: close_oldest (default) or reject
+	Policy DuplicateVINPolicy `json:"policy,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (v *VINConnectionLimit) Validate() error {
+	if v.MaxConnections < 0 {
+		return fmt.Errorf("vin_connection_limit max_connections must be positive, got %d", v.MaxConnections)
+	}
+	switch v.Policy {
+	case "", DuplicateVINCloseOldest, DuplicateVINReject:
+	default:
+		return fmt.Errorf("invalid vin_connection_limit policy: %s", v.Policy)
+	}
+	return nil
+}
+
+// Max returns the max number of connections of a vin
+func (v *VINConnectionLimit) Max() int {
+	if v.MaxConnections == 0 {
+		return 1
+	}
+	return v.MaxConnections
+}
+
+// QueueOverflowPolicy is applied to messages read from a vehicle while its inbound queue is full
+type QueueOverflowPolicy string
+
+const (
+	// QueueOverflowBlock stops reading from the vehicle until the queue has room
+	QueueOverflowBlock QueueOverflowPolicy = "block"
+	// QueueOverflowDropNewest drops the message just read
+	QueueOverflowDropNewest QueueOverflowPolicy = "drop_newest"
+	// QueueOverflowDropOldest drops the oldest queued message to make room for the message just read
+	QueueOverflowDropOldest QueueOverflowPolicy = "drop_oldest"
+)
+
+// InboundQueue config of the queue of messages each connection reads before dispatching them.
+// Dropped messages are not acked, so the vehicle sends them again
+type InboundQueue struct {
+	// Depth is the max number of messages queued per connection
+	Depth int `json:"depth"`
+
+	// Overflow is the policy applied when the queue is full: block (default), drop_newest or drop_oldest
+	Overflow QueueOverflowPolicy `json:"overflow,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (q *InboundQueue) Validate() error {
+	if q.Depth < 1 {
+		return fmt.Errorf("inbound_queue depth must be positive, got %d", q.Depth)
+	}
+	switch q.Overflow {
+	case "", QueueOverflowBlock, QueueOverflowDropNewest, QueueOverflowDropOldest:
+	default:
+		return fmt.Errorf("invalid inbound_queue overflow: %s", q.Overflow)
+	}
+	return nil
+}
+
+// GRPC config of the ingest endpoint streaming payloads of V records over gRPC
+type GRPC struct {
+	// Enabled starts the gRPC server, it is disabled by default
+	Enabled bool `json:"enabled"`
+
+	// Port is the port of the gRPC server, it must differ from the websocket port
+	Port int `json:"port"`
+
+	// AckBatch acks the payloads of a stream together, each payload is acked on its own when nil
+	AckBatch *AckBatch `json:"ack_batch,omitempty"`
+}
+
+const (
+	defaultAckBatchMaxAcks  = 100
+	defaultAckBatchInterval = 50 * time.Millisecond
+)
+
+// AckBatch config of the acks sent together by the gRPC ingest endpoint, acks of rejected payloads are never batched.
+// Websocket connections ack each record on its own, their protocol acks a single txid per message
+type AckBatch struct {
+	// MaxAcks sends the batched ack once it covers this many payloads, defaults to 100
+	MaxAcks int `json:"max_acks,omitempty"`
+
+	// Interval is the max time in milliseconds an ack waits in the batch, defaults to 50
+	Interval int `json:"interval,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (b *AckBatch) Validate() error {
+	if b.MaxAcks < 0 {
+		return fmt.Errorf("invalid grpc ack_batch max_acks: %d", b.MaxAcks)
+	}
+	if b.Interval < 0 {
+		return fmt.Errorf("invalid grpc ack_batch interval: %d", b.Interval)
+	}
+	return nil
+}
+
+// Limits returns the max number of acks of a batch and how long they can wait, applying the defaults
+func (b *AckBatch) Limits() (int, time.Duration) {
+	maxAcks, interval := b.MaxAcks, time.Duration(b.Interval)*time.Millisecond
+	if maxAcks == 0 {
+		maxAcks = defaultAckBatchMaxAcks
+	}
+	if interval == 0 {
+		interval = defaultAckBatchInterval
+	}
+	return maxAcks, interval
+}
+
+// Validate returns an error if the config contains unsupported values, serverPort is the websocket port
+func (g *GRPC) Validate(serverPort int) error {
+	if !g.Enabled {
+		return nil
+	}
+	if g.Port < 1 || g.Port > 65535 {
+		return fmt.Errorf("invalid grpc port: %d", g.Port)
+	}
+	if g.Port == serverPort {
+		return fmt.Errorf("grpc port must differ from the server port %d", serverPort)
+	}
+	if g.AckBatch != nil {
+		return g.AckBatch.Validate()
+	}
+	return nil
+}
+
+// DeadLetter config for records which failed to be produced to their datastore
+type DeadLetter struct {
+	// Dispatcher is the datastore failed records are forwarded to, with the record type dead_letter
+	Dispatcher telemetry.Dispatcher `json:"dispatcher,omitempty"`
 }
 
 // Pubsub config for the Google pubsub
@@ -131,14 +645,71 @@ type Pubsub struct {
 	// GCP Project ID
 	ProjectID string `json:"gcp_project_id,omitempty"`
 
+	// EnableMessageOrdering publishes records with the vin as ordering key so subscribers receive them in order per vehicle
+	EnableMessageOrdering bool `json:"enable_message_ordering,omitempty"`
+
+	// PublishSettings batches records into fewer publish requests and limits the records waiting to be published
+	PublishSettings *googlepubsub.PublishSettings `json:"publish_settings,omitempty"`
+
+	// Proxy routes the connections to pubsub through a proxy, defaults to the proxy environment variables
+	Proxy *proxy.Config `json:"proxy,omitempty"`
+
 	Publisher *pubsub.Client
 }
 
+// KafkaInstance is a kafka cluster records can be routed to in addition to the one of the kafka config
+type KafkaInstance struct {
+	// Kafka is the librdkafka configuration of the cluster, like the kafka config
+	Kafka *confluent.ConfigMap `json:"kafka"`
+
+	// KafkaProducer replaces the kafka_producer config for the instance, defaults to it
+	KafkaProducer *kafka.Config `json:"kafka_producer,omitempty"`
+}
+
+// producerConfig returns the producer behavior of the instance
+func (k *KafkaInstance) producerConfig(defaultConfig *kafka.Config) *kafka.Config {
+	if k.KafkaProducer != nil {
+		return k.KafkaProducer
+	}
+	return defaultConfig
+}
+
+// isKafka returns true for the kafka dispatcher and the kafka instances
+func (c *Config) isKafka(dispatcher telemetry.Dispatcher) bool {
+	return dispatcher == telemetry.Kafka || c.KafkaInstances[dispatcher] != nil
+}
+
+// datastoreType returns kafka for the kafka instances, and the dispatcher itself otherwise
+func (c *Config) datastoreType(dispatcher telemetry.Dispatcher) telemetry.Dispatcher {
+	if c.isKafka(dispatcher) {
+		return telemetry.Kafka
+	}
+	return dispatcher
+}
+
 // Kinesis is a configuration for aws Kinesis.
 type Kinesis struct {
 	MaxRetries   *int              `json:"max_retries,omitempty"`
 	OverrideHost string            `json:"override_host"`
 	Streams      map[string]string `json:"streams,omitempty"`
+
+	// AggregationEnabled packs multiple records into a single kinesis record using the KPL aggregation format
+	AggregationEnabled bool `json:"aggregation_enabled,omitempty"`
+
+	// AggregationFlushInterval is the maximum time in milliseconds records are buffered before being sent, defaults to 100
+	AggregationFlushInterval int `json:"aggregation_flush_interval,omitempty"`
+
+	// PartitionKeyStrategy spreads records across shards: vin (default), random or vin_hash_bucketed
+	PartitionKeyStrategy kinesis.PartitionKeyStrategy `json:"partition_key_strategy,omitempty"`
+
+	// PartitionKeyBuckets is the number of hash keys the records of a vehicle are spread across with vin_hash_bucketed
+	PartitionKeyBuckets int `json:"partition_key_buckets,omitempty"`
+
+	// Backoff retries throttled writes up to MaxRetries times with exponential backoff and jitter
+	Backoff *kinesis.Backoff `json:"backoff,omitempty"`
+
+	// Proxy routes the requests to kinesis through a proxy, defaults to the proxy environment variables
+	Proxy *proxy.Config `json:"proxy,omitempty"`
 }
 
 //go:embed files/eng_ca.crt
@@ -152,6 +723,60 @@ type TLS struct {
 	CAFile     string `json:"ca_file"`
 	ServerCert string `json:"server_cert"`
 	ServerKey  string `json:"server_key"`
+
+	// MinTLSVersion is the oldest TLS version accepted by the server: 1.2 (default) or 1.3
+	MinTLSVersion string `json:"min_tls_version,omitempty"`
+
+	// CipherSuites are the names of the TLS 1.2 cipher suites accepted by the server, ex.: TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+	// Defaults to the ECDHE suites with AES-GCM or ChaCha20-Poly1305, TLS 1.3 suites are not configurable
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+}
+
+// defaultCipherSuites are the TLS 1.2 cipher suites accepted by the server when none are configured
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// Validate returns an error if the server TLS policy contains unsupported values
+func (t *TLS) Validate() error {
+	_, _, err := t.serverPolicy()
+	return err
+}
+
+// serverPolicy returns the min version and cipher suites of the server. Only the cipher suites
+// go considers secure are accepted
+func (t *TLS) serverPolicy() (uint16, []uint16, error) {
+	var minVersion uint16
+	switch t.MinTLSVersion {
+	case "", "1.2":
+		minVersion = tls.VersionTLS12
+	case "1.3":
+		minVersion = tls.VersionTLS13
+	default:
+		return 0, nil, fmt.Errorf("invalid tls min_tls_version: %s, expected 1.2 or 1.3", t.MinTLSVersion)
+	}
+
+	if len(t.CipherSuites) == 0 {
+		return minVersion, defaultCipherSuites, nil
+	}
+	secureSuites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secureSuites[suite.Name] = suite.ID
+	}
+	cipherSuites := make([]uint16, 0, len(t.CipherSuites))
+	for _, name := range t.CipherSuites {
+		id, ok := secureSuites[name]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown or insecure tls cipher suite: %s", name)
+		}
+		cipherSuites = append(cipherSuites, id)
+	}
+	return minVersion, cipherSuites, nil
 }
 
 // AirbrakeTLSConfig return the TLS config needed for connecting with airbrake server
@@ -192,6 +817,10 @@ func (c *Config) ExtractServiceTLSConfig(logger *logrus.Logger) (*tls.Config, er
 	if c.TLS == nil {
 		return nil, errors.New("tls config is empty - telemetry server is mTLS only, make sure to provide certificates in the config")
 	}
+	minVersion, cipherSuites, err := c.TLS.serverPolicy()
+	if err != nil {
+		return nil, err
+	}
 
 	var caFileBytes []byte
 	var caEnv string
@@ -222,8 +851,10 @@ func (c *Config) ExtractServiceTLSConfig(logger *logrus.Logger) (*tls.Config, er
 	}
 
 	return &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:    caCertPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
 	}, nil
 }
 
@@ -242,10 +873,7 @@ func (c *Config) configureMetricsCollector(logger *logrus.Logger) {
 }
 
 func (c *Config) prometheusEnabled() bool {
-	if c.Monitoring != nil && c.Monitoring.PrometheusMetricsPort > 0 {
-		return true
-	}
-	return false
+	return c.Monitoring.PrometheusEnabled()
 }
 
 // ConfigureProducers validates and establishes connections to the producers (kafka/pubsub/logger)
@@ -255,6 +883,12 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 		return nil, nil, err
 	}
 
+	for dispatcher, datastoreConfig := range c.Datastores {
+		if err := datastoreConfig.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("datastore %s: %v", dispatcher, err)
+		}
+	}
+
 	producers := make(map[telemetry.Dispatcher]telemetry.Producer)
 	producers[telemetry.Logger] = simple.NewProtoLogger(c.LoggerConfig, logger)
 
@@ -264,24 +898,61 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 			requiredDispatchers[dispatchRule] = append(requiredDispatchers[dispatchRule], recordName)
 		}
 	}
+	if c.DeadLetter != nil {
+		requiredDispatchers[c.DeadLetter.Dispatcher] = append(requiredDispatchers[c.DeadLetter.Dispatcher], telemetry.DeadLetterTxType)
+	}
+	if c.UnroutedPolicy == telemetry.UnroutedDefaultRoute {
+		requiredDispatchers[c.UnroutedDefaultRoute] = append(requiredDispatchers[c.UnroutedDefaultRoute], unroutedRecordName)
+	}
+	if recordNames, ok := requiredDispatchers[telemetry.Tee]; ok {
+		if c.Tee == nil {
+			return nil, nil, errors.New("expected Tee to be configured")
+		}
+		for _, dispatcher := range c.Tee.Datastores {
+			requiredDispatchers[dispatcher] = append(requiredDispatchers[dispatcher], recordNames...)
+		}
+	}
+	if recordNames, ok := requiredDispatchers[telemetry.Failover]; ok {
+		if c.Failover == nil {
+			return nil, nil, errors.New("expected Failover to be configured")
+		}
+		for _, dispatcher := range []telemetry.Dispatcher{c.Failover.Primary, c.Failover.Standby} {
+			requiredDispatchers[dispatcher] = append(requiredDispatchers[dispatcher], recordNames...)
+		}
+	}
 
 	if _, ok := requiredDispatchers[telemetry.Kafka]; ok {
 		if c.Kafka == nil {
 			return nil, nil, errors.New("expected Kafka to be configured")
 		}
 		convertKafkaConfig(c.Kafka)
-		kafkaProducer, err := kafka.NewProducer(c.Kafka, c.Namespace, c.prometheusEnabled(), c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Kafka], logger)
+		kafkaProducer, err := kafka.NewProducer(telemetry.Kafka, c.Kafka, c.KafkaProducer, c.Namespace, c.prometheusEnabled(), c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Kafka], logger)
 		if err != nil {
 			return nil, nil, err
 		}
 		producers[telemetry.Kafka] = kafkaProducer
 	}
 
+	for name, instance := range c.KafkaInstances {
+		if _, ok := requiredDispatchers[name]; !ok {
+			continue
+		}
+		if instance == nil || instance.Kafka == nil {
+			return nil, nil, fmt.Errorf("expected the kafka config of the %s instance", name)
+		}
+		convertKafkaConfig(instance.Kafka)
+		kafkaProducer, err := kafka.NewProducer(name, instance.Kafka, instance.producerConfig(c.KafkaProducer), c.Namespace, c.prometheusEnabled(), c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[name], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[name] = kafkaProducer
+	}
+
 	if _, ok := requiredDispatchers[telemetry.Pubsub]; ok {
 		if c.Pubsub == nil {
 			return nil, nil, errors.New("expected Pubsub to be configured")
 		}
-		googleProducer, err := googlepubsub.NewProducer(c.prometheusEnabled(), c.Pubsub.ProjectID, c.Namespace, c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Pubsub], logger)
+		googleProducer, err := googlepubsub.NewProducer(c.prometheusEnabled(), c.Pubsub.ProjectID, c.Namespace, c.Pubsub.EnableMessageOrdering, c.Pubsub.PublishSettings, c.Pubsub.Proxy, c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Pubsub], logger)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -296,8 +967,12 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 		if c.Kinesis.MaxRetries != nil {
 			maxRetries = *c.Kinesis.MaxRetries
 		}
+		aggregationFlushInterval := 100
+		if c.Kinesis.AggregationFlushInterval > 0 {
+			aggregationFlushInterval = c.Kinesis.AggregationFlushInterval
+		}
 		streamMapping := c.CreateKinesisStreamMapping(recordNames)
-		kinesis, err := kinesis.NewProducer(maxRetries, streamMapping, c.Kinesis.OverrideHost, c.prometheusEnabled(), c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Kinesis], logger)
+		kinesis, err := kinesis.NewProducer(maxRetries, c.Kinesis.Backoff, streamMapping, c.Kinesis.OverrideHost, c.Kinesis.Proxy, c.Kinesis.AggregationEnabled, time.Duration(aggregationFlushInterval)*time.Millisecond, c.Kinesis.PartitionKeyStrategy, c.Kinesis.PartitionKeyBuckets, c.prometheusEnabled(), c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Kinesis], logger)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -315,20 +990,230 @@ func (c *Config) ConfigureProducers(airbrakeHandler *airbrake.Handler, logger *l
 		producers[telemetry.ZMQ] = zmqProducer
 	}
 
+	if _, ok := requiredDispatchers[telemetry.File]; ok {
+		if c.File == nil {
+			return nil, nil, errors.New("expected File to be configured")
+		}
+		fileProducer, err := file.NewProducer(c.File, c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.File], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.File] = fileProducer
+	}
+
+	if _, ok := requiredDispatchers[telemetry.Redis]; ok {
+		if c.Redis == nil {
+			return nil, nil, errors.New("expected Redis to be configured")
+		}
+		redisProducer, err := redis.NewProducer(c.Redis, c.MetricCollector, c.Namespace, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.Redis], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.Redis] = redisProducer
+	}
+
+	if _, ok := requiredDispatchers[telemetry.NATS]; ok {
+		if c.NATS == nil {
+			return nil, nil, errors.New("expected NATS to be configured")
+		}
+		natsProducer, err := nats.NewProducer(c.NATS, c.MetricCollector, c.Namespace, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.NATS], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.NATS] = natsProducer
+	}
+
+	if _, ok := requiredDispatchers[telemetry.S3]; ok {
+		if c.S3 == nil {
+			return nil, nil, errors.New("expected S3 to be configured")
+		}
+		s3Producer, err := s3.NewProducer(c.S3, c.Namespace, c.MetricCollector, airbrakeHandler, c.AckChan, reliableAckSources[telemetry.S3], logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.S3] = s3Producer
+	}
+
+	if _, ok := requiredDispatchers[telemetry.Null]; ok {
+		producers[telemetry.Null] = null.NewProducer(c.MetricCollector, c.AckChan, reliableAckSources[telemetry.Null])
+	}
+
+	var deadLetterProducer telemetry.Producer
+	if c.DeadLetter != nil {
+		deadLetterProducer = producers[c.DeadLetter.Dispatcher]
+	}
+	for dispatcher, batchConfig := range c.batchConfigs() {
+		if producer, ok := producers[dispatcher]; ok {
+			var deadLetter telemetry.Producer
+			if c.DeadLetter != nil && dispatcher != c.DeadLetter.Dispatcher {
+				deadLetter = deadLetterProducer
+			}
+			producers[dispatcher] = telemetry.NewBatchingProducer(producer, dispatcher, batchConfig, deadLetter, c.nacker(dispatcher), c.MetricCollector, logger)
+		}
+	}
+
+	if _, ok := requiredDispatchers[telemetry.Tee]; ok {
+		teeProducer, err := tee.NewProducer(c.Tee, producers, c.AckChan, reliableAckSources[telemetry.Tee], c.MetricCollector, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.Tee] = teeProducer
+	}
+
+	if _, ok := requiredDispatchers[telemetry.Failover]; ok {
+		failoverProducer, err := failover.NewProducer(c.Failover, producers, c.MetricCollector, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers[telemetry.Failover] = failoverProducer
+	}
+
+	if c.UnorderedDispatch {
+		workers := c.DispatchWorkers
+		if workers == 0 {
+			workers = telemetry.DefaultDispatchWorkers
+		}
+		c.dispatchPool = telemetry.NewDispatchPool(workers, c.MetricCollector)
+	}
+
+	dispatchProducerRules, err := c.DispatchRules(producers, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return producers, dispatchProducerRules, nil
+}
+
+// batchConfigs returns the batch options of the datastores writing records in batches
+func (c *Config) batchConfigs() map[telemetry.Dispatcher]*telemetry.BatchConfig {
+	batchConfigs := make(map[telemetry.Dispatcher]*telemetry.BatchConfig)
+	for dispatcher, datastoreConfig := range c.Datastores {
+		if datastoreConfig != nil && datastoreConfig.Batch != nil {
+			batchConfigs[dispatcher] = datastoreConfig.Batch
+		}
+	}
+	return batchConfigs
+}
+
+// DispatchRules maps each record type to the producers it is dispatched to, wrapped with their datastore options
+func (c *Config) DispatchRules(producers map[telemetry.Dispatcher]telemetry.Producer, logger *logrus.Logger) (map[string][]telemetry.Producer, error) {
+	var deadLetterProducer telemetry.Producer
+	if c.DeadLetter != nil {
+		var ok bool
+		if deadLetterProducer, ok = producers[c.DeadLetter.Dispatcher]; !ok {
+			return nil, fmt.Errorf("unknown dead letter dispatcher: %s", c.DeadLetter.Dispatcher)
+		}
+	}
+
+	guarded := c.withCircuitBreakers(producers, logger)
+	// the datastores of the tee apply their own options to the copies of the records they write
+	if teeProducer, ok := producers[telemetry.Tee].(*tee.Producer); ok {
+		guarded[telemetry.Tee] = c.withCircuitBreaker(telemetry.Tee, teeProducer.Wrap(func(dispatcher telemetry.Dispatcher) telemetry.Producer {
+			return c.wrapDatastore(dispatcher, guarded[dispatcher], deadLetterProducer, logger)
+		}), logger)
+	}
+	producers = guarded
 	dispatchProducerRules := make(map[string][]telemetry.Producer)
 	for recordName, dispatchRules := range c.Records {
 		var dispatchFuncs []telemetry.Producer
 		for _, dispatchRule := range dispatchRules {
-			dispatchFuncs = append(dispatchFuncs, producers[dispatchRule])
+			if producer, ok := producers[dispatchRule]; ok {
+				dispatchFuncs = append(dispatchFuncs, c.wrapProducer(dispatchRule, producer, deadLetterProducer, logger))
+			}
 		}
 		dispatchProducerRules[recordName] = dispatchFuncs
 
 		if len(dispatchProducerRules[recordName]) == 0 {
-			return nil, nil, fmt.Errorf("unknown_dispatch_rule record: %v, dispatchRule:%v", recordName, dispatchRules)
+			return nil, fmt.Errorf("unknown_dispatch_rule record: %v, dispatchRule:%v", recordName, dispatchRules)
 		}
 	}
 
-	return producers, dispatchProducerRules, nil
+	c.unroutedRoute = nil
+	if c.UnroutedPolicy == telemetry.UnroutedDefaultRoute {
+		producer, ok := producers[c.UnroutedDefaultRoute]
+		if !ok {
+			return nil, fmt.Errorf("unknown unrouted_default_route: %s", c.UnroutedDefaultRoute)
+		}
+		c.unroutedRoute = []telemetry.Producer{c.wrapProducer(c.UnroutedDefaultRoute, producer, deadLetterProducer, logger)}
+	}
+	return dispatchProducerRules, nil
+}
+
+// NewRouter returns a router dispatching records with rules and applying the unrouted policy, rules are
+// expected to come from DispatchRules
+func (c *Config) NewRouter(rules map[string][]telemetry.Producer) *telemetry.Router {
+	router := telemetry.NewRouter(rules, c.MetricCollector)
+	router.HandleUnrouted(c.UnroutedPolicy, c.unroutedRoute)
+	return router
+}
+
+// withCircuitBreakers returns the producers with a circuit breaker around the ones configured with it,
+// shared by every record type dispatched to them
+func (c *Config) withCircuitBreakers(producers map[telemetry.Dispatcher]telemetry.Producer, logger *logrus.Logger) map[telemetry.Dispatcher]telemetry.Producer {
+	guarded := make(map[telemetry.Dispatcher]telemetry.Producer, len(producers))
+	for dispatcher, producer := range producers {
+		guarded[dispatcher] = c.withCircuitBreaker(dispatcher, producer, logger)
+	}
+	return guarded
+}
+
+// withCircuitBreaker returns the producer with a circuit breaker around it if the dispatcher is configured with it
+func (c *Config) withCircuitBreaker(dispatcher telemetry.Dispatcher, producer telemetry.Producer, logger *logrus.Logger) telemetry.Producer {
+	if datastoreConfig, ok := c.Datastores[dispatcher]; ok && datastoreConfig != nil && datastoreConfig.CircuitBreaker != nil {
+		return telemetry.NewCircuitBreakerProducer(producer, dispatcher, datastoreConfig.CircuitBreaker, c.MetricCollector, logger)
+	}
+	return producer
+}
+
+// wrapProducer applies the options of the datastore with wrapDatastore, and the dispatch pool
+func (c *Config) wrapProducer(dispatcher telemetry.Dispatcher, producer telemetry.Producer, deadLetterProducer telemetry.Producer, logger *logrus.Logger) telemetry.Producer {
+	producer = c.wrapDatastore(dispatcher, producer, deadLetterProducer, logger)
+	if c.dispatchPool != nil {
+		datastoreConfig := c.Datastores[dispatcher]
+		producer = telemetry.NewPooledProducer(producer, c.dispatchPool, datastoreConfig != nil && datastoreConfig.OrderByVIN)
+	}
+	return producer
+}
+
+// wrapDatastore applies the payload limit, datastore options, dead letter routing, tracing, record logging and nacks configured for the dispatcher
+func (c *Config) wrapDatastore(dispatcher telemetry.Dispatcher, producer telemetry.Producer, deadLetterProducer telemetry.Producer, logger *logrus.Logger) telemetry.Producer {
+	datastoreConfig, ok := c.Datastores[dispatcher]
+	if limit := telemetry.MaxRecordBytes(c.datastoreType(dispatcher), datastoreConfig); limit > 0 {
+		producer = telemetry.NewPayloadLimitProducer(producer, dispatcher, limit, c.MetricCollector)
+	}
+	if ok && datastoreConfig != nil {
+		producer = telemetry.NewDatastoreProducer(producer, dispatcher, datastoreConfig, c.MetricCollector)
+	}
+	// the datastores of the tee forward the copies they fail to write
+	if deadLetterProducer != nil && dispatcher != c.DeadLetter.Dispatcher && dispatcher != telemetry.Tee {
+		producer = telemetry.NewDeadLetterProducer(producer, dispatcher, deadLetterProducer, logger)
+	}
+	if c.Tracing != nil {
+		producer = telemetry.NewTracingProducer(producer, dispatcher)
+	}
+	if c.RecordLogSampleRate > 0 {
+		producer = telemetry.NewRecordLogProducer(producer, dispatcher, c.RecordLogSampleRate, logger)
+	}
+	// inside the dispatch pool, which doesn't return the errors of the producers
+	if nacker := c.nacker(dispatcher); nacker != nil {
+		producer = telemetry.NewNackProducer(producer, nacker)
+	}
+	return producer
+}
+
+// nacker returns the nacker releasing the records the dispatcher fails to write, nil if it isn't required to ack records
+func (c *Config) nacker(dispatcher telemetry.Dispatcher) *telemetry.Nacker {
+	reliableAckSources, err := c.configureReliableAckSources()
+	if err != nil || c.AckChan == nil || len(reliableAckSources[dispatcher]) == 0 {
+		return nil
+	}
+	return telemetry.NewNacker(dispatcher, c.AckChan, reliableAckSources[dispatcher], c.MetricCollector)
+}
+
+// CloseDispatchPool produces the records queued in the dispatch pool, it is a no-op without UnorderedDispatch
+func (c *Config) CloseDispatchPool() {
+	if c.dispatchPool != nil {
+		c.dispatchPool.Close()
+	}
 }
 
 func (c *Config) configureReliableAckSources() (map[telemetry.Dispatcher]map[string]interface{}, error) {
@@ -340,6 +1225,9 @@ func (c *Config) configureReliableAckSources() (map[telemetry.Dispatcher]map[str
 		if dispatchRule == telemetry.Logger {
 			return nil, fmt.Errorf("logger cannot be configured as reliable ack for record: %s", txType)
 		}
+		if dispatchRule == telemetry.Failover {
+			return nil, fmt.Errorf("%s cannot be configured as reliable ack for record: %s", dispatchRule, txType)
+		}
 		dispatchers, ok := c.Records[txType]
 		if !ok {
 			return nil, fmt.Errorf("%s cannot be configured as reliable ack for record: %s since no record mapping exists", dispatchRule, txType)
@@ -349,7 +1237,7 @@ func (c *Config) configureReliableAckSources() (map[telemetry.Dispatcher]map[str
 		for _, dispatcher := range validDispatchers {
 			if dispatcher == dispatchRule {
 				dispatchRuleFound = true
-				reliableAckSources[dispatchRule] = map[string]interface{}{txType: true}
+				addReliableAckSource(reliableAckSources, dispatchRule, txType)
 				break
 			}
 		}
@@ -357,9 +1245,122 @@ func (c *Config) configureReliableAckSources() (map[telemetry.Dispatcher]map[str
 			return nil, fmt.Errorf("%s cannot be configured as reliable ack for record: %s. Valid datastores configured %v", dispatchRule, txType, validDispatchers)
 		}
 	}
+
+	for dispatcher, datastoreConfig := range c.Datastores {
+		if datastoreConfig == nil || !datastoreConfig.RequiredForAck {
+			continue
+		}
+		if dispatcher == telemetry.Logger {
+			return nil, errors.New("logger cannot be configured as required for ack")
+		}
+		if dispatcher == telemetry.Failover {
+			return nil, fmt.Errorf("%s cannot be configured as required for ack", dispatcher)
+		}
+		for txType, dispatchers := range c.Records {
+			if txType == "connectivity" {
+				continue
+			}
+			for _, recordDispatcher := range dispatchers {
+				if recordDispatcher == dispatcher {
+					addReliableAckSource(reliableAckSources, dispatcher, txType)
+				}
+			}
+		}
+	}
+
+	if c.Tee != nil {
+		if err := c.configureTeeAckSources(reliableAckSources); err != nil {
+			return nil, err
+		}
+	}
 	return reliableAckSources, nil
 }
 
+// configureTeeAckSources makes the datastores of the tee ack the copies of the records the tee acks. A record type
+// routed to the tee and to one of its datastores can't be acked by either, the datastore would ack it twice
+func (c *Config) configureTeeAckSources(reliableAckSources map[telemetry.Dispatcher]map[string]interface{}) error {
+	for txType, dispatchers := range c.Records {
+		if !slices.Contains(dispatchers, telemetry.Tee) {
+			continue
+		}
+		for _, dispatcher := range c.Tee.Datastores {
+			if !slices.Contains(dispatchers, dispatcher) {
+				continue
+			}
+			_, teeAcks := reliableAckSources[telemetry.Tee][txType]
+			_, datastoreAcks := reliableAckSources[dispatcher][txType]
+			if teeAcks || datastoreAcks {
+				return fmt.Errorf("record %s is routed to tee and its datastore %s, it can't be acked by either", txType, dispatcher)
+			}
+		}
+	}
+	for txType := range reliableAckSources[telemetry.Tee] {
+		for _, dispatcher := range c.Tee.Datastores {
+			addReliableAckSource(reliableAckSources, dispatcher, txType)
+		}
+	}
+	return nil
+}
+
+func addReliableAckSource(reliableAckSources map[telemetry.Dispatcher]map[string]interface{}, dispatcher telemetry.Dispatcher, txType string) {
+	if _, ok := reliableAckSources[dispatcher]; !ok {
+		reliableAckSources[dispatcher] = make(map[string]interface{})
+	}
+	reliableAckSources[dispatcher][txType] = true
+}
+
+// JSONSerializer returns the serializer of json payloads, enums are rendered as names unless json_enums_as_strings is false
+func (c *Config) JSONSerializer() *telemetry.JSONSerializer {
+	if c.JSONEnumsAsStrings == nil {
+		return telemetry.DefaultJSONSerializer
+	}
+	return &telemetry.JSONSerializer{EnumsAsStrings: *c.JSONEnumsAsStrings}
+}
+
+// RequiredAcks returns the number of datastores which must confirm a record before it is acked to the vehicle.
+// This is the reliable_ack_sources dispatcher of the record type and the datastores with required_for_ack,
+// records with no required datastore are acked as soon as they are dispatched
+func (c *Config) RequiredAcks(txType string) int {
+	if txType == "connectivity" {
+		return 0
+	}
+	// a datastore acks a record once, even when it is listed twice or is both the reliable ack source and required
+	required := make(map[telemetry.Dispatcher]bool)
+	for _, dispatcher := range parseValidDispatchers(c.Records[txType]) {
+		if c.ReliableAckSources[txType] == dispatcher {
+			required[dispatcher] = true
+			continue
+		}
+		if datastoreConfig, ok := c.Datastores[dispatcher]; ok && datastoreConfig != nil && datastoreConfig.RequiredForAck {
+			required[dispatcher] = true
+		}
+	}
+	return len(required)
+}
+
+// ReadinessDispatchers returns the datastores which must be reachable for the server to be ready,
+// an empty readiness_datastores list disables the checks
+func (c *Config) ReadinessDispatchers() []telemetry.Dispatcher {
+	if c.ReadinessDatastores != nil {
+		return c.ReadinessDatastores
+	}
+	required := make(map[telemetry.Dispatcher]bool)
+	for _, dispatcher := range c.ReliableAckSources {
+		required[dispatcher] = true
+	}
+	for dispatcher, datastoreConfig := range c.Datastores {
+		if datastoreConfig != nil && datastoreConfig.RequiredForAck {
+			required[dispatcher] = true
+		}
+	}
+	dispatchers := make([]telemetry.Dispatcher, 0, len(required))
+	for dispatcher := range required {
+		dispatchers = append(dispatchers, dispatcher)
+	}
+	sort.Slice(dispatchers, func(i, j int) bool { return dispatchers[i] < dispatchers[j] })
+	return dispatchers
+}
+
 // parseValidDispatchers removes no-op dispatcher from the input i.e. Logger
 func parseValidDispatchers(input []telemetry.Dispatcher) []telemetry.Dispatcher {
 	var result []telemetry.Dispatcher
@@ -381,6 +1382,23 @@ func convertKafkaConfig(input *confluent.ConfigMap) {
 	}
 }
 
+// NewKafkaConsumer returns the consumer of the consume-kafka run mode, connected to the brokers of the kafka
+// config with the sasl authentication of the producer
+func (c *Config) NewKafkaConsumer(logger *logrus.Logger) (*kafka.Consumer, error) {
+	if c.KafkaConsumer == nil {
+		return nil, errors.New("expected kafka_consumer to be configured")
+	}
+	if c.Kafka == nil {
+		return nil, errors.New("expected Kafka to be configured")
+	}
+	convertKafkaConfig(c.Kafka)
+	var sasl *kafka.SASLConfig
+	if c.KafkaProducer != nil {
+		sasl = c.KafkaProducer.SASL
+	}
+	return kafka.NewConsumer(c.Kafka, c.KafkaConsumer, sasl, c.MetricCollector, logger)
+}
+
 // CreateKinesisStreamMapping uses the config, overrides with ENV variable names, and finally falls back to namespace based names
 func (c *Config) CreateKinesisStreamMapping(recordNames []string) map[string]string {
 	streamMapping := make(map[string]string)
@@ -399,6 +1417,30 @@ func (c *Config) CreateKinesisStreamMapping(recordNames []string) map[string]str
 	return streamMapping
 }
 
+// AirbrakeOptions returns the sampling and rate limiting options of the airbrake handler
+func (c *Config) AirbrakeOptions() airbrake.Options {
+	if c.Airbrake == nil {
+		return airbrake.Options{}
+	}
+	window := c.Airbrake.RateLimitWindow
+	if window <= 0 {
+		window = 60
+	}
+	return airbrake.Options{
+		SampleRate: c.Airbrake.SampleRate,
+		RateLimit:  c.Airbrake.RateLimit,
+		Window:     time.Duration(window) * time.Second,
+	}
+}
+
+// DrainTimeout returns the max time to wait for in flight records when shutting down
+func (c *Config) DrainTimeout() time.Duration {
+	if c.ShutdownDrainTimeout <= 0 {
+		return 20 * time.Second
+	}
+	return time.Duration(c.ShutdownDrainTimeout) * time.Millisecond
+}
+
 // CreateAirbrakeNotifier intializes an airbrake notifier with standard configs
 func (c *Config) CreateAirbrakeNotifier(logger *logrus.Logger) (*githubairbrake.Notifier, *githubairbrake.NotifierOptions, error) {
 	if c.Airbrake == nil {
@@ -3,8 +3,12 @@ package config
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/sirupsen/logrus/hooks/test"
 
@@ -30,6 +34,7 @@ func LoadApplicationConfiguration() (config *Config, logger *logrus.Logger, err
 		logger.ErrorLog("read_application_configuration_error", err, nil)
 		return nil, nil, err
 	}
+	config.configFilePath = configFilePath
 
 	config.configureLogger(logger)
 	config.configureMetricsCollector(logger)
@@ -37,15 +42,7 @@ func LoadApplicationConfiguration() (config *Config, logger *logrus.Logger, err
 }
 
 func loadApplicationConfig(configFilePath string) (*Config, error) {
-	configFile, err := os.Open(configFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	config := &Config{
-		LoggerConfig: &simple.Config{},
-	}
-	err = json.NewDecoder(configFile).Decode(&config)
+	config, err := readConfigFile(configFilePath)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +57,71 @@ func loadApplicationConfig(configFilePath string) (*Config, error) {
 	return config, err
 }
 
+func readConfigFile(configFilePath string) (*Config, error) {
+	configFile, err := os.Open(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+
+	var raw interface{}
+	decoder := json.NewDecoder(configFile)
+	decoder.UseNumber()
+	if err = decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	missing := make(map[string]struct{})
+	raw = interpolateEnv(raw, missing)
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("config references unset environment variables: %s", strings.Join(names, ", "))
+	}
+	interpolated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		LoggerConfig: &simple.Config{},
+	}
+	if err = json.Unmarshal(interpolated, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// envReference matches the ${ENV_VAR} references of config values
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateEnv replaces the ${ENV_VAR} references in the string values of the decoded json with the environment
+// variables, the names of unset variables are added to missing
+func interpolateEnv(value interface{}, missing map[string]struct{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(v, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			envValue, ok := os.LookupEnv(name)
+			if !ok {
+				missing[name] = struct{}{}
+			}
+			return envValue
+		})
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = interpolateEnv(item, missing)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateEnv(item, missing)
+		}
+	}
+	return value
+}
+
 func loadConfigFlags() string {
 	applicationConfig := ""
 	flag.StringVar(&applicationConfig, "config", "config.json", "application configuration file")
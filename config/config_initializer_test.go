@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 
 	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
 
@@ -75,6 +76,26 @@ var _ = Describe("Test application config initialization", func() {
 		Expect(loadedConfig).To(Equal(expectedConfig))
 	})
 
+	It("interpolates environment variables", func() {
+		DeferCleanup(os.Unsetenv, "TEST_KAFKA_BROKER")
+		DeferCleanup(os.Unsetenv, "TEST_KAFKA_PASSWORD")
+		Expect(os.Setenv("TEST_KAFKA_BROKER", "env.broker:9093")).To(Succeed())
+		Expect(os.Setenv("TEST_KAFKA_PASSWORD", `pa"ss\word`)).To(Succeed())
+
+		configStr := strings.Replace(TestSmallConfig, `"some.broker1:9093,some.broker1:9093"`, `"${TEST_KAFKA_BROKER},backup.broker:9093", "sasl.password": "${TEST_KAFKA_PASSWORD}"`, 1)
+		loadedConfig, err := loadTestApplicationConfig(configStr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect((*loadedConfig.Kafka)["bootstrap.servers"]).To(Equal("env.broker:9093,backup.broker:9093"))
+		Expect((*loadedConfig.Kafka)["sasl.password"]).To(Equal(`pa"ss\word`))
+		Expect((*loadedConfig.Kafka)["queue.buffering.max.messages"]).To(Equal(float64(1000000)))
+	})
+
+	It("fails when an interpolated environment variable is unset", func() {
+		configStr := strings.Replace(TestSmallConfig, `"some.broker1:9093,some.broker1:9093"`, `"${TEST_UNSET_BROKER}", "sasl.password": "${TEST_UNSET_PASSWORD}"`, 1)
+		_, err := loadTestApplicationConfig(configStr)
+		Expect(err).To(MatchError("config references unset environment variables: TEST_UNSET_BROKER, TEST_UNSET_PASSWORD"))
+	})
+
 	It("returns an error if config is not appropriate", func() {
 		_, err := loadTestApplicationConfig(BadTopicConfig)
 		Expect(err).To(MatchError("invalid character '}' looking for beginning of object key string"))
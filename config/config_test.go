@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"os"
 
@@ -10,8 +12,12 @@ import (
 	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	githublogrus "github.com/sirupsen/logrus"
 
+	"github.com/teslamotors/fleet-telemetry/datastore/failover"
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	"github.com/teslamotors/fleet-telemetry/datastore/tee"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
@@ -105,6 +111,43 @@ var _ = Describe("Test full application config", func() {
 			Expect(tls.ClientCAs).NotTo(BeNil())
 			Expect(tls.ClientCAs.Subjects()).To(HaveLen(8)) //nolint:staticcheck
 		})
+
+		It("defaults to TLS 1.2 with modern cipher suites", func() {
+			config.TLS.CAFile = ""
+
+			tlsConfig, err := config.ExtractServiceTLSConfig(log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tlsConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(tlsConfig.CipherSuites).To(ConsistOf(
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			))
+		})
+
+		It("applies the configured TLS policy", func() {
+			config.TLS.CAFile = ""
+			config.TLS.MinTLSVersion = "1.3"
+			config.TLS.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+
+			tlsConfig, err := config.ExtractServiceTLSConfig(log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tlsConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+			Expect(tlsConfig.CipherSuites).To(Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}))
+		})
+
+		It("rejects unknown or insecure cipher suites and versions", func() {
+			config.TLS.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+			_, err := config.ExtractServiceTLSConfig(log)
+			Expect(err).To(MatchError("unknown or insecure tls cipher suite: TLS_RSA_WITH_RC4_128_SHA"))
+
+			config.TLS.CipherSuites = nil
+			config.TLS.MinTLSVersion = "1.0"
+			Expect(config.TLS.Validate()).To(MatchError("invalid tls min_tls_version: 1.0, expected 1.2 or 1.3"))
+		})
 	})
 
 	Context("basic config", func() {
@@ -126,6 +169,16 @@ var _ = Describe("Test full application config", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(config.TransmitDecodedRecords).To(BeTrue())
 		})
+
+		It("renders json enums as names by default", func() {
+			config, err := loadTestApplicationConfig(TestSmallConfig)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.JSONSerializer().EnumsAsStrings).To(BeTrue())
+
+			enumsAsStrings := false
+			config.JSONEnumsAsStrings = &enumsAsStrings
+			Expect(config.JSONSerializer().EnumsAsStrings).To(BeFalse())
+		})
 	})
 
 	Context("configure kafka", func() {
@@ -141,6 +194,53 @@ var _ = Describe("Test full application config", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(value.(int)).To(Equal(1000000))
 		})
+
+		It("creates a producer per kafka instance", func() {
+			config.KafkaInstances = map[telemetry.Dispatcher]*KafkaInstance{
+				"kafka_next": {Kafka: &confluent.ConfigMap{"bootstrap.servers": "next.broker:9093", "queue.buffering.max.messages": float64(1000)}},
+			}
+			config.Records = map[string][]telemetry.Dispatcher{"V": {"kafka", "kafka_next"}}
+			config.MetricCollector = noop.NewCollector()
+
+			dispatchers, producers, err := config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(producers["V"]).To(HaveLen(2))
+			Expect(dispatchers).To(HaveKey(telemetry.Dispatcher("kafka_next")))
+			Expect(dispatchers["kafka_next"]).NotTo(BeIdenticalTo(dispatchers[telemetry.Kafka]))
+			// the kafka limit applies to the records of the instance
+			Expect(producers["V"][1]).To(BeAssignableToTypeOf(&telemetry.PayloadLimitProducer{}))
+			for _, dispatcher := range dispatchers {
+				Expect(dispatcher.Close()).To(Succeed())
+			}
+		})
+
+		It("fails over between kafka and a kafka instance", func() {
+			config.KafkaInstances = map[telemetry.Dispatcher]*KafkaInstance{
+				"kafka_standby": {Kafka: &confluent.ConfigMap{"bootstrap.servers": "standby.broker:9093"}},
+			}
+			config.Failover = &failover.Config{Primary: telemetry.Kafka, Standby: "kafka_standby"}
+			config.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Failover}}
+			config.MetricCollector = noop.NewCollector()
+			Expect(config.Validate()).To(BeEmpty())
+
+			dispatchers, producers, err := config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(producers["V"]).To(HaveLen(1))
+			Expect(dispatchers).To(HaveKey(telemetry.Dispatcher("kafka_standby")))
+			Expect(dispatchers[telemetry.Failover].(*failover.Producer).Active()).To(Equal(telemetry.Kafka))
+			for _, dispatcher := range dispatchers {
+				Expect(dispatcher.Close()).To(Succeed())
+			}
+		})
+
+		It("fails on invalid partition key", func() {
+			config.KafkaProducer = &kafka.Config{PartitionKey: "random"}
+
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).To(MatchError("invalid kafka partition_key: random"))
+			Expect(producers).To(BeNil())
+		})
 	})
 
 	Context("configure airbrake", func() {
@@ -184,6 +284,173 @@ var _ = Describe("Test full application config", func() {
 			Entry("when reliable ack is mapped with unsupported txtype", TestBadTxTypeReliableAckConfig, "reliable ack not needed for txType: connectivity"),
 		)
 
+		It("combines reliable ack sources and required datastores", func() {
+			config, err := loadTestApplicationConfig(TestRequiredForAckConfig)
+			Expect(err).NotTo(HaveOccurred())
+
+			reliableAckSources, err := config.configureReliableAckSources()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reliableAckSources).To(Equal(map[telemetry.Dispatcher]map[string]interface{}{
+				telemetry.Kafka: {"V": true, "alerts": true},
+				telemetry.ZMQ:   {"V": true},
+			}))
+
+			Expect(config.RequiredAcks("V")).To(Equal(2))
+			Expect(config.RequiredAcks("alerts")).To(Equal(1))
+			Expect(config.RequiredAcks("errors")).To(Equal(0))
+			Expect(config.RequiredAcks("connectivity")).To(Equal(0))
+		})
+
+		It("counts a datastore once when it is the reliable ack source and required for ack", func() {
+			config, err := loadTestApplicationConfig(TestRequiredForAckConfig)
+			Expect(err).NotTo(HaveOccurred())
+			config.Datastores[telemetry.Kafka] = &telemetry.DatastoreConfig{RequiredForAck: true}
+			config.Records["V"] = append(config.Records["V"], telemetry.ZMQ)
+
+			Expect(config.RequiredAcks("V")).To(Equal(2))
+			Expect(config.RequiredAcks("alerts")).To(Equal(1))
+		})
+
+		It("gates readiness on the datastores required for acks", func() {
+			config, err := loadTestApplicationConfig(TestRequiredForAckConfig)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.ReadinessDispatchers()).To(Equal([]telemetry.Dispatcher{telemetry.Kafka, telemetry.ZMQ}))
+
+			config.ReadinessDatastores = []telemetry.Dispatcher{telemetry.Kafka}
+			Expect(config.ReadinessDispatchers()).To(Equal([]telemetry.Dispatcher{telemetry.Kafka}))
+		})
+
+		It("makes the datastores of the tee ack the records the tee acks", func() {
+			config, err := loadTestApplicationConfig(TestSmallConfig)
+			Expect(err).NotTo(HaveOccurred())
+			config.Tee = &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.NATS}}
+			config.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Tee}, "alerts": {telemetry.Tee, telemetry.Kafka}}
+			config.ReliableAckSources = map[string]telemetry.Dispatcher{"V": telemetry.Tee}
+
+			reliableAckSources, err := config.configureReliableAckSources()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reliableAckSources).To(Equal(map[telemetry.Dispatcher]map[string]interface{}{
+				telemetry.Tee:   {"V": true},
+				telemetry.Kafka: {"V": true},
+				telemetry.NATS:  {"V": true},
+			}))
+			Expect(config.RequiredAcks("V")).To(Equal(1))
+
+			config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{telemetry.Kafka: {RequiredForAck: true}}
+			_, err = config.configureReliableAckSources()
+			Expect(err).To(MatchError("record alerts is routed to tee and its datastore kafka, it can't be acked by either"))
+		})
+
+		It("rejects logger as required for ack", func() {
+			config, err := loadTestApplicationConfig(TestSmallConfig)
+			Expect(err).NotTo(HaveOccurred())
+			config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{telemetry.Logger: {RequiredForAck: true}}
+
+			_, err = config.configureReliableAckSources()
+			Expect(err).To(MatchError("logger cannot be configured as required for ack"))
+		})
+
+	})
+
+	Context("configure datastores", func() {
+		It("wraps the datastores of the tee with their options", func() {
+			config.Tee = &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.NATS}}
+			config.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Tee}}
+			config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{telemetry.NATS: {MaxRecordBytes: 4}}
+			config.MetricCollector = noop.NewCollector()
+
+			kafkaProducer, natsProducer := &recordingProducer{}, &recordingProducer{}
+			dispatchers := map[telemetry.Dispatcher]telemetry.Producer{telemetry.Kafka: kafkaProducer, telemetry.NATS: natsProducer}
+			teeProducer, err := tee.NewProducer(config.Tee, dispatchers, nil, nil, config.MetricCollector, log)
+			Expect(err).NotTo(HaveOccurred())
+			dispatchers[telemetry.Tee] = teeProducer
+
+			rules, err := config.DispatchRules(dispatchers, log)
+			Expect(err).NotTo(HaveOccurred())
+			err = rules["V"][0].Produce(&telemetry.Record{TxType: "V", PayloadBytes: []byte("payload")})
+			var oversizedErr *telemetry.OversizedRecordError
+			Expect(errors.As(err, &oversizedErr)).To(BeTrue())
+			Expect(oversizedErr.Dispatcher).To(Equal(telemetry.NATS))
+			Expect(kafkaProducer.records).To(HaveLen(1))
+			Expect(natsProducer.records).To(BeEmpty())
+		})
+
+		It("wraps producers with datastore options", func() {
+			config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{"kafka": {Serializer: telemetry.JSONFormat}}
+			config.MetricCollector = noop.NewCollector()
+
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(producers["V"]).To(HaveLen(1))
+			Expect(producers["V"][0]).To(BeAssignableToTypeOf(&telemetry.DatastoreProducer{}))
+		})
+
+		It("wraps producers with a circuit breaker", func() {
+			config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{"kafka": {CircuitBreaker: &telemetry.CircuitBreakerConfig{}}}
+			config.MetricCollector = noop.NewCollector()
+
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(producers["V"]).To(HaveLen(1))
+			limited := producers["V"][0].(*telemetry.DatastoreProducer).Producer
+			Expect(limited.(*telemetry.PayloadLimitProducer).Producer).To(BeAssignableToTypeOf(&telemetry.CircuitBreakerProducer{}))
+		})
+
+		It("batches the records of a datastore", func() {
+			config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{"kafka": {Batch: &telemetry.BatchConfig{MaxRecords: 100}}}
+			config.MetricCollector = noop.NewCollector()
+
+			dispatchers, producers, err := config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dispatchers[telemetry.Kafka]).To(BeAssignableToTypeOf(&telemetry.BatchingProducer{}))
+			limited := producers["V"][0].(*telemetry.DatastoreProducer).Producer
+			Expect(limited.(*telemetry.PayloadLimitProducer).Producer).To(BeAssignableToTypeOf(&telemetry.BatchingProducer{}))
+			Expect(dispatchers[telemetry.Kafka].Close()).To(Succeed())
+		})
+
+		It("limits the payload size of datastores without options", func() {
+			config.MetricCollector = noop.NewCollector()
+
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(producers["V"]).To(HaveLen(1))
+			Expect(producers["V"][0]).To(BeAssignableToTypeOf(&telemetry.PayloadLimitProducer{}))
+		})
+
+		It("fails on invalid serializer", func() {
+			config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{"kafka": {Serializer: "xml"}}
+
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).To(MatchError("datastore kafka: invalid serializer: xml"))
+			Expect(producers).To(BeNil())
+		})
+	})
+
+	Context("configure dead letter", func() {
+		It("wraps producers of other dispatchers", func() {
+			config.Records = map[string][]telemetry.Dispatcher{"V": {"kafka", "logger"}}
+			config.DeadLetter = &DeadLetter{Dispatcher: telemetry.Logger}
+
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(producers["V"]).To(HaveLen(2))
+			Expect(producers["V"][0]).To(BeAssignableToTypeOf(&telemetry.DeadLetterProducer{}))
+			Expect(producers["V"][1]).NotTo(BeAssignableToTypeOf(&telemetry.DeadLetterProducer{}))
+		})
+
+		It("fails when the dispatcher is unknown", func() {
+			config.DeadLetter = &DeadLetter{Dispatcher: "unknown"}
+
+			var err error
+			_, producers, err = config.ConfigureProducers(airbrake.NewAirbrakeHandler(nil), log)
+			Expect(err).To(MatchError("unknown dead letter dispatcher: unknown"))
+			Expect(producers).To(BeNil())
+		})
 	})
 
 	Context("configure kinesis", func() {
@@ -296,3 +563,19 @@ var _ = Describe("Test full application config", func() {
 		})
 	})
 })
+
+// recordingProducer records the records it produces
+type recordingProducer struct {
+	records []*telemetry.Record
+}
+
+func (p *recordingProducer) Produce(entry *telemetry.Record) error {
+	p.records = append(p.records, entry)
+	return nil
+}
+
+func (p *recordingProducer) Close() error { return nil }
+
+func (p *recordingProducer) ProcessReliableAck(_ *telemetry.Record) {}
+
+func (p *recordingProducer) ReportError(_ string, _ error, _ logrus.LogInfo) {}
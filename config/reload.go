@@ -0,0 +1,147 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// Reload reads the config file again. The returned config shares the metric collector, ack channel and dispatch pool of c
+func (c *Config) Reload() (*Config, error) {
+	if c.configFilePath == "" {
+		return nil, errors.New("config was not loaded from a file")
+	}
+	newConfig, err := readConfigFile(c.configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	newConfig.configFilePath = c.configFilePath
+	newConfig.MetricCollector = c.MetricCollector
+	newConfig.AckChan = c.AckChan
+	newConfig.dispatchPool = c.dispatchPool
+	return newConfig, nil
+}
+
+// ReloadChanges validates newConfig against the running config c. Only the record routing, datastore options,
+// dead letter, rate limits and vin filter are reloaded, it returns the other settings which changed and need a restart.
+// An error is returned if newConfig cannot be applied without a restart
+func (c *Config) ReloadChanges(newConfig *Config) ([]string, error) {
+	for dispatcher, datastoreConfig := range newConfig.Datastores {
+		if err := datastoreConfig.Validate(); err != nil {
+			return nil, fmt.Errorf("datastore %s: %v", dispatcher, err)
+		}
+	}
+
+	reliableAckSources, err := c.configureReliableAckSources()
+	if err != nil {
+		return nil, err
+	}
+	newReliableAckSources, err := newConfig.configureReliableAckSources()
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(reliableAckSources, newReliableAckSources) {
+		return nil, errors.New("reliable ack sources changed, requires restart")
+	}
+	if (c.RateLimit != nil && c.RateLimit.PerVIN != nil) != (newConfig.RateLimit != nil && newConfig.RateLimit.PerVIN != nil) {
+		return nil, errors.New("per vin rate limit enabled or disabled, requires restart")
+	}
+
+	settings := map[string][2]interface{}{
+		"host":                     {c.Host, newConfig.Host},
+		"port":                     {c.Port, newConfig.Port},
+		"status_port":              {c.StatusPort, newConfig.StatusPort},
+		"readiness_datastores":     {c.ReadinessDatastores, newConfig.ReadinessDatastores},
+		"tls":                      {c.TLS, newConfig.TLS},
+		"use_default_eng_ca":       {c.UseDefaultEngCA, newConfig.UseDefaultEngCA},
+		"keepalive":                {c.Keepalive, newConfig.Keepalive},
+		"idle_timeout":             {c.IdleTimeout, newConfig.IdleTimeout},
+		"max_connection_lifetime":  {c.MaxConnectionLifetime, newConfig.MaxConnectionLifetime},
+		"vin_connection_limit":     {c.VINConnectionLimit, newConfig.VINConnectionLimit},
+		"debug_vin":                {c.DebugVIN, newConfig.DebugVIN},
+		"metadata_lookup":          {c.MetadataLookup, newConfig.MetadataLookup},
+		"max_message_bytes":        {c.MaxMessageBytes, newConfig.MaxMessageBytes},
+		"shutdown_drain_timeout":   {c.ShutdownDrainTimeout, newConfig.ShutdownDrainTimeout},
+		"trusted_proxy_header":     {c.TrustedProxyHeader, newConfig.TrustedProxyHeader},
+		"socket_write_timeout":     {c.SocketWriteTimeout, newConfig.SocketWriteTimeout},
+		"kafka":                    {normalizedKafkaConfig(c.Kafka), normalizedKafkaConfig(newConfig.Kafka)},
+		"kafka_producer":           {c.KafkaProducer, newConfig.KafkaProducer},
+		"kafka_consumer":           {c.KafkaConsumer, newConfig.KafkaConsumer},
+		"kafka_instances":          {normalizedKafkaInstances(c.KafkaInstances), normalizedKafkaInstances(newConfig.KafkaInstances)},
+		"kinesis":                  {c.Kinesis, newConfig.Kinesis},
+		"pubsub":                   {c.Pubsub, newConfig.Pubsub},
+		"zmq":                      {c.ZMQ, newConfig.ZMQ},
+		"file":                     {c.File, newConfig.File},
+		"redis":                    {c.Redis, newConfig.Redis},
+		"nats":                     {c.NATS, newConfig.NATS},
+		"s3":                       {c.S3, newConfig.S3},
+		"tee":                      {c.Tee, newConfig.Tee},
+		"failover":                 {c.Failover, newConfig.Failover},
+		"unrouted_policy":          {c.UnroutedPolicy, newConfig.UnroutedPolicy},
+		"unrouted_default_route":   {c.UnroutedDefaultRoute, newConfig.UnroutedDefaultRoute},
+		"datastores.batch":         {c.batchConfigs(), newConfig.batchConfigs()},
+		"namespace":                {c.Namespace, newConfig.Namespace},
+		"monitoring":               {c.Monitoring, newConfig.Monitoring},
+		"tracing":                  {c.Tracing, newConfig.Tracing},
+		"logger":                   {c.LoggerConfig, newConfig.LoggerConfig},
+		"log_level":                {c.LogLevel, newConfig.LogLevel},
+		"json_log_enable":          {c.JSONLogEnable, newConfig.JSONLogEnable},
+		"transmit_decoded_records": {c.TransmitDecodedRecords, newConfig.TransmitDecodedRecords},
+		"json_enums_as_strings":    {c.JSONEnumsAsStrings, newConfig.JSONEnumsAsStrings},
+		"max_decompressed_size":    {c.MaxDecompressedSize, newConfig.MaxDecompressedSize},
+		"compression_enabled":      {c.CompressionEnabled, newConfig.CompressionEnabled},
+		"compression_level":        {c.CompressionLevel, newConfig.CompressionLevel},
+		"validate_payloads":        {c.ValidatePayloads, newConfig.ValidatePayloads},
+		"enforce_vin_cert_match":   {c.EnforceVINCertMatch, newConfig.EnforceVINCertMatch},
+		"invalid_payload_action":   {c.InvalidPayloadAction, newConfig.InvalidPayloadAction},
+		"backpressure":             {c.Backpressure, newConfig.Backpressure},
+		"inbound_queue":            {c.InboundQueue, newConfig.InboundQueue},
+		"unordered_dispatch":       {c.UnorderedDispatch, newConfig.UnorderedDispatch},
+		"dispatch_workers":         {c.DispatchWorkers, newConfig.DispatchWorkers},
+		"dedup":                    {c.Dedup, newConfig.Dedup},
+		"grpc":                     {c.GRPC, newConfig.GRPC},
+		"airbrake":                 {c.Airbrake, newConfig.Airbrake},
+	}
+	var restartRequired []string
+	for name, values := range settings {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			restartRequired = append(restartRequired, name)
+		}
+	}
+	sort.Strings(restartRequired)
+	return restartRequired, nil
+}
+
+// normalizedKafkaConfig returns a copy of input with the conversions applied when the producer is created
+func normalizedKafkaConfig(input *confluent.ConfigMap) *confluent.ConfigMap {
+	if input == nil {
+		return nil
+	}
+	output := make(confluent.ConfigMap, len(*input))
+	for key, val := range *input {
+		output[key] = val
+	}
+	convertKafkaConfig(&output)
+	return &output
+}
+
+// normalizedKafkaInstances returns a copy of input with the conversions of normalizedKafkaConfig applied to the instances
+func normalizedKafkaInstances(input map[telemetry.Dispatcher]*KafkaInstance) map[telemetry.Dispatcher]*KafkaInstance {
+	if input == nil {
+		return nil
+	}
+	output := make(map[telemetry.Dispatcher]*KafkaInstance, len(input))
+	for name, instance := range input {
+		if instance == nil {
+			output[name] = nil
+			continue
+		}
+		output[name] = &KafkaInstance{Kafka: normalizedKafkaConfig(instance.Kafka), KafkaProducer: instance.KafkaProducer}
+	}
+	return output
+}
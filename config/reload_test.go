@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Reload", func() {
+	var (
+		configPath string
+		config     *Config
+	)
+
+	writeConfig := func(configStr string) {
+		Expect(os.WriteFile(configPath, []byte(configStr), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		configFile, err := os.CreateTemp(GinkgoT().TempDir(), "config")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configFile.Close()).To(Succeed())
+		configPath = configFile.Name()
+
+		writeConfig(TestSmallConfig)
+		config, err = loadApplicationConfig(configPath)
+		Expect(err).NotTo(HaveOccurred())
+		config.configFilePath = configPath
+		convertKafkaConfig(config.Kafka)
+	})
+
+	It("reads the config file again", func() {
+		writeConfig(strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["kafka", "logger"]`, 1))
+
+		newConfig, err := config.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newConfig.Records["V"]).To(Equal([]telemetry.Dispatcher{telemetry.Kafka, telemetry.Logger}))
+		Expect(newConfig.MetricCollector).To(BeIdenticalTo(config.MetricCollector))
+		Expect(newConfig.AckChan).To(Equal(config.AckChan))
+	})
+
+	It("fails if the config was not loaded from a file", func() {
+		_, err := (&Config{}).Reload()
+		Expect(err).To(MatchError("config was not loaded from a file"))
+	})
+
+	It("reports no restart for routing changes", func() {
+		writeConfig(strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["kafka"], "T": ["logger"]`, 1))
+		newConfig, err := config.Reload()
+		Expect(err).NotTo(HaveOccurred())
+
+		restartRequired, err := config.ReloadChanges(newConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restartRequired).To(BeEmpty())
+	})
+
+	It("reports the settings requiring a restart", func() {
+		configStr := strings.Replace(TestSmallConfig, "some.broker1:9093,some.broker1:9093", "other.broker:9093", 1)
+		configStr = strings.Replace(configStr, `"namespace": "tesla_telemetry"`, `"namespace": "other"`, 1)
+		writeConfig(configStr)
+		newConfig, err := config.Reload()
+		Expect(err).NotTo(HaveOccurred())
+
+		restartRequired, err := config.ReloadChanges(newConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restartRequired).To(Equal([]string{"kafka", "namespace"}))
+	})
+
+	It("reports batch changes of datastores as requiring a restart", func() {
+		writeConfig(strings.Replace(TestSmallConfig, `"namespace": "tesla_telemetry",`, `"namespace": "tesla_telemetry", "datastores": {"kafka": {"batch": {"max_records": 100}}},`, 1))
+		newConfig, err := config.Reload()
+		Expect(err).NotTo(HaveOccurred())
+
+		restartRequired, err := config.ReloadChanges(newConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restartRequired).To(Equal([]string{"datastores.batch"}))
+	})
+
+	It("fails when reliable ack sources change", func() {
+		writeConfig(strings.Replace(TestSmallConfig, `"namespace": "tesla_telemetry",`, `"namespace": "tesla_telemetry", "reliable_ack_sources": {"V": "kafka"},`, 1))
+		newConfig, err := config.Reload()
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = config.ReloadChanges(newConfig)
+		Expect(err).To(MatchError("reliable ack sources changed, requires restart"))
+	})
+})
@@ -143,6 +143,45 @@ const TestUnusedTxTypeAsReliableAckConfig = `
 }
 `
 
+const TestRequiredForAckConfig = `
+{
+	"host": "127.0.0.1",
+	"port": 443,
+	"status_port": 8080,
+	"namespace": "tesla_telemetry",
+	"reliable_ack_sources": {
+		"V": "kafka",
+		"alerts": "kafka"
+	},
+	"kafka": {
+		"bootstrap.servers": "some.broker1:9093,some.broker1:9093",
+		"ssl.ca.location": "kafka.ca",
+		"ssl.certificate.location": "kafka.crt",
+		"ssl.key.location": "kafka.key",
+		"queue.buffering.max.messages": 1000000
+	},
+	"zmq": {
+		"addr": "tcp://127.0.0.1:5286"
+	},
+	"datastores": {
+		"zmq": {
+			"required_for_ack": true
+		}
+	},
+	"records": {
+		"V": ["kafka", "zmq", "logger"],
+		"alerts": ["kafka", "logger"],
+		"errors": ["logger"],
+		"connectivity": ["zmq"]
+	},
+	"tls": {
+		"ca_file": "tesla.ca",
+		"server_cert": "your_own_cert.crt",
+		"server_key": "your_own_key.key"
+	}
+}
+`
+
 const TestPubsubConfig = `
 {
 	"host": "127.0.0.1",
@@ -0,0 +1,337 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// knownDispatchers are the datastores records can be routed to
+var knownDispatchers = map[telemetry.Dispatcher]bool{
+	telemetry.Pubsub:   true,
+	telemetry.Kafka:    true,
+	telemetry.Kinesis:  true,
+	telemetry.Logger:   true,
+	telemetry.ZMQ:      true,
+	telemetry.File:     true,
+	telemetry.Redis:    true,
+	telemetry.NATS:     true,
+	telemetry.S3:       true,
+	telemetry.Null:     true,
+	telemetry.Tee:      true,
+	telemetry.Failover: true,
+}
+
+// isKnownDispatcher returns true for the datastores and the kafka instances of the config
+func (c *Config) isKnownDispatcher(dispatcher telemetry.Dispatcher) bool {
+	return knownDispatchers[dispatcher] || c.KafkaInstances[dispatcher] != nil
+}
+
+// Validate checks the config without connecting to the datastores and returns every problem found,
+// so they can be fixed at once before deploying it
+func (c *Config) Validate() []error {
+	var errs []error
+
+	recordNames := make([]string, 0, len(c.Records))
+	for recordName := range c.Records {
+		recordNames = append(recordNames, recordName)
+	}
+	sort.Strings(recordNames)
+	for name := range c.KafkaInstances {
+		if knownDispatchers[name] {
+			errs = append(errs, fmt.Errorf("kafka_instances: %s is the name of a datastore", name))
+		}
+	}
+	requiredDispatchers := make(map[telemetry.Dispatcher]bool)
+	for _, recordName := range recordNames {
+		dispatchers := c.Records[recordName]
+		if len(dispatchers) == 0 {
+			errs = append(errs, fmt.Errorf("record %s is not routed to any datastore", recordName))
+		}
+		for _, dispatcher := range dispatchers {
+			if !c.isKnownDispatcher(dispatcher) {
+				errs = append(errs, fmt.Errorf("record %s: unknown datastore %s", recordName, dispatcher))
+				continue
+			}
+			requiredDispatchers[dispatcher] = true
+		}
+	}
+
+	if c.DeadLetter != nil {
+		if !c.isKnownDispatcher(c.DeadLetter.Dispatcher) {
+			errs = append(errs, fmt.Errorf("unknown dead letter dispatcher: %s", c.DeadLetter.Dispatcher))
+		} else {
+			requiredDispatchers[c.DeadLetter.Dispatcher] = true
+		}
+	}
+	if err := c.UnroutedPolicy.Validate(); err != nil {
+		errs = append(errs, err)
+	} else if c.UnroutedPolicy == telemetry.UnroutedDefaultRoute {
+		switch {
+		case !c.isKnownDispatcher(c.UnroutedDefaultRoute):
+			errs = append(errs, fmt.Errorf("unknown unrouted_default_route: %s", c.UnroutedDefaultRoute))
+		// kinesis only writes the record types it has a stream for
+		case c.UnroutedDefaultRoute == telemetry.Kinesis:
+			errs = append(errs, errors.New("kinesis cannot be the unrouted_default_route"))
+		default:
+			requiredDispatchers[c.UnroutedDefaultRoute] = true
+		}
+	}
+	if requiredDispatchers[telemetry.Tee] && c.Tee != nil {
+		for _, dispatcher := range c.Tee.Datastores {
+			if c.isKnownDispatcher(dispatcher) && dispatcher != telemetry.Tee {
+				requiredDispatchers[dispatcher] = true
+			}
+		}
+	}
+	if requiredDispatchers[telemetry.Failover] && c.Failover != nil {
+		for _, dispatcher := range []telemetry.Dispatcher{c.Failover.Primary, c.Failover.Standby} {
+			if c.isKnownDispatcher(dispatcher) && dispatcher != telemetry.Failover {
+				requiredDispatchers[dispatcher] = true
+			}
+		}
+	}
+
+	dispatchers := make([]telemetry.Dispatcher, 0, len(requiredDispatchers))
+	for dispatcher := range requiredDispatchers {
+		dispatchers = append(dispatchers, dispatcher)
+	}
+	sort.Slice(dispatchers, func(i, j int) bool { return dispatchers[i] < dispatchers[j] })
+	for _, dispatcher := range dispatchers {
+		if err := c.validateProducerConfig(dispatcher); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	datastores := make([]telemetry.Dispatcher, 0, len(c.Datastores))
+	for dispatcher := range c.Datastores {
+		datastores = append(datastores, dispatcher)
+	}
+	sort.Slice(datastores, func(i, j int) bool { return datastores[i] < datastores[j] })
+	for _, dispatcher := range datastores {
+		if !c.isKnownDispatcher(dispatcher) {
+			errs = append(errs, fmt.Errorf("datastores: unknown datastore %s", dispatcher))
+		}
+		if datastoreConfig := c.Datastores[dispatcher]; datastoreConfig != nil {
+			if err := datastoreConfig.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("datastore %s: %v", dispatcher, err))
+			}
+			if err := c.validateAvroSerializer(dispatcher, datastoreConfig); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if _, err := c.configureReliableAckSources(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Backpressure != nil && c.Backpressure.LowWater >= c.Backpressure.HighWater {
+		errs = append(errs, fmt.Errorf("backpressure low_water (%d) must be lower than high_water (%d)", c.Backpressure.LowWater, c.Backpressure.HighWater))
+	}
+	if c.Dedup != nil {
+		if err := c.Dedup.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.DebugVIN != nil {
+		if err := c.DebugVIN.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if c.Monitoring == nil || c.Monitoring.ProfilerPort == 0 {
+			errs = append(errs, errors.New("debug_vin is served on the profiler port, it requires monitoring.profiler_port"))
+		}
+	}
+	if c.MetadataLookup != nil {
+		if err := c.MetadataLookup.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.VINConnectionLimit != nil {
+		if err := c.VINConnectionLimit.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.InboundQueue != nil {
+		if err := c.InboundQueue.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("idle_timeout must be positive, got %d", c.IdleTimeout))
+	}
+	if c.MaxConnectionLifetime < 0 {
+		errs = append(errs, fmt.Errorf("max_connection_lifetime must be positive, got %d", c.MaxConnectionLifetime))
+	}
+	if c.DispatchWorkers < 0 {
+		errs = append(errs, fmt.Errorf("dispatch_workers must be positive, got %d", c.DispatchWorkers))
+	}
+	if c.RecordLogSampleRate < 0 || c.RecordLogSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("record_log_sample_rate must be between 0 and 1, got %v", c.RecordLogSampleRate))
+	}
+	if c.KafkaConsumer != nil {
+		if err := c.KafkaConsumer.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if c.Kafka == nil {
+			errs = append(errs, errors.New("kafka_consumer requires the kafka config of the brokers"))
+		}
+		// the consumed records would be produced back to the topics they are read from
+		if requiredDispatchers[telemetry.Kafka] {
+			errs = append(errs, errors.New("kafka_consumer cannot dispatch records to kafka"))
+		}
+	}
+	if c.GRPC != nil {
+		if err := c.GRPC.Validate(c.Port); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch c.InvalidPayloadAction {
+	case "", InvalidPayloadNack, InvalidPayloadClose:
+	default:
+		errs = append(errs, fmt.Errorf("invalid invalid_payload_action: %s", c.InvalidPayloadAction))
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// validateAvroSerializer checks avro payloads are sent to kafka, which prefixes them with their schema id
+func (c *Config) validateAvroSerializer(dispatcher telemetry.Dispatcher, datastoreConfig *telemetry.DatastoreConfig) error {
+	if datastoreConfig.Serializer != telemetry.AvroFormat {
+		return nil
+	}
+	if !c.isKafka(dispatcher) {
+		return fmt.Errorf("datastore %s: the avro serializer is only supported by kafka", dispatcher)
+	}
+	producerConfig := c.KafkaProducer
+	if instance := c.KafkaInstances[dispatcher]; instance != nil {
+		producerConfig = instance.producerConfig(c.KafkaProducer)
+	}
+	if producerConfig == nil || producerConfig.SchemaRegistry == nil {
+		return fmt.Errorf("datastore %s: the avro serializer requires kafka_producer.schema_registry", dispatcher)
+	}
+	return nil
+}
+
+// validateTeeDatastores checks the datastores of the tee exist, records are batched by the datastores
+// themselves since the tee is created from their producers
+func (c *Config) validateTeeDatastores() error {
+	for _, dispatcher := range c.Tee.Datastores {
+		if !c.isKnownDispatcher(dispatcher) {
+			return fmt.Errorf("unknown datastore %s", dispatcher)
+		}
+	}
+	if datastoreConfig := c.Datastores[telemetry.Tee]; datastoreConfig != nil && datastoreConfig.Batch != nil {
+		return errors.New("batch is not supported by the tee, configure it on its datastores")
+	}
+	return nil
+}
+
+// validateFailoverDatastores checks the datastores of the failover exist, records are batched by the datastores
+// themselves since the failover is created from their producers
+func (c *Config) validateFailoverDatastores() error {
+	for _, dispatcher := range []telemetry.Dispatcher{c.Failover.Primary, c.Failover.Standby} {
+		if !c.isKnownDispatcher(dispatcher) {
+			return fmt.Errorf("unknown datastore %s", dispatcher)
+		}
+	}
+	if datastoreConfig := c.Datastores[telemetry.Failover]; datastoreConfig != nil && datastoreConfig.Batch != nil {
+		return errors.New("batch is not supported by the failover, configure it on its datastores")
+	}
+	return nil
+}
+
+// validateProducerConfig checks the settings of the producer of the dispatcher, as done when creating it
+func (c *Config) validateProducerConfig(dispatcher telemetry.Dispatcher) error {
+	var err error
+	switch dispatcher {
+	case telemetry.Kafka:
+		if c.Kafka == nil {
+			return errors.New("expected Kafka to be configured")
+		}
+		if err = c.KafkaProducer.Validate(); err == nil && c.KafkaProducer != nil {
+			_, err = c.KafkaProducer.ApplyTo(c.Kafka)
+		}
+	case telemetry.Pubsub:
+		if c.Pubsub == nil {
+			return errors.New("expected Pubsub to be configured")
+		}
+		err = c.Pubsub.PublishSettings.Validate()
+		if err == nil && c.Pubsub.Proxy != nil {
+			err = c.Pubsub.Proxy.Validate()
+		}
+	case telemetry.Kinesis:
+		if c.Kinesis == nil {
+			return errors.New("expected Kinesis to be configured")
+		}
+		err = c.Kinesis.PartitionKeyStrategy.Validate(c.Kinesis.PartitionKeyBuckets)
+		if err == nil && c.Kinesis.Backoff != nil {
+			err = c.Kinesis.Backoff.Validate()
+		}
+		if err == nil && c.Kinesis.Proxy != nil {
+			err = c.Kinesis.Proxy.Validate()
+		}
+	case telemetry.ZMQ:
+		if c.ZMQ == nil {
+			return errors.New("expected ZMQ to be configured")
+		}
+	case telemetry.File:
+		if c.File == nil {
+			return errors.New("expected File to be configured")
+		}
+		err = c.File.Validate()
+	case telemetry.Redis:
+		if c.Redis == nil {
+			return errors.New("expected Redis to be configured")
+		}
+		err = c.Redis.Validate()
+	case telemetry.NATS:
+		if c.NATS == nil {
+			return errors.New("expected NATS to be configured")
+		}
+		err = c.NATS.Validate()
+	case telemetry.S3:
+		if c.S3 == nil {
+			return errors.New("expected S3 to be configured")
+		}
+		err = c.S3.Validate()
+	case telemetry.Tee:
+		if c.Tee == nil {
+			return errors.New("expected Tee to be configured")
+		}
+		if err = c.Tee.Validate(); err == nil {
+			err = c.validateTeeDatastores()
+		}
+	case telemetry.Failover:
+		if c.Failover == nil {
+			return errors.New("expected Failover to be configured")
+		}
+		if err = c.Failover.Validate(); err == nil {
+			err = c.validateFailoverDatastores()
+		}
+	default:
+		if instance, ok := c.KafkaInstances[dispatcher]; ok {
+			if instance == nil || instance.Kafka == nil {
+				return fmt.Errorf("expected the kafka config of the %s instance", dispatcher)
+			}
+			producerConfig := instance.producerConfig(c.KafkaProducer)
+			if err = producerConfig.Validate(); err == nil && producerConfig != nil {
+				_, err = producerConfig.ApplyTo(instance.Kafka)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", dispatcher, err)
+	}
+	return nil
+}
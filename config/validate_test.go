@@ -0,0 +1,209 @@
+package config
+
+import (
+	"strings"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/failover"
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	"github.com/teslamotors/fleet-telemetry/datastore/tee"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Validate", func() {
+	It("accepts a valid config", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(BeEmpty())
+	})
+
+	It("reports every problem at once", func() {
+		configStr := strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["kafka"], "alerts": ["kinesis"], "errors": ["unknown"]`, 1)
+		configStr = strings.Replace(configStr, `"namespace": "tesla_telemetry",`, `"namespace": "tesla_telemetry",
+	"kinesis": {"partition_key_strategy": "shuffle"},
+	"datastores": {"kafka": {"include_fields": ["NotAField"]}},`, 1)
+		config, err := loadTestApplicationConfig(configStr)
+		Expect(err).NotTo(HaveOccurred())
+
+		errs := config.Validate()
+		Expect(errs).To(HaveLen(3))
+		Expect(errs[0]).To(MatchError(ContainSubstring("record errors: unknown datastore unknown")))
+		Expect(errs[1]).To(MatchError(ContainSubstring("kinesis: ")))
+		Expect(errs[2]).To(MatchError(ContainSubstring("datastore kafka: ")))
+		Expect(errs[2]).To(MatchError(ContainSubstring("NotAField")))
+	})
+
+	It("rejects malformed proxy urls", func() {
+		configStr := strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["kafka"], "alerts": ["pubsub"]`, 1)
+		configStr = strings.Replace(configStr, `"namespace": "tesla_telemetry",`, `"namespace": "tesla_telemetry",
+	"pubsub": {"gcp_project_id": "project", "proxy": {"url": "proxy:3128"}},`, 1)
+		config, err := loadTestApplicationConfig(configStr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(ConsistOf(MatchError(`pubsub: invalid proxy url "proxy:3128", expected an http, https or socks5 scheme`)))
+	})
+
+	It("rejects invalid inbound queues", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.InboundQueue = &InboundQueue{Depth: 0, Overflow: QueueOverflowDropOldest}
+		Expect(config.Validate()).To(ConsistOf(MatchError("inbound_queue depth must be positive, got 0")))
+
+		config.InboundQueue = &InboundQueue{Depth: 10, Overflow: "drop_all"}
+		Expect(config.Validate()).To(ConsistOf(MatchError("invalid inbound_queue overflow: drop_all")))
+	})
+
+	It("rejects a negative number of dispatch workers", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.DispatchWorkers = -1
+		Expect(config.Validate()).To(ConsistOf(MatchError("dispatch_workers must be positive, got -1")))
+	})
+
+	It("rejects kafka consumers dispatching back to kafka", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.KafkaConsumer = &kafka.ConsumerConfig{Topics: []string{"tesla_V"}, GroupID: "bridge"}
+		Expect(config.Validate()).To(ConsistOf(MatchError("kafka_consumer cannot dispatch records to kafka")))
+	})
+
+	It("requires a schema registry for the avro serializer of kafka", func() {
+		configStr := strings.Replace(TestSmallConfig, `"namespace": "tesla_telemetry",`, `"namespace": "tesla_telemetry",
+	"datastores": {"kafka": {"serializer": "avro"}, "kinesis": {"serializer": "avro"}},`, 1)
+		config, err := loadTestApplicationConfig(configStr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(ConsistOf(
+			MatchError("datastore kafka: the avro serializer requires kafka_producer.schema_registry"),
+			MatchError("datastore kinesis: the avro serializer is only supported by kafka"),
+		))
+
+		config.KafkaProducer = &kafka.Config{SchemaRegistry: &kafka.SchemaRegistryConfig{URL: "mock://registry"}}
+		Expect(config.Validate()).To(ConsistOf(MatchError("datastore kinesis: the avro serializer is only supported by kafka")))
+	})
+
+	It("validates the kafka instances", func() {
+		configStr := strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["kafka", "kafka_next"], "alerts": ["kafka_other"]`, 1)
+		config, err := loadTestApplicationConfig(configStr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(ConsistOf(
+			MatchError("record V: unknown datastore kafka_next"),
+			MatchError("record alerts: unknown datastore kafka_other"),
+		))
+
+		config.KafkaInstances = map[telemetry.Dispatcher]*KafkaInstance{
+			"kafka_next":  {Kafka: &confluent.ConfigMap{"bootstrap.servers": "next.broker:9093"}},
+			"kafka_other": {KafkaProducer: &kafka.Config{PartitionKey: "random"}},
+			"nats":        {Kafka: &confluent.ConfigMap{}},
+		}
+		config.Datastores = map[telemetry.Dispatcher]*telemetry.DatastoreConfig{"kafka_next": {Serializer: telemetry.AvroFormat}}
+		Expect(config.Validate()).To(ConsistOf(
+			MatchError("kafka_instances: nats is the name of a datastore"),
+			MatchError("expected the kafka config of the kafka_other instance"),
+			MatchError("datastore kafka_next: the avro serializer requires kafka_producer.schema_registry"),
+		))
+	})
+
+	It("validates the datastores of the tee", func() {
+		configStr := strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["tee"]`, 1)
+		config, err := loadTestApplicationConfig(configStr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(ConsistOf(MatchError("expected Tee to be configured")))
+
+		config.Tee = &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.NATS}}
+		Expect(config.Validate()).To(ConsistOf(MatchError("expected NATS to be configured")))
+	})
+
+	It("validates the datastores of the failover", func() {
+		configStr := strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["failover"]`, 1)
+		config, err := loadTestApplicationConfig(configStr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(ConsistOf(MatchError("expected Failover to be configured")))
+
+		config.Failover = &failover.Config{Primary: telemetry.Kafka, Standby: telemetry.NATS}
+		Expect(config.Validate()).To(ConsistOf(MatchError("expected NATS to be configured")))
+	})
+
+	It("validates the unrouted policy", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.UnroutedPolicy = "ignore"
+		Expect(config.Validate()).To(ConsistOf(MatchError("invalid unrouted_policy: ignore")))
+
+		config.UnroutedPolicy = telemetry.UnroutedDefaultRoute
+		config.UnroutedDefaultRoute = telemetry.Kinesis
+		Expect(config.Validate()).To(ConsistOf(MatchError("kinesis cannot be the unrouted_default_route")))
+
+		config.UnroutedDefaultRoute = telemetry.NATS
+		Expect(config.Validate()).To(ConsistOf(MatchError("expected NATS to be configured")))
+	})
+
+	It("rejects negative connection limits", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.IdleTimeout = -1
+		config.MaxConnectionLifetime = -1
+		Expect(config.Validate()).To(ConsistOf(
+			MatchError("idle_timeout must be positive, got -1"),
+			MatchError("max_connection_lifetime must be positive, got -1"),
+		))
+	})
+
+	It("requires the profiler port and a long token for debug_vin", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.Monitoring = nil
+		config.DebugVIN = &DebugVIN{Token: "secret"}
+		Expect(config.Validate()).To(ConsistOf(
+			MatchError("debug_vin token must have at least 16 characters"),
+			MatchError("debug_vin is served on the profiler port, it requires monitoring.profiler_port"),
+		))
+	})
+
+	It("rejects invalid metadata_lookup urls, timeouts and limits", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.MetadataLookup = &MetadataLookup{URL: "fleet-api/{vin}"}
+		Expect(config.Validate()).To(ConsistOf(MatchError(`invalid metadata_lookup url: "fleet-api/{vin}"`)))
+		config.MetadataLookup = &MetadataLookup{URL: "https://fleet-api/{vin}", Timeout: -1}
+		Expect(config.Validate()).To(ConsistOf(MatchError("metadata_lookup timeout must be positive, got -1")))
+		config.MetadataLookup = &MetadataLookup{URL: "https://fleet-api/{vin}", CacheTTL: -1}
+		Expect(config.Validate()).To(ConsistOf(MatchError("metadata_lookup cache_ttl must be positive, got -1")))
+		config.MetadataLookup = &MetadataLookup{URL: "https://fleet-api/{vin}", MaxConcurrentLookups: -1}
+		Expect(config.Validate()).To(ConsistOf(MatchError("metadata_lookup max_concurrent_lookups must be positive, got -1")))
+	})
+
+	It("rejects unknown duplicate vin policies", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.VINConnectionLimit = &VINConnectionLimit{MaxConnections: 2, Policy: "close_newest"}
+		Expect(config.Validate()).To(ConsistOf(MatchError("invalid vin_connection_limit policy: close_newest")))
+	})
+
+	It("rejects record log sample rates above 1", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.RecordLogSampleRate = 1.5
+		Expect(config.Validate()).To(ConsistOf(MatchError("record_log_sample_rate must be between 0 and 1, got 1.5")))
+	})
+
+	It("rejects grpc ports clashing with the server", func() {
+		config, err := loadTestApplicationConfig(TestSmallConfig)
+		Expect(err).NotTo(HaveOccurred())
+		config.GRPC = &GRPC{Enabled: false}
+		Expect(config.Validate()).To(BeEmpty())
+
+		config.GRPC = &GRPC{Enabled: true, Port: config.Port}
+		Expect(config.Validate()).To(ConsistOf(MatchError(ContainSubstring("grpc port must differ from the server port"))))
+
+		config.GRPC = &GRPC{Enabled: true, Port: config.Port + 1, AckBatch: &AckBatch{MaxAcks: -1}}
+		Expect(config.Validate()).To(ConsistOf(MatchError("invalid grpc ack_batch max_acks: -1")))
+	})
+
+	It("requires the configs of the routed datastores", func() {
+		config, err := loadTestApplicationConfig(strings.Replace(TestSmallConfig, `"V": ["kafka"]`, `"V": ["kafka", "redis"]`, 1))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(ConsistOf(MatchError("expected Redis to be configured")))
+	})
+})
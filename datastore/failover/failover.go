@@ -0,0 +1,362 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	defaultFailureThreshold    = 5
+	defaultProbeInterval       = 30 * time.Second
+	defaultHealthCheckInterval = 10 * time.Second
+)
+
+// Config lists the datastore records routed to the failover are written to, and the standby taking over when it fails
+type Config struct {
+	// Primary receives the records while it is healthy, ex.: "kafka"
+	Primary telemetry.Dispatcher `json:"primary"`
+
+	// Standby receives the records once the primary failed failure_threshold times in a row, ex.: "nats" or a kafka
+	// instance
+	Standby telemetry.Dispatcher `json:"standby"`
+
+	// FailureThreshold is the number of consecutive errors or failed health checks of the primary cutting over to the
+	// standby, defaults to 5
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+
+	// ProbeInterval is the time in milliseconds between two records sent to the primary while the standby is active,
+	// defaults to 30000. The primary becomes active again once it accepts a record
+	ProbeInterval int `json:"probe_interval,omitempty"`
+
+	// HealthCheckInterval is the time in milliseconds between two health checks of the primary, defaults to 10000.
+	// Only applies to datastores able to report their health, like kafka
+	HealthCheckInterval int `json:"health_check_interval,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	if c.Primary == "" || c.Standby == "" {
+		return errors.New("failover requires a primary and a standby datastore")
+	}
+	if c.Primary == c.Standby {
+		return fmt.Errorf("failover requires two different datastores, got %s twice", c.Primary)
+	}
+	for _, dispatcher := range []telemetry.Dispatcher{c.Primary, c.Standby} {
+		if dispatcher == telemetry.Failover || dispatcher == telemetry.Tee {
+			return fmt.Errorf("failover cannot write records to %s", dispatcher)
+		}
+	}
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("invalid failover failure_threshold: %d", c.FailureThreshold)
+	}
+	if c.ProbeInterval < 0 {
+		return fmt.Errorf("invalid failover probe_interval: %d", c.ProbeInterval)
+	}
+	if c.HealthCheckInterval < 0 {
+		return fmt.Errorf("invalid failover health_check_interval: %d", c.HealthCheckInterval)
+	}
+	return nil
+}
+
+// Producer writes records to the primary datastore and cuts over to the standby after consecutive errors, records
+// are never written to both. Errors are those returned by Produce, and the delivery failures of primaries reporting
+// their deliveries like kafka. Consecutive failed health checks of the primary cut over too.
+// While the standby is active, a record is sent to the primary every probe interval and the primary becomes active
+// again once it accepts it, or delivers it when it reports its deliveries. Probes the primary fails to write or to
+// deliver are written to the standby
+type Producer struct {
+	dispatchers      [2]telemetry.Dispatcher
+	producers        [2]telemetry.Producer
+	failureThreshold int
+	probeInterval    time.Duration
+	// reportsDeliveries is true when the primary reports the delivery of the records it accepted
+	reportsDeliveries bool
+	logger            *logrus.Logger
+
+	mu                  sync.Mutex
+	active              int
+	consecutiveFailures int
+	failedHealthChecks  int
+	lastProbeAt         time.Time
+	probing             bool
+	// probeID is the correlation id of the record probing a primary reporting its deliveries
+	probeID uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const (
+	primary = 0
+	standby = 1
+)
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	activeDatastore adapter.Gauge
+	cutoverCount    adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// NewProducer returns a producer failing over between the producers of the datastores of config.
+// The producers are shared with the other routes, closing the failover leaves them open
+func NewProducer(config *Config, producers map[telemetry.Dispatcher]telemetry.Producer, metricsCollector metrics.MetricCollector, logger *logrus.Logger) (*Producer, error) {
+	registerMetricsOnce(metricsCollector)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	producer := &Producer{
+		dispatchers:      [2]telemetry.Dispatcher{config.Primary, config.Standby},
+		failureThreshold: config.FailureThreshold,
+		probeInterval:    time.Duration(config.ProbeInterval) * time.Millisecond,
+		logger:           logger,
+		done:             make(chan struct{}),
+	}
+	if producer.failureThreshold == 0 {
+		producer.failureThreshold = defaultFailureThreshold
+	}
+	if producer.probeInterval == 0 {
+		producer.probeInterval = defaultProbeInterval
+	}
+	healthCheckInterval := time.Duration(config.HealthCheckInterval) * time.Millisecond
+	if healthCheckInterval == 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+
+	for i, dispatcher := range producer.dispatchers {
+		child, ok := producers[dispatcher]
+		if !ok {
+			return nil, fmt.Errorf("failover datastore %s is not configured", dispatcher)
+		}
+		producer.producers[i] = child
+	}
+	if reporter, ok := producer.producers[primary].(telemetry.DeliveryReporter); ok {
+		producer.reportsDeliveries = true
+		reporter.OnDelivery(producer.recordDelivery)
+	}
+	if checker, ok := producer.producers[primary].(telemetry.HealthChecker); ok {
+		go producer.checkHealth(checker, healthCheckInterval)
+	}
+	producer.reportActive()
+	return producer, nil
+}
+
+// Produce writes the record to the active datastore. The record reaching the failure threshold of the primary is
+// written to the standby, and probes failing on the primary are written to the standby too
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	target := p.target(entry)
+	err := p.producers[target].Produce(entry)
+	if target == standby {
+		return err
+	}
+	if p.recordWrite(err) {
+		return p.producers[standby].Produce(entry)
+	}
+	return err
+}
+
+// Active returns the datastore currently receiving the records
+func (p *Producer) Active() telemetry.Dispatcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dispatchers[p.active]
+}
+
+// target returns the datastore the record is written to, the primary once per probe interval while the standby is
+// active and the last health check of the primary succeeded
+func (p *Producer) target(entry *telemetry.Record) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active == primary {
+		return primary
+	}
+	// a single record probes the primary at a time
+	if p.probing || p.failedHealthChecks > 0 || time.Since(p.lastProbeAt) < p.probeInterval {
+		return standby
+	}
+	p.probing = true
+	p.lastProbeAt = time.Now()
+	if p.reportsDeliveries {
+		p.probeID = entry.CorrelationID()
+	}
+	return primary
+}
+
+// recordWrite updates the failover with the error the primary returned for a record, it returns true when the
+// record must be written to the standby
+func (p *Producer) recordWrite(err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wasProbe := p.probing
+	if err == nil {
+		// the delivery report of the record tells whether the primary recovered
+		if !p.reportsDeliveries {
+			p.probing = false
+			p.recordSuccess()
+		}
+		return false
+	}
+
+	p.probing = false
+	p.consecutiveFailures++
+	if wasProbe {
+		return true
+	}
+	return p.recordFailure(p.consecutiveFailures, err)
+}
+
+// recordDelivery updates the failover with the delivery report of a record written to the primary, by the failover
+// or by other routes. While the standby is active only the report of the probe is considered, the probe is written
+// to the standby when its delivery failed
+func (p *Producer) recordDelivery(entry *telemetry.Record, err error) {
+	if !p.recordReport(entry, err) {
+		return
+	}
+	if err := p.producers[standby].Produce(entry); err != nil {
+		p.ReportError("failover_probe_error", err, logrus.LogInfo{"datastore": p.dispatchers[standby], "record_type": entry.TxType})
+	}
+}
+
+// recordReport updates the failover with a delivery report, it returns true when the report is the failed delivery
+// of a probe
+func (p *Producer) recordReport(entry *telemetry.Record, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wasProbe := false
+	if p.active != primary {
+		if !p.probing || entry.CorrelationID() != p.probeID {
+			return false
+		}
+		p.probing = false
+		wasProbe = true
+	}
+	if err == nil {
+		p.recordSuccess()
+		return false
+	}
+	p.consecutiveFailures++
+	p.recordFailure(p.consecutiveFailures, err)
+	return wasProbe
+}
+
+// recordHealth updates the failover with the result of a health check of the primary, the standby doesn't receive
+// probes until a check succeeds
+func (p *Producer) recordHealth(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		p.failedHealthChecks = 0
+		return
+	}
+	p.failedHealthChecks++
+	p.recordFailure(p.failedHealthChecks, err)
+}
+
+// recordSuccess makes the primary active again, p.mu must be held
+func (p *Producer) recordSuccess() {
+	p.consecutiveFailures = 0
+	if p.active != primary {
+		p.cutover(primary, 0, nil)
+	}
+}
+
+// recordFailure cuts over to the standby once failures reach the threshold, it returns true if it did.
+// p.mu must be held
+func (p *Producer) recordFailure(failures int, err error) bool {
+	if p.active != primary || failures < p.failureThreshold {
+		return false
+	}
+	p.lastProbeAt = time.Now()
+	p.cutover(standby, failures, err)
+	return true
+}
+
+// checkHealth checks the health of the primary every interval until the failover is closed
+func (p *Producer) checkHealth(checker telemetry.HealthChecker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := checker.CheckHealth(ctx)
+		cancel()
+		p.recordHealth(err)
+	}
+}
+
+func (p *Producer) cutover(target int, failures int, err error) {
+	from := p.dispatchers[p.active]
+	p.active = target
+	p.reportActive()
+	metricsRegistry.cutoverCount.Inc(map[string]string{"datastore": string(p.dispatchers[target])})
+	logInfo := logrus.LogInfo{"from": from, "to": p.dispatchers[target], "consecutive_errors": failures}
+	if err != nil {
+		logInfo["error"] = err.Error()
+	}
+	p.logger.ActivityLog("failover_cutover", logInfo)
+}
+
+// reportActive sets the failover_active_datastore gauge to 1 for the active datastore and 0 for the other
+func (p *Producer) reportActive() {
+	for i, dispatcher := range p.dispatchers {
+		var value int64
+		if i == p.active {
+			value = 1
+		}
+		metricsRegistry.activeDatastore.Set(value, map[string]string{"datastore": string(dispatcher)})
+	}
+}
+
+// Close stops the health checks of the primary, the datastores are closed with the other producers
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
+
+// ProcessReliableAck noop method, the datastores ack the records they are configured for
+func (p *Producer) ProcessReliableAck(_ *telemetry.Record) {
+}
+
+// ReportError to logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.activeDatastore = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "failover_active_datastore",
+		Help:   "1 for the datastore of the failover receiving the records, 0 for the other.",
+		Labels: []string{"datastore"},
+	})
+
+	metricsRegistry.cutoverCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "failover_cutover_total",
+		Help:   "The number of times the failover switched the datastore receiving the records.",
+		Labels: []string{"datastore"},
+	})
+}
@@ -0,0 +1,285 @@
+package failover_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/failover"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// FakeProducer records the records it produces and returns err
+type FakeProducer struct {
+	mu      sync.Mutex
+	err     error
+	records []*telemetry.Record
+}
+
+func (f *FakeProducer) Produce(entry *telemetry.Record) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, entry)
+	return f.err
+}
+
+// produced returns the records produced so far
+func (f *FakeProducer) produced() []*telemetry.Record {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*telemetry.Record(nil), f.records...)
+}
+
+func (f *FakeProducer) Close() error { return nil }
+
+func (f *FakeProducer) ProcessReliableAck(_ *telemetry.Record) {}
+
+func (f *FakeProducer) ReportError(_ string, _ error, _ logrus.LogInfo) {}
+
+// ReportingProducer is a FakeProducer reporting the deliveries of its records when deliver is called
+type ReportingProducer struct {
+	FakeProducer
+	report func(entry *telemetry.Record, err error)
+}
+
+func (r *ReportingProducer) OnDelivery(report func(entry *telemetry.Record, err error)) {
+	r.report = report
+}
+
+func (r *ReportingProducer) deliver(entry *telemetry.Record, err error) {
+	r.report(entry, err)
+}
+
+// CheckingProducer is a FakeProducer reporting healthErr as its health
+type CheckingProducer struct {
+	FakeProducer
+	mu        sync.Mutex
+	healthErr error
+}
+
+func (c *CheckingProducer) CheckHealth(_ context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.healthErr
+}
+
+func (c *CheckingProducer) setHealth(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.healthErr = err
+}
+
+var _ = Describe("Producer", func() {
+	var (
+		kafka     *FakeProducer
+		nats      *FakeProducer
+		producers map[telemetry.Dispatcher]telemetry.Producer
+		record    *telemetry.Record
+		producer  *failover.Producer
+		hook      *test.Hook
+	)
+
+	BeforeEach(func() {
+		kafka = &FakeProducer{}
+		nats = &FakeProducer{}
+		producers = map[telemetry.Dispatcher]telemetry.Producer{telemetry.Kafka: kafka, telemetry.NATS: nats}
+		record = &telemetry.Record{TxType: "V", Vin: "42", Txid: "txid"}
+
+		var logger *logrus.Logger
+		logger, hook = logrus.NoOpLogger()
+		var err error
+		producer, err = failover.NewProducer(&failover.Config{Primary: telemetry.Kafka, Standby: telemetry.NATS, FailureThreshold: 2, ProbeInterval: 50}, producers, noop.NewCollector(), logger)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("produces the records to the primary while it is healthy", func() {
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(kafka.records).To(ConsistOf(record))
+		Expect(nats.records).To(BeEmpty())
+		Expect(producer.Active()).To(Equal(telemetry.Kafka))
+	})
+
+	It("cuts over to the standby after consecutive failures of the primary", func() {
+		kafka.err = errors.New("all brokers down")
+		Expect(producer.Produce(record)).To(MatchError("all brokers down"))
+		Expect(nats.records).To(BeEmpty())
+
+		// the record reaching the threshold is written to the standby
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(nats.records).To(HaveLen(1))
+		Expect(producer.Active()).To(Equal(telemetry.NATS))
+
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(kafka.records).To(HaveLen(2))
+		Expect(nats.records).To(HaveLen(2))
+
+		Expect(hook.AllEntries()).To(HaveLen(1))
+		Expect(hook.LastEntry().Message).To(Equal("failover_cutover"))
+		Expect(hook.LastEntry().Data).To(HaveKeyWithValue("to", telemetry.NATS))
+	})
+
+	It("resets the failure count when the primary succeeds", func() {
+		kafka.err = errors.New("timeout")
+		Expect(producer.Produce(record)).NotTo(Succeed())
+		kafka.err = nil
+		Expect(producer.Produce(record)).To(Succeed())
+		kafka.err = errors.New("timeout")
+		Expect(producer.Produce(record)).NotTo(Succeed())
+		Expect(producer.Active()).To(Equal(telemetry.Kafka))
+		Expect(nats.records).To(BeEmpty())
+	})
+
+	It("probes the primary and fails back once it recovered", func() {
+		kafka.err = errors.New("all brokers down")
+		Expect(producer.Produce(record)).NotTo(Succeed())
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Active()).To(Equal(telemetry.NATS))
+
+		// a failing probe is written to the standby
+		time.Sleep(60 * time.Millisecond)
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(kafka.records).To(HaveLen(3))
+		Expect(nats.records).To(HaveLen(2))
+		Expect(producer.Active()).To(Equal(telemetry.NATS))
+
+		kafka.err = nil
+		time.Sleep(60 * time.Millisecond)
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(kafka.records).To(HaveLen(4))
+		Expect(nats.records).To(HaveLen(2))
+		Expect(producer.Active()).To(Equal(telemetry.Kafka))
+		Expect(hook.LastEntry().Data).To(HaveKeyWithValue("to", telemetry.Kafka))
+	})
+
+	It("returns the errors of the standby", func() {
+		kafka.err = errors.New("all brokers down")
+		nats.err = errors.New("no responders")
+		Expect(producer.Produce(record)).NotTo(Succeed())
+		Expect(producer.Produce(record)).To(MatchError("no responders"))
+		Expect(producer.Produce(record)).To(MatchError("no responders"))
+		Expect(kafka.records).To(HaveLen(2))
+	})
+
+	Context("when the primary reports its deliveries", func() {
+		var reporting *ReportingProducer
+
+		BeforeEach(func() {
+			reporting = &ReportingProducer{}
+			producers[telemetry.Kafka] = reporting
+			logger, _ := logrus.NoOpLogger()
+			var err error
+			producer, err = failover.NewProducer(&failover.Config{Primary: telemetry.Kafka, Standby: telemetry.NATS, FailureThreshold: 2, ProbeInterval: 50}, producers, noop.NewCollector(), logger)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("cuts over after consecutive delivery failures", func() {
+			Expect(producer.Produce(record)).To(Succeed())
+			reporting.deliver(record, errors.New("message timed out"))
+			// accepting a record doesn't reset the failures, delivering it does
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(producer.Active()).To(Equal(telemetry.Kafka))
+			reporting.deliver(record, errors.New("message timed out"))
+			Expect(producer.Active()).To(Equal(telemetry.NATS))
+
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(reporting.records).To(HaveLen(2))
+			Expect(nats.records).To(HaveLen(1))
+		})
+
+		It("resets the failure count when a record is delivered", func() {
+			reporting.deliver(record, errors.New("message timed out"))
+			reporting.deliver(record, nil)
+			reporting.deliver(record, errors.New("message timed out"))
+			Expect(producer.Active()).To(Equal(telemetry.Kafka))
+		})
+
+		It("fails back once a probe is delivered", func() {
+			reporting.deliver(record, errors.New("message timed out"))
+			reporting.deliver(record, errors.New("message timed out"))
+			Expect(producer.Active()).To(Equal(telemetry.NATS))
+
+			time.Sleep(60 * time.Millisecond)
+			probe := &telemetry.Record{TxType: "V", Vin: "43"}
+			Expect(producer.Produce(probe)).To(Succeed())
+			Expect(reporting.records).To(ConsistOf(probe))
+			// a single probe is in flight, deliveries of other records are ignored
+			Expect(producer.Produce(record)).To(Succeed())
+			reporting.deliver(record, nil)
+			Expect(producer.Active()).To(Equal(telemetry.NATS))
+
+			reporting.deliver(probe, nil)
+			Expect(producer.Active()).To(Equal(telemetry.Kafka))
+		})
+
+		It("keeps the standby active and writes the probe to it when its delivery fails", func() {
+			reporting.deliver(record, errors.New("message timed out"))
+			reporting.deliver(record, errors.New("message timed out"))
+
+			time.Sleep(60 * time.Millisecond)
+			probe := &telemetry.Record{TxType: "V", Vin: "43"}
+			Expect(producer.Produce(probe)).To(Succeed())
+			Expect(nats.produced()).To(BeEmpty())
+			// the primary reports the delivery from its own goroutine, once the probe was accepted
+			go reporting.deliver(probe, errors.New("message timed out"))
+			Eventually(nats.produced).Should(ConsistOf(probe))
+			Expect(producer.Active()).To(Equal(telemetry.NATS))
+
+			time.Sleep(60 * time.Millisecond)
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(reporting.produced()).To(HaveLen(2))
+		})
+	})
+
+	Context("when the primary reports its health", func() {
+		var checking *CheckingProducer
+
+		BeforeEach(func() {
+			checking = &CheckingProducer{healthErr: errors.New("no brokers")}
+			producers[telemetry.Kafka] = checking
+			logger, _ := logrus.NoOpLogger()
+			var err error
+			producer, err = failover.NewProducer(&failover.Config{Primary: telemetry.Kafka, Standby: telemetry.NATS, FailureThreshold: 2, ProbeInterval: 10, HealthCheckInterval: 10}, producers, noop.NewCollector(), logger)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(producer.Close)
+		})
+
+		It("cuts over after consecutive failed health checks and probes once it is healthy", func() {
+			Eventually(producer.Active).Should(Equal(telemetry.NATS))
+			time.Sleep(30 * time.Millisecond)
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(checking.records).To(BeEmpty())
+
+			checking.setHealth(nil)
+			Eventually(func() telemetry.Dispatcher {
+				_ = producer.Produce(record)
+				return producer.Active()
+			}).Should(Equal(telemetry.Kafka))
+		})
+	})
+
+	It("requires the datastores to be configured", func() {
+		logger, _ := logrus.NoOpLogger()
+		_, err := failover.NewProducer(&failover.Config{Primary: telemetry.Kafka, Standby: telemetry.S3}, producers, noop.NewCollector(), logger)
+		Expect(err).To(MatchError("failover datastore s3 is not configured"))
+	})
+
+	DescribeTable("rejects invalid configs",
+		func(config *failover.Config, errMessage string) {
+			Expect(config.Validate()).To(MatchError(errMessage))
+		},
+		Entry("no standby", &failover.Config{Primary: telemetry.Kafka}, "failover requires a primary and a standby datastore"),
+		Entry("same datastore", &failover.Config{Primary: telemetry.Kafka, Standby: telemetry.Kafka}, "failover requires two different datastores, got kafka twice"),
+		Entry("tee", &failover.Config{Primary: telemetry.Kafka, Standby: telemetry.Tee}, "failover cannot write records to tee"),
+		Entry("negative threshold", &failover.Config{Primary: telemetry.Kafka, Standby: telemetry.NATS, FailureThreshold: -1}, "invalid failover failure_threshold: -1"),
+		Entry("negative probe interval", &failover.Config{Primary: telemetry.Kafka, Standby: telemetry.NATS, ProbeInterval: -1}, "invalid failover probe_interval: -1"),
+		Entry("negative health check interval", &failover.Config{Primary: telemetry.Kafka, Standby: telemetry.NATS, HealthCheckInterval: -1}, "invalid failover health_check_interval: -1"),
+	)
+})
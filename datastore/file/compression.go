@@ -0,0 +1,177 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec of the stream of records written to files and objects
+type Compression string
+
+const (
+	// NoCompression writes the records as is
+	NoCompression Compression = "none"
+	// GzipCompression compresses with gzip, levels range from 1 (fastest) to 9 (smallest)
+	GzipCompression Compression = "gzip"
+	// ZstdCompression compresses with zstd, levels range from 1 to 22 and are mapped to the 4 speeds of the encoder
+	ZstdCompression Compression = "zstd"
+
+	maxZstdLevel = 22
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Validate returns an error if the compression or its level are not supported, level 0 selects the default level
+// of the compression
+func (c Compression) Validate(level int) error {
+	switch c {
+	case NoCompression:
+		if level != 0 {
+			return fmt.Errorf("compression_level %d requires a compression", level)
+		}
+	case GzipCompression:
+		if level < 0 || level > gzip.BestCompression {
+			return fmt.Errorf("invalid gzip compression_level %d, expected 1 to %d", level, gzip.BestCompression)
+		}
+	case ZstdCompression:
+		if level < 0 || level > maxZstdLevel {
+			return fmt.Errorf("invalid zstd compression_level %d, expected 1 to %d", level, maxZstdLevel)
+		}
+	default:
+		return fmt.Errorf("invalid compression %s, expected none, gzip or zstd", c)
+	}
+	return nil
+}
+
+// Extension is appended to the name of the files and objects written with the compression
+func (c Compression) Extension() string {
+	switch c {
+	case GzipCompression:
+		return ".gz"
+	case ZstdCompression:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// CompressionOf returns the compression of a file from its extension
+func CompressionOf(path string) Compression {
+	for _, compression := range []Compression{GzipCompression, ZstdCompression} {
+		if strings.HasSuffix(path, compression.Extension()) {
+			return compression
+		}
+	}
+	return NoCompression
+}
+
+// CompressWriter compresses the data written to it, Flush makes the data written so far readable
+type CompressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// NewCompressWriter returns a writer compressing to w, closing it doesn't close w
+func NewCompressWriter(w io.Writer, compression Compression, level int) (CompressWriter, error) {
+	switch compression {
+	case GzipCompression:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		writer, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return writer, nil
+	case ZstdCompression:
+		options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		writer, err := zstd.NewWriter(w, options...)
+		if err != nil {
+			return nil, err
+		}
+		return writer, nil
+	default:
+		return nopCompressWriter{w}, nil
+	}
+}
+
+type nopCompressWriter struct {
+	io.Writer
+}
+
+func (nopCompressWriter) Flush() error { return nil }
+
+func (nopCompressWriter) Close() error { return nil }
+
+// NewDecompressReader returns a reader of the data compressed in r
+func NewDecompressReader(r io.Reader, compression Compression) (io.ReadCloser, error) {
+	switch compression {
+	case GzipCompression:
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
+	case ZstdCompression:
+		reader, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return reader.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// sniffCompression detects compressed files without extension, such as objects downloaded under another name.
+// Uncompressed files can't start like compressed ones since entries start with the tag of their first field
+func sniffCompression(r *bufio.Reader) Compression {
+	header, _ := r.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return GzipCompression
+	case bytes.HasPrefix(header, zstdMagic):
+		return ZstdCompression
+	default:
+		return NoCompression
+	}
+}
+
+// Open returns a reader of the records of a file, decompressed according to its extension or, without
+// extension of a compression, to its first bytes
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(f)
+	compression := CompressionOf(path)
+	if compression == NoCompression {
+		compression = sniffCompression(buffered)
+	}
+	decompressed, err := NewDecompressReader(buffered, compression)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	reader := NewReader(decompressed)
+	reader.close = func() error {
+		_ = decompressed.Close()
+		return f.Close()
+	}
+	return reader, nil
+}
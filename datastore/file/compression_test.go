@@ -0,0 +1,68 @@
+package file_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/file"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// BenchmarkCompression compresses a file of V records with each compression, the ratio is reported as the
+// compressed size over the uncompressed size
+//
+//	go test ./datastore/file -run '^$' -bench Compression
+func BenchmarkCompression(b *testing.B) {
+	var records []byte
+	for i := 0; i < 1000; i++ {
+		payload, err := proto.Marshal(&protos.Payload{
+			Vin:       "5YJ3E1EA7JF000001",
+			CreatedAt: timestamppb.Now(),
+			Data: []*protos.Datum{
+				{Key: protos.Field_VehicleSpeed, Value: &protos.Value{Value: &protos.Value_StringValue{StringValue: fmt.Sprint(i % 120)}}},
+				{Key: protos.Field_Odometer, Value: &protos.Value{Value: &protos.Value_DoubleValue{DoubleValue: 12000 + float64(i)/10}}},
+				{Key: protos.Field_Location, Value: &protos.Value{Value: &protos.Value_LocationValue{LocationValue: &protos.LocationValue{Latitude: 37.412374 + float64(i)/1e5, Longitude: -122.145867}}}},
+			},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		record := &telemetry.Record{TxType: "V", Vin: "5YJ3E1EA7JF000001", Txid: fmt.Sprint(i), PayloadBytes: payload, ReceivedTimestamp: int64(i)}
+		records = file.AppendEntry(records, record)
+	}
+
+	for _, bench := range []struct {
+		compression file.Compression
+		level       int
+	}{
+		{file.GzipCompression, 1},
+		{file.GzipCompression, 6},
+		{file.ZstdCompression, 1},
+		{file.ZstdCompression, 3},
+		{file.ZstdCompression, 9},
+	} {
+		b.Run(fmt.Sprintf("%s-%d", bench.compression, bench.level), func(b *testing.B) {
+			var compressed bytes.Buffer
+			b.SetBytes(int64(len(records)))
+			for i := 0; i < b.N; i++ {
+				compressed.Reset()
+				writer, err := file.NewCompressWriter(&compressed, bench.compression, bench.level)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := writer.Write(records); err != nil {
+					b.Fatal(err)
+				}
+				if err := writer.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(compressed.Len())/float64(len(records)), "ratio")
+		})
+	}
+}
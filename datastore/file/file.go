@@ -0,0 +1,386 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// FsyncPolicy controls when record files are synced to disk
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs the file after every record, records are acked once synced
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncRotate syncs the file when it is rotated or the producer is closed, its records are acked then
+	FsyncRotate FsyncPolicy = "rotate"
+	// FsyncNever leaves syncing to the operating system, records are acked once their file is flushed when it is
+	// rotated or the producer is closed
+	FsyncNever FsyncPolicy = "never"
+
+	// defaultMaxFileSize is the size in bytes at which files are rotated when not configured
+	defaultMaxFileSize = 100 * 1024 * 1024
+	// ageCheckInterval is how often the age of the current file is checked when max_file_age is set
+	ageCheckInterval = time.Second
+
+	filePrefix     = "records-"
+	fileSuffix     = ".pb"
+	fileTimeLayout = "20060102T150405.000000000Z"
+)
+
+// Config contains the data necessary to configure a file producer
+type Config struct {
+	// Dir is the directory the record files are written to, it is created if missing
+	Dir string `json:"dir"`
+
+	// MaxFileSize rotates the current file once it reaches this size in bytes before compression, defaults to 100mb
+	MaxFileSize int64 `json:"max_file_size"`
+
+	// MaxFileAge rotates the current file once it is older than this many seconds, even without new records, disabled
+	// when 0. It bounds how long records wait for their ack with the rotate and never fsync policies
+	MaxFileAge int `json:"max_file_age"`
+
+	// Fsync is when files are synced to disk: always, rotate (default) or never
+	Fsync FsyncPolicy `json:"fsync"`
+
+	// Compression of the files: none (default), gzip or zstd. Compressed records are only readable once flushed,
+	// on every record with the always fsync policy and when the file is rotated otherwise
+	Compression Compression `json:"compression,omitempty"`
+
+	// CompressionLevel of the compression, defaults to the default level of the compression
+	CompressionLevel int `json:"compression_level,omitempty"`
+}
+
+// Producer writes records to rotating files as length prefixed protobuf messages
+type Producer struct {
+	config             *Config
+	maxFileSize        int64
+	maxFileAge         time.Duration
+	file               *os.File
+	writer             CompressWriter
+	fileSize           int64
+	fileOpenedAt       time.Time
+	lock               sync.Mutex
+	logger             *logrus.Logger
+	airbrakeHandler    *airbrake.Handler
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+	nacker             *telemetry.Nacker
+	produceErrors      *telemetry.ProduceErrorCounter
+	// pending are the records of the current file waiting for it to be flushed and synced to be acked
+	pending []*telemetry.Record
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	writeCount       adapter.Counter
+	writeBytesTotal  adapter.Counter
+	errorCount       adapter.Counter
+	rotationCount    adapter.Counter
+	reliableAckCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	if c.Dir == "" {
+		return errors.New("file dir cannot be empty")
+	}
+	switch c.Fsync {
+	case "", FsyncAlways, FsyncRotate, FsyncNever:
+	default:
+		return fmt.Errorf("invalid file fsync policy: %s", c.Fsync)
+	}
+	if err := c.compression().Validate(c.CompressionLevel); err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+	return nil
+}
+
+func (c *Config) compression() Compression {
+	if c.Compression == "" {
+		return NoCompression
+	}
+	return c.Compression
+}
+
+// NewProducer creates the record directory and returns a producer writing to it, files are created on the first record
+func NewProducer(config *Config, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+	registerMetricsOnce(metricsCollector)
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	maxFileSize := config.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = defaultMaxFileSize
+	}
+
+	logger.ActivityLog("file_registered", logrus.LogInfo{"dir": config.Dir, "fsync": config.Fsync, "compression": config.compression()})
+	producer := &Producer{
+		produceErrors:      telemetry.NewProduceErrorCounter(telemetry.File, metricsCollector),
+		config:             config,
+		maxFileSize:        maxFileSize,
+		maxFileAge:         time.Duration(config.MaxFileAge) * time.Second,
+		logger:             logger,
+		airbrakeHandler:    airbrakeHandler,
+		ackChan:            ackChan,
+		reliableAckTxTypes: reliableAckTxTypes,
+		nacker:             telemetry.NewNacker(telemetry.File, ackChan, reliableAckTxTypes, metricsCollector),
+		done:               make(chan struct{}),
+	}
+	if producer.maxFileAge > 0 {
+		producer.wg.Add(1)
+		go producer.rotateExpiredFiles(ageCheckInterval)
+	}
+	return producer, nil
+}
+
+// Produce appends the record to the current file, rotating it first if needed. The record is acked once synced with
+// the always fsync policy, and once its file is rotated or the producer closed otherwise
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	entry.ProduceTime = time.Now()
+	data := AppendEntry(nil, entry)
+
+	if err := p.write(entry, data); err != nil {
+		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		p.produceErrors.Inc(err)
+		p.reportRecordError("file_write_error", err, entry, logrus.LogInfo{"record_type": entry.TxType, "txid": entry.Txid})
+		return err
+	}
+
+	metricsRegistry.writeCount.Inc(map[string]string{"record_type": entry.TxType})
+	metricsRegistry.writeBytesTotal.Add(int64(len(data)), map[string]string{"record_type": entry.TxType})
+	if p.config.Fsync == FsyncAlways {
+		p.ProcessReliableAck(entry)
+	}
+	return nil
+}
+
+func (p *Producer) write(entry *telemetry.Record, data []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.file != nil && (p.fileSize >= p.maxFileSize || p.expired()) {
+		if err := p.closeFile(); err != nil {
+			return err
+		}
+		metricsRegistry.rotationCount.Inc(map[string]string{})
+	}
+	if p.file == nil {
+		if err := p.openFile(); err != nil {
+			return err
+		}
+	}
+
+	n, err := p.writer.Write(data)
+	p.fileSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if p.config.Fsync == FsyncAlways {
+		if err := p.writer.Flush(); err != nil {
+			return err
+		}
+		return p.file.Sync()
+	}
+	if _, ok := p.reliableAckTxTypes[entry.TxType]; ok {
+		p.pending = append(p.pending, entry)
+	}
+	return nil
+}
+
+func (p *Producer) expired() bool {
+	return p.maxFileAge > 0 && time.Since(p.fileOpenedAt) >= p.maxFileAge
+}
+
+// rotateExpiredFiles rotates the current file every interval once it is older than the max age, so that its records
+// are synced and acked when no new record is written, until the producer is closed
+func (p *Producer) rotateExpiredFiles(interval time.Duration) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.lock.Lock()
+		if p.file != nil && p.expired() {
+			if err := p.closeFile(); err != nil {
+				p.ReportError("file_rotation_error", err, logrus.LogInfo{"dir": p.config.Dir})
+			} else {
+				metricsRegistry.rotationCount.Inc(map[string]string{})
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *Producer) openFile() error {
+	now := time.Now().UTC()
+	if !now.After(p.fileOpenedAt) {
+		// file names need to be unique and sorted when rotating several times within the clock resolution
+		now = p.fileOpenedAt.Add(time.Nanosecond)
+	}
+	name := filepath.Join(p.config.Dir, filePrefix+now.Format(fileTimeLayout)+fileSuffix+p.config.compression().Extension())
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	writer, err := NewCompressWriter(file, p.config.compression(), p.config.CompressionLevel)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	p.file = file
+	p.writer = writer
+	p.fileSize = 0
+	p.fileOpenedAt = now
+	return nil
+}
+
+// closeFile flushes, syncs according to the fsync policy and closes the current file, then acks its pending records,
+// or nacks them if they might not have been written
+func (p *Producer) closeFile() error {
+	pending := p.pending
+	p.pending = nil
+	err := p.syncAndCloseFile()
+	for _, entry := range pending {
+		if err != nil {
+			p.nacker.Nack(entry, err)
+		} else {
+			p.ProcessReliableAck(entry)
+		}
+	}
+	return err
+}
+
+func (p *Producer) syncAndCloseFile() error {
+	file := p.file
+	p.file = nil
+	if err := p.writer.Close(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if p.config.Fsync != FsyncNever {
+		if err := file.Sync(); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Close stops the age based rotation, then syncs and closes the current file, acking its records
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	p.wg.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	return p.closeFile()
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+	}
+}
+
+// ReportError to airbrake and logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.airbrakeHandler.ReportLogMessage(logrus.ERROR, message, err, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(telemetry.File)}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+// ListFiles returns the record files of dir, compressed or not, oldest first
+func ListFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), CompressionOf(entry.Name()).Extension())
+		if entry.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.writeCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "file_write_total",
+		Help:   "The number of records written to files.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.writeBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "file_write_total_bytes",
+		Help:   "The number of bytes written to files.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "file_err",
+		Help:   "The number of errors while writing records to files.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.rotationCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "file_rotation_total",
+		Help:   "The number of record files rotated.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "file_reliable_ack_total",
+		Help:   "The number of records written to files for which we sent a reliable ACK.",
+		Labels: []string{"record_type"},
+	})
+}
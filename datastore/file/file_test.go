@@ -0,0 +1,263 @@
+package file_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/file"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Producer", func() {
+	var (
+		config *file.Config
+		record *telemetry.Record
+	)
+
+	newProducer := func() telemetry.Producer {
+		logger, _ := logrus.NoOpLogger()
+		producer, err := file.NewProducer(config, noop.NewCollector(), airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		return producer
+	}
+
+	readAll := func(path string) ([]*telemetry.Record, error) {
+		reader, err := file.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+
+		var records []*telemetry.Record
+		for {
+			rec, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				return records, nil
+			}
+			if err != nil {
+				return records, err
+			}
+			records = append(records, rec)
+		}
+	}
+
+	BeforeEach(func() {
+		config = &file.Config{Dir: GinkgoT().TempDir(), Fsync: file.FsyncAlways}
+		record = &telemetry.Record{TxType: "V", Vin: "42", Txid: "txid", PayloadBytes: []byte("data"), ReceivedTimestamp: 1000, Timestamp: 900}
+	})
+
+	It("writes records which can be read back", func() {
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		files, err := file.ListFiles(config.Dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+
+		records, err := readAll(files[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].TxType).To(Equal("V"))
+		Expect(records[0].Vin).To(Equal("42"))
+		Expect(records[0].Txid).To(Equal("txid"))
+		Expect(records[0].Payload()).To(Equal([]byte("data")))
+		Expect(records[0].ReceivedTimestamp).To(Equal(int64(1000)))
+		Expect(records[0].Timestamp).To(Equal(int64(900)))
+		Expect(records[0].Encoding()).To(Equal(telemetry.ProtobufFormat))
+	})
+
+	It("restores the encoding of the payloads", func() {
+		record.SetEncoding(telemetry.JSONFormat)
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		files, err := file.ListFiles(config.Dir)
+		Expect(err).NotTo(HaveOccurred())
+		records, err := readAll(files[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Encoding()).To(Equal(telemetry.JSONFormat))
+	})
+
+	It("rotates files above the max size", func() {
+		config.MaxFileSize = 1
+		producer := newProducer()
+		for i := 0; i < 3; i++ {
+			Expect(producer.Produce(record)).To(Succeed())
+		}
+		Expect(producer.Close()).To(Succeed())
+
+		files, err := file.ListFiles(config.Dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(3))
+		for _, path := range files {
+			records, err := readAll(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(records).To(HaveLen(1))
+		}
+	})
+
+	It("reports partially written records", func() {
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		files, err := file.ListFiles(config.Dir)
+		Expect(err).NotTo(HaveOccurred())
+		info, err := os.Stat(files[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Truncate(files[0], info.Size()-2)).To(Succeed())
+
+		records, err := readAll(files[0])
+		Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+		Expect(records).To(HaveLen(1))
+	})
+
+	DescribeTable("compresses files",
+		func(compression file.Compression, extension string) {
+			config.Compression = compression
+			config.Fsync = file.FsyncRotate
+			config.MaxFileSize = 1
+			producer := newProducer()
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(producer.Close()).To(Succeed())
+
+			files, err := file.ListFiles(config.Dir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(2))
+			for _, path := range files {
+				Expect(path).To(HaveSuffix(extension))
+				records, err := readAll(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(records).To(HaveLen(1))
+				Expect(records[0].Payload()).To(Equal([]byte("data")))
+			}
+		},
+		Entry("with gzip", file.GzipCompression, ".pb.gz"),
+		Entry("with zstd", file.ZstdCompression, ".pb.zst"),
+	)
+
+	It("reads the records flushed to compressed files before they are closed", func() {
+		config.Compression = file.ZstdCompression
+		producer := newProducer()
+		DeferCleanup(producer.Close)
+		Expect(producer.Produce(record)).To(Succeed())
+
+		files, err := file.ListFiles(config.Dir)
+		Expect(err).NotTo(HaveOccurred())
+		reader, err := file.Open(files[0])
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+		read, err := reader.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.Txid).To(Equal("txid"))
+	})
+
+	It("detects the compression of files without extension", func() {
+		config.Compression = file.GzipCompression
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		files, err := file.ListFiles(config.Dir)
+		Expect(err).NotTo(HaveOccurred())
+		renamed := strings.TrimSuffix(files[0], ".gz")
+		Expect(os.Rename(files[0], renamed)).To(Succeed())
+		records, err := readAll(renamed)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(1))
+	})
+
+	Context("with reliable acks", func() {
+		var ackChan chan *telemetry.Record
+
+		newAckingProducer := func() telemetry.Producer {
+			logger, _ := logrus.NoOpLogger()
+			producer, err := file.NewProducer(config, noop.NewCollector(), airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"V": true}, logger)
+			Expect(err).NotTo(HaveOccurred())
+			return producer
+		}
+
+		BeforeEach(func() {
+			ackChan = make(chan *telemetry.Record, 10)
+		})
+
+		It("acks the records once synced with the always policy", func() {
+			producer := newAckingProducer()
+			DeferCleanup(producer.Close)
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(ackChan).To(Receive(Equal(record)))
+		})
+
+		DescribeTable("acks the records once their file is closed",
+			func(fsync file.FsyncPolicy) {
+				config.Fsync = fsync
+				config.Compression = file.GzipCompression
+				producer := newAckingProducer()
+				Expect(producer.Produce(record)).To(Succeed())
+				Expect(producer.Produce(&telemetry.Record{TxType: "connectivity", Vin: "42"})).To(Succeed())
+				Consistently(ackChan, 100*time.Millisecond).ShouldNot(Receive())
+
+				Expect(producer.Close()).To(Succeed())
+				Expect(ackChan).To(Receive(Equal(record)))
+				Expect(ackChan).NotTo(Receive())
+			},
+			Entry("with the rotate policy", file.FsyncRotate),
+			Entry("with the never policy", file.FsyncNever),
+		)
+
+		It("acks the records of the files it rotated", func() {
+			config.Fsync = file.FsyncRotate
+			config.MaxFileSize = 1
+			producer := newAckingProducer()
+			DeferCleanup(producer.Close)
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(ackChan).NotTo(Receive())
+			Expect(producer.Produce(record)).To(Succeed())
+			Expect(ackChan).To(Receive(Equal(record)))
+			Expect(ackChan).NotTo(Receive())
+		})
+
+		It("rotates the files older than the max age without new records", func() {
+			config.Fsync = file.FsyncRotate
+			config.MaxFileAge = 1
+			config.Compression = file.ZstdCompression
+			producer := newAckingProducer()
+			DeferCleanup(producer.Close)
+			Expect(producer.Produce(record)).To(Succeed())
+			Eventually(ackChan, 3*time.Second).Should(Receive(Equal(record)))
+
+			files, err := file.ListFiles(config.Dir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			records, err := readAll(files[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(records).To(HaveLen(1))
+		})
+	})
+
+	It("rejects compression levels out of range", func() {
+		config.Compression = file.ZstdCompression
+		config.CompressionLevel = 23
+		Expect(config.Validate()).To(MatchError("file: invalid zstd compression_level 23, expected 1 to 22"))
+	})
+
+	It("rejects unknown fsync policies", func() {
+		config.Fsync = "sometimes"
+		logger, _ := logrus.NoOpLogger()
+		_, err := file.NewProducer(config, noop.NewCollector(), airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).To(MatchError("invalid file fsync policy: sometimes"))
+	})
+})
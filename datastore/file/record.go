@@ -0,0 +1,141 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// record field numbers of the protobuf encoded entries
+	txTypeField            protowire.Number = 1
+	vinField               protowire.Number = 2
+	txidField              protowire.Number = 3
+	payloadField           protowire.Number = 4
+	receivedTimestampField protowire.Number = 5
+	timestampField         protowire.Number = 6
+	encodingField          protowire.Number = 7
+
+	// maxEntrySize guards against reading a corrupted length prefix, payloads are limited to telemetry.SizeLimit
+	maxEntrySize = 2 * telemetry.SizeLimit
+)
+
+// AppendEntry appends the record to b as a length prefixed protobuf message, the format of the record files
+func AppendEntry(b []byte, record *telemetry.Record) []byte {
+	var message []byte
+	message = protowire.AppendTag(message, txTypeField, protowire.BytesType)
+	message = protowire.AppendString(message, record.TxType)
+	message = protowire.AppendTag(message, vinField, protowire.BytesType)
+	message = protowire.AppendString(message, record.Vin)
+	message = protowire.AppendTag(message, txidField, protowire.BytesType)
+	message = protowire.AppendString(message, record.Txid)
+	message = protowire.AppendTag(message, payloadField, protowire.BytesType)
+	message = protowire.AppendBytes(message, record.Payload())
+	message = protowire.AppendTag(message, receivedTimestampField, protowire.VarintType)
+	message = protowire.AppendVarint(message, uint64(record.ReceivedTimestamp))
+	message = protowire.AppendTag(message, timestampField, protowire.VarintType)
+	message = protowire.AppendVarint(message, uint64(record.Timestamp))
+	message = protowire.AppendTag(message, encodingField, protowire.BytesType)
+	message = protowire.AppendString(message, string(record.Encoding()))
+	return protowire.AppendBytes(b, message)
+}
+
+// parseEntry decodes a protobuf message written by AppendEntry, unknown fields are skipped. The encoding of entries
+// written without it defaults to protobuf
+func parseEntry(message []byte) (*telemetry.Record, error) {
+	record := &telemetry.Record{}
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		message = message[n:]
+
+		switch {
+		case typ == protowire.BytesType && (num >= txTypeField && num <= payloadField || num == encodingField):
+			value, n := protowire.ConsumeBytes(message)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			message = message[n:]
+			switch num {
+			case txTypeField:
+				record.TxType = string(value)
+			case vinField:
+				record.Vin = string(value)
+			case txidField:
+				record.Txid = string(value)
+			case payloadField:
+				record.PayloadBytes = append([]byte(nil), value...)
+			case encodingField:
+				record.SetEncoding(telemetry.PayloadFormat(value))
+			}
+		case typ == protowire.VarintType && (num == receivedTimestampField || num == timestampField):
+			value, n := protowire.ConsumeVarint(message)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			message = message[n:]
+			if num == receivedTimestampField {
+				record.ReceivedTimestamp = int64(value)
+			} else {
+				record.Timestamp = int64(value)
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, message)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			message = message[n:]
+		}
+	}
+	// hashed once, like the records received from vehicles
+	record.AddMetadata(telemetry.IdempotencyKeyMetadataKey, record.IdempotencyKey())
+	return record, nil
+}
+
+// Reader reads the records of a file written by the file producer
+type Reader struct {
+	reader *bufio.Reader
+	close  func() error
+}
+
+// NewReader returns a reader of records from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(r)}
+}
+
+// Read returns the next record, io.EOF is returned once all records are read
+// and io.ErrUnexpectedEOF if the file ends with a partially written record
+func (r *Reader) Read() (*telemetry.Record, error) {
+	size, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxEntrySize {
+		return nil, fmt.Errorf("invalid record size: %d", size)
+	}
+
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, message); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return parseEntry(message)
+}
+
+// Close releases the file of readers returned by Open, it is a noop for readers returned by NewReader
+func (r *Reader) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
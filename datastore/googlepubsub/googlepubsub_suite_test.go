@@ -0,0 +1,13 @@
+package googlepubsub_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestGooglePubsub(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Google Pubsub Suite Tests")
+}
@@ -5,11 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 
+	"github.com/teslamotors/fleet-telemetry/datastore/proxy"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/metrics"
 	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
@@ -19,15 +25,27 @@ import (
 
 // Producer client to handle google pubsub interactions
 type Producer struct {
-	pubsubClient       *pubsub.Client
-	projectID          string
-	namespace          string
-	metricsCollector   metrics.MetricCollector
-	prometheusEnabled  bool
-	logger             *logrus.Logger
-	airbrakeHandler    *airbrake.Handler
-	ackChan            chan (*telemetry.Record)
-	reliableAckTxTypes map[string]interface{}
+	pubsubClient          *pubsub.Client
+	projectID             string
+	namespace             string
+	enableMessageOrdering bool
+	publishSettings       *PublishSettings
+	topics                map[string]*topicHandle
+	topicsLock            sync.Mutex
+	metricsCollector      metrics.MetricCollector
+	prometheusEnabled     bool
+	logger                *logrus.Logger
+	airbrakeHandler       *airbrake.Handler
+	ackChan               chan (*telemetry.Record)
+	reliableAckTxTypes    map[string]interface{}
+	produceErrors         *telemetry.ProduceErrorCounter
+}
+
+// topicHandle caches the handle of a topic once it exists, its lock is held while the topic is looked up so
+// records of the topic wait for the lookup without blocking the records of other topics
+type topicHandle struct {
+	lock  sync.Mutex
+	topic atomic.Pointer[pubsub.Topic]
 }
 
 // Metrics stores metrics reported from this package
@@ -44,7 +62,7 @@ var (
 	metricsOnce     sync.Once
 )
 
-func configurePubsub(projectID string) (*pubsub.Client, error) {
+func configurePubsub(projectID string, proxyConfig *proxy.Config) (*pubsub.Client, error) {
 	if projectID == "" {
 		return nil, errors.New("GCP Project ID cannot be empty")
 	}
@@ -53,70 +71,114 @@ func configurePubsub(projectID string) (*pubsub.Client, error) {
 	if useEmulator && useGcpPubsub {
 		return nil, errors.New("pubsub cannot initialize with both emulator and GCP resource")
 	}
-	return pubsub.NewClient(context.Background(), projectID)
+	ctx := context.Background()
+	var opts []option.ClientOption
+	if proxyConfig != nil {
+		dialer, err := proxyConfig.Dialer()
+		if err != nil {
+			return nil, err
+		}
+		httpClient, err := proxyConfig.HTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithContextDialer(dialer)))
+		// credentials fetch their tokens with the http client of the context
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	}
+	return pubsub.NewClient(ctx, projectID, opts...)
 }
 
 // NewProducer establishes the pubsub connection and define the dispatch method
-func NewProducer(prometheusEnabled bool, projectID string, namespace string, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+func NewProducer(prometheusEnabled bool, projectID string, namespace string, enableMessageOrdering bool, publishSettings *PublishSettings, proxyConfig *proxy.Config, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
 	registerMetricsOnce(metricsCollector)
-	pubsubClient, err := configurePubsub(projectID)
+	if err := publishSettings.Validate(); err != nil {
+		return nil, err
+	}
+	pubsubClient, err := configurePubsub(projectID, proxyConfig)
 	if err != nil {
 		return nil, fmt.Errorf("pubsub_connect_error %s", err)
 	}
 
 	p := &Producer{
-		projectID:          projectID,
-		namespace:          namespace,
-		pubsubClient:       pubsubClient,
-		prometheusEnabled:  prometheusEnabled,
-		metricsCollector:   metricsCollector,
-		logger:             logger,
-		airbrakeHandler:    airbrakeHandler,
-		ackChan:            ackChan,
-		reliableAckTxTypes: reliableAckTxTypes,
-	}
-	p.logger.ActivityLog("pubsub_registered", logrus.LogInfo{"project": projectID, "namespace": namespace})
+		produceErrors:         telemetry.NewProduceErrorCounter(telemetry.Pubsub, metricsCollector),
+		projectID:             projectID,
+		namespace:             namespace,
+		enableMessageOrdering: enableMessageOrdering,
+		publishSettings:       publishSettings,
+		topics:                make(map[string]*topicHandle),
+		pubsubClient:          pubsubClient,
+		prometheusEnabled:     prometheusEnabled,
+		metricsCollector:      metricsCollector,
+		logger:                logger,
+		airbrakeHandler:       airbrakeHandler,
+		ackChan:               ackChan,
+		reliableAckTxTypes:    reliableAckTxTypes,
+	}
+	p.logger.ActivityLog("pubsub_registered", logrus.LogInfo{"project": projectID, "namespace": namespace, "message_ordering": enableMessageOrdering})
 	return p, nil
 }
 
 // Produce sends the record payload to pubsub
-func (p *Producer) Produce(entry *telemetry.Record) {
-	ctx := context.Background()
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	return p.ProduceContext(context.Background(), entry)
+}
 
+// ProduceContext sends the record payload to pubsub, waiting for the result until ctx is done
+func (p *Producer) ProduceContext(ctx context.Context, entry *telemetry.Record) error {
 	topicName := telemetry.BuildTopicName(p.namespace, entry.TxType)
 	logInfo := logrus.LogInfo{"topic_name": topicName, "txid": entry.Txid}
-	pubsubTopic, err := p.createTopicIfNotExists(ctx, topicName)
-
+	pubsubTopic, err := p.getTopic(ctx, topicName, logInfo)
 	if err != nil {
-		p.ReportError("pubsub_topic_creation_error", err, logInfo)
 		metricsRegistry.notConnectedTotal.Inc(map[string]string{})
-		return
+		p.produceErrors.Inc(err)
+		return err
 	}
 
-	if exists, err := pubsubTopic.Exists(ctx); !exists || err != nil {
-		p.ReportError("pubsub_topic_check_error", err, logInfo)
-		metricsRegistry.notConnectedTotal.Inc(map[string]string{})
-		return
+	message := &pubsub.Message{
+		Data:       entry.Payload(),
+		Attributes: attributesFromRecord(entry),
+	}
+	if p.enableMessageOrdering {
+		message.OrderingKey = entry.Vin
 	}
 
 	entry.ProduceTime = time.Now()
-	result := pubsubTopic.Publish(ctx, &pubsub.Message{
-		Data:       entry.Payload(),
-		Attributes: entry.Metadata(),
-	})
+	result := pubsubTopic.Publish(ctx, message)
 	if _, err = result.Get(ctx); err != nil {
-		p.ReportError("pubsub_err", err, logInfo)
+		p.reportRecordError("pubsub_err", err, entry, logInfo)
 		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
-		return
+		p.produceErrors.Inc(err)
+		if message.OrderingKey != "" {
+			// a failed publish pauses the ordering key until it is resumed
+			pubsubTopic.ResumePublish(message.OrderingKey)
+		}
+		return err
 	}
 	p.ProcessReliableAck(entry)
 	metricsRegistry.publishBytesTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
 	metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
+	return nil
+}
 
+// attributesFromRecord exposes the record metadata as message attributes so subscriptions can filter on them
+func attributesFromRecord(entry *telemetry.Record) map[string]string {
+	attributes := entry.Metadata()
+	if entry.Timestamp > 0 {
+		attributes["created_at"] = strconv.FormatInt(entry.Timestamp, 10)
+	}
+	return attributes
 }
 
 // Close the producer
 func (p *Producer) Close() error {
+	p.topicsLock.Lock()
+	for _, handle := range p.topics {
+		if pubsubTopic := handle.topic.Load(); pubsubTopic != nil {
+			pubsubTopic.Stop()
+		}
+	}
+	p.topicsLock.Unlock()
 	return p.pubsubClient.Close()
 }
 
@@ -129,6 +191,46 @@ func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
 	}
 }
 
+// getTopic returns the cached topic handle, message ordering is tracked per handle. The topic is created on its
+// first record, a single record of the topic looks it up at a time and the next ones reuse the result
+func (p *Producer) getTopic(ctx context.Context, topicName string, logInfo logrus.LogInfo) (*pubsub.Topic, error) {
+	p.topicsLock.Lock()
+	handle, ok := p.topics[topicName]
+	if !ok {
+		handle = &topicHandle{}
+		p.topics[topicName] = handle
+	}
+	p.topicsLock.Unlock()
+
+	if pubsubTopic := handle.topic.Load(); pubsubTopic != nil {
+		return pubsubTopic, nil
+	}
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	if pubsubTopic := handle.topic.Load(); pubsubTopic != nil {
+		return pubsubTopic, nil
+	}
+
+	pubsubTopic, err := p.createTopicIfNotExists(ctx, topicName)
+	if err != nil {
+		p.ReportError("pubsub_topic_creation_error", err, logInfo)
+		return nil, err
+	}
+
+	if exists, err := pubsubTopic.Exists(ctx); !exists || err != nil {
+		p.ReportError("pubsub_topic_check_error", err, logInfo)
+		if err == nil {
+			err = fmt.Errorf("pubsub topic does not exist: %s", topicName)
+		}
+		return nil, err
+	}
+
+	pubsubTopic.EnableMessageOrdering = p.enableMessageOrdering
+	p.publishSettings.apply(&pubsubTopic.PublishSettings)
+	handle.topic.Store(pubsubTopic)
+	return pubsubTopic, nil
+}
+
 func (p *Producer) createTopicIfNotExists(ctx context.Context, topic string) (*pubsub.Topic, error) {
 	pubsubTopic := p.pubsubClient.Topic(topic)
 	exists, err := pubsubTopic.Exists(ctx)
@@ -148,6 +250,13 @@ func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo
 	p.logger.ErrorLog(message, err, logInfo)
 }
 
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(telemetry.Pubsub), Namespace: p.namespace}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
 func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
 	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
 }
@@ -0,0 +1,74 @@
+package googlepubsub_test
+
+import (
+	"cloud.google.com/go/pubsub/pstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/googlepubsub"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Producer", func() {
+	var (
+		server *pstest.Server
+		record *telemetry.Record
+	)
+
+	BeforeEach(func() {
+		server = pstest.NewServer()
+		DeferCleanup(server.Close)
+		GinkgoT().Setenv("PUBSUB_EMULATOR_HOST", server.Addr)
+
+		record = &telemetry.Record{TxType: "V", Vin: "42", Txid: "txid", PayloadBytes: []byte("data")}
+	})
+
+	newProducer := func(enableMessageOrdering bool) telemetry.Producer {
+		logger, _ := logrus.NoOpLogger()
+		producer, err := googlepubsub.NewProducer(false, "project", "tesla", enableMessageOrdering, nil, nil, noop.NewCollector(), airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+		return producer
+	}
+
+	It("publishes without ordering key by default", func() {
+		producer := newProducer(false)
+		Expect(producer.Produce(record)).To(Succeed())
+
+		messages := server.Messages()
+		Expect(messages).To(HaveLen(1))
+		Expect(messages[0].Data).To(Equal([]byte("data")))
+		Expect(messages[0].OrderingKey).To(BeEmpty())
+	})
+
+	It("sets the record metadata as attributes", func() {
+		producer := newProducer(false)
+		record.Timestamp = 1700000000000
+		record.AddMetadata("source", "test")
+		Expect(producer.Produce(record)).To(Succeed())
+
+		messages := server.Messages()
+		Expect(messages).To(HaveLen(1))
+		Expect(messages[0].Attributes).To(HaveKeyWithValue("vin", "42"))
+		Expect(messages[0].Attributes).To(HaveKeyWithValue("txtype", "V"))
+		Expect(messages[0].Attributes).To(HaveKeyWithValue("txid", "txid"))
+		Expect(messages[0].Attributes).To(HaveKeyWithValue("created_at", "1700000000000"))
+		Expect(messages[0].Attributes).To(HaveKeyWithValue("source", "test"))
+	})
+
+	It("uses the vin as ordering key", func() {
+		producer := newProducer(true)
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Produce(record)).To(Succeed())
+
+		messages := server.Messages()
+		Expect(messages).To(HaveLen(2))
+		for _, message := range messages {
+			Expect(message.OrderingKey).To(Equal("42"))
+		}
+	})
+})
@@ -0,0 +1,80 @@
+package googlepubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PublishSettings tunes how records are batched into publish requests, zero values keep the library defaults.
+// Larger thresholds send fewer and bigger requests at the cost of records waiting longer before being published.
+type PublishSettings struct {
+	// CountThreshold publishes a batch once it holds this many messages, at most 1000
+	CountThreshold int `json:"count_threshold,omitempty"`
+
+	// ByteThreshold publishes a batch once it holds this many bytes, at most 10MB
+	ByteThreshold int `json:"byte_threshold,omitempty"`
+
+	// DelayThreshold is the max time in milliseconds a message waits for its batch to fill up
+	DelayThreshold int `json:"delay_threshold,omitempty"`
+
+	// MaxOutstandingMessages blocks publishing once this many messages are waiting to be published
+	MaxOutstandingMessages int `json:"max_outstanding_messages,omitempty"`
+
+	// MaxOutstandingBytes blocks publishing once this many bytes are waiting to be published
+	MaxOutstandingBytes int `json:"max_outstanding_bytes,omitempty"`
+}
+
+// maxDelayThreshold bounds the delay threshold so records are not held back for longer than a vehicle waits for its ack
+const maxDelayThreshold = 10 * time.Second
+
+// Validate checks the settings are within the bounds accepted by pubsub
+func (s *PublishSettings) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.CountThreshold < 0 || s.CountThreshold > pubsub.MaxPublishRequestCount {
+		return fmt.Errorf("pubsub count_threshold must be between 0 and %d", pubsub.MaxPublishRequestCount)
+	}
+	if s.ByteThreshold < 0 || s.ByteThreshold > pubsub.MaxPublishRequestBytes {
+		return fmt.Errorf("pubsub byte_threshold must be between 0 and %d", int(pubsub.MaxPublishRequestBytes))
+	}
+	if s.DelayThreshold < 0 || time.Duration(s.DelayThreshold)*time.Millisecond > maxDelayThreshold {
+		return fmt.Errorf("pubsub delay_threshold must be between 0 and %d", maxDelayThreshold.Milliseconds())
+	}
+	if s.MaxOutstandingMessages < 0 || s.MaxOutstandingBytes < 0 {
+		return errors.New("pubsub max_outstanding_messages and max_outstanding_bytes cannot be negative")
+	}
+	if s.MaxOutstandingBytes > 0 && s.MaxOutstandingBytes < s.ByteThreshold {
+		return errors.New("pubsub max_outstanding_bytes cannot be lower than byte_threshold")
+	}
+	return nil
+}
+
+// apply overrides the publish settings of the topic with the configured values
+func (s *PublishSettings) apply(settings *pubsub.PublishSettings) {
+	if s == nil {
+		return
+	}
+	if s.CountThreshold > 0 {
+		settings.CountThreshold = s.CountThreshold
+	}
+	if s.ByteThreshold > 0 {
+		settings.ByteThreshold = s.ByteThreshold
+	}
+	if s.DelayThreshold > 0 {
+		settings.DelayThreshold = time.Duration(s.DelayThreshold) * time.Millisecond
+	}
+	if s.MaxOutstandingMessages > 0 {
+		settings.FlowControlSettings.MaxOutstandingMessages = s.MaxOutstandingMessages
+	}
+	if s.MaxOutstandingBytes > 0 {
+		settings.FlowControlSettings.MaxOutstandingBytes = s.MaxOutstandingBytes
+	}
+	if s.MaxOutstandingMessages > 0 || s.MaxOutstandingBytes > 0 {
+		// limits are only enforced when publishing blocks, the default ignores them
+		settings.FlowControlSettings.LimitExceededBehavior = pubsub.FlowControlBlock
+	}
+}
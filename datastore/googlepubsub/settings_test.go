@@ -0,0 +1,63 @@
+package googlepubsub
+
+import (
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("PublishSettings", func() {
+	It("propagates the settings to the topic", func() {
+		server := pstest.NewServer()
+		DeferCleanup(server.Close)
+		GinkgoT().Setenv("PUBSUB_EMULATOR_HOST", server.Addr)
+
+		logger, _ := logrus.NoOpLogger()
+		settings := &PublishSettings{CountThreshold: 500, ByteThreshold: 2000000, DelayThreshold: 50, MaxOutstandingMessages: 5000, MaxOutstandingBytes: 50000000}
+		producer, err := NewProducer(false, "project", "tesla", false, settings, nil, noop.NewCollector(), airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "42", Txid: "txid", PayloadBytes: []byte("data")})).To(Succeed())
+
+		topic := producer.(*Producer).topics["tesla_V"].topic.Load()
+		Expect(topic).NotTo(BeNil())
+		Expect(topic.PublishSettings.CountThreshold).To(Equal(500))
+		Expect(topic.PublishSettings.ByteThreshold).To(Equal(2000000))
+		Expect(topic.PublishSettings.DelayThreshold).To(Equal(50 * time.Millisecond))
+		Expect(topic.PublishSettings.FlowControlSettings.MaxOutstandingMessages).To(Equal(5000))
+		Expect(topic.PublishSettings.FlowControlSettings.MaxOutstandingBytes).To(Equal(50000000))
+		Expect(topic.PublishSettings.FlowControlSettings.LimitExceededBehavior).To(Equal(pubsub.FlowControlBlock))
+	})
+
+	It("keeps the library defaults when unset", func() {
+		settings := pubsub.DefaultPublishSettings
+		(&PublishSettings{}).apply(&settings)
+		Expect(settings).To(Equal(pubsub.DefaultPublishSettings))
+
+		var unset *PublishSettings
+		unset.apply(&settings)
+		Expect(unset.Validate()).To(Succeed())
+		Expect(settings).To(Equal(pubsub.DefaultPublishSettings))
+	})
+
+	DescribeTable("rejects settings out of bounds",
+		func(settings *PublishSettings, errMessage string) {
+			Expect(settings.Validate()).To(MatchError(ContainSubstring(errMessage)))
+		},
+		Entry("count threshold", &PublishSettings{CountThreshold: 1001}, "count_threshold"),
+		Entry("byte threshold", &PublishSettings{ByteThreshold: 10000001}, "byte_threshold"),
+		Entry("delay threshold", &PublishSettings{DelayThreshold: -1}, "delay_threshold"),
+		Entry("negative flow control", &PublishSettings{MaxOutstandingMessages: -1}, "cannot be negative"),
+		Entry("outstanding bytes below a batch", &PublishSettings{ByteThreshold: 1000, MaxOutstandingBytes: 100}, "cannot be lower than byte_threshold"),
+	)
+})
@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/schemaregistry"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// avroMagicByte starts the confluent wire format, followed by the schema id and the avro payload
+const avroMagicByte = 0
+
+// SchemaRegistryConfig locates the schema registry holding the avro schemas of the records produced
+// with the avro serializer
+type SchemaRegistryConfig struct {
+	// URL of the schema registry, ex.: https://schema-registry:8081
+	URL string `json:"url"`
+
+	// Username and Password authenticate with basic auth when set
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *SchemaRegistryConfig) Validate() error {
+	if c.URL == "" {
+		return errors.New("kafka schema_registry requires a url")
+	}
+	return nil
+}
+
+// AvroSerializer prefixes avro payloads with the id of their schema, registering the schemas under the
+// <topic>-value subjects
+type AvroSerializer struct {
+	client schemaregistry.Client
+
+	// ids caches the schema id of each subject and schema, so the registry is only called once per record type
+	ids sync.Map
+}
+
+type subjectSchema struct {
+	subject string
+	schema  *telemetry.AvroSchema
+}
+
+// NewAvroSerializer returns a serializer registering schemas in the schema registry. Urls starting with mock://
+// use an in-memory registry
+func NewAvroSerializer(config *SchemaRegistryConfig) (*AvroSerializer, error) {
+	registryConfig := schemaregistry.NewConfig(config.URL)
+	if config.Username != "" {
+		registryConfig = schemaregistry.NewConfigWithAuthentication(config.URL, config.Username, config.Password)
+	}
+	client, err := schemaregistry.NewClient(registryConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroSerializer{client: client}, nil
+}
+
+// Serialize returns the value of the kafka message of an avro record produced to topic
+func (s *AvroSerializer) Serialize(topic string, record *telemetry.Record) ([]byte, error) {
+	schema, err := record.AvroSchema()
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.schemaID(subjectSchema{subject: topic + "-value", schema: schema})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := record.Payload()
+	value := make([]byte, 5, 5+len(payload))
+	value[0] = avroMagicByte
+	binary.BigEndian.PutUint32(value[1:], uint32(id))
+	return append(value, payload...), nil
+}
+
+func (s *AvroSerializer) schemaID(key subjectSchema) (int, error) {
+	if id, ok := s.ids.Load(key); ok {
+		return id.(int), nil
+	}
+	id, err := s.client.Register(key.subject, schemaregistry.SchemaInfo{Schema: key.schema.JSON}, false)
+	if err != nil {
+		return 0, fmt.Errorf("register avro schema of %s: %w", key.schema.Name, err)
+	}
+	s.ids.Store(key, id)
+	return id, nil
+}
@@ -0,0 +1,61 @@
+package kafka_test
+
+import (
+	"encoding/binary"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("AvroSerializer", func() {
+	newRecord := func(txType string, payload proto.Message) *telemetry.Record {
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{}, logger)
+		payloadBytes, err := proto.Marshal(payload)
+		Expect(err).NotTo(HaveOccurred())
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte(txType), Payload: payloadBytes}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		record.PayloadBytes, err = record.EncodePayload(telemetry.AvroFormat)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	It("prefixes payloads with the schema id of their record type", func() {
+		serializer, err := kafka.NewAvroSerializer(&kafka.SchemaRegistryConfig{URL: "mock://registry"})
+		Expect(err).NotTo(HaveOccurred())
+
+		record := newRecord("V", &protos.Payload{Vin: "42"})
+		value, err := serializer.Serialize("tesla_V", record)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value[0]).To(BeZero())
+		Expect(value[5:]).To(Equal(record.Payload()))
+		schemaID := binary.BigEndian.Uint32(value[1:5])
+
+		value, err = serializer.Serialize("tesla_V", newRecord("V", &protos.Payload{Vin: "42"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(binary.BigEndian.Uint32(value[1:5])).To(Equal(schemaID))
+
+		alerts := newRecord("alerts", &protos.VehicleAlerts{Vin: "42"})
+		value, err = serializer.Serialize("tesla_alerts", alerts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value[5:]).To(Equal(alerts.Payload()))
+	})
+
+	It("requires decoded records", func() {
+		serializer, err := kafka.NewAvroSerializer(&kafka.SchemaRegistryConfig{URL: "mock://registry"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = serializer.Serialize("tesla_V", &telemetry.Record{TxType: "V"})
+		Expect(err).To(MatchError("avro schema requires a decoded record"))
+	})
+})
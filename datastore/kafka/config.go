@@ -0,0 +1,246 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// PartitionKeyStrategy defines how the kafka message key is derived from a record
+type PartitionKeyStrategy string
+
+const (
+	// PartitionKeyVin keys messages by vin (default)
+	PartitionKeyVin PartitionKeyStrategy = "vin"
+	// PartitionKeyTxType keys messages by record type
+	PartitionKeyTxType PartitionKeyStrategy = "txtype"
+	// PartitionKeyVinTxType keys messages by vin and record type
+	PartitionKeyVinTxType PartitionKeyStrategy = "vin+txtype"
+)
+
+// SASLMechanism authenticates the producer with the brokers
+type SASLMechanism string
+
+const (
+	// SASLPlain sends the username and password as is, it should only be used over TLS
+	SASLPlain SASLMechanism = "PLAIN"
+	// SASLScramSHA256 authenticates with SCRAM-SHA-256 credentials
+	SASLScramSHA256 SASLMechanism = "SCRAM-SHA-256"
+	// SASLScramSHA512 authenticates with SCRAM-SHA-512 credentials
+	SASLScramSHA512 SASLMechanism = "SCRAM-SHA-512"
+	// SASLOAuthBearer authenticates with tokens from an OIDC endpoint or a TokenProvider
+	SASLOAuthBearer SASLMechanism = "OAUTHBEARER"
+)
+
+// OAuthBearerTokenProvider returns the token of the OAUTHBEARER mechanism, it is called whenever the token must be refreshed
+type OAuthBearerTokenProvider func() (kafka.OAuthBearerToken, error)
+
+// SASLConfig contains the credentials of the SASL authentication
+type SASLConfig struct {
+	// Mechanism is one of PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER
+	Mechanism SASLMechanism `json:"mechanism"`
+
+	// Username and Password are the credentials of the PLAIN and SCRAM mechanisms
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// OIDC fetches the OAUTHBEARER tokens with the client credentials grant
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+
+	// TokenProvider supplies the OAUTHBEARER tokens instead of OIDC, for programs embedding the producer
+	TokenProvider OAuthBearerTokenProvider `json:"-"`
+}
+
+// OIDCConfig identifies the client requesting OAUTHBEARER tokens from the token endpoint
+type OIDCConfig struct {
+	TokenEndpointURL string `json:"token_endpoint_url"`
+	ClientID         string `json:"client_id"`
+	ClientSecret     string `json:"client_secret"`
+	Scope            string `json:"scope,omitempty"`
+}
+
+// Validate returns an error if the mechanism is unknown or its credentials are missing
+func (c *SASLConfig) Validate() error {
+	switch c.Mechanism {
+	case SASLPlain, SASLScramSHA256, SASLScramSHA512:
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("kafka sasl %s requires a username and password", c.Mechanism)
+		}
+	case SASLOAuthBearer:
+		if c.TokenProvider != nil {
+			return nil
+		}
+		if c.OIDC == nil || c.OIDC.TokenEndpointURL == "" || c.OIDC.ClientID == "" || c.OIDC.ClientSecret == "" {
+			return errors.New("kafka sasl OAUTHBEARER requires oidc token_endpoint_url, client_id and client_secret")
+		}
+	default:
+		return fmt.Errorf("invalid kafka sasl mechanism: %s", c.Mechanism)
+	}
+	return nil
+}
+
+// properties returns the librdkafka properties of the SASL authentication
+func (c *SASLConfig) properties() kafka.ConfigMap {
+	properties := kafka.ConfigMap{"sasl.mechanisms": string(c.Mechanism)}
+	switch {
+	case c.Mechanism != SASLOAuthBearer:
+		properties["sasl.username"] = c.Username
+		properties["sasl.password"] = c.Password
+	case c.TokenProvider == nil:
+		properties["sasl.oauthbearer.method"] = "oidc"
+		properties["sasl.oauthbearer.token.endpoint.url"] = c.OIDC.TokenEndpointURL
+		properties["sasl.oauthbearer.client.id"] = c.OIDC.ClientID
+		properties["sasl.oauthbearer.client.secret"] = c.OIDC.ClientSecret
+		if c.OIDC.Scope != "" {
+			properties["sasl.oauthbearer.scope"] = c.OIDC.Scope
+		}
+	}
+	return properties
+}
+
+// Config contains producer options which are not part of the librdkafka configuration
+type Config struct {
+	// PartitionKey selects the message key used for partitioning: vin (default), txtype or vin+txtype
+	PartitionKey PartitionKeyStrategy `json:"partition_key,omitempty"`
+
+	// IncludeHeaders attaches record metadata as message headers, defaults to true.
+	// Disable it for brokers without header support
+	IncludeHeaders *bool `json:"include_headers,omitempty"`
+
+	// Idempotent enables the idempotent producer so retries don't duplicate records, it requires acks=all
+	Idempotent bool `json:"idempotent,omitempty"`
+
+	// MaxInFlight is the max number of unacknowledged requests per broker connection, at most 5 when idempotent
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// TransactionalID enables the transactional producer. Records are produced asynchronously one by one,
+	// so transactions are not supported and setting it fails validation
+	TransactionalID string `json:"transactional_id,omitempty"`
+
+	// SASL authenticates with the brokers, over TLS unless security.protocol is set in the kafka config
+	SASL *SASLConfig `json:"sasl,omitempty"`
+
+	// SchemaRegistry registers the schemas of the records sent with the avro serializer, required by it
+	SchemaRegistry *SchemaRegistryConfig `json:"schema_registry,omitempty"`
+}
+
+// maxIdempotentInFlight is the librdkafka limit of in flight requests for the idempotent producer
+const maxIdempotentInFlight = 5
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.PartitionKey {
+	case "", PartitionKeyVin, PartitionKeyTxType, PartitionKeyVinTxType:
+	default:
+		return fmt.Errorf("invalid kafka partition_key: %s", c.PartitionKey)
+	}
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("invalid kafka max_in_flight: %d", c.MaxInFlight)
+	}
+	if c.Idempotent && c.MaxInFlight > maxIdempotentInFlight {
+		return fmt.Errorf("kafka idempotent producer requires max_in_flight <= %d, got %d", maxIdempotentInFlight, c.MaxInFlight)
+	}
+	if c.TransactionalID != "" {
+		return errors.New("kafka transactional_id is not supported, records are produced asynchronously outside of transactions")
+	}
+	if c.SchemaRegistry != nil {
+		if err := c.SchemaRegistry.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.SASL != nil {
+		return c.SASL.Validate()
+	}
+	return nil
+}
+
+// ApplyTo returns a copy of configMap with the librdkafka properties matching the producer options,
+// it fails if they conflict with properties already set
+func (c *Config) ApplyTo(configMap *kafka.ConfigMap) (*kafka.ConfigMap, error) {
+	output := kafka.ConfigMap{}
+	for key, value := range *configMap {
+		output[key] = value
+	}
+	if c == nil {
+		return &output, nil
+	}
+
+	if c.MaxInFlight > 0 {
+		output["max.in.flight.requests.per.connection"] = c.MaxInFlight
+	}
+	if c.SASL != nil {
+		for key, value := range c.SASL.properties() {
+			if existing, ok := output[key]; ok && fmt.Sprint(existing) != fmt.Sprint(value) {
+				return nil, fmt.Errorf("kafka sasl conflicts with %s set in the kafka config", key)
+			}
+			output[key] = value
+		}
+		if _, ok := output["security.protocol"]; !ok {
+			output["security.protocol"] = "sasl_ssl"
+		}
+	}
+	if !c.Idempotent {
+		return &output, nil
+	}
+
+	for _, key := range []string{"acks", "request.required.acks"} {
+		if acks, ok := output[key]; ok && fmt.Sprint(acks) != "all" && fmt.Sprint(acks) != "-1" {
+			return nil, fmt.Errorf("kafka idempotent producer requires acks=all, got %s=%v", key, acks)
+		}
+	}
+	for _, key := range []string{"max.in.flight.requests.per.connection", "max.in.flight"} {
+		if inFlight, ok := output[key].(int); ok && inFlight > maxIdempotentInFlight {
+			return nil, fmt.Errorf("kafka idempotent producer requires max_in_flight <= %d, got %s=%d", maxIdempotentInFlight, key, inFlight)
+		}
+	}
+	output["enable.idempotence"] = true
+	output["acks"] = "all"
+	return &output, nil
+}
+
+// SendsPlaintextCredentials returns true if the SASL PLAIN credentials are not encrypted by TLS
+func (c *Config) SendsPlaintextCredentials(configMap *kafka.ConfigMap) bool {
+	if c == nil || c.SASL == nil || c.SASL.Mechanism != SASLPlain {
+		return false
+	}
+	return !strings.EqualFold(fmt.Sprint((*configMap)["security.protocol"]), "sasl_ssl")
+}
+
+// MessageKey returns the kafka message key for the record
+func (c *Config) MessageKey(record *telemetry.Record) []byte {
+	strategy := PartitionKeyVin
+	if c != nil && c.PartitionKey != "" {
+		strategy = c.PartitionKey
+	}
+	switch strategy {
+	case PartitionKeyTxType:
+		return []byte(record.TxType)
+	case PartitionKeyVinTxType:
+		return []byte(record.Vin + "+" + record.TxType)
+	default:
+		return []byte(record.Vin)
+	}
+}
+
+// Headers returns the kafka message headers for the record, or nil if headers are disabled
+func (c *Config) Headers(record *telemetry.Record) []kafka.Header {
+	if c != nil && c.IncludeHeaders != nil && !*c.IncludeHeaders {
+		return nil
+	}
+	headers := headersFromRecord(record)
+	headers = append(headers, kafka.Header{
+		Key:   "producetime",
+		Value: []byte(fmt.Sprint(record.ProduceTime.UnixMilli())),
+	}, kafka.Header{
+		Key:   "encoding",
+		Value: []byte(record.Encoding()),
+	})
+	return headers
+}
@@ -0,0 +1,163 @@
+package kafka_test
+
+import (
+	"time"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Config", func() {
+	record := &telemetry.Record{Vin: "VIN42", TxType: "V"}
+
+	DescribeTable("MessageKey",
+		func(config *kafka.Config, expected string) {
+			Expect(config.Validate()).To(Succeed())
+			Expect(config.MessageKey(record)).To(Equal([]byte(expected)))
+		},
+		Entry("nil config defaults to vin", nil, "VIN42"),
+		Entry("empty strategy defaults to vin", &kafka.Config{}, "VIN42"),
+		Entry("vin", &kafka.Config{PartitionKey: kafka.PartitionKeyVin}, "VIN42"),
+		Entry("txtype", &kafka.Config{PartitionKey: kafka.PartitionKeyTxType}, "V"),
+		Entry("vin+txtype", &kafka.Config{PartitionKey: kafka.PartitionKeyVinTxType}, "VIN42+V"),
+	)
+
+	It("rejects unknown strategies", func() {
+		config := &kafka.Config{PartitionKey: "random"}
+		Expect(config.Validate()).To(MatchError("invalid kafka partition_key: random"))
+	})
+
+	Context("Headers", func() {
+		headerRecord := &telemetry.Record{Vin: "VIN42", TxType: "V", Txid: "txid-42", ProduceTime: time.UnixMilli(1700000000000)}
+
+		It("includes metadata and produce time by default", func() {
+			headers := (&kafka.Config{}).Headers(headerRecord)
+			Expect(headers).To(ContainElements(
+				confluent.Header{Key: "vin", Value: []byte("VIN42")},
+				confluent.Header{Key: "txtype", Value: []byte("V")},
+				confluent.Header{Key: "txid", Value: []byte("txid-42")},
+				confluent.Header{Key: "producetime", Value: []byte("1700000000000")},
+			))
+		})
+
+		It("omits headers when disabled", func() {
+			includeHeaders := false
+			config := &kafka.Config{IncludeHeaders: &includeHeaders}
+			Expect(config.Headers(headerRecord)).To(BeNil())
+		})
+	})
+
+	Describe("ApplyTo", func() {
+		It("keeps the config unchanged by default", func() {
+			configMap := &confluent.ConfigMap{"bootstrap.servers": "kafka:9092"}
+			output, err := (&kafka.Config{}).ApplyTo(configMap)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(output).To(Equal(configMap))
+		})
+
+		It("enables the idempotent producer", func() {
+			configMap := &confluent.ConfigMap{"bootstrap.servers": "kafka:9092"}
+			config := &kafka.Config{Idempotent: true, MaxInFlight: 5}
+			Expect(config.Validate()).To(Succeed())
+
+			output, err := config.ApplyTo(configMap)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*output).To(Equal(confluent.ConfigMap{
+				"bootstrap.servers":                     "kafka:9092",
+				"enable.idempotence":                    true,
+				"acks":                                  "all",
+				"max.in.flight.requests.per.connection": 5,
+			}))
+			Expect(*configMap).To(HaveLen(1))
+		})
+
+		It("rejects acks other than all", func() {
+			_, err := (&kafka.Config{Idempotent: true}).ApplyTo(&confluent.ConfigMap{"acks": 1})
+			Expect(err).To(MatchError("kafka idempotent producer requires acks=all, got acks=1"))
+		})
+
+		It("rejects too many in flight requests", func() {
+			Expect((&kafka.Config{Idempotent: true, MaxInFlight: 6}).Validate()).To(MatchError("kafka idempotent producer requires max_in_flight <= 5, got 6"))
+
+			_, err := (&kafka.Config{Idempotent: true}).ApplyTo(&confluent.ConfigMap{"max.in.flight.requests.per.connection": 10})
+			Expect(err).To(MatchError("kafka idempotent producer requires max_in_flight <= 5, got max.in.flight.requests.per.connection=10"))
+		})
+
+		DescribeTable("configures SASL",
+			func(sasl *kafka.SASLConfig, expected confluent.ConfigMap) {
+				config := &kafka.Config{SASL: sasl}
+				Expect(config.Validate()).To(Succeed())
+
+				output, err := config.ApplyTo(&confluent.ConfigMap{"bootstrap.servers": "kafka:9092"})
+				Expect(err).NotTo(HaveOccurred())
+				expected["bootstrap.servers"] = "kafka:9092"
+				Expect(*output).To(Equal(expected))
+			},
+			Entry("PLAIN", &kafka.SASLConfig{Mechanism: kafka.SASLPlain, Username: "user", Password: "secret"}, confluent.ConfigMap{
+				"security.protocol": "sasl_ssl",
+				"sasl.mechanisms":   "PLAIN",
+				"sasl.username":     "user",
+				"sasl.password":     "secret",
+			}),
+			Entry("SCRAM-SHA-256", &kafka.SASLConfig{Mechanism: kafka.SASLScramSHA256, Username: "user", Password: "secret"}, confluent.ConfigMap{
+				"security.protocol": "sasl_ssl",
+				"sasl.mechanisms":   "SCRAM-SHA-256",
+				"sasl.username":     "user",
+				"sasl.password":     "secret",
+			}),
+			Entry("SCRAM-SHA-512", &kafka.SASLConfig{Mechanism: kafka.SASLScramSHA512, Username: "user", Password: "secret"}, confluent.ConfigMap{
+				"security.protocol": "sasl_ssl",
+				"sasl.mechanisms":   "SCRAM-SHA-512",
+				"sasl.username":     "user",
+				"sasl.password":     "secret",
+			}),
+			Entry("OAUTHBEARER with OIDC", &kafka.SASLConfig{Mechanism: kafka.SASLOAuthBearer, OIDC: &kafka.OIDCConfig{TokenEndpointURL: "https://idp/token", ClientID: "client", ClientSecret: "secret", Scope: "kafka"}}, confluent.ConfigMap{
+				"security.protocol":                   "sasl_ssl",
+				"sasl.mechanisms":                     "OAUTHBEARER",
+				"sasl.oauthbearer.method":             "oidc",
+				"sasl.oauthbearer.token.endpoint.url": "https://idp/token",
+				"sasl.oauthbearer.client.id":          "client",
+				"sasl.oauthbearer.client.secret":      "secret",
+				"sasl.oauthbearer.scope":              "kafka",
+			}),
+			Entry("OAUTHBEARER with a token provider", &kafka.SASLConfig{Mechanism: kafka.SASLOAuthBearer, TokenProvider: func() (confluent.OAuthBearerToken, error) {
+				return confluent.OAuthBearerToken{}, nil
+			}}, confluent.ConfigMap{
+				"security.protocol": "sasl_ssl",
+				"sasl.mechanisms":   "OAUTHBEARER",
+			}),
+		)
+
+		DescribeTable("rejects invalid SASL configs",
+			func(sasl *kafka.SASLConfig, errMessage string) {
+				Expect((&kafka.Config{SASL: sasl}).Validate()).To(MatchError(errMessage))
+			},
+			Entry("unknown mechanism", &kafka.SASLConfig{Mechanism: "GSSAPI"}, "invalid kafka sasl mechanism: GSSAPI"),
+			Entry("missing password", &kafka.SASLConfig{Mechanism: kafka.SASLScramSHA512, Username: "user"}, "kafka sasl SCRAM-SHA-512 requires a username and password"),
+			Entry("missing token source", &kafka.SASLConfig{Mechanism: kafka.SASLOAuthBearer}, "kafka sasl OAUTHBEARER requires oidc token_endpoint_url, client_id and client_secret"),
+		)
+
+		It("rejects SASL settings conflicting with the kafka config", func() {
+			config := &kafka.Config{SASL: &kafka.SASLConfig{Mechanism: kafka.SASLPlain, Username: "user", Password: "secret"}}
+			_, err := config.ApplyTo(&confluent.ConfigMap{"sasl.mechanisms": "SCRAM-SHA-512"})
+			Expect(err).To(MatchError("kafka sasl conflicts with sasl.mechanisms set in the kafka config"))
+		})
+
+		It("detects PLAIN credentials sent without TLS", func() {
+			config := &kafka.Config{SASL: &kafka.SASLConfig{Mechanism: kafka.SASLPlain, Username: "user", Password: "secret"}}
+			Expect(config.SendsPlaintextCredentials(&confluent.ConfigMap{"security.protocol": "sasl_plaintext"})).To(BeTrue())
+			Expect(config.SendsPlaintextCredentials(&confluent.ConfigMap{"security.protocol": "SASL_SSL"})).To(BeFalse())
+
+			scram := &kafka.Config{SASL: &kafka.SASLConfig{Mechanism: kafka.SASLScramSHA512, Username: "user", Password: "secret"}}
+			Expect(scram.SendsPlaintextCredentials(&confluent.ConfigMap{"security.protocol": "sasl_plaintext"})).To(BeFalse())
+		})
+
+		It("rejects transactional ids", func() {
+			Expect((&kafka.Config{TransactionalID: "fleet-telemetry"}).Validate()).To(HaveOccurred())
+		})
+	})
+})
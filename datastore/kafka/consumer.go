@@ -0,0 +1,220 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// defaultCommitIntervalMs is how often the offsets of the dispatched messages are committed when not configured
+	defaultCommitIntervalMs = 5000
+
+	// consumerPollTimeout bounds how long the consumer waits for a message before checking if it should stop
+	consumerPollTimeout = 100 * time.Millisecond
+)
+
+// ConsumerConfig configures the kafka consumer mode, which dispatches the records of kafka topics to the other datastores
+type ConsumerConfig struct {
+	// Topics are the topics consumed, their messages must have been produced with headers
+	Topics []string `json:"topics"`
+
+	// GroupID is the consumer group sharing the partitions of the topics and their committed offsets
+	GroupID string `json:"group_id"`
+
+	// AutoOffsetReset is where partitions without committed offset are consumed from: earliest (default) or latest
+	AutoOffsetReset string `json:"auto_offset_reset,omitempty"`
+
+	// CommitIntervalMs is how often the offsets of the dispatched messages are committed, defaults to 5s
+	CommitIntervalMs int `json:"commit_interval_ms,omitempty"`
+}
+
+// Validate returns an error if no topic or group is configured
+func (c *ConsumerConfig) Validate() error {
+	if len(c.Topics) == 0 {
+		return errors.New("kafka_consumer requires topics")
+	}
+	if c.GroupID == "" {
+		return errors.New("kafka_consumer requires a group_id")
+	}
+	switch c.AutoOffsetReset {
+	case "", "earliest", "latest":
+	default:
+		return fmt.Errorf("invalid kafka_consumer auto_offset_reset: %s, expected earliest or latest", c.AutoOffsetReset)
+	}
+	if c.CommitIntervalMs < 0 {
+		return fmt.Errorf("invalid kafka_consumer commit_interval_ms: %d", c.CommitIntervalMs)
+	}
+	return nil
+}
+
+// ApplyTo returns the consumer properties of configMap, without the go properties of the producer, with the group and
+// offset management of the consumer. Offsets are only stored once messages are written, and committed periodically
+func (c *ConsumerConfig) ApplyTo(configMap *kafka.ConfigMap, sasl *SASLConfig) (*kafka.ConfigMap, error) {
+	output := kafka.ConfigMap{}
+	for key, value := range *configMap {
+		if !strings.HasPrefix(key, "go.") {
+			output[key] = value
+		}
+	}
+	if sasl != nil {
+		producerConfig := &Config{SASL: sasl}
+		if err := producerConfig.Validate(); err != nil {
+			return nil, err
+		}
+		withSASL, err := producerConfig.ApplyTo(&output)
+		if err != nil {
+			return nil, err
+		}
+		output = *withSASL
+	}
+
+	autoOffsetReset := c.AutoOffsetReset
+	if autoOffsetReset == "" {
+		autoOffsetReset = "earliest"
+	}
+	commitIntervalMs := c.CommitIntervalMs
+	if commitIntervalMs == 0 {
+		commitIntervalMs = defaultCommitIntervalMs
+	}
+	output["group.id"] = c.GroupID
+	output["auto.offset.reset"] = autoOffsetReset
+	output["enable.auto.commit"] = true
+	output["auto.commit.interval.ms"] = commitIntervalMs
+	output["enable.auto.offset.store"] = false
+	return &output, nil
+}
+
+// Consumer reads the records written with headers by the kafka producer, to dispatch them to other datastores
+type Consumer struct {
+	kafkaConsumer *kafka.Consumer
+	offsets       *offsetTracker
+	logger        *logrus.Logger
+}
+
+// NewConsumer joins the consumer group and subscribes to the topics of consumerConfig
+func NewConsumer(configMap *kafka.ConfigMap, consumerConfig *ConsumerConfig, sasl *SASLConfig, metricsCollector metrics.MetricCollector, logger *logrus.Logger) (*Consumer, error) {
+	registerMetricsOnce(metricsCollector)
+
+	if err := consumerConfig.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := consumerConfig.ApplyTo(configMap, sasl)
+	if err != nil {
+		return nil, err
+	}
+	kafkaConsumer, err := kafka.NewConsumer(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := kafkaConsumer.SubscribeTopics(consumerConfig.Topics, nil); err != nil {
+		_ = kafkaConsumer.Close()
+		return nil, err
+	}
+	logger.ActivityLog("kafka_consumer_subscribed", logrus.LogInfo{"topics": consumerConfig.Topics, "group_id": consumerConfig.GroupID})
+	return &Consumer{kafkaConsumer: kafkaConsumer, offsets: newOffsetTracker(kafkaConsumer, logger), logger: logger}, nil
+}
+
+// Run dispatches the records of the consumed messages until ctx is done or the consumer fails. dispatch returns the
+// errors of the datastores, and records of the types with requiredAcks wait for the acks of their datastores on acks.
+// The offset of a message is stored once it and the messages before it in the partition were written or acked, the
+// partition of a message failing to be written is consumed again from it after a backoff. Messages without txtype
+// header or without dispatch rule are skipped. The acks keep being read once Run returned
+func (c *Consumer) Run(ctx context.Context, dispatch func(*telemetry.Record) error, requiredAcks func(txType string) int, acks <-chan *telemetry.Record) error {
+	if acks != nil {
+		go c.handleAcks(acks)
+	}
+	for ctx.Err() == nil {
+		c.offsets.rewind(time.Now())
+		message, err := c.kafkaConsumer.ReadMessage(consumerPollTimeout)
+		if err != nil {
+			var kafkaErr kafka.Error
+			if !errors.As(err, &kafkaErr) {
+				return err
+			}
+			if kafkaErr.IsFatal() {
+				return kafkaErr
+			}
+			if !kafkaErr.IsTimeout() {
+				c.logger.ErrorLog("kafka_consumer_error", kafkaErr, nil)
+			}
+			continue
+		}
+
+		consumed, ok := c.offsets.track(message.TopicPartition)
+		if !ok {
+			continue
+		}
+		c.dispatchMessage(message, consumed, dispatch, requiredAcks)
+	}
+	return nil
+}
+
+func (c *Consumer) dispatchMessage(message *kafka.Message, consumed *consumedMessage, dispatch func(*telemetry.Record) error, requiredAcks func(txType string) int) {
+	topic := *message.TopicPartition.Topic
+	record, err := RecordFromMessage(message)
+	if err != nil {
+		c.skipMessage(message, consumed, err)
+		return
+	}
+
+	// the pending acks need to be set before dispatching as datastores can ack right away
+	awaitsAcks := false
+	if required := requiredAcks(record.TxType); required > 0 {
+		record.SetPendingAcks(required)
+		c.offsets.awaitAcks(consumed, record.CorrelationID())
+		awaitsAcks = true
+	}
+	if err := dispatch(record); err != nil {
+		if errors.Is(err, telemetry.ErrUnroutedRecord) {
+			c.skipMessage(message, consumed, err)
+			return
+		}
+		c.offsets.failed(consumed, err)
+		return
+	}
+	metricsRegistry.consumeCount.Inc(map[string]string{"topic": topic, "record_type": record.TxType})
+	if !awaitsAcks {
+		c.offsets.written(consumed)
+	}
+}
+
+// skipMessage stores the offset of a message which can't be dispatched, it is not consumed again
+func (c *Consumer) skipMessage(message *kafka.Message, consumed *consumedMessage, err error) {
+	topic := *message.TopicPartition.Topic
+	metricsRegistry.consumeSkippedCount.Inc(map[string]string{"topic": topic})
+	c.logger.ErrorLog("kafka_consumer_message_error", err, logrus.LogInfo{"topic": topic, "partition": message.TopicPartition.Partition, "offset": message.TopicPartition.Offset})
+	c.offsets.written(consumed)
+}
+
+// handleAcks stores the offsets of the records acked by their datastores, and rewinds the partitions of the
+// records a datastore failed to write
+func (c *Consumer) handleAcks(acks <-chan *telemetry.Record) {
+	for record := range acks {
+		if record.ReleaseAck() {
+			c.offsets.acked(record.CorrelationID(), record.AckError())
+		}
+	}
+}
+
+// Close commits the offsets of the written messages and leaves the consumer group. The datastores should be
+// closed first, so the records they buffer are written and acked before their offsets are committed
+func (c *Consumer) Close() error {
+	if _, err := c.kafkaConsumer.Commit(); err != nil {
+		var kafkaErr kafka.Error
+		// nothing was stored since the last commit
+		if !errors.As(err, &kafkaErr) || kafkaErr.Code() != kafka.ErrNoOffset {
+			c.logger.ErrorLog("kafka_consumer_commit_error", err, nil)
+		}
+	}
+	c.offsets.close()
+	return c.kafkaConsumer.Close()
+}
@@ -0,0 +1,206 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+)
+
+// consumerRetryBackoff is how long a partition waits before the message its datastores failed to write is consumed again
+const consumerRetryBackoff = time.Second
+
+// consumedMessage is a message dispatched to the datastores whose offset is not stored yet
+type consumedMessage struct {
+	partition     kafka.TopicPartition
+	correlationID uint64
+	written       bool
+	// dropped messages are consumed again after a failure, their acks are ignored
+	dropped bool
+}
+
+// partitionOffsets tracks the messages of a partition which are dispatched
+type partitionOffsets struct {
+	// inFlight holds the messages from the oldest, the written ones at its front are stored
+	inFlight []*consumedMessage
+	// rewindTo is the offset the partition is consumed from again after a failure, rewinding is false when there is none
+	rewindTo  kafka.Offset
+	rewindAt  time.Time
+	rewinding bool
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// offsetStore is the part of the kafka consumer storing offsets and rewinding partitions
+type offsetStore interface {
+	StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	Seek(partition kafka.TopicPartition, ignoredTimeoutMs int) error
+}
+
+// offsetTracker stores the offset of a message once it and the messages before it in the partition were written, a
+// message which fails to be written rewinds its partition so it is consumed again
+type offsetTracker struct {
+	mutex        sync.Mutex
+	store        offsetStore
+	logger       *logrus.Logger
+	partitions   map[partitionKey]*partitionOffsets
+	awaitingAcks map[uint64]*consumedMessage
+	// closed is set once the consumer is closed, acks received later are ignored
+	closed bool
+}
+
+func newOffsetTracker(store offsetStore, logger *logrus.Logger) *offsetTracker {
+	return &offsetTracker{
+		store:        store,
+		logger:       logger,
+		partitions:   make(map[partitionKey]*partitionOffsets),
+		awaitingAcks: make(map[uint64]*consumedMessage),
+	}
+}
+
+// track returns the entry of a message read from kafka, false if its partition is rewinding to an earlier offset and
+// the message is consumed again afterwards
+func (t *offsetTracker) track(partition kafka.TopicPartition) (*consumedMessage, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	offsets := t.partitionOffsets(partition)
+	if offsets.rewinding && partition.Offset >= offsets.rewindTo {
+		return nil, false
+	}
+	message := &consumedMessage{partition: partition}
+	offsets.inFlight = append(offsets.inFlight, message)
+	return message, true
+}
+
+// awaitAcks makes the message wait for the acks of the record with the correlation id
+func (t *offsetTracker) awaitAcks(message *consumedMessage, correlationID uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	message.correlationID = correlationID
+	t.awaitingAcks[correlationID] = message
+}
+
+// acked marks the message of the record with the correlation id as written, or rewinds its partition if err is set
+func (t *offsetTracker) acked(correlationID uint64, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	message, ok := t.awaitingAcks[correlationID]
+	if !ok {
+		return
+	}
+	delete(t.awaitingAcks, correlationID)
+	if err != nil {
+		t.fail(message, err)
+		return
+	}
+	t.write(message)
+}
+
+// written marks the message as written
+func (t *offsetTracker) written(message *consumedMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.write(message)
+}
+
+// failed rewinds the partition of the message so it is consumed again after the backoff
+func (t *offsetTracker) failed(message *consumedMessage, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.fail(message, err)
+}
+
+// rewind seeks the partitions whose backoff elapsed to the offset of their failed message
+func (t *offsetTracker) rewind(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, offsets := range t.partitions {
+		if !offsets.rewinding || now.Before(offsets.rewindAt) {
+			continue
+		}
+		offsets.rewinding = false
+		topic := key.topic
+		partition := kafka.TopicPartition{Topic: &topic, Partition: key.partition, Offset: offsets.rewindTo}
+		if err := t.store.Seek(partition, 0); err != nil {
+			t.logger.ErrorLog("kafka_consumer_seek_error", err, logrus.LogInfo{"topic": topic, "partition": key.partition, "offset": offsets.rewindTo})
+		}
+	}
+}
+
+// close ignores the acks received once the consumer is closed
+func (t *offsetTracker) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+}
+
+func (t *offsetTracker) partitionOffsets(partition kafka.TopicPartition) *partitionOffsets {
+	key := partitionKey{topic: *partition.Topic, partition: partition.Partition}
+	offsets, ok := t.partitions[key]
+	if !ok {
+		offsets = &partitionOffsets{}
+		t.partitions[key] = offsets
+	}
+	return offsets
+}
+
+// write stores the offset following the written messages at the front of the partition, t.mutex must be held
+func (t *offsetTracker) write(message *consumedMessage) {
+	if message.dropped {
+		return
+	}
+	message.written = true
+	offsets := t.partitionOffsets(message.partition)
+	written := 0
+	for written < len(offsets.inFlight) && offsets.inFlight[written].written {
+		written++
+	}
+	if written == 0 {
+		return
+	}
+	last := offsets.inFlight[written-1].partition
+	offsets.inFlight = offsets.inFlight[written:]
+	if t.closed {
+		return
+	}
+	last.Offset++
+	if _, err := t.store.StoreOffsets([]kafka.TopicPartition{last}); err != nil {
+		t.logger.ErrorLog("kafka_consumer_store_offset_error", err, logrus.LogInfo{"topic": *last.Topic, "partition": last.Partition})
+	}
+}
+
+// fail drops the message and the ones after it in the partition, which is rewound to the message, t.mutex must be held
+func (t *offsetTracker) fail(message *consumedMessage, err error) {
+	if message.dropped {
+		return
+	}
+	offsets := t.partitionOffsets(message.partition)
+	for i, inFlight := range offsets.inFlight {
+		if inFlight != message {
+			continue
+		}
+		for _, dropped := range offsets.inFlight[i:] {
+			dropped.dropped = true
+			delete(t.awaitingAcks, dropped.correlationID)
+		}
+		offsets.inFlight = offsets.inFlight[:i]
+		break
+	}
+	if !offsets.rewinding || message.partition.Offset < offsets.rewindTo {
+		offsets.rewindTo = message.partition.Offset
+	}
+	offsets.rewinding = true
+	offsets.rewindAt = time.Now().Add(consumerRetryBackoff)
+
+	topic := *message.partition.Topic
+	metricsRegistry.consumeRetryCount.Inc(map[string]string{"topic": topic})
+	t.logger.ErrorLog("kafka_consumer_write_error", err, logrus.LogInfo{"topic": topic, "partition": message.partition.Partition, "offset": message.partition.Offset})
+}
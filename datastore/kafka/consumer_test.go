@@ -0,0 +1,147 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("ConsumerConfig", func() {
+	DescribeTable("rejects invalid configs",
+		func(config *kafka.ConsumerConfig, errMessage string) {
+			Expect(config.Validate()).To(MatchError(errMessage))
+		},
+		Entry("no topic", &kafka.ConsumerConfig{GroupID: "bridge"}, "kafka_consumer requires topics"),
+		Entry("no group", &kafka.ConsumerConfig{Topics: []string{"tesla_V"}}, "kafka_consumer requires a group_id"),
+		Entry("unknown offset reset", &kafka.ConsumerConfig{Topics: []string{"tesla_V"}, GroupID: "bridge", AutoOffsetReset: "smallest"}, "invalid kafka_consumer auto_offset_reset: smallest, expected earliest or latest"),
+		Entry("negative commit interval", &kafka.ConsumerConfig{Topics: []string{"tesla_V"}, GroupID: "bridge", CommitIntervalMs: -1}, "invalid kafka_consumer commit_interval_ms: -1"),
+	)
+
+	It("stores offsets once dispatched and commits them periodically", func() {
+		config := &kafka.ConsumerConfig{Topics: []string{"tesla_V"}, GroupID: "bridge"}
+		Expect(config.Validate()).To(Succeed())
+
+		configMap, err := config.ApplyTo(&confluent.ConfigMap{"bootstrap.servers": "kafka:9092", "go.logs.channel.enable": true}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*configMap).To(Equal(confluent.ConfigMap{
+			"bootstrap.servers":        "kafka:9092",
+			"group.id":                 "bridge",
+			"auto.offset.reset":        "earliest",
+			"enable.auto.commit":       true,
+			"auto.commit.interval.ms":  5000,
+			"enable.auto.offset.store": false,
+		}))
+	})
+
+	It("authenticates with the sasl config of the producer", func() {
+		config := &kafka.ConsumerConfig{Topics: []string{"tesla_V"}, GroupID: "bridge", AutoOffsetReset: "latest"}
+		sasl := &kafka.SASLConfig{Mechanism: kafka.SASLScramSHA512, Username: "user", Password: "secret"}
+
+		configMap, err := config.ApplyTo(&confluent.ConfigMap{"bootstrap.servers": "kafka:9092"}, sasl)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*configMap).To(HaveKeyWithValue("sasl.mechanisms", "SCRAM-SHA-512"))
+		Expect(*configMap).To(HaveKeyWithValue("security.protocol", "sasl_ssl"))
+		Expect(*configMap).To(HaveKeyWithValue("auto.offset.reset", "latest"))
+	})
+})
+
+var _ = Describe("Consumer", func() {
+	var (
+		consumer   *kafka.Consumer
+		dispatched chan *telemetry.Record
+		acks       chan *telemetry.Record
+		cancel     context.CancelFunc
+	)
+
+	// run consumes two records of a mock cluster topic, the first dispatch fails with dispatchErr
+	run := func(requiredAcks int, dispatchErr error) {
+		cluster, err := confluent.NewMockCluster(1)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(cluster.Close)
+		Expect(cluster.CreateTopic("tesla_V", 1, 1)).To(Succeed())
+
+		producer, err := confluent.NewProducer(&confluent.ConfigMap{"bootstrap.servers": cluster.BootstrapServers()})
+		Expect(err).NotTo(HaveOccurred())
+		defer producer.Close()
+		topic := "tesla_V"
+		deliveries := make(chan confluent.Event, 1)
+		for _, vin := range []string{"vin-1", "vin-2"} {
+			record := &telemetry.Record{TxType: "V", Vin: vin}
+			Expect(producer.Produce(&confluent.Message{
+				TopicPartition: confluent.TopicPartition{Topic: &topic, Partition: 0},
+				Headers:        (&kafka.Config{}).Headers(record),
+			}, deliveries)).To(Succeed())
+			Eventually(deliveries, 5*time.Second).Should(Receive())
+		}
+
+		logger, _ := logrus.NoOpLogger()
+		consumer, err = kafka.NewConsumer(&confluent.ConfigMap{"bootstrap.servers": cluster.BootstrapServers()}, &kafka.ConsumerConfig{Topics: []string{topic}, GroupID: "bridge"}, nil, noop.NewCollector(), logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(consumer.Close)
+
+		dispatched = make(chan *telemetry.Record, 10)
+		acks = make(chan *telemetry.Record)
+		failed := false
+		dispatch := func(record *telemetry.Record) error {
+			dispatched <- record
+			if !failed && dispatchErr != nil {
+				failed = true
+				return dispatchErr
+			}
+			return nil
+		}
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = consumer.Run(ctx, dispatch, func(string) int { return requiredAcks }, acks)
+		}()
+		DeferCleanup(func() { cancel(); <-done })
+	}
+
+	receiveVIN := func() string {
+		var record *telemetry.Record
+		Eventually(dispatched, 20*time.Second).Should(Receive(&record))
+		return record.Vin
+	}
+
+	It("consumes a message again when a datastore failed to write it", func() {
+		run(0, errors.New("broker down"))
+
+		Expect(receiveVIN()).To(Equal("vin-1"))
+		Expect(receiveVIN()).To(Equal("vin-1"))
+		Expect(receiveVIN()).To(Equal("vin-2"))
+		Consistently(dispatched).ShouldNot(Receive())
+	})
+
+	It("consumes a message again when a required datastore nacked it", func() {
+		run(1, nil)
+
+		var first *telemetry.Record
+		Eventually(dispatched, 20*time.Second).Should(Receive(&first))
+		Expect(first.Vin).To(Equal("vin-1"))
+		var second *telemetry.Record
+		Eventually(dispatched).Should(Receive(&second))
+		Expect(second.Vin).To(Equal("vin-2"))
+		second.FailAck(errors.New("broker down"))
+		acks <- second
+		acks <- first
+
+		var retried *telemetry.Record
+		Eventually(dispatched, 5*time.Second).Should(Receive(&retried))
+		Expect(retried.Vin).To(Equal("vin-2"))
+		acks <- retried
+		Consistently(dispatched).ShouldNot(Receive())
+	})
+})
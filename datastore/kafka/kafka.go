@@ -1,6 +1,8 @@
 package kafka
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -14,9 +16,14 @@ import (
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
 
+const defaultHealthCheckTimeout = 2 * time.Second
+
 // Producer client to handle kafka interactions
 type Producer struct {
+	// dispatcher is kafka or the name of the kafka instance
+	dispatcher         telemetry.Dispatcher
 	kafkaProducer      *kafka.Producer
+	config             *Config
 	namespace          string
 	prometheusEnabled  bool
 	metricsCollector   metrics.MetricCollector
@@ -25,17 +32,32 @@ type Producer struct {
 	deliveryChan       chan kafka.Event
 	ackChan            chan (*telemetry.Record)
 	reliableAckTxTypes map[string]interface{}
+	// nacker releases the records whose delivery failed, they are nacked to the vehicle
+	nacker         *telemetry.Nacker
+	produceErrors  *telemetry.ProduceErrorCounter
+	avroSerializer *AvroSerializer
+
+	deliveryReportsLock sync.RWMutex
+	deliveryReports     []func(entry *telemetry.Record, err error)
+
+	// closed stops reporting the queue metrics, which must be done before closing the kafka producer
+	closed      chan struct{}
+	metricsDone chan struct{}
+	closeOnce   sync.Once
 }
 
 // Metrics stores metrics reported from this package
 type Metrics struct {
-	producerCount     adapter.Counter
-	bytesTotal        adapter.Counter
-	producerAckCount  adapter.Counter
-	bytesAckTotal     adapter.Counter
-	errorCount        adapter.Counter
-	reliableAckCount  adapter.Counter
-	producerQueueSize adapter.Gauge
+	producerCount       adapter.Counter
+	bytesTotal          adapter.Counter
+	producerAckCount    adapter.Counter
+	bytesAckTotal       adapter.Counter
+	errorCount          adapter.Counter
+	reliableAckCount    adapter.Counter
+	producerQueueSize   adapter.Gauge
+	consumeCount        adapter.Counter
+	consumeSkippedCount adapter.Counter
+	consumeRetryCount   adapter.Counter
 }
 
 var (
@@ -43,17 +65,41 @@ var (
 	metricsOnce     sync.Once
 )
 
-// NewProducer establishes the kafka connection and define the dispatch method
-func NewProducer(config *kafka.ConfigMap, namespace string, prometheusEnabled bool, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+// NewProducer establishes the kafka connection and define the dispatch method, dispatcher is kafka or the name of
+// the kafka instance the config belongs to
+func NewProducer(dispatcher telemetry.Dispatcher, config *kafka.ConfigMap, producerConfig *Config, namespace string, prometheusEnabled bool, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
 	registerMetricsOnce(metricsCollector)
 
+	if err := producerConfig.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := producerConfig.ApplyTo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if producerConfig.SendsPlaintextCredentials(config) {
+		logger.Log(logrus.WARN, "kafka_sasl_plain_without_tls", logrus.LogInfo{"security_protocol": (*config)["security.protocol"]})
+	}
+
 	kafkaProducer, err := kafka.NewProducer(config)
 	if err != nil {
 		return nil, err
 	}
 
+	var avroSerializer *AvroSerializer
+	if producerConfig != nil && producerConfig.SchemaRegistry != nil {
+		if avroSerializer, err = NewAvroSerializer(producerConfig.SchemaRegistry); err != nil {
+			return nil, err
+		}
+	}
+
 	producer := &Producer{
+		dispatcher:         dispatcher,
+		avroSerializer:     avroSerializer,
+		produceErrors:      telemetry.NewProduceErrorCounter(dispatcher, metricsCollector),
 		kafkaProducer:      kafkaProducer,
+		config:             producerConfig,
 		namespace:          namespace,
 		metricsCollector:   metricsCollector,
 		prometheusEnabled:  prometheusEnabled,
@@ -62,36 +108,64 @@ func NewProducer(config *kafka.ConfigMap, namespace string, prometheusEnabled bo
 		deliveryChan:       make(chan kafka.Event),
 		ackChan:            ackChan,
 		reliableAckTxTypes: reliableAckTxTypes,
+		nacker:             telemetry.NewNacker(dispatcher, ackChan, reliableAckTxTypes, metricsCollector),
+		closed:             make(chan struct{}),
+		metricsDone:        make(chan struct{}),
 	}
 
 	go producer.handleProducerEvents()
+	if producerConfig != nil && producerConfig.SASL != nil && producerConfig.SASL.TokenProvider != nil {
+		go producer.refreshOAuthBearerTokens(producerConfig.SASL.TokenProvider)
+	}
 	go producer.reportProducerMetrics()
-	producer.logger.ActivityLog("kafka_registered", logrus.LogInfo{"namespace": namespace})
+	producer.logger.ActivityLog("kafka_registered", logrus.LogInfo{"namespace": namespace, "datastore": dispatcher})
 	return producer, nil
 }
 
-// Produce asynchronously sends the record payload to kafka
-func (p *Producer) Produce(entry *telemetry.Record) {
+// Produce asynchronously sends the record payload to kafka, delivery failures are only reported
+func (p *Producer) Produce(entry *telemetry.Record) error {
 	topic := telemetry.BuildTopicName(p.namespace, entry.TxType)
+	entry.ProduceTime = time.Now()
+
+	value, err := p.messageValue(topic, entry)
+	if err != nil {
+		p.reportRecordError("kafka_avro_err", err, entry, nil)
+		metricsRegistry.errorCount.Inc(map[string]string{})
+		p.produceErrors.Inc(err)
+		return err
+	}
 
 	msg := &kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Value:          entry.Payload(),
-		Key:            []byte(entry.Vin),
-		Headers:        headersFromRecord(entry),
-		Timestamp:      time.Now(),
+		Value:          value,
+		Key:            p.config.MessageKey(entry),
+		Headers:        p.config.Headers(entry),
+		Timestamp:      entry.ProduceTime,
 		Opaque:         entry,
 	}
 
 	// Note: confluent kafka supports the concept of one channel per connection, so we could add those here and get rid of reliableAckWorkers
 	// ex.: https://github.com/confluentinc/confluent-kafka-go/blob/master/examples/producer_custom_channel_example/producer_custom_channel_example.go#L79
-	entry.ProduceTime = time.Now()
 	if err := p.kafkaProducer.Produce(msg, p.deliveryChan); err != nil {
-		p.logError(err)
-		return
+		p.reportRecordError("kafka_err", err, entry, nil)
+		metricsRegistry.errorCount.Inc(map[string]string{})
+		p.produceErrors.IncClass(errorClass(err))
+		return err
 	}
 	metricsRegistry.producerCount.Inc(map[string]string{"record_type": entry.TxType})
 	metricsRegistry.bytesTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
+	return nil
+}
+
+// messageValue returns the record payload, prefixed with the schema id when it is encoded with avro
+func (p *Producer) messageValue(topic string, entry *telemetry.Record) ([]byte, error) {
+	if entry.Encoding() != telemetry.AvroFormat {
+		return entry.Payload(), nil
+	}
+	if p.avroSerializer == nil {
+		return nil, errors.New("avro records require kafka_producer.schema_registry")
+	}
+	return p.avroSerializer.Serialize(topic, entry)
 }
 
 // ReportError to airbrake and logger
@@ -100,6 +174,13 @@ func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo
 	p.logger.ErrorLog(message, err, logInfo)
 }
 
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(p.dispatcher), Namespace: p.namespace}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
 func headersFromRecord(record *telemetry.Record) (headers []kafka.Header) {
 	for key, val := range record.Metadata() {
 		headers = append(headers, kafka.Header{
@@ -115,16 +196,26 @@ func (p *Producer) handleProducerEvents() {
 		switch ev := e.(type) {
 		case kafka.Error:
 			p.logError(fmt.Errorf("producer_error %v", ev))
+			p.produceErrors.IncClass(errorClass(ev))
 		case *kafka.Message:
+			entry, ok := ev.Opaque.(*telemetry.Record)
 			if ev.TopicPartition.Error != nil {
-				p.logError(fmt.Errorf("topic_partition_error %v", ev))
+				p.produceErrors.IncClass(errorClass(ev.TopicPartition.Error))
+				if ok {
+					p.reportRecordError("kafka_err", fmt.Errorf("topic_partition_error %v", ev), entry, nil)
+					metricsRegistry.errorCount.Inc(map[string]string{})
+					p.reportDelivery(entry, ev.TopicPartition.Error)
+					p.nacker.Nack(entry, ev.TopicPartition.Error)
+				} else {
+					p.logError(fmt.Errorf("topic_partition_error %v", ev))
+				}
 				continue
 			}
-			entry, ok := ev.Opaque.(*telemetry.Record)
 			if !ok {
 				p.logError(fmt.Errorf("opaque_record_missing %v", ev))
 				continue
 			}
+			p.reportDelivery(entry, nil)
 			p.ProcessReliableAck(entry)
 			metricsRegistry.producerAckCount.Inc(map[string]string{"record_type": entry.TxType})
 			metricsRegistry.bytesAckTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
@@ -134,9 +225,64 @@ func (p *Producer) handleProducerEvents() {
 	}
 }
 
+// OnDelivery calls report with each record once kafka acknowledged it, or with the error its delivery failed with
+func (p *Producer) OnDelivery(report func(entry *telemetry.Record, err error)) {
+	p.deliveryReportsLock.Lock()
+	defer p.deliveryReportsLock.Unlock()
+	p.deliveryReports = append(p.deliveryReports, report)
+}
+
+func (p *Producer) reportDelivery(entry *telemetry.Record, err error) {
+	p.deliveryReportsLock.RLock()
+	defer p.deliveryReportsLock.RUnlock()
+	for _, report := range p.deliveryReports {
+		report(entry, err)
+	}
+}
+
+// refreshOAuthBearerTokens sets the token of the provider whenever librdkafka requests a new one
+func (p *Producer) refreshOAuthBearerTokens(tokenProvider OAuthBearerTokenProvider) {
+	for e := range p.kafkaProducer.Events() {
+		switch ev := e.(type) {
+		case kafka.OAuthBearerTokenRefresh:
+			token, err := tokenProvider()
+			if err == nil {
+				err = p.kafkaProducer.SetOAuthBearerToken(token)
+			}
+			if err != nil {
+				p.logError(fmt.Errorf("oauthbearer_token_refresh_error %v", err))
+				p.produceErrors.IncClass(telemetry.ErrorClassAuth)
+				_ = p.kafkaProducer.SetOAuthBearerTokenFailure(err.Error())
+			}
+		case kafka.Error:
+			p.logError(fmt.Errorf("producer_error %v", ev))
+			p.produceErrors.IncClass(errorClass(ev))
+		}
+	}
+}
+
+// QueueSize returns the number of messages waiting to be delivered
+func (p *Producer) QueueSize() int {
+	return p.kafkaProducer.Len()
+}
+
+// CheckHealth fetches the cluster metadata, which fails when no broker is reachable
+func (p *Producer) CheckHealth(ctx context.Context) error {
+	timeout := defaultHealthCheckTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	_, err := p.kafkaProducer.GetMetadata(nil, false, int(timeout.Milliseconds()))
+	return err
+}
+
 // Close the producer
 func (p *Producer) Close() error {
-	p.kafkaProducer.Close()
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		<-p.metricsDone
+		p.kafkaProducer.Close()
+	})
 	return nil
 }
 
@@ -149,15 +295,43 @@ func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
 	}
 }
 
+// errorClass returns the class of the errors of the kafka client in datastore_produce_errors_total
+func errorClass(err error) telemetry.ErrorClass {
+	var kafkaErr kafka.Error
+	if !errors.As(err, &kafkaErr) {
+		return telemetry.ClassifyError(err)
+	}
+	switch kafkaErr.Code() {
+	case kafka.ErrMsgTimedOut, kafka.ErrTimedOut, kafka.ErrTimedOutQueue, kafka.ErrRequestTimedOut:
+		return telemetry.ErrorClassTimeout
+	case kafka.ErrAuthentication, kafka.ErrSaslAuthenticationFailed, kafka.ErrTopicAuthorizationFailed,
+		kafka.ErrClusterAuthorizationFailed, kafka.ErrSsl:
+		return telemetry.ErrorClassAuth
+	case kafka.ErrTransport, kafka.ErrAllBrokersDown, kafka.ErrBrokerNotAvailable, kafka.ErrNetworkException,
+		kafka.ErrLeaderNotAvailable, kafka.ErrNotLeaderForPartition:
+		return telemetry.ErrorClassConnection
+	case kafka.ErrMsgSizeTooLarge, kafka.ErrInvalidMsg:
+		return telemetry.ErrorClassSerialization
+	}
+	return telemetry.ErrorClassOther
+}
+
 func (p *Producer) logError(err error) {
 	p.ReportError("kafka_err", err, nil)
 	metricsRegistry.errorCount.Inc(map[string]string{})
 }
 
 func (p *Producer) reportProducerMetrics() {
+	defer close(p.metricsDone)
 	interval := 5 * time.Second
 	t := time.NewTicker(interval)
-	for range t.C {
+	defer t.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-t.C:
+		}
 		total := p.kafkaProducer.Len()
 		eventsCount := len(p.kafkaProducer.Events())
 		metricsRegistry.producerQueueSize.Set(int64(total), map[string]string{"type": "total"})
@@ -212,4 +386,22 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 		Help:   "Total pending messages to produce",
 		Labels: []string{"type"},
 	})
+
+	metricsRegistry.consumeCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "kafka_consume_total",
+		Help:   "The number of records consumed from Kafka and dispatched in the kafka consumer mode.",
+		Labels: []string{"topic", "record_type"},
+	})
+
+	metricsRegistry.consumeSkippedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "kafka_consume_skipped_total",
+		Help:   "The number of messages consumed from Kafka which could not be rebuilt into records or dispatched.",
+		Labels: []string{"topic"},
+	})
+
+	metricsRegistry.consumeRetryCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "kafka_consume_retries_total",
+		Help:   "The number of messages consumed from Kafka again because a datastore failed to write their records.",
+		Labels: []string{"topic"},
+	})
 }
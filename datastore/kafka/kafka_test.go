@@ -0,0 +1,57 @@
+package kafka_test
+
+import (
+	"time"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Producer", func() {
+	var (
+		cluster    *confluent.MockCluster
+		producer   telemetry.Producer
+		deliveries chan error
+	)
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = confluent.NewMockCluster(1)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(cluster.Close)
+		Expect(cluster.CreateTopic("tesla_V", 1, 1)).To(Succeed())
+
+		logger, _ := logrus.NoOpLogger()
+		configMap := &confluent.ConfigMap{"bootstrap.servers": cluster.BootstrapServers(), "message.timeout.ms": 500}
+		producer, err = kafka.NewProducer("kafka_next", configMap, &kafka.Config{}, "tesla", false, noop.NewCollector(), airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+
+		deliveries = make(chan error, 1)
+		producer.(telemetry.DeliveryReporter).OnDelivery(func(_ *telemetry.Record, err error) {
+			deliveries <- err
+		})
+	})
+
+	It("reports the delivery of the records", func() {
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "vin-1"})).To(Succeed())
+		var err error
+		Eventually(deliveries, 5*time.Second).Should(Receive(&err))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports the records it failed to deliver", func() {
+		Expect(cluster.SetBrokerDown(1)).To(Succeed())
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "vin-1"})).To(Succeed())
+		var err error
+		Eventually(deliveries, 5*time.Second).Should(Receive(&err))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// RecordFromMessage rebuilds a record from a message written by the producer with headers enabled,
+// unknown headers are kept as record metadata. Other keys reserved by the server, such as the trace context,
+// are dropped
+func RecordFromMessage(message *kafka.Message) (*telemetry.Record, error) {
+	record := &telemetry.Record{PayloadBytes: message.Value}
+	hasIdempotencyKey := false
+	for _, header := range message.Headers {
+		value := string(header.Value)
+		switch header.Key {
+		case "vin":
+			record.Vin = value
+		case "txtype":
+			record.TxType = value
+		case "txid":
+			record.Txid = value
+		case "receivedat":
+			record.ReceivedTimestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "timestamp":
+			record.Timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "version":
+			version, _ := strconv.Atoi(value)
+			record.Version = version
+		case "serverreceivedat":
+			if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+				record.ServerReceivedAt = time.UnixMilli(millis)
+			}
+		case "sourceip":
+			record.SourceIP = value
+		case "encoding":
+			record.SetEncoding(telemetry.PayloadFormat(value))
+		case "producetime":
+			// set again when the record is produced
+		case telemetry.IdempotencyKeyMetadataKey, telemetry.FirmwareMetadataKey, telemetry.ProtocolMetadataKey:
+			hasIdempotencyKey = hasIdempotencyKey || header.Key == telemetry.IdempotencyKeyMetadataKey
+			record.AddMetadata(header.Key, value)
+		default:
+			if !telemetry.IsReservedMetadataKey(header.Key) {
+				record.AddMetadata(header.Key, value)
+			}
+		}
+	}
+	if record.TxType == "" {
+		return nil, errors.New("kafka message has no txtype header")
+	}
+	if !hasIdempotencyKey {
+		record.AddMetadata(telemetry.IdempotencyKeyMetadataKey, record.IdempotencyKey())
+	}
+	return record, nil
+}
@@ -0,0 +1,62 @@
+package kafka_test
+
+import (
+	"time"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/kafka"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("RecordFromMessage", func() {
+	It("rebuilds the record from the message headers", func() {
+		original := &telemetry.Record{
+			Vin:               "VIN42",
+			TxType:            "V",
+			Txid:              "txid-42",
+			ReceivedTimestamp: 1700000000001,
+			Timestamp:         1700000000000,
+			Version:           2,
+			ServerReceivedAt:  time.UnixMilli(1700000000002),
+			SourceIP:          "203.0.113.7",
+			PayloadBytes:      []byte("data"),
+			ProduceTime:       time.Now(),
+		}
+		original.AddMetadata("source", "test")
+
+		record, err := kafka.RecordFromMessage(&confluent.Message{Value: original.Payload(), Headers: (&kafka.Config{}).Headers(original)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Payload()).To(Equal([]byte("data")))
+		Expect(record.ServerReceivedAt.Equal(original.ServerReceivedAt)).To(BeTrue())
+		Expect(record.Metadata()).To(Equal(original.Metadata()))
+		Expect(record.IdempotencyKey()).To(Equal(original.IdempotencyKey()))
+	})
+
+	It("restores the encoding of the payload", func() {
+		original := &telemetry.Record{TxType: "V", Vin: "VIN42", PayloadBytes: []byte(`{"vin":"VIN42"}`)}
+		original.SetEncoding(telemetry.JSONFormat)
+
+		record, err := kafka.RecordFromMessage(&confluent.Message{Value: original.Payload(), Headers: (&kafka.Config{}).Headers(original)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Encoding()).To(Equal(telemetry.JSONFormat))
+	})
+
+	It("drops the other keys reserved by the server", func() {
+		record, err := kafka.RecordFromMessage(&confluent.Message{Value: []byte("data"), Headers: []confluent.Header{
+			{Key: "txtype", Value: []byte("V")},
+			{Key: "traceparent", Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")},
+			{Key: telemetry.FirmwareMetadataKey, Value: []byte("2024.44.25")},
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Metadata()).NotTo(HaveKey("traceparent"))
+		Expect(record.Metadata()).To(HaveKeyWithValue(telemetry.FirmwareMetadataKey, "2024.44.25"))
+	})
+
+	It("requires the txtype header", func() {
+		_, err := kafka.RecordFromMessage(&confluent.Message{Value: []byte("data")})
+		Expect(err).To(MatchError("kafka message has no txtype header"))
+	})
+})
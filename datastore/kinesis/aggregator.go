@@ -0,0 +1,102 @@
+package kinesis
+
+import (
+	"crypto/md5"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// maxAggregatedRecordSize is the kinesis limit for the data and partition key of a single record
+	maxAggregatedRecordSize = 1024 * 1024
+
+	// aggregatedRecord field numbers, see https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+	partitionKeyTableField protowire.Number = 1
+	recordsField           protowire.Number = 3
+
+	// record field numbers
+	partitionKeyIndexField protowire.Number = 1
+	dataField              protowire.Number = 3
+)
+
+// kplMagic prefixes every KPL aggregated record
+var kplMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// aggregatedBatch accumulates records destined to the same stream into a single KPL aggregated record, sent with the
+// partition key of its first record
+type aggregatedBatch struct {
+	partitionKey     string
+	partitionKeys    []string
+	partitionIndexes map[string]uint64
+	records          []*telemetry.Record
+	recordIndexes    []uint64
+	protoSize        int
+}
+
+func newAggregatedBatch() *aggregatedBatch {
+	return &aggregatedBatch{partitionIndexes: make(map[string]uint64)}
+}
+
+// sizeWith returns the size of the kinesis record (data and partition key) if entry were added
+func (b *aggregatedBatch) sizeWith(entry *telemetry.Record, partitionKey string) int {
+	protoSize := b.protoSize
+	index, ok := b.partitionIndexes[partitionKey]
+	if !ok {
+		index = uint64(len(b.partitionKeys))
+		protoSize += protowire.SizeTag(partitionKeyTableField) + protowire.SizeBytes(len(partitionKey))
+	}
+	protoSize += protowire.SizeTag(recordsField) + protowire.SizeBytes(recordSize(index, entry))
+
+	aggregatedPartitionKey := b.partitionKey
+	if aggregatedPartitionKey == "" {
+		aggregatedPartitionKey = partitionKey
+	}
+	return len(kplMagic) + protoSize + md5.Size + len(aggregatedPartitionKey)
+}
+
+func (b *aggregatedBatch) add(entry *telemetry.Record, partitionKey string) {
+	index, ok := b.partitionIndexes[partitionKey]
+	if !ok {
+		index = uint64(len(b.partitionKeys))
+		b.partitionIndexes[partitionKey] = index
+		b.partitionKeys = append(b.partitionKeys, partitionKey)
+		b.protoSize += protowire.SizeTag(partitionKeyTableField) + protowire.SizeBytes(len(partitionKey))
+	}
+	if b.partitionKey == "" {
+		b.partitionKey = partitionKey
+	}
+	b.protoSize += protowire.SizeTag(recordsField) + protowire.SizeBytes(recordSize(index, entry))
+	b.records = append(b.records, entry)
+	b.recordIndexes = append(b.recordIndexes, index)
+}
+
+// encode serializes the batch as magic header, AggregatedRecord protobuf and md5 checksum of the protobuf
+func (b *aggregatedBatch) encode() []byte {
+	message := make([]byte, 0, b.protoSize)
+	for _, partitionKey := range b.partitionKeys {
+		message = protowire.AppendTag(message, partitionKeyTableField, protowire.BytesType)
+		message = protowire.AppendString(message, partitionKey)
+	}
+	for i, entry := range b.records {
+		index := b.recordIndexes[i]
+		message = protowire.AppendTag(message, recordsField, protowire.BytesType)
+		message = protowire.AppendVarint(message, uint64(recordSize(index, entry)))
+		message = protowire.AppendTag(message, partitionKeyIndexField, protowire.VarintType)
+		message = protowire.AppendVarint(message, index)
+		message = protowire.AppendTag(message, dataField, protowire.BytesType)
+		message = protowire.AppendBytes(message, entry.Payload())
+	}
+
+	checksum := md5.Sum(message)
+	data := make([]byte, 0, len(kplMagic)+len(message)+len(checksum))
+	data = append(data, kplMagic...)
+	data = append(data, message...)
+	return append(data, checksum[:]...)
+}
+
+func recordSize(partitionKeyIndex uint64, entry *telemetry.Record) int {
+	return protowire.SizeTag(partitionKeyIndexField) + protowire.SizeVarint(partitionKeyIndex) +
+		protowire.SizeTag(dataField) + protowire.SizeBytes(len(entry.Payload()))
+}
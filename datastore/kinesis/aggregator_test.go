@@ -0,0 +1,185 @@
+package kinesis
+
+import (
+	"crypto/md5"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// recordingKinesis accepts the records and keeps the aggregated records it was sent
+type recordingKinesis struct {
+	kinesisiface.KinesisAPI
+	mu      sync.Mutex
+	records []*kinesis.PutRecordInput
+}
+
+func (k *recordingKinesis) PutRecordWithContext(_ aws.Context, input *kinesis.PutRecordInput, _ ...request.Option) (*kinesis.PutRecordOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.records = append(k.records, input)
+	return &kinesis.PutRecordOutput{ShardId: aws.String("shard-1"), SequenceNumber: aws.String("1")}, nil
+}
+
+// aggregatedRecords returns the partition keys of the records of each aggregated record, by outer partition key
+func (k *recordingKinesis) aggregatedRecords() map[string][]string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	aggregated := make(map[string][]string)
+	for _, input := range k.records {
+		partitionKeys, records := decodeAggregatedRecord(input.Data[len(kplMagic) : len(input.Data)-md5.Size])
+		for _, record := range records {
+			aggregated[*input.PartitionKey] = append(aggregated[*input.PartitionKey], partitionKeys[record.partitionKeyIndex])
+		}
+	}
+	return aggregated
+}
+
+type decodedRecord struct {
+	partitionKeyIndex uint64
+	data              []byte
+}
+
+func decodeAggregatedRecord(message []byte) (partitionKeys []string, records []decodedRecord) {
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		Expect(n).To(BeNumerically(">", 0))
+		Expect(typ).To(Equal(protowire.BytesType))
+		message = message[n:]
+		value, n := protowire.ConsumeBytes(message)
+		Expect(n).To(BeNumerically(">", 0))
+		message = message[n:]
+
+		switch num {
+		case partitionKeyTableField:
+			partitionKeys = append(partitionKeys, string(value))
+		case recordsField:
+			var record decodedRecord
+			for len(value) > 0 {
+				fieldNum, _, n := protowire.ConsumeTag(value)
+				value = value[n:]
+				switch fieldNum {
+				case partitionKeyIndexField:
+					record.partitionKeyIndex, n = protowire.ConsumeVarint(value)
+				case dataField:
+					record.data, n = protowire.ConsumeBytes(value)
+				}
+				Expect(n).To(BeNumerically(">", 0))
+				value = value[n:]
+			}
+			records = append(records, record)
+		}
+	}
+	return
+}
+
+var _ = Describe("aggregatedBatch", func() {
+	It("encodes records in the KPL aggregation format", func() {
+		batch := newAggregatedBatch()
+		records := []*telemetry.Record{
+			{Vin: "VIN1", PayloadBytes: []byte("first")},
+			{Vin: "VIN2", PayloadBytes: []byte("second")},
+			{Vin: "VIN1", PayloadBytes: []byte("third")},
+		}
+		expectedSize := 0
+		for _, record := range records {
+			expectedSize = batch.sizeWith(record, record.Vin)
+			batch.add(record, record.Vin)
+		}
+
+		data := batch.encode()
+		Expect(len(data) + len(batch.partitionKey)).To(Equal(expectedSize))
+		Expect(data[:len(kplMagic)]).To(Equal(kplMagic))
+
+		message := data[len(kplMagic) : len(data)-md5.Size]
+		checksum := md5.Sum(message)
+		Expect(data[len(data)-md5.Size:]).To(Equal(checksum[:]))
+
+		partitionKeys, decoded := decodeAggregatedRecord(message)
+		Expect(partitionKeys).To(Equal([]string{"VIN1", "VIN2"}))
+		Expect(decoded).To(Equal([]decodedRecord{
+			{partitionKeyIndex: 0, data: []byte("first")},
+			{partitionKeyIndex: 1, data: []byte("second")},
+			{partitionKeyIndex: 0, data: []byte("third")},
+		}))
+		Expect(batch.partitionKey).To(Equal("VIN1"))
+	})
+
+	It("reports records which exceed the kinesis limit", func() {
+		record := &telemetry.Record{Vin: "VIN1", PayloadBytes: make([]byte, maxAggregatedRecordSize)}
+		Expect(newAggregatedBatch().sizeWith(record, record.Vin)).To(BeNumerically(">", maxAggregatedRecordSize))
+	})
+})
+
+var _ = Describe("aggregation", func() {
+	var api *recordingKinesis
+
+	newAggregatingProducer := func(strategy PartitionKeyStrategy) *Producer {
+		registerMetricsOnce(noop.NewCollector())
+		logger, _ := logrus.NoOpLogger()
+		partitioner, err := newPartitioner(strategy, 0)
+		Expect(err).NotTo(HaveOccurred())
+		producer := &Producer{
+			kinesis:            api,
+			retrier:            newRetrier(0, nil),
+			logger:             logger,
+			streams:            map[string]string{"V": "stream_V"},
+			airbrakeHandler:    airbrake.NewAirbrakeHandler(nil),
+			partitioner:        partitioner,
+			aggregationEnabled: true,
+			batches:            make(map[batchKey]*aggregatedBatch),
+			done:               make(chan struct{}),
+		}
+		producer.flushWg.Add(1)
+		go producer.flushAggregatedRecords(time.Hour)
+		return producer
+	}
+
+	produce := func(producer *Producer, vins ...string) {
+		for _, vin := range vins {
+			Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: vin, PayloadBytes: []byte(vin)})).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		api = &recordingKinesis{}
+	})
+
+	It("flushes the partially filled batches on close", func() {
+		producer := newAggregatingProducer(PartitionByVin)
+		produce(producer, "VIN1")
+		Expect(producer.QueueSize()).To(Equal(1))
+		Expect(api.aggregatedRecords()).To(BeEmpty())
+
+		Expect(producer.Close()).To(Succeed())
+		Expect(producer.QueueSize()).To(BeZero())
+		Expect(api.aggregatedRecords()).To(Equal(map[string][]string{"VIN1": {"VIN1"}}))
+	})
+
+	It("aggregates the records of each vin on their own, so they reach the shard of the vin", func() {
+		producer := newAggregatingProducer(PartitionByVin)
+		produce(producer, "VIN1", "VIN2", "VIN1")
+		Expect(producer.Close()).To(Succeed())
+		Expect(api.aggregatedRecords()).To(Equal(map[string][]string{"VIN1": {"VIN1", "VIN1"}, "VIN2": {"VIN2"}}))
+	})
+
+	It("aggregates the records of every vin with the random strategy", func() {
+		producer := newAggregatingProducer(PartitionRandom)
+		produce(producer, "VIN1", "VIN2", "VIN1")
+		Expect(producer.Close()).To(Succeed())
+		Expect(api.aggregatedRecords()).To(Equal(map[string][]string{"VIN1": {"VIN1", "VIN2", "VIN1"}}))
+	})
+})
@@ -1,14 +1,19 @@
 package kinesis
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 
+	"github.com/teslamotors/fleet-telemetry/datastore/proxy"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/metrics"
 	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
@@ -16,9 +21,16 @@ import (
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
 
+const (
+	// maxPutRecordsCount and maxPutRecordsSize are the limits of a PutRecords request
+	maxPutRecordsCount = 500
+	maxPutRecordsSize  = 5 * 1024 * 1024
+)
+
 // Producer client to handle kinesis interactions
 type Producer struct {
-	kinesis            *kinesis.Kinesis
+	kinesis            kinesisiface.KinesisAPI
+	retrier            *retrier
 	logger             *logrus.Logger
 	prometheusEnabled  bool
 	metricsCollector   metrics.MetricCollector
@@ -26,6 +38,20 @@ type Producer struct {
 	airbrakeHandler    *airbrake.Handler
 	ackChan            chan (*telemetry.Record)
 	reliableAckTxTypes map[string]interface{}
+	partitioner        *partitioner
+
+	aggregationEnabled bool
+	aggregationLock    sync.Mutex
+	batches            map[batchKey]*aggregatedBatch
+	done               chan struct{}
+	flushWg            sync.WaitGroup
+	produceErrors      *telemetry.ProduceErrorCounter
+}
+
+// batchKey identifies a pending aggregated batch, by stream and aggregation key of its records
+type batchKey struct {
+	stream         string
+	aggregationKey string
 }
 
 // Metrics stores metrics reported from this package
@@ -34,6 +60,7 @@ type Metrics struct {
 	publishCount     adapter.Counter
 	byteTotal        adapter.Counter
 	reliableAckCount adapter.Counter
+	retryCount       adapter.Counter
 }
 
 var (
@@ -41,17 +68,42 @@ var (
 	metricsOnce     sync.Once
 )
 
-// NewProducer configures and tests the kinesis connection
-func NewProducer(maxRetries int, streams map[string]string, overrideHost string, prometheusEnabled bool, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+// NewProducer configures and tests the kinesis connection. When aggregationEnabled is set, records are
+// aggregated per stream and vin, or per stream with PartitionRandom, using the KPL format and flushed every aggregationFlushInterval or when full.
+// partitionKeyStrategy picks the shard of records, partitionKeyBuckets is only used by PartitionByVinHashBucket.
+// When backoff is set, writes are retried up to maxRetries times with backoff instead of by the aws sdk
+func NewProducer(maxRetries int, backoff *Backoff, streams map[string]string, overrideHost string, proxyConfig *proxy.Config, aggregationEnabled bool, aggregationFlushInterval time.Duration, partitionKeyStrategy PartitionKeyStrategy, partitionKeyBuckets int, prometheusEnabled bool, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
 	registerMetricsOnce(metricsCollector)
 
+	partitioner, err := newPartitioner(partitionKeyStrategy, partitionKeyBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	if backoff != nil {
+		if err := backoff.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	sdkMaxRetries := maxRetries
+	if backoff != nil {
+		sdkMaxRetries = 0
+	}
 	config := &aws.Config{
-		MaxRetries:                    aws.Int(maxRetries),
+		MaxRetries:                    aws.Int(sdkMaxRetries),
 		CredentialsChainVerboseErrors: aws.Bool(true),
 	}
 	if overrideHost != "" {
 		config = config.WithEndpoint(overrideHost)
 	}
+	if proxyConfig != nil {
+		httpClient, err := proxyConfig.HTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		config = config.WithHTTPClient(httpClient)
+	}
 	sess, err := session.NewSessionWithOptions(session.Options{
 		Config:            *config,
 		SharedConfigState: session.SharedConfigEnable,
@@ -65,8 +117,10 @@ func NewProducer(maxRetries int, streams map[string]string, overrideHost string,
 		return nil, fmt.Errorf("failed to list streams (test connection): %v", err)
 	}
 
-	return &Producer{
+	producer := &Producer{
+		produceErrors:      telemetry.NewProduceErrorCounter(telemetry.Kinesis, metricsCollector),
 		kinesis:            service,
+		retrier:            newRetrier(maxRetries, backoff),
 		logger:             logger,
 		prometheusEnabled:  prometheusEnabled,
 		metricsCollector:   metricsCollector,
@@ -74,37 +128,275 @@ func NewProducer(maxRetries int, streams map[string]string, overrideHost string,
 		airbrakeHandler:    airbrakeHandler,
 		ackChan:            ackChan,
 		reliableAckTxTypes: reliableAckTxTypes,
-	}, nil
+		partitioner:        partitioner,
+		aggregationEnabled: aggregationEnabled,
+		batches:            make(map[batchKey]*aggregatedBatch),
+		done:               make(chan struct{}),
+	}
+
+	if aggregationEnabled {
+		producer.flushWg.Add(1)
+		go producer.flushAggregatedRecords(aggregationFlushInterval)
+	}
+	return producer, nil
+}
+
+// Produce sends the record payload to kinesis. Aggregated records are sent asynchronously,
+// their failures are only reported
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	return p.ProduceContext(context.Background(), entry)
 }
 
-// Produce asynchronously sends the record payload to kineses
-func (p *Producer) Produce(entry *telemetry.Record) {
+// ProduceContext sends the record payload to kinesis, non aggregated writes are canceled when ctx is done
+func (p *Producer) ProduceContext(ctx context.Context, entry *telemetry.Record) error {
 	entry.ProduceTime = time.Now()
 	stream, ok := p.streams[entry.TxType]
 	if !ok {
-		p.ReportError("kinesis_produce_stream_not_configured", nil, logrus.LogInfo{"record_type": entry.TxType})
-		return
+		err := fmt.Errorf("kinesis stream not configured for record type: %s", entry.TxType)
+		p.reportRecordError("kinesis_produce_stream_not_configured", nil, entry, logrus.LogInfo{"record_type": entry.TxType})
+		p.produceErrors.IncClass(telemetry.ErrorClassOther)
+		return err
+	}
+	if p.aggregationEnabled {
+		return p.aggregate(ctx, stream, entry)
 	}
+	return p.putRecord(ctx, stream, entry)
+}
+
+// ProduceBatch sends the records to kinesis with PutRecords requests, grouped by stream.
+// Aggregated records are added to the pending aggregated batches instead. A *telemetry.BatchError
+// lists the records which were not written, the others are acked
+func (p *Producer) ProduceBatch(entries []*telemetry.Record) error {
+	batchErr := telemetry.NewBatchError()
+	streamEntries := make(map[string][]*telemetry.Record)
+	for _, entry := range entries {
+		entry.ProduceTime = time.Now()
+		stream, ok := p.streams[entry.TxType]
+		if !ok {
+			p.reportRecordError("kinesis_produce_stream_not_configured", nil, entry, logrus.LogInfo{"record_type": entry.TxType})
+			p.produceErrors.IncClass(telemetry.ErrorClassOther)
+			batchErr.Add(entry, fmt.Errorf("kinesis stream not configured for record type: %s", entry.TxType))
+			continue
+		}
+		if p.aggregationEnabled {
+			if err := p.aggregate(context.Background(), stream, entry); err != nil {
+				batchErr.Add(entry, err)
+			}
+			continue
+		}
+		streamEntries[stream] = append(streamEntries[stream], entry)
+	}
+
+	for stream, entries := range streamEntries {
+		for len(entries) > 0 {
+			count, size := 0, 0
+			for count < len(entries) && count < maxPutRecordsCount {
+				recordSize := len(entries[count].Payload()) + len(entries[count].Vin)
+				if count > 0 && size+recordSize > maxPutRecordsSize {
+					break
+				}
+				size += recordSize
+				count++
+			}
+			p.putRecords(stream, entries[:count], batchErr)
+			entries = entries[count:]
+		}
+	}
+	return batchErr.ErrorOrNil()
+}
+
+// putRecords sends the records in a single request, the records rejected with a retryable error are sent again.
+// Records which were not written are added to batchErr and not acked
+func (p *Producer) putRecords(stream string, entries []*telemetry.Record, batchErr *telemetry.BatchError) {
+	pending := entries
+	rejected := make(map[*telemetry.Record]error)
+	err := p.retrier.do(context.Background(), func(ctx context.Context) error {
+		requestEntries := make([]*kinesis.PutRecordsRequestEntry, 0, len(pending))
+		for _, entry := range pending {
+			requestEntries = append(requestEntries, &kinesis.PutRecordsRequestEntry{
+				Data:            entry.Payload(),
+				PartitionKey:    aws.String(entry.Vin),
+				ExplicitHashKey: p.partitioner.explicitHashKey(entry.Vin),
+			})
+		}
+
+		output, err := p.kinesis.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{StreamName: aws.String(stream), Records: requestEntries})
+		if err != nil {
+			return err
+		}
+
+		var retryable []*telemetry.Record
+		var retryErr error
+		for i, entry := range pending {
+			delete(rejected, entry)
+			if i < len(output.Records) && output.Records[i].ErrorCode == nil {
+				p.ProcessReliableAck(entry)
+				metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
+				metricsRegistry.byteTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
+				continue
+			}
+			recordErr := errors.New("kinesis did not return the record result")
+			if i < len(output.Records) {
+				recordErr = awserr.New(aws.StringValue(output.Records[i].ErrorCode), aws.StringValue(output.Records[i].ErrorMessage), nil)
+			}
+			rejected[entry] = recordErr
+			if isRetryable(recordErr) {
+				retryable = append(retryable, entry)
+				retryErr = recordErr
+			}
+		}
+		pending = retryable
+		return retryErr
+	})
+	if err != nil && len(rejected) == 0 {
+		p.ReportError("kinesis_err", err, logrus.LogInfo{"stream": stream, "record_count": len(pending)})
+		for _, entry := range pending {
+			rejected[entry] = err
+		}
+	} else {
+		for entry, recordErr := range rejected {
+			p.reportRecordError("kinesis_err", recordErr, entry, nil)
+		}
+	}
+	for entry, recordErr := range rejected {
+		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		p.produceErrors.Inc(recordErr)
+		batchErr.Add(entry, recordErr)
+	}
+}
+
+func (p *Producer) putRecord(ctx context.Context, stream string, entry *telemetry.Record) error {
 	kinesisRecord := &kinesis.PutRecordInput{
-		Data:         entry.Payload(),
-		StreamName:   aws.String(stream),
-		PartitionKey: aws.String(entry.Vin),
+		Data:            entry.Payload(),
+		StreamName:      aws.String(stream),
+		PartitionKey:    aws.String(entry.Vin),
+		ExplicitHashKey: p.partitioner.explicitHashKey(entry.Vin),
 	}
 
-	kinesisRecordOutput, err := p.kinesis.PutRecord(kinesisRecord)
+	var kinesisRecordOutput *kinesis.PutRecordOutput
+	err := p.retrier.do(ctx, func(ctx context.Context) (err error) {
+		kinesisRecordOutput, err = p.kinesis.PutRecordWithContext(ctx, kinesisRecord)
+		return err
+	})
 	if err != nil {
-		p.ReportError("kinesis_err", err, nil)
+		p.reportRecordError("kinesis_err", err, entry, nil)
 		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
-		return
+		p.produceErrors.Inc(err)
+		return err
 	}
 	p.ProcessReliableAck(entry)
 	p.logger.Log(logrus.DEBUG, "kinesis_message_dispatched", logrus.LogInfo{"vin": entry.Vin, "record_type": entry.TxType, "txid": entry.Txid, "shard_id": *kinesisRecordOutput.ShardId, "sequence_number": *kinesisRecordOutput.SequenceNumber})
 	metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
 	metricsRegistry.byteTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
+	return nil
 }
 
-// Close the producer
+// aggregate adds the record to the pending batch of the stream and of its vin, or of the stream with the random
+// partition key strategy. The batch is sent first if the record doesn't fit
+func (p *Producer) aggregate(ctx context.Context, stream string, entry *telemetry.Record) error {
+	partitionKey := entry.Vin
+	if newAggregatedBatch().sizeWith(entry, partitionKey) > maxAggregatedRecordSize {
+		return p.putRecord(ctx, stream, entry)
+	}
+
+	key := batchKey{stream: stream, aggregationKey: p.partitioner.aggregationKey(entry.Vin)}
+	var fullBatch *aggregatedBatch
+	p.aggregationLock.Lock()
+	batch, ok := p.batches[key]
+	if !ok {
+		batch = newAggregatedBatch()
+		p.batches[key] = batch
+	}
+	if batch.sizeWith(entry, partitionKey) > maxAggregatedRecordSize {
+		fullBatch = batch
+		batch = newAggregatedBatch()
+		p.batches[key] = batch
+	}
+	batch.add(entry, partitionKey)
+	p.aggregationLock.Unlock()
+
+	if fullBatch != nil {
+		p.putAggregatedRecord(stream, fullBatch)
+	}
+	return nil
+}
+
+func (p *Producer) flushAggregatedRecords(interval time.Duration) {
+	defer p.flushWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.flushBatches()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Producer) flushBatches() {
+	p.aggregationLock.Lock()
+	batches := p.batches
+	p.batches = make(map[batchKey]*aggregatedBatch)
+	p.aggregationLock.Unlock()
+
+	for key, batch := range batches {
+		p.putAggregatedRecord(key.stream, batch)
+	}
+}
+
+func (p *Producer) putAggregatedRecord(stream string, batch *aggregatedBatch) {
+	if len(batch.records) == 0 {
+		return
+	}
+	kinesisRecord := &kinesis.PutRecordInput{
+		Data:            batch.encode(),
+		StreamName:      aws.String(stream),
+		PartitionKey:    aws.String(batch.partitionKey),
+		ExplicitHashKey: p.partitioner.explicitHashKey(batch.partitionKey),
+	}
+
+	var kinesisRecordOutput *kinesis.PutRecordOutput
+	err := p.retrier.do(context.Background(), func(ctx context.Context) (err error) {
+		kinesisRecordOutput, err = p.kinesis.PutRecordWithContext(ctx, kinesisRecord)
+		return err
+	})
+	if err != nil {
+		p.ReportError("kinesis_err", err, logrus.LogInfo{"stream": stream, "record_count": len(batch.records)})
+		for _, entry := range batch.records {
+			metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+			p.produceErrors.Inc(err)
+		}
+		return
+	}
+	for _, entry := range batch.records {
+		p.ProcessReliableAck(entry)
+		metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
+		metricsRegistry.byteTotal.Add(int64(entry.Length()), map[string]string{"record_type": entry.TxType})
+	}
+	p.logger.Log(logrus.DEBUG, "kinesis_aggregated_message_dispatched", logrus.LogInfo{"stream": stream, "record_count": len(batch.records), "shard_id": *kinesisRecordOutput.ShardId, "sequence_number": *kinesisRecordOutput.SequenceNumber})
+}
+
+// QueueSize returns the number of records waiting to be aggregated
+func (p *Producer) QueueSize() int {
+	p.aggregationLock.Lock()
+	defer p.aggregationLock.Unlock()
+
+	size := 0
+	for _, batch := range p.batches {
+		size += len(batch.records)
+	}
+	return size
+}
+
+// Close the producer, flushing pending aggregated records
 func (p *Producer) Close() error {
+	if p.aggregationEnabled {
+		close(p.done)
+		p.flushWg.Wait()
+		p.flushBatches()
+	}
 	return nil
 }
 
@@ -123,6 +415,13 @@ func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo
 	p.logger.ErrorLog(message, err, logInfo)
 }
 
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(telemetry.Kinesis)}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
 func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
 	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
 }
@@ -151,4 +450,10 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 		Help:   "The number of records produced to Kinesis for which we sent a reliable ACK.",
 		Labels: []string{"record_type"},
 	})
+
+	metricsRegistry.retryCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "kinesis_retry",
+		Help:   "The number of Kinesis writes retried after a throttling or transient error, by attempt.",
+		Labels: []string{"attempt"},
+	})
 }
@@ -0,0 +1,13 @@
+package kinesis
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestKinesis(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Kinesis Suite Tests")
+}
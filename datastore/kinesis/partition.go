@@ -0,0 +1,81 @@
+package kinesis
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/big"
+	"math/rand/v2"
+)
+
+// PartitionKeyStrategy decides how records are spread across the shards of a stream
+type PartitionKeyStrategy string
+
+const (
+	// PartitionByVin sends the records of a vehicle to a single shard, preserving their order
+	PartitionByVin PartitionKeyStrategy = "vin"
+	// PartitionRandom spreads records evenly across shards regardless of their vehicle
+	PartitionRandom PartitionKeyStrategy = "random"
+	// PartitionByVinHashBucket spreads the records of a vehicle across a fixed number of hash keys,
+	// their order is only preserved within a bucket
+	PartitionByVinHashBucket PartitionKeyStrategy = "vin_hash_bucketed"
+)
+
+// hashKeySpace is the size of the kinesis hash key range, shards own contiguous ranges of it
+var hashKeySpace = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// partitioner computes the explicit hash key which overrides the md5 of the vin partition key
+type partitioner struct {
+	strategy PartitionKeyStrategy
+	buckets  int
+}
+
+func newPartitioner(strategy PartitionKeyStrategy, buckets int) (*partitioner, error) {
+	if err := strategy.Validate(buckets); err != nil {
+		return nil, err
+	}
+	return &partitioner{strategy: strategy, buckets: buckets}, nil
+}
+
+// Validate returns an error if the strategy is unknown or buckets is not supported by the strategy
+func (s PartitionKeyStrategy) Validate(buckets int) error {
+	switch s {
+	case "", PartitionByVin, PartitionRandom:
+	case PartitionByVinHashBucket:
+		if buckets < 1 {
+			return fmt.Errorf("partition_key_buckets must be positive with the %s strategy", s)
+		}
+	default:
+		return fmt.Errorf("invalid partition_key_strategy: %s", s)
+	}
+	return nil
+}
+
+// explicitHashKey returns the hash key of a record of the vin, nil lets kinesis hash the partition key
+func (p *partitioner) explicitHashKey(vin string) *string {
+	var hashKey *big.Int
+	switch p.strategy {
+	case PartitionRandom:
+		hashKey = new(big.Int).Lsh(new(big.Int).SetUint64(rand.Uint64()), 64)
+		hashKey.Or(hashKey, new(big.Int).SetUint64(rand.Uint64()))
+	case PartitionByVinHashBucket:
+		// the buckets of a vin are evenly spaced from the hash key kinesis would have used for it
+		checksum := md5.Sum([]byte(vin))
+		offset := new(big.Int).Div(hashKeySpace, big.NewInt(int64(p.buckets)))
+		offset.Mul(offset, big.NewInt(int64(rand.IntN(p.buckets))))
+		hashKey = new(big.Int).SetBytes(checksum[:])
+		hashKey.Add(hashKey, offset).Mod(hashKey, hashKeySpace)
+	default:
+		return nil
+	}
+	explicitHashKey := hashKey.String()
+	return &explicitHashKey
+}
+
+// aggregationKey returns the key of the aggregated batch the records of the vin are added to. Only the random strategy
+// aggregates the records of different vehicles, the others keep a batch per vin so its records stay on its shards
+func (p *partitioner) aggregationKey(vin string) string {
+	if p.strategy == PartitionRandom {
+		return ""
+	}
+	return vin
+}
@@ -0,0 +1,85 @@
+package kinesis
+
+import (
+	"fmt"
+	"math/big"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// shardCounts counts the records sent to each of the shards evenly splitting the hash key space
+func shardCounts(p *partitioner, shards int, vins []string, recordsPerVin int) []int {
+	counts := make([]int, shards)
+	shardSize := new(big.Int).Div(hashKeySpace, big.NewInt(int64(shards)))
+	for _, vin := range vins {
+		for i := 0; i < recordsPerVin; i++ {
+			hashKey, ok := new(big.Int).SetString(*p.explicitHashKey(vin), 10)
+			Expect(ok).To(BeTrue())
+			Expect(hashKey.Sign()).To(BeNumerically(">=", 0))
+			Expect(hashKey.Cmp(hashKeySpace)).To(Equal(-1))
+			counts[new(big.Int).Div(hashKey, shardSize).Int64()]++
+		}
+	}
+	return counts
+}
+
+var _ = Describe("partitioner", func() {
+	It("lets kinesis hash the vin by default", func() {
+		p, err := newPartitioner("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.explicitHashKey("VIN42")).To(BeNil())
+
+		p, err = newPartitioner(PartitionByVin, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.explicitHashKey("VIN42")).To(BeNil())
+	})
+
+	It("spreads records of a single vehicle evenly with the random strategy", func() {
+		p, err := newPartitioner(PartitionRandom, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, count := range shardCounts(p, 8, []string{"VIN42"}, 80000) {
+			Expect(count).To(BeNumerically("~", 10000, 500))
+		}
+	})
+
+	It("spreads a vehicle across its buckets", func() {
+		p, err := newPartitioner(PartitionByVinHashBucket, 4)
+		Expect(err).NotTo(HaveOccurred())
+
+		hashKeys := map[string]struct{}{}
+		for i := 0; i < 1000; i++ {
+			hashKeys[*p.explicitHashKey("VIN42")] = struct{}{}
+		}
+		Expect(hashKeys).To(HaveLen(4))
+
+		counts := shardCounts(p, 4, []string{"VIN42"}, 40000)
+		for _, count := range counts {
+			Expect(count).To(BeNumerically("~", 10000, 500))
+		}
+	})
+
+	It("spreads a fleet evenly with the bucketed strategy", func() {
+		p, err := newPartitioner(PartitionByVinHashBucket, 4)
+		Expect(err).NotTo(HaveOccurred())
+
+		vins := make([]string, 4000)
+		for i := range vins {
+			vins[i] = fmt.Sprintf("5YJ3E1EA%09d", i)
+		}
+		for _, count := range shardCounts(p, 16, vins, 20) {
+			Expect(count).To(BeNumerically("~", 5000, 500))
+		}
+	})
+
+	It("rejects unknown strategies", func() {
+		_, err := newPartitioner("round_robin", 0)
+		Expect(err).To(MatchError("invalid partition_key_strategy: round_robin"))
+	})
+
+	It("requires buckets with the bucketed strategy", func() {
+		_, err := newPartitioner(PartitionByVinHashBucket, 0)
+		Expect(err).To(MatchError("partition_key_buckets must be positive with the vin_hash_bucketed strategy"))
+	})
+})
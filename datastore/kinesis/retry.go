@@ -0,0 +1,133 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	defaultBackoffInitialInterval = 100 * time.Millisecond
+	defaultBackoffMaxInterval     = 5 * time.Second
+	defaultBackoffRecordDeadline  = 10 * time.Second
+)
+
+// Backoff retries the writes failing with a throttling or transient error with exponential backoff and full jitter,
+// instead of the immediate retries of the aws sdk
+type Backoff struct {
+	// InitialInterval is the max wait in milliseconds before the first retry, doubled on each attempt. Defaults to 100
+	InitialInterval int `json:"initial_interval,omitempty"`
+
+	// MaxInterval caps the wait in milliseconds between two attempts, defaults to 5000
+	MaxInterval int `json:"max_interval,omitempty"`
+
+	// RecordDeadline is the max time in milliseconds spent writing a record, retries included. Defaults to 10000
+	RecordDeadline int `json:"record_deadline,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (b *Backoff) Validate() error {
+	if b.InitialInterval < 0 || b.MaxInterval < 0 || b.RecordDeadline < 0 {
+		return fmt.Errorf("invalid kinesis backoff: intervals and deadline cannot be negative")
+	}
+	if b.MaxInterval > 0 && b.InitialInterval > b.MaxInterval {
+		return fmt.Errorf("kinesis backoff initial_interval (%d) cannot exceed max_interval (%d)", b.InitialInterval, b.MaxInterval)
+	}
+	return nil
+}
+
+// retrier runs kinesis writes until they succeed, fail with an error which is not retryable,
+// exhaust the retries or reach the record deadline
+type retrier struct {
+	maxRetries      int
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	deadline        time.Duration
+}
+
+// newRetrier returns a retrier for the backoff config, writes are not retried when it is nil
+func newRetrier(maxRetries int, backoff *Backoff) *retrier {
+	if backoff == nil {
+		return &retrier{}
+	}
+	r := &retrier{
+		maxRetries:      maxRetries,
+		initialInterval: defaultBackoffInitialInterval,
+		maxInterval:     defaultBackoffMaxInterval,
+		deadline:        defaultBackoffRecordDeadline,
+	}
+	if backoff.InitialInterval > 0 {
+		r.initialInterval = time.Duration(backoff.InitialInterval) * time.Millisecond
+	}
+	if backoff.MaxInterval > 0 {
+		r.maxInterval = time.Duration(backoff.MaxInterval) * time.Millisecond
+	}
+	if backoff.RecordDeadline > 0 {
+		r.deadline = time.Duration(backoff.RecordDeadline) * time.Millisecond
+	}
+	return r
+}
+
+// do calls write until it succeeds or must not be retried, it returns the error of the last attempt
+func (r *retrier) do(ctx context.Context, write func(ctx context.Context) error) error {
+	if r.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.deadline)
+		defer cancel()
+	}
+	for attempt := 1; ; attempt++ {
+		err := write(ctx)
+		if err == nil || attempt > r.maxRetries || !isRetryable(err) {
+			return err
+		}
+		metricsRegistry.retryCount.Inc(map[string]string{"attempt": attemptBucket(attempt)})
+		timer := time.NewTimer(r.wait(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// wait returns a random duration up to the exponential backoff of the attempt
+func (r *retrier) wait(attempt int) time.Duration {
+	backoff := r.maxInterval
+	if attempt < 32 && r.initialInterval<<(attempt-1) < r.maxInterval {
+		backoff = r.initialInterval << (attempt - 1)
+	}
+	return time.Duration(rand.Int64N(int64(backoff)) + 1)
+}
+
+// attemptBucket labels the retry metric with a bounded number of values
+func attemptBucket(attempt int) string {
+	switch {
+	case attempt <= 3:
+		return fmt.Sprint(attempt)
+	case attempt <= 5:
+		return "4-5"
+	default:
+		return "6+"
+	}
+}
+
+// isRetryable returns true for throttling and transient service errors
+func isRetryable(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case kinesis.ErrCodeProvisionedThroughputExceededException, kinesis.ErrCodeLimitExceededException,
+		kinesis.ErrCodeInternalFailureException, kinesis.ErrCodeKMSThrottlingException, "InternalFailure", "ServiceUnavailable":
+		return true
+	}
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
@@ -0,0 +1,151 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var errThrottled = awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "rate exceeded", nil)
+
+// throttlingKinesis fails the first throttled calls, then accepts the records
+type throttlingKinesis struct {
+	kinesisiface.KinesisAPI
+	throttled int
+	err       error
+	calls     int
+	batches   [][]*kinesis.PutRecordsRequestEntry
+}
+
+func (k *throttlingKinesis) PutRecordWithContext(_ aws.Context, _ *kinesis.PutRecordInput, _ ...request.Option) (*kinesis.PutRecordOutput, error) {
+	k.calls++
+	if k.calls <= k.throttled {
+		return nil, k.err
+	}
+	return &kinesis.PutRecordOutput{ShardId: aws.String("shard-1"), SequenceNumber: aws.String("1")}, nil
+}
+
+// PutRecordsWithContext throttles the first record of the request during the throttled calls
+func (k *throttlingKinesis) PutRecordsWithContext(_ aws.Context, input *kinesis.PutRecordsInput, _ ...request.Option) (*kinesis.PutRecordsOutput, error) {
+	k.calls++
+	k.batches = append(k.batches, input.Records)
+	output := &kinesis.PutRecordsOutput{}
+	for i := range input.Records {
+		result := &kinesis.PutRecordsResultEntry{ShardId: aws.String("shard-1"), SequenceNumber: aws.String("1")}
+		if i == 0 && k.calls <= k.throttled {
+			result = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException), ErrorMessage: aws.String("rate exceeded")}
+		}
+		output.Records = append(output.Records, result)
+	}
+	return output, nil
+}
+
+var _ = Describe("retries", func() {
+	var (
+		api      *throttlingKinesis
+		producer *Producer
+	)
+
+	newTestProducer := func(maxRetries int, backoff *Backoff) {
+		registerMetricsOnce(noop.NewCollector())
+		logger, _ := logrus.NoOpLogger()
+		partitioner, err := newPartitioner(PartitionByVin, 0)
+		Expect(err).NotTo(HaveOccurred())
+		producer = &Producer{
+			kinesis:         api,
+			retrier:         newRetrier(maxRetries, backoff),
+			logger:          logger,
+			streams:         map[string]string{"V": "stream_V"},
+			airbrakeHandler: airbrake.NewAirbrakeHandler(nil),
+			partitioner:     partitioner,
+		}
+	}
+
+	BeforeEach(func() {
+		api = &throttlingKinesis{throttled: 2, err: errThrottled}
+	})
+
+	It("retries throttled records until they succeed", func() {
+		newTestProducer(3, &Backoff{InitialInterval: 1, MaxInterval: 5})
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "VIN42"})).To(Succeed())
+		Expect(api.calls).To(Equal(3))
+	})
+
+	It("gives up after max retries", func() {
+		newTestProducer(1, &Backoff{InitialInterval: 1, MaxInterval: 5})
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "VIN42"})).To(MatchError(errThrottled))
+		Expect(api.calls).To(Equal(2))
+	})
+
+	It("does not retry without backoff", func() {
+		newTestProducer(3, nil)
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "VIN42"})).To(MatchError(errThrottled))
+		Expect(api.calls).To(Equal(1))
+	})
+
+	It("does not retry errors which are not retryable", func() {
+		api.err = awserr.New(kinesis.ErrCodeResourceNotFoundException, "stream not found", nil)
+		newTestProducer(3, &Backoff{InitialInterval: 1, MaxInterval: 5})
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "VIN42"})).To(HaveOccurred())
+		Expect(api.calls).To(Equal(1))
+	})
+
+	It("stops retrying at the record deadline", func() {
+		api.throttled = 100
+		newTestProducer(100, &Backoff{InitialInterval: 20, MaxInterval: 20, RecordDeadline: 50})
+		Expect(producer.Produce(&telemetry.Record{TxType: "V", Vin: "VIN42"})).To(MatchError(errThrottled))
+		Expect(api.calls).To(BeNumerically("<", 10))
+	})
+
+	It("retries only the throttled records of a batch", func() {
+		newTestProducer(3, &Backoff{InitialInterval: 1, MaxInterval: 5})
+		first := &telemetry.Record{TxType: "V", Vin: "VIN1", PayloadBytes: []byte("1")}
+		second := &telemetry.Record{TxType: "V", Vin: "VIN2", PayloadBytes: []byte("2")}
+		Expect(producer.ProduceBatch([]*telemetry.Record{first, second})).To(Succeed())
+
+		Expect(api.batches).To(HaveLen(3))
+		Expect(api.batches[0]).To(HaveLen(2))
+		Expect(api.batches[1]).To(HaveLen(1))
+		Expect(api.batches[1][0].Data).To(Equal([]byte("1")))
+	})
+
+	It("reports the records of a batch still throttled after max retries", func() {
+		newTestProducer(1, &Backoff{InitialInterval: 1, MaxInterval: 5})
+		first := &telemetry.Record{TxType: "V", Vin: "VIN1", PayloadBytes: []byte("1")}
+		second := &telemetry.Record{TxType: "V", Vin: "VIN2", PayloadBytes: []byte("2")}
+		err := producer.ProduceBatch([]*telemetry.Record{first, second})
+
+		var batchErr *telemetry.BatchError
+		Expect(errors.As(err, &batchErr)).To(BeTrue())
+		Expect(batchErr.Failed).To(HaveLen(1))
+		Expect(batchErr.Failed).To(HaveKey(first.CorrelationID()))
+	})
+
+	It("buckets the retry attempts", func() {
+		Expect(attemptBucket(1)).To(Equal("1"))
+		Expect(attemptBucket(5)).To(Equal("4-5"))
+		Expect(attemptBucket(9)).To(Equal("6+"))
+	})
+
+	It("waits at most the exponential backoff", func() {
+		r := newRetrier(5, &Backoff{InitialInterval: 10, MaxInterval: 30})
+		for i := 0; i < 100; i++ {
+			Expect(r.wait(1)).To(BeNumerically("<=", 10*1000*1000))
+			Expect(r.wait(4)).To(BeNumerically("<=", 30*1000*1000))
+		}
+		Expect(r.do(context.Background(), func(context.Context) error { return nil })).To(Succeed())
+	})
+})
@@ -0,0 +1,291 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	defaultSubjectTemplate = "{namespace}.{txtype}.{vin}"
+	defaultPublishTimeout  = 5 * time.Second
+	defaultReconnectWait   = 2 * time.Second
+)
+
+// Config contains the data necessary to configure a nats producer
+type Config struct {
+	// URL of the nats servers, comma separated
+	URL string `json:"url"`
+
+	// SubjectTemplate names the subject of a record, {namespace}, {txtype} and {vin} are replaced.
+	// Defaults to {namespace}.{txtype}.{vin}
+	SubjectTemplate string `json:"subject_template,omitempty"`
+
+	// JetStream publishes to the streams bound to the subjects and waits for their ack
+	JetStream bool `json:"jetstream,omitempty"`
+
+	// CredentialsFile is the user credentials file used to authenticate
+	CredentialsFile string `json:"credentials_file,omitempty"`
+
+	// TLS enables TLS with optional CA and client certificate files
+	TLS *TLS `json:"tls,omitempty"`
+
+	// PublishTimeout is the max time in milliseconds to wait for a JetStream ack, defaults to 5000
+	PublishTimeout int `json:"publish_timeout,omitempty"`
+
+	// MaxReconnects is the number of reconnect attempts after a disconnection, unlimited when 0
+	MaxReconnects int `json:"max_reconnects,omitempty"`
+
+	// ReconnectWait is the time in milliseconds between reconnect attempts, defaults to 2000
+	ReconnectWait int `json:"reconnect_wait,omitempty"`
+}
+
+// TLS contains the certificate files used to connect to nats
+type TLS struct {
+	CAFile   string `json:"ca_file,omitempty"`
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// Producer publishes records to nats subjects
+type Producer struct {
+	conn               *nats.Conn
+	jetStream          jetstream.JetStream
+	subjectTemplate    string
+	publishTimeout     time.Duration
+	namespace          string
+	logger             *logrus.Logger
+	airbrakeHandler    *airbrake.Handler
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+	produceErrors      *telemetry.ProduceErrorCounter
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	publishCount     adapter.Counter
+	byteTotal        adapter.Counter
+	errorCount       adapter.Counter
+	reconnectCount   adapter.Counter
+	reliableAckCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	if c.URL == "" {
+		return errors.New("nats url cannot be empty")
+	}
+	return nil
+}
+
+// NewProducer connects to nats and returns a producer publishing records to subjects
+func NewProducer(config *Config, metricsCollector metrics.MetricCollector, namespace string, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+	registerMetricsOnce(metricsCollector)
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	reconnectWait := defaultReconnectWait
+	if config.ReconnectWait > 0 {
+		reconnectWait = time.Duration(config.ReconnectWait) * time.Millisecond
+	}
+	maxReconnects := config.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = -1
+	}
+	options := []nats.Option{
+		nats.Name("fleet-telemetry"),
+		nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(reconnectWait),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.ErrorLog("nats_disconnected", err, nil)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			metricsRegistry.reconnectCount.Inc(map[string]string{})
+			logger.ActivityLog("nats_reconnected", logrus.LogInfo{"url": conn.ConnectedUrlRedacted()})
+		}),
+	}
+	if config.CredentialsFile != "" {
+		options = append(options, nats.UserCredentials(config.CredentialsFile))
+	}
+	if config.TLS != nil {
+		if config.TLS.CAFile != "" {
+			options = append(options, nats.RootCAs(config.TLS.CAFile))
+		}
+		if config.TLS.CertFile != "" || config.TLS.KeyFile != "" {
+			options = append(options, nats.ClientCert(config.TLS.CertFile, config.TLS.KeyFile))
+		}
+	}
+
+	conn, err := nats.Connect(config.URL, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	producer := &Producer{
+		produceErrors:      telemetry.NewProduceErrorCounter(telemetry.NATS, metricsCollector),
+		conn:               conn,
+		subjectTemplate:    config.SubjectTemplate,
+		publishTimeout:     defaultPublishTimeout,
+		namespace:          namespace,
+		logger:             logger,
+		airbrakeHandler:    airbrakeHandler,
+		ackChan:            ackChan,
+		reliableAckTxTypes: reliableAckTxTypes,
+	}
+	if producer.subjectTemplate == "" {
+		producer.subjectTemplate = defaultSubjectTemplate
+	}
+	if config.PublishTimeout > 0 {
+		producer.publishTimeout = time.Duration(config.PublishTimeout) * time.Millisecond
+	}
+	if config.JetStream {
+		if producer.jetStream, err = jetstream.New(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	logger.ActivityLog("nats_registered", logrus.LogInfo{"url": conn.ConnectedUrlRedacted(), "jetstream": config.JetStream, "namespace": namespace})
+	return producer, nil
+}
+
+// Produce publishes the record to its subject
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.publishTimeout)
+	defer cancel()
+	return p.ProduceContext(ctx, entry)
+}
+
+// ProduceContext publishes the record to its subject, JetStream acks are awaited until ctx is done
+func (p *Producer) ProduceContext(ctx context.Context, entry *telemetry.Record) error {
+	entry.ProduceTime = time.Now()
+	msg := &nats.Msg{
+		Subject: p.subject(entry),
+		Data:    entry.Payload(),
+		Header:  nats.Header{},
+	}
+	for key, value := range entry.Metadata() {
+		msg.Header.Set(key, value)
+	}
+
+	var err error
+	if p.jetStream != nil {
+		_, err = p.jetStream.PublishMsg(ctx, msg)
+	} else {
+		err = p.conn.PublishMsg(msg)
+	}
+	if err != nil {
+		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		p.produceErrors.Inc(err)
+		p.reportRecordError("nats_err", err, entry, logrus.LogInfo{"subject": msg.Subject})
+		return err
+	}
+	p.ProcessReliableAck(entry)
+	metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
+	metricsRegistry.byteTotal.Add(int64(len(msg.Data)), map[string]string{"record_type": entry.TxType})
+	return nil
+}
+
+// subject renders the subject template of the record, empty tokens such as the namespace when it isn't set are dropped
+// since nats rejects subjects like ".V.vin"
+func (p *Producer) subject(entry *telemetry.Record) string {
+	subject := strings.NewReplacer("{namespace}", p.namespace, "{txtype}", entry.TxType, "{vin}", entry.Vin).Replace(p.subjectTemplate)
+	tokens := strings.Split(subject, ".")
+	nonEmpty := tokens[:0]
+	for _, token := range tokens {
+		if token != "" {
+			nonEmpty = append(nonEmpty, token)
+		}
+	}
+	return strings.Join(nonEmpty, ".")
+}
+
+// CheckHealth returns an error while the connection to the server is down
+func (p *Producer) CheckHealth(_ context.Context) error {
+	if !p.conn.IsConnected() {
+		return fmt.Errorf("nats connection %s", p.conn.Status())
+	}
+	return nil
+}
+
+// Close flushes pending messages and closes the connection
+func (p *Producer) Close() error {
+	return p.conn.Drain()
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+	}
+}
+
+// ReportError to airbrake and logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.airbrakeHandler.ReportLogMessage(logrus.ERROR, message, err, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(telemetry.NATS), Namespace: p.namespace}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.publishCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "nats_publish_total",
+		Help:   "The number of records published to nats.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.byteTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "nats_publish_total_bytes",
+		Help:   "The number of payload bytes published to nats.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "nats_err",
+		Help:   "The number of errors while publishing records to nats.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.reconnectCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "nats_reconnect_total",
+		Help:   "The number of times the nats connection was reestablished.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "nats_reliable_ack_total",
+		Help:   "The number of records published to nats for which we sent a reliable ACK.",
+		Labels: []string{"record_type"},
+	})
+}
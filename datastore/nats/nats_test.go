@@ -0,0 +1,149 @@
+package nats_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsclient "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/nats"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Producer", func() {
+	var (
+		natsServer *server.Server
+		conn       *natsclient.Conn
+		config     *nats.Config
+		record     *telemetry.Record
+	)
+
+	newProducer := func() telemetry.Producer {
+		logger, _ := logrus.NoOpLogger()
+		producer, err := nats.NewProducer(config, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+		return producer
+	}
+
+	BeforeEach(func() {
+		var err error
+		natsServer, err = server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: GinkgoT().TempDir(), NoLog: true, NoSigs: true})
+		Expect(err).NotTo(HaveOccurred())
+		natsServer.Start()
+		Expect(natsServer.ReadyForConnections(5 * time.Second)).To(BeTrue())
+		DeferCleanup(natsServer.Shutdown)
+
+		conn, err = natsclient.Connect(natsServer.ClientURL())
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+
+		config = &nats.Config{URL: natsServer.ClientURL()}
+		record = &telemetry.Record{TxType: "V", Vin: "VIN42", Txid: "txid-42", PayloadBytes: []byte("data")}
+	})
+
+	It("publishes records to the subject of their type and vin", func() {
+		sub, err := conn.SubscribeSync("tesla_telemetry.V.VIN42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Flush()).To(Succeed())
+
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+
+		msg, err := sub.NextMsg(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg.Data).To(Equal([]byte("data")))
+		Expect(msg.Header.Get("vin")).To(Equal("VIN42"))
+		Expect(msg.Header.Get("txtype")).To(Equal("V"))
+	})
+
+	It("names subjects from the template", func() {
+		sub, err := conn.SubscribeSync("telemetry.VIN42.V")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Flush()).To(Succeed())
+
+		config.SubjectTemplate = "telemetry.{vin}.{txtype}"
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+
+		_, err = sub.NextMsg(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("drops the namespace from the subject when it is empty", func() {
+		sub, err := conn.SubscribeSync("V.VIN42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Flush()).To(Succeed())
+
+		logger, _ := logrus.NoOpLogger()
+		producer, err := nats.NewProducer(config, noop.NewCollector(), "", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+		Expect(producer.Produce(record)).To(Succeed())
+
+		_, err = sub.NextMsg(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("with jetstream", func() {
+		BeforeEach(func() {
+			config.JetStream = true
+		})
+
+		It("stores records in the stream", func() {
+			js, err := jetstream.New(conn)
+			Expect(err).NotTo(HaveOccurred())
+			stream, err := js.CreateStream(context.Background(), jetstream.StreamConfig{Name: "telemetry", Subjects: []string{"tesla_telemetry.>"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			producer := newProducer()
+			Expect(producer.Produce(record)).To(Succeed())
+
+			info, err := stream.Info(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.State.Msgs).To(Equal(uint64(1)))
+		})
+
+		It("fails when no stream is bound to the subject", func() {
+			config.PublishTimeout = 200
+			producer := newProducer()
+			Expect(producer.Produce(record)).NotTo(Succeed())
+		})
+	})
+
+	It("reports its connection health", func() {
+		logger, _ := logrus.NoOpLogger()
+		producer, err := nats.NewProducer(config, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() { _ = producer.Close() })
+		checker := producer.(telemetry.HealthChecker)
+		Expect(checker.CheckHealth(context.Background())).To(Succeed())
+
+		natsServer.Shutdown()
+		Eventually(func() error { return checker.CheckHealth(context.Background()) }).Should(HaveOccurred())
+	})
+
+	It("acks reliable records", func() {
+		logger, _ := logrus.NoOpLogger()
+		ackChan := make(chan *telemetry.Record, 1)
+		producer, err := nats.NewProducer(config, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"V": true}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		defer producer.Close()
+
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(ackChan).To(Receive(Equal(record)))
+	})
+
+	It("requires a url", func() {
+		logger, _ := logrus.NoOpLogger()
+		_, err := nats.NewProducer(&nats.Config{}, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).To(MatchError("nats url cannot be empty"))
+	})
+})
@@ -0,0 +1,92 @@
+package null
+
+import (
+	"sync"
+	"sync/atomic"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// Producer counts and discards the records dispatched to it, to measure the throughput of the server
+// without the cost of a datastore
+type Producer struct {
+	records            atomic.Int64
+	bytes              atomic.Int64
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	recordCount      adapter.Counter
+	reliableAckCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// NewProducer returns a producer discarding records, the records of reliableAckTxTypes are acked right away
+func NewProducer(metricsCollector metrics.MetricCollector, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}) *Producer {
+	registerMetricsOnce(metricsCollector)
+	return &Producer{ackChan: ackChan, reliableAckTxTypes: reliableAckTxTypes}
+}
+
+// Produce counts the record and drops it
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	p.records.Add(1)
+	p.bytes.Add(int64(entry.Length()))
+	metricsRegistry.recordCount.Inc(map[string]string{"record_type": entry.TxType})
+	p.ProcessReliableAck(entry)
+	return nil
+}
+
+// Records returns the number of records produced
+func (p *Producer) Records() int64 {
+	return p.records.Load()
+}
+
+// Bytes returns the size of the payloads of the records produced
+func (p *Producer) Bytes() int64 {
+	return p.bytes.Load()
+}
+
+// Close noop method
+func (p *Producer) Close() error {
+	return nil
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+	}
+}
+
+// ReportError noop method
+func (p *Producer) ReportError(_ string, _ error, _ logrus.LogInfo) {
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.recordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "null_records_total",
+		Help:   "The number of records discarded by the null datastore.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "null_reliable_ack_total",
+		Help:   "The number of records discarded by the null datastore for which we sent a reliable ACK.",
+		Labels: []string{"record_type"},
+	})
+}
@@ -0,0 +1,13 @@
+package null_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestNull(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Null Suite Tests")
+}
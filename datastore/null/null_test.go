@@ -0,0 +1,32 @@
+package null_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/null"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Producer", func() {
+	It("counts the records it discards", func() {
+		producer := null.NewProducer(noop.NewCollector(), nil, nil)
+		record := &telemetry.Record{TxType: "V", Vin: "42", PayloadBytes: []byte("data")}
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Records()).To(Equal(int64(2)))
+		Expect(producer.Bytes()).To(Equal(int64(8)))
+	})
+
+	It("acks the records of the reliable ack types", func() {
+		ackChan := make(chan *telemetry.Record, 1)
+		producer := null.NewProducer(noop.NewCollector(), ackChan, map[string]interface{}{"V": true})
+		record := &telemetry.Record{TxType: "V", Vin: "42"}
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(ackChan).To(Receive(Equal(record)))
+
+		Expect(producer.Produce(&telemetry.Record{TxType: "alerts", Vin: "42"})).To(Succeed())
+		Expect(ackChan).NotTo(Receive())
+	})
+})
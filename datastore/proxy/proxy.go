@@ -0,0 +1,157 @@
+// Package proxy routes the outbound connections of datastores through an http or socks5 proxy
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Config of the proxy a datastore connects through. Datastores without proxy use the HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY environment variables
+type Config struct {
+	// URL of the proxy, ex.: http://proxy:3128, https://proxy:3129 or socks5://proxy:1080
+	URL string `json:"url"`
+
+	// Username and Password authenticate with the proxy when set, they take precedence over the user of the url
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	_, err := c.parseURL()
+	return err
+}
+
+func (c *Config) parseURL() (*url.URL, error) {
+	proxyURL, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy url %q, expected an http, https or socks5 scheme", c.URL)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy url %q, missing host", c.URL)
+	}
+	if c.Password != "" && c.Username == "" {
+		return nil, errors.New("proxy password requires a username")
+	}
+	if c.Username != "" {
+		proxyURL.User = url.UserPassword(c.Username, c.Password)
+	}
+	return proxyURL, nil
+}
+
+// HTTPClient returns a client sending its requests through the proxy
+func (c *Config) HTTPClient() (*http.Client, error) {
+	proxyURL, err := c.parseURL()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		dialer, err := xproxy.FromURL(proxyURL, xproxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = nil
+		transport.DialContext = dialer.(xproxy.ContextDialer).DialContext
+	default:
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Dialer returns a function opening tcp connections through the proxy, for clients which aren't http based.
+// Http proxies tunnel the connections with CONNECT requests
+func (c *Config) Dialer() (func(ctx context.Context, address string) (net.Conn, error), error) {
+	proxyURL, err := c.parseURL()
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		dialer, err := xproxy.FromURL(proxyURL, xproxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, address string) (net.Conn, error) {
+			return dialer.(xproxy.ContextDialer).DialContext(ctx, "tcp", address)
+		}, nil
+	default:
+		return func(ctx context.Context, address string) (net.Conn, error) {
+			return dialConnect(ctx, proxyURL, address)
+		}, nil
+	}
+}
+
+// dialConnect opens a tunnel to address with a CONNECT request to the http proxy
+func dialConnect(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// the tunnel carries no data before the client speaks, the reader can't buffer past the response
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect to %s: %s", address, response.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// connectTimeout bounds the ping sent to redis when the producer is created
+const connectTimeout = 5 * time.Second
+
+// Config contains the data necessary to configure a redis streams producer
+type Config struct {
+	// Addr is the host:port of the redis server
+	Addr string `json:"addr"`
+
+	// Username and Password authenticate with redis ACLs, Password alone uses AUTH
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// DB is the redis database number
+	DB int `json:"db,omitempty"`
+
+	// PoolSize is the max number of connections, defaults to 10 per CPU
+	PoolSize int `json:"pool_size,omitempty"`
+
+	// StreamTemplate names the stream of a record, {namespace}, {txtype} and {vin} are replaced.
+	// Defaults to {namespace}_{txtype}
+	StreamTemplate string `json:"stream_template,omitempty"`
+
+	// MaxLen approximately trims the streams to this many entries, disabled when 0
+	MaxLen int64 `json:"max_len,omitempty"`
+
+	// TLS enables TLS with optional CA and client certificate files
+	TLS *TLS `json:"tls,omitempty"`
+}
+
+// TLS contains the certificate files used to connect to redis
+type TLS struct {
+	CAFile   string `json:"ca_file,omitempty"`
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// Producer adds records to redis streams
+type Producer struct {
+	client             *redis.Client
+	config             *Config
+	namespace          string
+	logger             *logrus.Logger
+	airbrakeHandler    *airbrake.Handler
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+	produceErrors      *telemetry.ProduceErrorCounter
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	publishCount     adapter.Counter
+	byteTotal        adapter.Counter
+	errorCount       adapter.Counter
+	reliableAckCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// Validate returns an error if the config contains unsupported values or unreadable certificate files
+func (c *Config) Validate() error {
+	if c.Addr == "" {
+		return errors.New("redis addr cannot be empty")
+	}
+	if c.TLS != nil {
+		if _, err := c.TLS.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewProducer connects to redis and returns a producer adding records to streams
+func NewProducer(config *Config, metricsCollector metrics.MetricCollector, namespace string, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+	registerMetricsOnce(metricsCollector)
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	options := &redis.Options{
+		Addr:     config.Addr,
+		Username: config.Username,
+		Password: config.Password,
+		DB:       config.DB,
+		PoolSize: config.PoolSize,
+	}
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("redis ping: %w", err)
+	}
+
+	logger.ActivityLog("redis_registered", logrus.LogInfo{"addr": config.Addr, "namespace": namespace})
+	return &Producer{
+		produceErrors:      telemetry.NewProduceErrorCounter(telemetry.Redis, metricsCollector),
+		client:             client,
+		config:             config,
+		namespace:          namespace,
+		logger:             logger,
+		airbrakeHandler:    airbrakeHandler,
+		ackChan:            ackChan,
+		reliableAckTxTypes: reliableAckTxTypes,
+	}, nil
+}
+
+func (t *TLS) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		caCert, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in redis ca_file: %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Produce adds the record to its stream
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	return p.ProduceContext(context.Background(), entry)
+}
+
+// ProduceContext adds the record to its stream, the write is canceled when ctx is done
+func (p *Producer) ProduceContext(ctx context.Context, entry *telemetry.Record) error {
+	entry.ProduceTime = time.Now()
+	payload := entry.Payload()
+	args := &redis.XAddArgs{
+		Stream: p.streamName(entry),
+		Values: []interface{}{"vin", entry.Vin, "txtype", entry.TxType, "txid", entry.Txid, "payload", payload},
+	}
+	if p.config.MaxLen > 0 {
+		args.MaxLen = p.config.MaxLen
+		args.Approx = true
+	}
+
+	if err := p.client.XAdd(ctx, args).Err(); err != nil {
+		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		p.produceErrors.Inc(err)
+		p.reportRecordError("redis_err", err, entry, logrus.LogInfo{"stream": args.Stream})
+		return err
+	}
+	p.ProcessReliableAck(entry)
+	metricsRegistry.publishCount.Inc(map[string]string{"record_type": entry.TxType})
+	metricsRegistry.byteTotal.Add(int64(len(payload)), map[string]string{"record_type": entry.TxType})
+	return nil
+}
+
+func (p *Producer) streamName(entry *telemetry.Record) string {
+	if p.config.StreamTemplate == "" {
+		return telemetry.BuildTopicName(p.namespace, entry.TxType)
+	}
+	return strings.NewReplacer("{namespace}", p.namespace, "{txtype}", entry.TxType, "{vin}", entry.Vin).Replace(p.config.StreamTemplate)
+}
+
+// CheckHealth pings the redis server
+func (p *Producer) CheckHealth(ctx context.Context) error {
+	return p.client.Ping(ctx).Err()
+}
+
+// Close the redis connection pool
+func (p *Producer) Close() error {
+	return p.client.Close()
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+	}
+}
+
+// ReportError to airbrake and logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.airbrakeHandler.ReportLogMessage(logrus.ERROR, message, err, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(telemetry.Redis), Namespace: p.namespace}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.publishCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "redis_publish_total",
+		Help:   "The number of records added to redis streams.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.byteTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "redis_publish_total_bytes",
+		Help:   "The number of payload bytes added to redis streams.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "redis_err",
+		Help:   "The number of errors while adding records to redis streams.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "redis_reliable_ack_total",
+		Help:   "The number of records added to redis streams for which we sent a reliable ACK.",
+		Labels: []string{"record_type"},
+	})
+}
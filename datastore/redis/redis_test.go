@@ -0,0 +1,91 @@
+package redis_test
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/redis"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Producer", func() {
+	var (
+		server *miniredis.Miniredis
+		config *redis.Config
+		record *telemetry.Record
+	)
+
+	newProducer := func() telemetry.Producer {
+		logger, _ := logrus.NoOpLogger()
+		producer, err := redis.NewProducer(config, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(producer.Close)
+		return producer
+	}
+
+	BeforeEach(func() {
+		server = miniredis.RunT(GinkgoT())
+		config = &redis.Config{Addr: server.Addr()}
+		record = &telemetry.Record{TxType: "V", Vin: "VIN42", Txid: "txid-42", PayloadBytes: []byte("data")}
+	})
+
+	It("adds records to the stream of their type", func() {
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+
+		entries, err := server.Stream("tesla_telemetry_V")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Values).To(Equal([]string{"vin", "VIN42", "txtype", "V", "txid", "txid-42", "payload", "data"}))
+	})
+
+	It("names streams from the template", func() {
+		config.StreamTemplate = "telemetry:{vin}:{txtype}"
+		producer := newProducer()
+		Expect(producer.Produce(record)).To(Succeed())
+
+		entries, err := server.Stream("telemetry:VIN42:V")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("trims streams to max len", func() {
+		config.MaxLen = 2
+		producer := newProducer()
+		for i := 0; i < 5; i++ {
+			Expect(producer.Produce(record)).To(Succeed())
+		}
+
+		entries, err := server.Stream("tesla_telemetry_V")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(entries)).To(BeNumerically("<", 5))
+	})
+
+	It("acks reliable records", func() {
+		logger, _ := logrus.NoOpLogger()
+		ackChan := make(chan *telemetry.Record, 1)
+		producer, err := redis.NewProducer(config, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"V": true}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		defer producer.Close()
+
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(ackChan).To(Receive(Equal(record)))
+	})
+
+	It("fails when redis is unreachable", func() {
+		server.Close()
+		logger, _ := logrus.NoOpLogger()
+		_, err := redis.NewProducer(config, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("requires an address", func() {
+		logger, _ := logrus.NoOpLogger()
+		_, err := redis.NewProducer(&redis.Config{}, noop.NewCollector(), "tesla_telemetry", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).To(MatchError("redis addr cannot be empty"))
+	})
+})
@@ -0,0 +1,618 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/file"
+	"github.com/teslamotors/fleet-telemetry/datastore/proxy"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// Format is the encoding of the records in the objects
+type Format string
+
+const (
+	// ProtobufFormat writes length prefixed record entries, the format of the file datastore
+	ProtobufFormat Format = "protobuf"
+	// JSONFormat writes the json payload of each record on its own line
+	JSONFormat Format = "json"
+
+	defaultKeyTemplate        = "{namespace}/{txtype}/{date}"
+	defaultMaxObjectSize      = 64 * 1024 * 1024
+	defaultFlushInterval      = 300 * time.Second
+	defaultMaxOpenObjects     = 1024
+	defaultUploadRetries      = 3
+	defaultUploadRetryBackoff = time.Second
+
+	// flushCheckInterval is how often objects are checked against the flush interval
+	flushCheckInterval = time.Second
+	// uploadTimeout bounds the upload of an object, including the retries of the client
+	uploadTimeout = 5 * time.Minute
+	// uploadQueueSize is the number of full objects waiting to be uploaded before records are blocked
+	uploadQueueSize = 16
+)
+
+var errProducerClosed = errors.New("s3 producer is closed")
+
+// Config contains the data necessary to configure an s3 producer
+type Config struct {
+	// Bucket receives the record objects
+	Bucket string `json:"bucket"`
+
+	// Region of the bucket, defaults to the AWS config of the environment
+	Region string `json:"region,omitempty"`
+
+	// OverrideHost sends the requests to an s3 compatible endpoint using path style addressing
+	OverrideHost string `json:"override_host,omitempty"`
+
+	// KeyTemplate is the prefix of the object keys, {namespace}, {txtype}, {vin}, {date} (2006-01-02) and {hour} (15)
+	// are replaced using the time the record is received. Defaults to {namespace}/{txtype}/{date}.
+	// With {vin} an object is buffered in memory for each connected vehicle, bounded by max_open_objects
+	KeyTemplate string `json:"key_template,omitempty"`
+
+	// MaxOpenObjects is the number of objects buffered at once, the oldest one is uploaded early when a record
+	// needs a new object. Defaults to 1024
+	MaxOpenObjects int `json:"max_open_objects,omitempty"`
+
+	// Format of the records in the objects: protobuf (default) or json
+	Format Format `json:"format,omitempty"`
+
+	// Compression of the objects: gzip (default), zstd or none
+	Compression file.Compression `json:"compression,omitempty"`
+
+	// CompressionLevel of the compression, defaults to the default level of the compression
+	CompressionLevel int `json:"compression_level,omitempty"`
+
+	// MaxObjectSize uploads an object once it holds this many bytes before compression, defaults to 64mb
+	MaxObjectSize int `json:"max_object_size,omitempty"`
+
+	// FlushInterval uploads an object once it is older than this many seconds, defaults to 300
+	FlushInterval int `json:"flush_interval,omitempty"`
+
+	// UploadRetries is the number of times a failed upload is attempted again, defaults to 3. The records of
+	// objects which still fail are nacked
+	UploadRetries *int `json:"upload_retries,omitempty"`
+
+	// UploadRetryBackoff is the time in milliseconds before the first retry of an upload, doubled for each
+	// following retry, defaults to 1000
+	UploadRetryBackoff int `json:"upload_retry_backoff,omitempty"`
+
+	// ServerSideEncryption is the encryption of the objects at rest: AES256 or aws:kms, defaults to the bucket setting
+	ServerSideEncryption string `json:"server_side_encryption,omitempty"`
+
+	// KMSKeyID is the key encrypting the objects, it implies aws:kms encryption
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	// AssumeRoleARN is a role assumed with the credentials of the environment to write the objects
+	AssumeRoleARN string `json:"assume_role_arn,omitempty"`
+
+	// ExternalID is passed when assuming the role
+	ExternalID string `json:"external_id,omitempty"`
+
+	// Proxy routes the requests to s3 through a proxy, defaults to the proxy environment variables
+	Proxy *proxy.Config `json:"proxy,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	if c.Bucket == "" {
+		return errors.New("s3 bucket cannot be empty")
+	}
+	switch c.Format {
+	case "", ProtobufFormat, JSONFormat:
+	default:
+		return fmt.Errorf("invalid s3 format: %s", c.Format)
+	}
+	switch c.ServerSideEncryption {
+	case "", awss3.ServerSideEncryptionAes256, awss3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("invalid s3 server_side_encryption: %s", c.ServerSideEncryption)
+	}
+	if c.KMSKeyID != "" && c.ServerSideEncryption == awss3.ServerSideEncryptionAes256 {
+		return errors.New("s3 kms_key_id requires aws:kms server_side_encryption")
+	}
+	if c.MaxObjectSize < 0 || c.FlushInterval < 0 {
+		return errors.New("s3 max_object_size and flush_interval cannot be negative")
+	}
+	if c.MaxOpenObjects < 0 || c.UploadRetryBackoff < 0 || (c.UploadRetries != nil && *c.UploadRetries < 0) {
+		return errors.New("s3 max_open_objects, upload_retries and upload_retry_backoff cannot be negative")
+	}
+	if err := c.compression().Validate(c.CompressionLevel); err != nil {
+		return fmt.Errorf("s3: %w", err)
+	}
+	if c.Proxy != nil {
+		if err := c.Proxy.Validate(); err != nil {
+			return fmt.Errorf("s3: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) compression() file.Compression {
+	if c.Compression == "" {
+		return file.GzipCompression
+	}
+	return c.Compression
+}
+
+// object buffers the compressed records sharing a key prefix
+type object struct {
+	prefix   string
+	data     bytes.Buffer
+	writer   file.CompressWriter
+	size     int
+	count    int
+	openedAt time.Time
+	// records acked to the vehicles once the object is uploaded
+	records []*telemetry.Record
+}
+
+// Producer buffers records into compressed objects uploaded to s3
+type Producer struct {
+	config             *Config
+	client             *awss3.S3
+	namespace          string
+	maxObjectSize      int
+	maxOpenObjects     int
+	flushInterval      time.Duration
+	uploadRetries      int
+	uploadRetryBackoff time.Duration
+	objects            map[string]*object
+	lock               sync.Mutex
+	closed             bool
+	closeOnce          sync.Once
+	uploads            chan *object
+	done               chan struct{}
+	flushWg            sync.WaitGroup
+	uploadWg           sync.WaitGroup
+	logger             *logrus.Logger
+	airbrakeHandler    *airbrake.Handler
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+	nacker             *telemetry.Nacker
+	produceErrors      *telemetry.ProduceErrorCounter
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	writeCount        adapter.Counter
+	uploadCount       adapter.Counter
+	uploadBytesTotal  adapter.Counter
+	uploadRecordCount adapter.Counter
+	errorCount        adapter.Counter
+	uploadErrorCount  adapter.Counter
+	uploadRetryCount  adapter.Counter
+	reliableAckCount  adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// NewProducer configures the s3 client and checks the bucket is reachable
+func NewProducer(config *Config, namespace string, metricsCollector metrics.MetricCollector, airbrakeHandler *airbrake.Handler, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, logger *logrus.Logger) (telemetry.Producer, error) {
+	registerMetricsOnce(metricsCollector)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	awsConfig := &aws.Config{CredentialsChainVerboseErrors: aws.Bool(true)}
+	if config.Region != "" {
+		awsConfig = awsConfig.WithRegion(config.Region)
+	}
+	if config.OverrideHost != "" {
+		awsConfig = awsConfig.WithEndpoint(config.OverrideHost).WithS3ForcePathStyle(true)
+	}
+	if config.Proxy != nil {
+		httpClient, err := config.Proxy.HTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		awsConfig = awsConfig.WithHTTPClient(httpClient)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.AssumeRoleARN != "" {
+		awsConfig = awsConfig.WithCredentials(stscreds.NewCredentials(sess, config.AssumeRoleARN, func(provider *stscreds.AssumeRoleProvider) {
+			if config.ExternalID != "" {
+				provider.ExternalID = aws.String(config.ExternalID)
+			}
+		}))
+	}
+
+	client := awss3.New(sess, awsConfig)
+	if _, err := client.HeadBucket(&awss3.HeadBucketInput{Bucket: aws.String(config.Bucket)}); err != nil {
+		return nil, fmt.Errorf("failed to access bucket %s (test connection): %v", config.Bucket, err)
+	}
+
+	producer := &Producer{
+		produceErrors:      telemetry.NewProduceErrorCounter(telemetry.S3, metricsCollector),
+		config:             config,
+		client:             client,
+		namespace:          namespace,
+		maxObjectSize:      config.MaxObjectSize,
+		maxOpenObjects:     config.MaxOpenObjects,
+		flushInterval:      time.Duration(config.FlushInterval) * time.Second,
+		uploadRetries:      defaultUploadRetries,
+		uploadRetryBackoff: time.Duration(config.UploadRetryBackoff) * time.Millisecond,
+		objects:            make(map[string]*object),
+		uploads:            make(chan *object, uploadQueueSize),
+		done:               make(chan struct{}),
+		logger:             logger,
+		airbrakeHandler:    airbrakeHandler,
+		ackChan:            ackChan,
+		reliableAckTxTypes: reliableAckTxTypes,
+		nacker:             telemetry.NewNacker(telemetry.S3, ackChan, reliableAckTxTypes, metricsCollector),
+	}
+	if producer.maxObjectSize == 0 {
+		producer.maxObjectSize = defaultMaxObjectSize
+	}
+	if producer.maxOpenObjects == 0 {
+		producer.maxOpenObjects = defaultMaxOpenObjects
+	}
+	if producer.flushInterval == 0 {
+		producer.flushInterval = defaultFlushInterval
+	}
+	if config.UploadRetries != nil {
+		producer.uploadRetries = *config.UploadRetries
+	}
+	if producer.uploadRetryBackoff == 0 {
+		producer.uploadRetryBackoff = defaultUploadRetryBackoff
+	}
+
+	producer.uploadWg.Add(1)
+	go producer.uploadObjects()
+	producer.flushWg.Add(1)
+	go producer.flushObjects()
+
+	logger.ActivityLog("s3_registered", logrus.LogInfo{"bucket": config.Bucket, "format": producer.format(), "compression": config.compression()})
+	return producer, nil
+}
+
+// Produce appends the record to the object of its key prefix, records are uploaded asynchronously
+// and acked once their object is uploaded
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	entry.ProduceTime = time.Now()
+	logInfo := logrus.LogInfo{"record_type": entry.TxType, "txid": entry.Txid}
+	data, err := p.encode(entry)
+	if err != nil {
+		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		p.produceErrors.IncClass(telemetry.ErrorClassSerialization)
+		p.reportRecordError("s3_encode_error", err, entry, logInfo)
+		return err
+	}
+	prefix := p.keyPrefix(entry)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return errProducerClosed
+	}
+
+	obj, ok := p.objects[prefix]
+	if !ok {
+		if len(p.objects) >= p.maxOpenObjects {
+			p.uploadOldestObject()
+		}
+		obj = &object{prefix: prefix, openedAt: entry.ProduceTime}
+		if obj.writer, err = file.NewCompressWriter(&obj.data, p.config.compression(), p.config.CompressionLevel); err != nil {
+			metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+			p.produceErrors.IncClass(telemetry.ErrorClassSerialization)
+			p.reportRecordError("s3_compress_error", err, entry, logInfo)
+			return err
+		}
+		p.objects[prefix] = obj
+	}
+	if _, err := obj.writer.Write(data); err != nil {
+		metricsRegistry.errorCount.Inc(map[string]string{"record_type": entry.TxType})
+		p.produceErrors.Inc(err)
+		p.reportRecordError("s3_write_error", err, entry, logInfo)
+		return err
+	}
+	obj.size += len(data)
+	obj.count++
+	if _, ok := p.reliableAckTxTypes[entry.TxType]; ok {
+		obj.records = append(obj.records, entry)
+	}
+	metricsRegistry.writeCount.Inc(map[string]string{"record_type": entry.TxType})
+
+	if obj.size >= p.maxObjectSize {
+		delete(p.objects, prefix)
+		// blocks records while the uploads are behind
+		p.uploads <- obj
+	}
+	return nil
+}
+
+// uploadOldestObject queues the object opened first for upload, p.lock must be held
+func (p *Producer) uploadOldestObject() {
+	var oldest *object
+	for _, obj := range p.objects {
+		if oldest == nil || obj.openedAt.Before(oldest.openedAt) {
+			oldest = obj
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(p.objects, oldest.prefix)
+	p.uploads <- oldest
+}
+
+func (p *Producer) format() Format {
+	if p.config.Format == "" {
+		return ProtobufFormat
+	}
+	return p.config.Format
+}
+
+// encode returns the bytes appended to the object for the record
+func (p *Producer) encode(entry *telemetry.Record) ([]byte, error) {
+	if p.format() == ProtobufFormat {
+		return file.AppendEntry(nil, entry), nil
+	}
+	payload, err := entry.EncodePayload(telemetry.JSONFormat)
+	if err != nil {
+		return nil, err
+	}
+	return append(payload, '\n'), nil
+}
+
+// keyPrefix renders the key template for the record
+func (p *Producer) keyPrefix(entry *telemetry.Record) string {
+	template := p.config.KeyTemplate
+	if template == "" {
+		template = defaultKeyTemplate
+	}
+	receivedAt := entry.ProduceTime.UTC()
+	return strings.NewReplacer(
+		"{namespace}", p.namespace,
+		"{txtype}", entry.TxType,
+		"{vin}", entry.Vin,
+		"{date}", receivedAt.Format("2006-01-02"),
+		"{hour}", receivedAt.Format("15"),
+	).Replace(template)
+}
+
+// objectKey appends a unique name to the prefix of the object
+func (p *Producer) objectKey(obj *object) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	extension := ".pb"
+	if p.format() == JSONFormat {
+		extension = ".ndjson"
+	}
+	extension += p.config.compression().Extension()
+	return fmt.Sprintf("%s/%s-%s%s", strings.TrimSuffix(obj.prefix, "/"), obj.openedAt.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(suffix), extension)
+}
+
+// contentType of the objects
+func (p *Producer) contentType() string {
+	switch p.config.compression() {
+	case file.GzipCompression:
+		return "application/gzip"
+	case file.ZstdCompression:
+		return "application/zstd"
+	}
+	if p.format() == JSONFormat {
+		return "application/x-ndjson"
+	}
+	return "application/octet-stream"
+}
+
+// flushObjects queues the objects older than the flush interval for upload
+func (p *Producer) flushObjects() {
+	defer p.flushWg.Done()
+	ticker := time.NewTicker(flushCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.lock.Lock()
+			for prefix, obj := range p.objects {
+				if time.Since(obj.openedAt) >= p.flushInterval {
+					delete(p.objects, prefix)
+					p.uploads <- obj
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+func (p *Producer) uploadObjects() {
+	defer p.uploadWg.Done()
+	for obj := range p.uploads {
+		p.upload(obj)
+	}
+}
+
+// upload writes the object to the bucket and acks its records. Failed uploads are retried with an exponential
+// backoff, the records of objects which can't be uploaded are nacked
+func (p *Producer) upload(obj *object) {
+	key := p.objectKey(obj)
+	logInfo := logrus.LogInfo{"bucket": p.config.Bucket, "key": key, "records": obj.count}
+	if err := obj.writer.Close(); err != nil {
+		metricsRegistry.uploadErrorCount.Inc(map[string]string{})
+		p.produceErrors.IncClass(telemetry.ErrorClassSerialization)
+		p.ReportError("s3_compress_error", err, logInfo)
+		p.nackRecords(obj, err)
+		return
+	}
+
+	backoff := p.uploadRetryBackoff
+	err := p.putObject(key, obj)
+	for attempt := 1; err != nil && attempt <= p.uploadRetries; attempt++ {
+		metricsRegistry.uploadRetryCount.Inc(map[string]string{})
+		p.logger.ErrorLog("s3_upload_retry", err, logrus.LogInfo{"bucket": p.config.Bucket, "key": key, "attempt": attempt, "backoff_ms": backoff.Milliseconds()})
+		time.Sleep(backoff)
+		backoff *= 2
+		err = p.putObject(key, obj)
+	}
+	if err != nil {
+		metricsRegistry.uploadErrorCount.Inc(map[string]string{})
+		p.produceErrors.Inc(err)
+		p.ReportError("s3_upload_error", err, logInfo)
+		p.nackRecords(obj, err)
+		return
+	}
+
+	metricsRegistry.uploadCount.Inc(map[string]string{})
+	metricsRegistry.uploadBytesTotal.Add(int64(obj.data.Len()), map[string]string{})
+	metricsRegistry.uploadRecordCount.Add(int64(obj.count), map[string]string{})
+	for _, record := range obj.records {
+		p.ProcessReliableAck(record)
+	}
+}
+
+// nackRecords releases the records of an object which can't be uploaded, so the vehicles send them again
+func (p *Producer) nackRecords(obj *object, err error) {
+	for _, record := range obj.records {
+		p.nacker.Nack(record, err)
+	}
+}
+
+// putObject sends a single upload request for the object
+func (p *Producer) putObject(key string, obj *object) error {
+	input := &awss3.PutObjectInput{
+		Bucket:      aws.String(p.config.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(obj.data.Bytes()),
+		ContentType: aws.String(p.contentType()),
+		// readers of the objects can tell their compression without relying on the key
+		Metadata: map[string]*string{"compression": aws.String(string(p.config.compression()))},
+	}
+	if p.config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(p.config.ServerSideEncryption)
+	}
+	if p.config.KMSKeyID != "" {
+		input.ServerSideEncryption = aws.String(awss3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(p.config.KMSKeyID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	_, err := p.client.PutObjectWithContext(ctx, input)
+	return err
+}
+
+// Close uploads the buffered objects and waits for the uploads to complete, later calls are no-ops
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.flushWg.Wait()
+
+		p.lock.Lock()
+		p.closed = true
+		for prefix, obj := range p.objects {
+			delete(p.objects, prefix)
+			p.uploads <- obj
+		}
+		p.lock.Unlock()
+
+		close(p.uploads)
+		p.uploadWg.Wait()
+	})
+	return nil
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	if ok {
+		p.ackChan <- entry
+		metricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": entry.TxType})
+	}
+}
+
+// ReportError to airbrake and logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.airbrakeHandler.ReportLogMessage(logrus.ERROR, message, err, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(telemetry.S3), Namespace: p.namespace}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.writeCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_write_total",
+		Help:   "The number of records buffered for upload to s3.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.uploadCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_upload_total",
+		Help:   "The number of objects uploaded to s3.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.uploadBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_upload_total_bytes",
+		Help:   "The number of compressed bytes uploaded to s3.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.uploadRecordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_upload_records_total",
+		Help:   "The number of records in the objects uploaded to s3.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.errorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_err",
+		Help:   "The number of errors while buffering records for s3.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.uploadErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_upload_err",
+		Help:   "The number of objects which failed to be uploaded to s3 after the retries, their records are nacked.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.uploadRetryCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_upload_retries_total",
+		Help:   "The number of times an upload to s3 was attempted again after failing.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.reliableAckCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "s3_reliable_ack_total",
+		Help:   "The number of records uploaded to s3 for which we sent a reliable ACK.",
+		Labels: []string{"record_type"},
+	})
+}
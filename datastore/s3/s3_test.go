@@ -0,0 +1,270 @@
+package s3_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/file"
+	"github.com/teslamotors/fleet-telemetry/datastore/s3"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// upload is an object received by the fake s3 server
+type upload struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// fakeS3 accepts bucket checks and object uploads, the first failures uploads are rejected
+type fakeS3 struct {
+	lock     sync.Mutex
+	uploads  []upload
+	failures int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		body, _ := io.ReadAll(r.Body)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.uploads = append(f.uploads, upload{path: r.URL.Path, header: r.Header.Clone(), body: body})
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) Uploads() []upload {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]upload(nil), f.uploads...)
+}
+
+func gunzip(data []byte) []byte {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	Expect(err).NotTo(HaveOccurred())
+	content, err := io.ReadAll(reader)
+	Expect(err).NotTo(HaveOccurred())
+	return content
+}
+
+var _ = Describe("Producer", func() {
+	var (
+		fake    *fakeS3
+		server  *httptest.Server
+		config  *s3.Config
+		ackChan chan *telemetry.Record
+	)
+
+	newRecord := func(vin string) *telemetry.Record {
+		payload, err := proto.Marshal(&protos.Payload{Vin: vin, Data: []*protos.Datum{{Key: protos.Field_VehicleName, Value: &protos.Value{Value: &protos.Value_StringValue{StringValue: "cybertruck"}}}}})
+		Expect(err).NotTo(HaveOccurred())
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: vin, SenderID: "vehicle_device." + vin}, map[string][]telemetry.Producer{}, logger)
+		message := messages.StreamMessage{TXID: []byte("txid"), SenderID: []byte("vehicle_device." + vin), MessageTopic: []byte("V"), Payload: payload}
+		messageBytes, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := telemetry.NewRecord(serializer, messageBytes, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	newProducer := func() telemetry.Producer {
+		logger, _ := logrus.NoOpLogger()
+		producer, err := s3.NewProducer(config, "tesla", noop.NewCollector(), airbrake.NewAirbrakeHandler(nil), ackChan, map[string]interface{}{"V": true}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		return producer
+	}
+
+	BeforeEach(func() {
+		fake = &fakeS3{}
+		server = httptest.NewServer(fake)
+		DeferCleanup(server.Close)
+		GinkgoT().Setenv("AWS_ACCESS_KEY_ID", "key")
+		GinkgoT().Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		GinkgoT().Setenv("AWS_REGION", "us-west-2")
+		GinkgoT().Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+		config = &s3.Config{Bucket: "archive", OverrideHost: server.URL}
+		ackChan = make(chan *telemetry.Record, 10)
+	})
+
+	It("uploads the buffered records on close", func() {
+		producer := newProducer()
+		Expect(producer.Produce(newRecord("VIN1"))).To(Succeed())
+		Expect(producer.Produce(newRecord("VIN2"))).To(Succeed())
+		Expect(fake.Uploads()).To(BeEmpty())
+		Expect(ackChan).To(BeEmpty())
+
+		Expect(producer.Close()).To(Succeed())
+		uploads := fake.Uploads()
+		Expect(uploads).To(HaveLen(1))
+		Expect(uploads[0].path).To(HavePrefix("/archive/tesla/V/" + time.Now().UTC().Format("2006-01-02") + "/"))
+		Expect(uploads[0].path).To(HaveSuffix(".pb.gz"))
+
+		reader := file.NewReader(bytes.NewReader(gunzip(uploads[0].body)))
+		for _, vin := range []string{"VIN1", "VIN2"} {
+			record, err := reader.Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.Vin).To(Equal(vin))
+			Expect(record.TxType).To(Equal("V"))
+		}
+		_, err := reader.Read()
+		Expect(err).To(MatchError(io.EOF))
+		Expect(ackChan).To(HaveLen(2))
+	})
+
+	It("uploads objects once they reach the max size", func() {
+		config.MaxObjectSize = 1
+		producer := newProducer()
+		DeferCleanup(producer.Close)
+
+		Expect(producer.Produce(newRecord("VIN1"))).To(Succeed())
+		Eventually(fake.Uploads).Should(HaveLen(1))
+		Eventually(ackChan).Should(HaveLen(1))
+	})
+
+	It("partitions json objects with the key template", func() {
+		config.Format = s3.JSONFormat
+		config.KeyTemplate = "{txtype}/vin={vin}"
+		producer := newProducer()
+		Expect(producer.Produce(newRecord("VIN1"))).To(Succeed())
+		Expect(producer.Produce(newRecord("VIN1"))).To(Succeed())
+		Expect(producer.Produce(newRecord("VIN2"))).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		uploads := fake.Uploads()
+		Expect(uploads).To(HaveLen(2))
+		for _, upload := range uploads {
+			Expect(upload.path).To(HaveSuffix(".ndjson.gz"))
+			if !strings.HasPrefix(upload.path, "/archive/V/vin=VIN1/") {
+				Expect(upload.path).To(HavePrefix("/archive/V/vin=VIN2/"))
+				continue
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(gunzip(upload.body)))
+			lines := 0
+			for scanner.Scan() {
+				var payload map[string]interface{}
+				Expect(json.Unmarshal(scanner.Bytes(), &payload)).To(Succeed())
+				Expect(payload).To(HaveKeyWithValue("vin", "VIN1"))
+				lines++
+			}
+			Expect(lines).To(Equal(2))
+		}
+	})
+
+	It("uploads the oldest object once max_open_objects are buffered", func() {
+		config.KeyTemplate = "{txtype}/vin={vin}"
+		config.MaxOpenObjects = 1
+		producer := newProducer()
+		DeferCleanup(producer.Close)
+
+		Expect(producer.Produce(newRecord("VIN1"))).To(Succeed())
+		Expect(producer.Produce(newRecord("VIN2"))).To(Succeed())
+		Eventually(fake.Uploads).Should(HaveLen(1))
+		Expect(fake.Uploads()[0].path).To(HavePrefix("/archive/V/vin=VIN1/"))
+	})
+
+	It("retries failed uploads", func() {
+		fake.failures = 1
+		config.UploadRetryBackoff = 1
+		producer := newProducer()
+		record := newRecord("VIN1")
+		record.SetPendingAcks(1)
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		Expect(fake.Uploads()).To(HaveLen(1))
+		Expect(ackChan).To(Receive(Equal(record)))
+		Expect(record.AckError()).NotTo(HaveOccurred())
+	})
+
+	It("nacks the records of objects failing to be uploaded after the retries", func() {
+		fake.failures = 3
+		retries := 2
+		config.UploadRetries = &retries
+		config.UploadRetryBackoff = 1
+		producer := newProducer()
+		record := newRecord("VIN1")
+		record.SetPendingAcks(1)
+		Expect(producer.Produce(record)).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		Expect(fake.Uploads()).To(BeEmpty())
+		Expect(ackChan).To(Receive(Equal(record)))
+		Expect(record.AckError()).To(HaveOccurred())
+	})
+
+	It("can be closed twice", func() {
+		producer := newProducer()
+		Expect(producer.Close()).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+	})
+
+	It("compresses objects with zstd", func() {
+		config.Compression = file.ZstdCompression
+		config.CompressionLevel = 3
+		producer := newProducer()
+		Expect(producer.Produce(newRecord("VIN1"))).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		uploads := fake.Uploads()
+		Expect(uploads).To(HaveLen(1))
+		Expect(uploads[0].path).To(HaveSuffix(".pb.zst"))
+		Expect(uploads[0].header.Get("Content-Type")).To(Equal("application/zstd"))
+		Expect(uploads[0].header.Get("X-Amz-Meta-Compression")).To(Equal("zstd"))
+
+		decompressed, err := file.NewDecompressReader(bytes.NewReader(uploads[0].body), file.ZstdCompression)
+		Expect(err).NotTo(HaveOccurred())
+		record, err := file.NewReader(decompressed).Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Vin).To(Equal("VIN1"))
+	})
+
+	It("requests kms encryption", func() {
+		config.KMSKeyID = "alias/archive"
+		producer := newProducer()
+		Expect(producer.Produce(newRecord("VIN1"))).To(Succeed())
+		Expect(producer.Close()).To(Succeed())
+
+		uploads := fake.Uploads()
+		Expect(uploads).To(HaveLen(1))
+		Expect(uploads[0].header.Get("X-Amz-Server-Side-Encryption")).To(Equal("aws:kms"))
+		Expect(uploads[0].header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")).To(Equal("alias/archive"))
+	})
+
+	DescribeTable("rejects invalid configs",
+		func(config *s3.Config, errMessage string) {
+			Expect(config.Validate()).To(MatchError(errMessage))
+		},
+		Entry("without bucket", &s3.Config{}, "s3 bucket cannot be empty"),
+		Entry("with an unknown format", &s3.Config{Bucket: "archive", Format: "xml"}, "invalid s3 format: xml"),
+		Entry("with an unknown encryption", &s3.Config{Bucket: "archive", ServerSideEncryption: "rot13"}, "invalid s3 server_side_encryption: rot13"),
+		Entry("with a kms key and AES256", &s3.Config{Bucket: "archive", ServerSideEncryption: "AES256", KMSKeyID: "key"}, "s3 kms_key_id requires aws:kms server_side_encryption"),
+		Entry("with an unknown compression", &s3.Config{Bucket: "archive", Compression: "brotli"}, "s3: invalid compression brotli, expected none, gzip or zstd"),
+		Entry("with a gzip level above 9", &s3.Config{Bucket: "archive", CompressionLevel: 12}, "s3: invalid gzip compression_level 12, expected 1 to 9"),
+		Entry("with negative max_open_objects", &s3.Config{Bucket: "archive", MaxOpenObjects: -1}, "s3 max_open_objects, upload_retries and upload_retry_backoff cannot be negative"),
+	)
+})
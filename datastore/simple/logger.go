@@ -36,13 +36,14 @@ func (p *Producer) ProcessReliableAck(_ *telemetry.Record) {
 }
 
 // Produce sends the data to the logger
-func (p *Producer) Produce(entry *telemetry.Record) {
+func (p *Producer) Produce(entry *telemetry.Record) error {
 	data, err := p.recordToLogMap(entry)
 	if err != nil {
 		p.logger.ErrorLog("record_logging_error", err, logrus.LogInfo{"vin": entry.Vin, "txtype": entry.TxType, "metadata": entry.Metadata()})
-		return
+		return err
 	}
 	p.logger.ActivityLog("record_payload", logrus.LogInfo{"vin": entry.Vin, "metadata": entry.Metadata(), "data": data})
+	return nil
 }
 
 // ReportError noop method
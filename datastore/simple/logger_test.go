@@ -93,7 +93,7 @@ var _ = Describe("ProtoLogger", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(record).NotTo(BeNil())
 
-				protoLogger.Produce(record)
+				Expect(protoLogger.Produce(record)).To(Succeed())
 
 				lastLog := hook.LastEntry()
 				Expect(lastLog.Message).To(Equal("record_payload"))
@@ -124,7 +124,7 @@ var _ = Describe("ProtoLogger", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(record).NotTo(BeNil())
 
-				protoLogger.Produce(record)
+				Expect(protoLogger.Produce(record)).To(Succeed())
 
 				data, ok := hook.LastEntry().Data["data"].(map[string]interface{})
 				Expect(ok).To(BeTrue())
@@ -0,0 +1,226 @@
+package tee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// Requirement selects which datastores must accept a record for the tee to succeed
+type Requirement string
+
+const (
+	// RequireBoth fails records which either datastore rejects
+	RequireBoth Requirement = "both"
+	// RequireAny only fails records which both datastores reject, the failure of one is logged and counted
+	RequireAny Requirement = "any"
+)
+
+// Config lists the two datastores the records routed to the tee are duplicated to
+type Config struct {
+	// Datastores are the two dispatchers receiving every record, ex.: ["kafka", "nats"]
+	Datastores []telemetry.Dispatcher `json:"datastores"`
+
+	// Require is both (default) or any
+	Require Requirement `json:"require,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	if len(c.Datastores) != 2 {
+		return fmt.Errorf("tee requires two datastores, got %d", len(c.Datastores))
+	}
+	if c.Datastores[0] == c.Datastores[1] {
+		return fmt.Errorf("tee requires two different datastores, got %s twice", c.Datastores[0])
+	}
+	for _, dispatcher := range c.Datastores {
+		if dispatcher == telemetry.Tee {
+			return errors.New("tee cannot duplicate records to itself")
+		}
+		if dispatcher == telemetry.Failover {
+			return errors.New("tee cannot duplicate records to the failover")
+		}
+	}
+	switch c.Require {
+	case "", RequireBoth, RequireAny:
+	default:
+		return fmt.Errorf("invalid tee require: %s, expected both or any", c.Require)
+	}
+	return nil
+}
+
+// ChildError is returned when one of the datastores of the tee fails to produce a record
+type ChildError struct {
+	Dispatcher telemetry.Dispatcher
+	Err        error
+}
+
+func (e *ChildError) Error() string {
+	return fmt.Sprintf("tee datastore %s: %v", e.Dispatcher, e.Err)
+}
+
+func (e *ChildError) Unwrap() error {
+	return e.Err
+}
+
+// Producer writes each record to two datastores concurrently. Produce returns once both returned, so
+// asynchronous producers like kafka only confirm the record was queued. The record types the tee acks are acked once
+// the datastores acked or nacked their copy, depending on the requirement
+type Producer struct {
+	dispatchers        [2]telemetry.Dispatcher
+	producers          [2]telemetry.Producer
+	require            Requirement
+	ackChan            chan (*telemetry.Record)
+	reliableAckTxTypes map[string]interface{}
+	logger             *logrus.Logger
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	childErrorCount adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// NewProducer returns a producer duplicating records to the producers of the datastores listed in config.
+// The producers are shared with the other routes, closing the tee leaves them open. The datastores are expected to ack
+// the reliableAckTxTypes of the tee
+func NewProducer(config *Config, producers map[telemetry.Dispatcher]telemetry.Producer, ackChan chan (*telemetry.Record), reliableAckTxTypes map[string]interface{}, metricsCollector metrics.MetricCollector, logger *logrus.Logger) (*Producer, error) {
+	registerMetricsOnce(metricsCollector)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	producer := &Producer{require: config.Require, ackChan: ackChan, reliableAckTxTypes: reliableAckTxTypes, logger: logger}
+	if producer.require == "" {
+		producer.require = RequireBoth
+	}
+	for i, dispatcher := range config.Datastores {
+		child, ok := producers[dispatcher]
+		if !ok {
+			return nil, fmt.Errorf("tee datastore %s is not configured", dispatcher)
+		}
+		producer.dispatchers[i] = dispatcher
+		producer.producers[i] = child
+	}
+	return producer, nil
+}
+
+// Wrap returns a copy of the tee writing to the producers wrap returns for its datastores, for instance the producers
+// with the options of their datastore
+func (p *Producer) Wrap(wrap func(dispatcher telemetry.Dispatcher) telemetry.Producer) *Producer {
+	wrapped := *p
+	for i, dispatcher := range p.dispatchers {
+		wrapped.producers[i] = wrap(dispatcher)
+	}
+	return &wrapped
+}
+
+// Produce writes the record to both datastores. The second one receives a clone of the record, unless the tee acks
+// the record and each datastore receives a copy it acks
+func (p *Producer) Produce(entry *telemetry.Record) error {
+	var records [2]*telemetry.Record
+	acked := p.acks(entry)
+	if acked {
+		required := len(records)
+		if p.require == RequireAny {
+			required = 1
+		}
+		copy(records[:], entry.SplitAcks(len(records), required))
+	} else {
+		records = [2]*telemetry.Record{entry, entry.Clone()}
+	}
+
+	var errs [2]error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		errs[1] = p.producers[1].Produce(records[1])
+	}()
+	errs[0] = p.producers[0].Produce(records[0])
+	<-done
+
+	var failed []error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		metricsRegistry.childErrorCount.Inc(map[string]string{"datastore": string(p.dispatchers[i]), "record_type": entry.TxType})
+		failed = append(failed, &ChildError{Dispatcher: p.dispatchers[i], Err: err})
+	}
+	if len(failed) == 0 || (p.require == RequireAny && len(failed) < len(errs)) {
+		if len(failed) > 0 {
+			p.logger.ErrorLog("tee_datastore_error", failed[0], logrus.LogInfo{"vin": entry.Vin, "txid": entry.Txid, "record_type": entry.TxType})
+		}
+		return nil
+	}
+	if acked {
+		// the datastores nacked their copies, which nacks the record
+		return telemetry.MarkNacked(errors.Join(failed...))
+	}
+	return errors.Join(failed...)
+}
+
+// acks returns true if the datastores ack the copies of the record on its behalf
+func (p *Producer) acks(entry *telemetry.Record) bool {
+	_, ok := p.reliableAckTxTypes[entry.TxType]
+	return ok && entry.AwaitsAcks()
+}
+
+// CheckHealth checks the datastores able to report their health, the tee is unhealthy once the datastores it requires
+// are. It gates readiness when the tee acks records
+func (p *Producer) CheckHealth(ctx context.Context) error {
+	var failed []error
+	for i, producer := range p.producers {
+		checker, ok := producer.(telemetry.HealthChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.CheckHealth(ctx); err != nil {
+			failed = append(failed, &ChildError{Dispatcher: p.dispatchers[i], Err: err})
+		}
+	}
+	if p.require == RequireAny && len(failed) < len(p.producers) {
+		return nil
+	}
+	return errors.Join(failed...)
+}
+
+// Close noop method, the datastores are closed with the other producers
+func (p *Producer) Close() error {
+	return nil
+}
+
+// ProcessReliableAck sends to ackChan if reliable ack is configured, for the records which are not written to the
+// datastores
+func (p *Producer) ProcessReliableAck(entry *telemetry.Record) {
+	if _, ok := p.reliableAckTxTypes[entry.TxType]; ok {
+		p.ackChan <- entry
+	}
+}
+
+// ReportError to logger
+func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo) {
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.childErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "tee_datastore_errors_total",
+		Help:   "The number of records a datastore of the tee failed to produce.",
+		Labels: []string{"datastore", "record_type"},
+	})
+}
@@ -0,0 +1,13 @@
+package tee_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTee(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tee Suite Tests")
+}
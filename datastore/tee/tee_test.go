@@ -0,0 +1,190 @@
+package tee_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/tee"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// FakeProducer records the records it produces and returns err
+type FakeProducer struct {
+	mu      sync.Mutex
+	err     error
+	records []*telemetry.Record
+}
+
+func (f *FakeProducer) Produce(entry *telemetry.Record) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, entry)
+	return f.err
+}
+
+func (f *FakeProducer) Close() error { return nil }
+
+func (f *FakeProducer) ProcessReliableAck(_ *telemetry.Record) {}
+
+func (f *FakeProducer) ReportError(_ string, _ error, _ logrus.LogInfo) {}
+
+// CheckingProducer is a FakeProducer reporting healthErr as its health
+type CheckingProducer struct {
+	FakeProducer
+	healthErr error
+}
+
+func (c *CheckingProducer) CheckHealth(_ context.Context) error {
+	return c.healthErr
+}
+
+var _ = Describe("Producer", func() {
+	var (
+		kafka     *FakeProducer
+		nats      *FakeProducer
+		producers map[telemetry.Dispatcher]telemetry.Producer
+		record    *telemetry.Record
+
+		ackChan            chan (*telemetry.Record)
+		reliableAckTxTypes map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		kafka = &FakeProducer{}
+		nats = &FakeProducer{}
+		producers = map[telemetry.Dispatcher]telemetry.Producer{telemetry.Kafka: kafka, telemetry.NATS: nats}
+		record = &telemetry.Record{TxType: "V", Vin: "42", Txid: "txid"}
+		ackChan = make(chan *telemetry.Record, 1)
+		reliableAckTxTypes = nil
+	})
+
+	newProducer := func(require tee.Requirement) *tee.Producer {
+		logger, _ := logrus.NoOpLogger()
+		producer, err := tee.NewProducer(&tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.NATS}, Require: require}, producers, ackChan, reliableAckTxTypes, noop.NewCollector(), logger)
+		Expect(err).NotTo(HaveOccurred())
+		return producer
+	}
+
+	It("produces the record to both datastores", func() {
+		Expect(newProducer("").Produce(record)).To(Succeed())
+		Expect(kafka.records).To(ConsistOf(record))
+		Expect(nats.records).To(HaveLen(1))
+		Expect(nats.records[0].Txid).To(Equal("txid"))
+	})
+
+	It("fails when a datastore fails and both are required", func() {
+		nats.err = errors.New("no responders")
+		err := newProducer(tee.RequireBoth).Produce(record)
+
+		var childErr *tee.ChildError
+		Expect(errors.As(err, &childErr)).To(BeTrue())
+		Expect(childErr.Dispatcher).To(Equal(telemetry.NATS))
+		Expect(err).To(MatchError("tee datastore nats: no responders"))
+		Expect(kafka.records).To(HaveLen(1))
+	})
+
+	It("succeeds when one datastore succeeds and any is required", func() {
+		nats.err = errors.New("no responders")
+		Expect(newProducer(tee.RequireAny).Produce(record)).To(Succeed())
+
+		kafka.err = errors.New("queue full")
+		err := newProducer(tee.RequireAny).Produce(record)
+		Expect(err).To(MatchError(ContainSubstring("tee datastore kafka: queue full")))
+		Expect(err).To(MatchError(ContainSubstring("tee datastore nats: no responders")))
+	})
+
+	It("writes the record to the datastores wrap returns", func() {
+		other := &FakeProducer{}
+		wrapped := newProducer("").Wrap(func(dispatcher telemetry.Dispatcher) telemetry.Producer {
+			if dispatcher == telemetry.NATS {
+				return other
+			}
+			return producers[dispatcher]
+		})
+
+		Expect(wrapped.Produce(record)).To(Succeed())
+		Expect(kafka.records).To(HaveLen(1))
+		Expect(other.records).To(HaveLen(1))
+		Expect(nats.records).To(BeEmpty())
+	})
+
+	Context("when the tee acks the record type", func() {
+		BeforeEach(func() {
+			reliableAckTxTypes = map[string]interface{}{"V": true}
+			record.SetPendingAcks(1)
+		})
+
+		It("writes copies the datastores ack", func() {
+			Expect(newProducer("").Produce(record)).To(Succeed())
+			Expect(kafka.records).To(HaveLen(1))
+			Expect(kafka.records[0]).NotTo(BeIdenticalTo(record))
+
+			Expect(kafka.records[0].ReleaseAck()).To(BeFalse())
+			Expect(nats.records[0].ReleaseAck()).To(BeTrue())
+			Expect(record.AckError()).NotTo(HaveOccurred())
+		})
+
+		It("fails the record when a copy fails and both are required", func() {
+			nats.err = errors.New("no responders")
+			nacker := telemetry.NewNacker(telemetry.Tee, ackChan, reliableAckTxTypes, noop.NewCollector())
+			err := telemetry.NewNackProducer(newProducer(tee.RequireBoth), nacker).Produce(record)
+			Expect(err).To(MatchError("tee datastore nats: no responders"))
+			// the tee doesn't nack the record in addition to the datastore
+			Expect(ackChan).NotTo(Receive())
+
+			// the datastore nacks its copy
+			nats.records[0].FailAck(nats.err)
+			Expect(nats.records[0].ReleaseAck()).To(BeFalse())
+			Expect(kafka.records[0].ReleaseAck()).To(BeTrue())
+			Expect(record.AckError()).To(MatchError("no responders"))
+		})
+
+		It("acks the record when a copy fails and any is required", func() {
+			nats.err = errors.New("no responders")
+			Expect(newProducer(tee.RequireAny).Produce(record)).To(Succeed())
+
+			nats.records[0].FailAck(nats.err)
+			Expect(nats.records[0].ReleaseAck()).To(BeFalse())
+			Expect(kafka.records[0].ReleaseAck()).To(BeTrue())
+			Expect(record.AckError()).NotTo(HaveOccurred())
+		})
+
+		It("acks the records it drops", func() {
+			newProducer("").ProcessReliableAck(record)
+			Expect(ackChan).To(Receive(Equal(record)))
+		})
+	})
+
+	It("checks the health of the datastores it requires", func() {
+		checking := &CheckingProducer{healthErr: errors.New("no brokers")}
+		producers[telemetry.NATS] = checking
+		Expect(newProducer(tee.RequireBoth).CheckHealth(context.Background())).To(MatchError("tee datastore nats: no brokers"))
+		Expect(newProducer(tee.RequireAny).CheckHealth(context.Background())).To(Succeed())
+
+		checking.healthErr = nil
+		Expect(newProducer(tee.RequireBoth).CheckHealth(context.Background())).To(Succeed())
+	})
+
+	It("requires the datastores to be configured", func() {
+		logger, _ := logrus.NoOpLogger()
+		_, err := tee.NewProducer(&tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.S3}}, producers, nil, nil, noop.NewCollector(), logger)
+		Expect(err).To(MatchError("tee datastore s3 is not configured"))
+	})
+
+	DescribeTable("rejects invalid configs",
+		func(config *tee.Config, errMessage string) {
+			Expect(config.Validate()).To(MatchError(errMessage))
+		},
+		Entry("one datastore", &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka}}, "tee requires two datastores, got 1"),
+		Entry("same datastore", &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.Kafka}}, "tee requires two different datastores, got kafka twice"),
+		Entry("itself", &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.Tee}}, "tee cannot duplicate records to itself"),
+		Entry("failover", &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.Failover}}, "tee cannot duplicate records to the failover"),
+		Entry("unknown requirement", &tee.Config{Datastores: []telemetry.Dispatcher{telemetry.Kafka, telemetry.NATS}, Require: "all"}, "invalid tee require: all, expected both or any"),
+	)
+})
@@ -3,8 +3,11 @@ package zmq
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"os"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pebbe/zmq4"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
@@ -29,8 +32,24 @@ type Config struct {
 
 	// Verbose controls if verbose logging is enabled for the socket.
 	Verbose bool `json:"verbose"`
+
+	// SndHWM is the maximum number of messages queued per subscriber. When 0,
+	// the libzmq default of 1000 is used.
+	SndHWM int `json:"snd_hwm"`
+
+	// SendTimeoutMs is how long a send blocks on a full queue when BlockOnFull
+	// is set. When 0, the send blocks until the queue has room.
+	SendTimeoutMs int `json:"send_timeout_ms"`
+
+	// BlockOnFull blocks sends while a subscriber queue is full instead of
+	// dropping the message.
+	BlockOnFull bool `json:"block_on_full"`
 }
 
+// ErrQueueFull is returned when a message is dropped because a subscriber
+// queue reached the high water mark.
+var ErrQueueFull = errors.New("zmq subscriber queue full")
+
 // KeyJSON contains z85 key data
 type KeyJSON struct {
 	// Secret is the secret key encoded as a 40 char z85 string.
@@ -43,6 +62,7 @@ type KeyJSON struct {
 // Metrics stores metrics reported from this package
 type Metrics struct {
 	errorCount       adapter.Counter
+	droppedCount     adapter.Counter
 	publishCount     adapter.Counter
 	byteTotal        adapter.Counter
 	reliableAckCount adapter.Counter
@@ -67,22 +87,45 @@ type Producer struct {
 	airbrakeHandler    *airbrake.Handler
 	ackChan            chan (*telemetry.Record)
 	reliableAckTxTypes map[string]interface{}
+	blockOnFull        bool
+	produceErrors      *telemetry.ProduceErrorCounter
 }
 
-// Produce the record to the socket.
-func (p *Producer) Produce(rec *telemetry.Record) {
-	if p.ctx.Err() != nil {
-		return
+// Produce the record to the socket. Messages exceeding the high water mark
+// are dropped unless BlockOnFull is configured.
+func (p *Producer) Produce(rec *telemetry.Record) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	topic := telemetry.BuildTopicName(p.namespace, rec.TxType)
+	var nBytes int
+	var err error
+	if p.blockOnFull {
+		nBytes, err = p.sock.SendMessage(topic, rec.Payload())
+	} else {
+		nBytes, err = p.sock.SendMessageDontwait(topic, rec.Payload())
+	}
+	if zmq4.AsErrno(err) == zmq4.Errno(syscall.EAGAIN) {
+		if p.blockOnFull {
+			metricsRegistry.errorCount.Inc(map[string]string{"record_type": rec.TxType})
+			p.produceErrors.IncClass(telemetry.ErrorClassTimeout)
+			p.reportRecordError("zmq_send_timeout", err, rec, nil)
+		} else {
+			metricsRegistry.droppedCount.Inc(map[string]string{"record_type": rec.TxType})
+			p.logger.Log(logrus.DEBUG, "zmq_message_dropped", logrus.LogInfo{"record_type": rec.TxType, "txid": rec.Txid})
+		}
+		return ErrQueueFull
 	}
-	nBytes, err := p.sock.SendMessage(telemetry.BuildTopicName(p.namespace, rec.TxType), rec.Payload())
 	if err != nil {
 		metricsRegistry.errorCount.Inc(map[string]string{"record_type": rec.TxType})
-		p.ReportError("zmq_dispatch_error", err, nil)
-		return
+		p.produceErrors.Inc(err)
+		p.reportRecordError("zmq_dispatch_error", err, rec, nil)
+		return err
 	}
 	p.ProcessReliableAck(rec)
 	metricsRegistry.byteTotal.Add(int64(nBytes), map[string]string{"record_type": rec.TxType})
 	metricsRegistry.publishCount.Inc(map[string]string{"record_type": rec.TxType})
+	return nil
 }
 
 // ReportError to airbrake and logger
@@ -91,6 +134,13 @@ func (p *Producer) ReportError(message string, err error, logInfo logrus.LogInfo
 	p.logger.ErrorLog(message, err, logInfo)
 }
 
+// reportRecordError to airbrake with the record context and logger
+func (p *Producer) reportRecordError(message string, err error, entry *telemetry.Record, logInfo logrus.LogInfo) {
+	errorContext := airbrake.ErrorContext{Vin: entry.Vin, TxType: entry.TxType, Datastore: string(telemetry.ZMQ), Namespace: p.namespace}
+	p.airbrakeHandler.ReportLogMessageWithContext(logrus.ERROR, message, err, errorContext, logInfo)
+	p.logger.ErrorLog(message, err, logInfo)
+}
+
 // Close the underlying socket.
 func (p *Producer) Close() error {
 	if p.sock != nil {
@@ -171,11 +221,27 @@ func NewProducer(ctx context.Context, config *Config, metrics metrics.MetricColl
 		}
 	}
 
+	if config.SndHWM > 0 {
+		if err = sock.SetSndhwm(config.SndHWM); err != nil {
+			return
+		}
+	}
+	// Report full queues to the sender instead of dropping silently, so drops can be counted.
+	if err = sock.SetXpubNodrop(true); err != nil {
+		return
+	}
+	if config.BlockOnFull && config.SendTimeoutMs > 0 {
+		if err = sock.SetSndtimeo(time.Duration(config.SendTimeoutMs) * time.Millisecond); err != nil {
+			return
+		}
+	}
+
 	if err = sock.Bind(config.Addr); err != nil {
 		return
 	}
 
 	return &Producer{
+		produceErrors:      telemetry.NewProduceErrorCounter(telemetry.ZMQ, metrics),
 		namespace:          namespace,
 		ctx:                ctx,
 		sock:               sock,
@@ -183,6 +249,7 @@ func NewProducer(ctx context.Context, config *Config, metrics metrics.MetricColl
 		airbrakeHandler:    airbrakeHandler,
 		ackChan:            ackChan,
 		reliableAckTxTypes: reliableAckTxTypes,
+		blockOnFull:        config.BlockOnFull,
 	}, nil
 }
 
@@ -232,6 +299,12 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 		Labels: []string{"record_type"},
 	})
 
+	metricsRegistry.droppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "zmq_dropped_total",
+		Help:   "The number of messages dropped because a ZMQ subscriber queue was full.",
+		Labels: []string{"record_type"},
+	})
+
 	metricsRegistry.publishCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "zmq_publish_total",
 		Help:   "The number of messages published to ZMQ.",
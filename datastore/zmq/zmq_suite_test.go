@@ -0,0 +1,13 @@
+package zmq_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestZMQ(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ZMQ Suite Tests")
+}
@@ -0,0 +1,78 @@
+package zmq_test
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/pebbe/zmq4"
+
+	"github.com/teslamotors/fleet-telemetry/datastore/zmq"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// countingCollector keeps the total of every counter by name
+type countingCollector struct {
+	noop.Collector
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+type countingCounter struct {
+	name      string
+	collector *countingCollector
+}
+
+func (c *countingCounter) Add(n int64, _ adapter.Labels) {
+	c.collector.mutex.Lock()
+	defer c.collector.mutex.Unlock()
+	c.collector.counts[c.name] += n
+}
+
+func (c *countingCounter) Inc(labels adapter.Labels) {
+	c.Add(1, labels)
+}
+
+func (c *countingCollector) RegisterCounter(options adapter.CollectorOptions) adapter.Counter {
+	return &countingCounter{name: options.Name, collector: c}
+}
+
+func (c *countingCollector) count(name string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[name]
+}
+
+var _ = Describe("Producer", func() {
+	It("drops messages above the high water mark", func() {
+		logger, _ := logrus.NoOpLogger()
+		collector := &countingCollector{counts: make(map[string]int64)}
+		config := &zmq.Config{Addr: "inproc://zmq_hwm_test", SndHWM: 1}
+
+		producer, err := zmq.NewProducer(context.Background(), config, collector, "tesla", airbrake.NewAirbrakeHandler(nil), nil, nil, logger)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { Expect(producer.Close()).To(Succeed()) }()
+
+		subscriber, err := zmq4.NewSocket(zmq4.SUB)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { Expect(subscriber.Close()).To(Succeed()) }()
+		Expect(subscriber.SetRcvhwm(1)).To(Succeed())
+		Expect(subscriber.SetSubscribe("")).To(Succeed())
+		Expect(subscriber.Connect(config.Addr)).To(Succeed())
+
+		record := &telemetry.Record{TxType: "V", PayloadBytes: []byte("data")}
+		Eventually(func() int64 {
+			err := producer.Produce(record)
+			if err != nil {
+				Expect(err).To(MatchError(zmq.ErrQueueFull))
+			}
+			return collector.count("zmq_dropped_total")
+		}).Should(BeNumerically(">", 0))
+	})
+})
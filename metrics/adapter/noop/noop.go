@@ -23,6 +23,11 @@ func (p *Collector) RegisterTimer(_ adapter.CollectorOptions) adapter.Timer {
 	return &Timer{}
 }
 
+// RegisterHistogram returns a noop Histogram
+func (p *Collector) RegisterHistogram(_ adapter.CollectorOptions) adapter.Histogram {
+	return &Histogram{}
+}
+
 // Shutdown (noop)
 func (p *Collector) Shutdown() {
 }
@@ -8,19 +8,26 @@ import (
 // Collector is a prometheus based implementation of the stats collector
 type Collector struct {
 	collectors []prometheus.Collector
+	registerer prometheus.Registerer
 	stopChan   chan struct{}
 }
 
 // NewCollector returns a Prometheus metrics collector
 func NewCollector() *Collector {
+	return NewCollectorWithLabels(nil)
+}
+
+// NewCollectorWithLabels returns a Prometheus metrics collector adding the static labels to every series
+func NewCollectorWithLabels(staticLabels map[string]string) *Collector {
 	return &Collector{
 		stopChan:   make(chan struct{}),
 		collectors: []prometheus.Collector{},
+		registerer: prometheus.WrapRegistererWith(prometheus.Labels(staticLabels), prometheus.DefaultRegisterer),
 	}
 }
 
 func (c *Collector) register(collector prometheus.Collector) {
-	prometheus.MustRegister(collector)
+	c.registerer.MustRegister(collector)
 	c.collectors = append(c.collectors, prometheus.Collector(collector))
 }
 
@@ -75,14 +82,32 @@ func (c *Collector) RegisterTimer(options adapter.CollectorOptions) adapter.Time
 	}
 }
 
+// RegisterHistogram registers a new histogram with Prometheus, with the default buckets when options has none
+func (c *Collector) RegisterHistogram(options adapter.CollectorOptions) adapter.Histogram {
+	histogram := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    options.Name,
+			Help:    options.Help,
+			Buckets: options.Buckets,
+		},
+		options.Labels,
+	)
+
+	c.register(histogram)
+
+	return &Histogram{
+		histogram,
+	}
+}
+
 // Shutdown unregisters and safely shuts down
 func (c *Collector) Shutdown() {
 	close(c.stopChan)
-	unregisterAll(c.collectors)
+	c.unregisterAll()
 }
 
-func unregisterAll(collectors []prometheus.Collector) {
-	for _, c := range collectors {
-		prometheus.Unregister(c)
+func (c *Collector) unregisterAll() {
+	for _, collector := range c.collectors {
+		c.registerer.Unregister(collector)
 	}
 }
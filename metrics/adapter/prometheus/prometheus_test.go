@@ -238,6 +238,41 @@ var _ = Describe("Prometheus Metric Adapter", Ordered, func() {
 		})
 	})
 
+	Context("histogram", func() {
+		It("counts observations per bucket", func() {
+			histogram := metricCollector.RegisterHistogram(adapter.CollectorOptions{
+				Name:    "histogram_with_label",
+				Help:    "help text",
+				Labels:  []string{"key"},
+				Buckets: []float64{1, 10},
+			})
+			histogram.Observe(5, map[string]string{"key": "value"})
+			histogram.Observe(50, map[string]string{"key": "value"})
+
+			metrics := getMetrics()
+			Expect(metrics).To(ContainSubstring("histogram_with_label_bucket{key=\"value\",le=\"1\"} 0"))
+			Expect(metrics).To(ContainSubstring("histogram_with_label_bucket{key=\"value\",le=\"10\"} 1"))
+			Expect(metrics).To(ContainSubstring("histogram_with_label_bucket{key=\"value\",le=\"+Inf\"} 2"))
+			Expect(metrics).To(ContainSubstring("histogram_with_label_count{key=\"value\"} 2"))
+		})
+	})
+
+	Context("static labels", func() {
+		It("adds the labels to every series", func() {
+			labeledCollector := prometheus.NewCollectorWithLabels(map[string]string{"env": "test", "region": "eu"})
+			defer labeledCollector.Shutdown()
+
+			labeledCollector.RegisterCounter(adapter.CollectorOptions{
+				Name:   "static_label_counter",
+				Help:   "help text",
+				Labels: []string{"key"},
+			}).Add(3, map[string]string{"key": "value"})
+
+			metrics := getMetrics()
+			Expect(metrics).To(ContainSubstring("static_label_counter{env=\"test\",key=\"value\",region=\"eu\"} 3"))
+		})
+	})
+
 	Context("Shutdown", func() {
 		It("shuts down", func() {
 			metricCollector.Shutdown()
@@ -32,6 +32,14 @@ func (c *Collector) RegisterTimer(options adapter.CollectorOptions) adapter.Time
 	}
 }
 
+// RegisterHistogram creates a new histogram for Statsd, reported as a timer since statsd computes the distribution
+func (c *Collector) RegisterHistogram(options adapter.CollectorOptions) adapter.Histogram {
+	return &Timer{
+		name:   options.Name,
+		client: c.client,
+	}
+}
+
 // RegisterCounter creates a new counter for Statsd
 func (c *Collector) RegisterCounter(options adapter.CollectorOptions) adapter.Counter {
 	return &Counter{
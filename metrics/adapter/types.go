@@ -8,6 +8,9 @@ type CollectorOptions struct {
 	Name   string
 	Help   string
 	Labels []string
+
+	// Buckets are the upper bounds of the buckets of a histogram, ignored by other metric types
+	Buckets []float64
 }
 
 // Gauge can be set to anything
@@ -28,3 +31,8 @@ type Counter interface {
 type Timer interface {
 	Observe(int64, Labels)
 }
+
+// Histogram counts observations per bucket
+type Histogram interface {
+	Observe(int64, Labels)
+}
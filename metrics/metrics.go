@@ -13,11 +13,25 @@ import (
 	"github.com/teslamotors/fleet-telemetry/metrics/adapter/statsd"
 )
 
+const (
+	// PrometheusExporter exposes the metrics for scraping on /metrics
+	PrometheusExporter = "prometheus"
+	// StatsdExporter sends the metrics to a statsd server
+	StatsdExporter = "statsd"
+)
+
 // MonitoringConfig for profiler and prometheus
 type MonitoringConfig struct {
+	// Exporter selects the metrics backend: prometheus or statsd.
+	// When empty, prometheus is used if PrometheusMetricsPort is set and statsd if Statsd is set
+	Exporter string `json:"exporter,omitempty"`
+
 	// PrometheusMetricsPort port to run prometheus on
 	PrometheusMetricsPort int `json:"prometheus_metrics_port,omitempty"`
 
+	// StaticLabels are added to every prometheus series, ex.: env or region
+	StaticLabels map[string]string `json:"static_labels,omitempty"`
+
 	// Statsd metrics if you are not using prometheus
 	Statsd *StatsdConfig `json:"statsd,omitempty"`
 
@@ -47,16 +61,35 @@ type MetricCollector interface {
 	RegisterCounter(adapter.CollectorOptions) adapter.Counter
 	RegisterGauge(adapter.CollectorOptions) adapter.Gauge
 	RegisterTimer(adapter.CollectorOptions) adapter.Timer
+	RegisterHistogram(adapter.CollectorOptions) adapter.Histogram
 	Shutdown()
 }
 
+// PrometheusEnabled returns true if metrics are exported to prometheus
+func (m *MonitoringConfig) PrometheusEnabled() bool {
+	if m == nil {
+		return false
+	}
+	if m.Exporter != "" {
+		return m.Exporter == PrometheusExporter
+	}
+	return m.PrometheusMetricsPort > 0
+}
+
+func (m *MonitoringConfig) statsdEnabled() bool {
+	if m == nil || m.Statsd == nil {
+		return false
+	}
+	return m.Exporter == "" || m.Exporter == StatsdExporter
+}
+
 // NewCollector creates a collector based on monitoring configuration
 func NewCollector(monitoringConfig *MonitoringConfig, logger *logrus.Logger) MetricCollector {
-	isPrometheus := monitoringConfig != nil && monitoringConfig.PrometheusMetricsPort > 0
-	isStatsd := monitoringConfig != nil && monitoringConfig.Statsd != nil
+	isPrometheus := monitoringConfig.PrometheusEnabled()
+	isStatsd := monitoringConfig.statsdEnabled()
 
 	if isPrometheus {
-		return prometheus.NewCollector()
+		return prometheus.NewCollectorWithLabels(monitoringConfig.StaticLabels)
 	}
 
 	if isStatsd {
@@ -67,7 +100,11 @@ func NewCollector(monitoringConfig *MonitoringConfig, logger *logrus.Logger) Met
 		return statsd.NewCollector(monitoringConfig.Statsd.HostPort, monitoringConfig.Statsd.Prefix, logger, flushDuration)
 	}
 
-	logger.ActivityLog("config_skipping_empty_metrics_provider", nil)
+	logInfo := logrus.LogInfo{}
+	if monitoringConfig != nil && monitoringConfig.Exporter != "" {
+		logInfo["exporter"] = monitoringConfig.Exporter
+	}
+	logger.ActivityLog("config_skipping_empty_metrics_provider", logInfo)
 	return noop.NewCollector()
 }
 
@@ -0,0 +1,20 @@
+package metrics_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+var _ = Describe("MonitoringConfig", func() {
+	DescribeTable("PrometheusEnabled",
+		func(config *metrics.MonitoringConfig, expected bool) {
+			Expect(config.PrometheusEnabled()).To(Equal(expected))
+		},
+		Entry("nil config", nil, false),
+		Entry("port set", &metrics.MonitoringConfig{PrometheusMetricsPort: 9090}, true),
+		Entry("exporter set", &metrics.MonitoringConfig{Exporter: metrics.PrometheusExporter}, true),
+		Entry("statsd exporter with port", &metrics.MonitoringConfig{Exporter: metrics.StatsdExporter, PrometheusMetricsPort: 9090}, false),
+	)
+})
@@ -0,0 +1,166 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.35.1
+// 	protoc        v5.28.3
+// source: protos/vehicle_ingest.proto
+
+package protos
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// VehicleIngestAck is sent back by the gRPC ingest endpoint for each payload streamed by the vehicle
+type VehicleIngestAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// sequence is the position of the payload in the stream, starting at 1
+	Sequence uint64 `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// error is set when the payload was rejected
+	Error string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	// sequences are the positions of the payloads acked together when the server batches acks, sequence is then 0
+	Sequences []uint64 `protobuf:"varint,3,rep,packed,name=sequences,proto3" json:"sequences,omitempty"`
+}
+
+func (x *VehicleIngestAck) Reset() {
+	*x = VehicleIngestAck{}
+	mi := &file_protos_vehicle_ingest_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VehicleIngestAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VehicleIngestAck) ProtoMessage() {}
+
+func (x *VehicleIngestAck) ProtoReflect() protoreflect.Message {
+	mi := &file_protos_vehicle_ingest_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VehicleIngestAck.ProtoReflect.Descriptor instead.
+func (*VehicleIngestAck) Descriptor() ([]byte, []int) {
+	return file_protos_vehicle_ingest_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *VehicleIngestAck) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *VehicleIngestAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *VehicleIngestAck) GetSequences() []uint64 {
+	if x != nil {
+		return x.Sequences
+	}
+	return nil
+}
+
+var File_protos_vehicle_ingest_proto protoreflect.FileDescriptor
+
+var file_protos_vehicle_ingest_proto_rawDesc = []byte{
+	0x0a, 0x1b, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2f, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65,
+	0x5f, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x18, 0x74,
+	0x65, 0x6c, 0x65, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65,
+	0x5f, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2f,
+	0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x5f, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x22, 0x62, 0x0a, 0x10, 0x56, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x49, 0x6e, 0x67,
+	0x65, 0x73, 0x74, 0x41, 0x63, 0x6b, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e,
+	0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e,
+	0x63, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x65, 0x71, 0x75,
+	0x65, 0x6e, 0x63, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x04, 0x52, 0x09, 0x73, 0x65, 0x71,
+	0x75, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x32, 0x6a, 0x0a, 0x0d, 0x56, 0x65, 0x68, 0x69, 0x63, 0x6c,
+	0x65, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x12, 0x59, 0x0a, 0x06, 0x53, 0x74, 0x72, 0x65, 0x61,
+	0x6d, 0x12, 0x1f, 0x2e, 0x74, 0x65, 0x6c, 0x65, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e, 0x76, 0x65,
+	0x68, 0x69, 0x63, 0x6c, 0x65, 0x5f, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x50, 0x61, 0x79, 0x6c, 0x6f,
+	0x61, 0x64, 0x1a, 0x2a, 0x2e, 0x74, 0x65, 0x6c, 0x65, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e, 0x76,
+	0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x5f, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x2e, 0x56, 0x65,
+	0x68, 0x69, 0x63, 0x6c, 0x65, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x41, 0x63, 0x6b, 0x28, 0x01,
+	0x30, 0x01, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d,
+	0x2f, 0x74, 0x65, 0x73, 0x6c, 0x61, 0x6d, 0x6f, 0x74, 0x6f, 0x72, 0x73, 0x2f, 0x66, 0x6c, 0x65,
+	0x65, 0x74, 0x2d, 0x74, 0x65, 0x6c, 0x65, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2f, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_protos_vehicle_ingest_proto_rawDescOnce sync.Once
+	file_protos_vehicle_ingest_proto_rawDescData = file_protos_vehicle_ingest_proto_rawDesc
+)
+
+func file_protos_vehicle_ingest_proto_rawDescGZIP() []byte {
+	file_protos_vehicle_ingest_proto_rawDescOnce.Do(func() {
+		file_protos_vehicle_ingest_proto_rawDescData = protoimpl.X.CompressGZIP(file_protos_vehicle_ingest_proto_rawDescData)
+	})
+	return file_protos_vehicle_ingest_proto_rawDescData
+}
+
+var file_protos_vehicle_ingest_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_protos_vehicle_ingest_proto_goTypes = []any{
+	(*VehicleIngestAck)(nil), // 0: telemetry.vehicle_ingest.VehicleIngestAck
+	(*Payload)(nil),          // 1: telemetry.vehicle_data.Payload
+}
+var file_protos_vehicle_ingest_proto_depIdxs = []int32{
+	1, // 0: telemetry.vehicle_ingest.VehicleIngest.Stream:input_type -> telemetry.vehicle_data.Payload
+	0, // 1: telemetry.vehicle_ingest.VehicleIngest.Stream:output_type -> telemetry.vehicle_ingest.VehicleIngestAck
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_protos_vehicle_ingest_proto_init() }
+func file_protos_vehicle_ingest_proto_init() {
+	if File_protos_vehicle_ingest_proto != nil {
+		return
+	}
+	file_protos_vehicle_data_proto_init()
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_protos_vehicle_ingest_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_protos_vehicle_ingest_proto_goTypes,
+		DependencyIndexes: file_protos_vehicle_ingest_proto_depIdxs,
+		MessageInfos:      file_protos_vehicle_ingest_proto_msgTypes,
+	}.Build()
+	File_protos_vehicle_ingest_proto = out.File
+	file_protos_vehicle_ingest_proto_rawDesc = nil
+	file_protos_vehicle_ingest_proto_goTypes = nil
+	file_protos_vehicle_ingest_proto_depIdxs = nil
+}
@@ -11,12 +11,19 @@ import (
 // Handler reports errors to airbrake
 type Handler struct {
 	airbrakeNotifier *githubairbrake.Notifier
+	throttle         *throttle
 }
 
 // NewAirbrakeHandler returns a new instance of AirbrakeHandler
 func NewAirbrakeHandler(airbrakeNotifier *githubairbrake.Notifier) *Handler {
+	return NewAirbrakeHandlerWithOptions(airbrakeNotifier, Options{})
+}
+
+// NewAirbrakeHandlerWithOptions returns a new instance of AirbrakeHandler sampling and rate limiting notices
+func NewAirbrakeHandlerWithOptions(airbrakeNotifier *githubairbrake.Notifier, options Options) *Handler {
 	return &Handler{
 		airbrakeNotifier: airbrakeNotifier,
+		throttle:         newThrottle(options),
 	}
 }
 
@@ -35,10 +42,21 @@ func (a *Handler) ReportError(r *http.Request, err error) {
 	if a.airbrakeNotifier == nil {
 		return
 	}
+	ok, occurrences := a.throttle.allow("request_error")
+	if !ok {
+		return
+	}
 	notice := githubairbrake.NewNotice(err.Error(), r, 1)
+	addOccurrences(notice, occurrences)
 	a.airbrakeNotifier.SendNoticeAsync(notice)
 }
 
+func addOccurrences(notice *githubairbrake.Notice, occurrences int) {
+	if occurrences > 1 {
+		notice.Params["occurrences"] = occurrences
+	}
+}
+
 // WithReporting dispatches 5xx messages with some metadata to airbrake if notifier is configured
 func (a *Handler) WithReporting(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -65,10 +83,44 @@ func (a *Handler) logMessage(logType logrus.LogType, message string, err error,
 	return notice
 }
 
+// ErrorContext identifies the record and datastore an error is reported for
+type ErrorContext struct {
+	Vin       string
+	TxType    string
+	Datastore string
+	Namespace string
+}
+
+func (c ErrorContext) addParams(notice *githubairbrake.Notice) {
+	params := map[string]string{
+		"vin":       c.Vin,
+		"txtype":    c.TxType,
+		"datastore": c.Datastore,
+		"namespace": c.Namespace,
+	}
+	for key, value := range params {
+		if value != "" {
+			notice.Params[key] = value
+		}
+	}
+}
+
 // ReportLogMessage log message to airbrake
 func (a *Handler) ReportLogMessage(logType logrus.LogType, message string, err error, logInfo logrus.LogInfo) {
+	a.ReportLogMessageWithContext(logType, message, err, ErrorContext{}, logInfo)
+}
+
+// ReportLogMessageWithContext log message to airbrake with the context of the record which triggered it
+func (a *Handler) ReportLogMessageWithContext(logType logrus.LogType, message string, err error, errorContext ErrorContext, logInfo logrus.LogInfo) {
 	if a.airbrakeNotifier == nil {
 		return
 	}
-	a.airbrakeNotifier.SendNoticeAsync(a.logMessage(logType, message, err, logInfo))
+	ok, occurrences := a.throttle.allow(message)
+	if !ok {
+		return
+	}
+	notice := a.logMessage(logType, message, err, logInfo)
+	errorContext.addParams(notice)
+	addOccurrences(notice, occurrences)
+	a.airbrakeNotifier.SendNoticeAsync(notice)
 }
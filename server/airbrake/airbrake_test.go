@@ -4,6 +4,9 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -41,6 +44,76 @@ var _ = Describe("AirbrakeMiddleware", func() {
 		Entry("200", http.StatusOK, "ok"),
 	)
 
+	Context("throttle", func() {
+		var now time.Time
+
+		newTestThrottle := func(options Options) *throttle {
+			t := newThrottle(options)
+			now = time.Unix(1700000000, 0)
+			t.now = func() time.Time { return now }
+			return t
+		}
+
+		It("is disabled without options", func() {
+			Expect(newThrottle(Options{})).To(BeNil())
+			ok, occurrences := (*throttle)(nil).allow("test_err")
+			Expect(ok).To(BeTrue())
+			Expect(occurrences).To(Equal(1))
+		})
+
+		It("samples 1 in N per error type", func() {
+			t := newTestThrottle(Options{SampleRate: 3})
+			allowed := 0
+			for i := 0; i < 9; i++ {
+				if ok, _ := t.allow("test_err"); ok {
+					allowed++
+				}
+			}
+			Expect(allowed).To(Equal(3))
+
+			ok, occurrences := t.allow("other_err")
+			Expect(ok).To(BeTrue())
+			Expect(occurrences).To(Equal(1))
+		})
+
+		It("rate limits and coalesces occurrences into the next window", func() {
+			t := newTestThrottle(Options{RateLimit: 2, Window: time.Minute})
+			for i := 0; i < 2; i++ {
+				ok, occurrences := t.allow("test_err")
+				Expect(ok).To(BeTrue())
+				Expect(occurrences).To(Equal(1))
+			}
+			for i := 0; i < 5; i++ {
+				ok, _ := t.allow("test_err")
+				Expect(ok).To(BeFalse())
+			}
+
+			now = now.Add(time.Minute)
+			ok, occurrences := t.allow("test_err")
+			Expect(ok).To(BeTrue())
+			Expect(occurrences).To(Equal(6))
+		})
+
+		It("is safe for concurrent use", func() {
+			t := newTestThrottle(Options{SampleRate: 2})
+			var wg sync.WaitGroup
+			var allowed atomic.Int32
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						if ok, _ := t.allow("test_err"); ok {
+							allowed.Add(1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			Expect(allowed.Load()).To(Equal(int32(500)))
+		})
+	})
+
 	Context("logMessage", func() {
 
 		It("for error", func() {
@@ -57,6 +130,12 @@ var _ = Describe("AirbrakeMiddleware", func() {
 			Expect(notice.Params).Should(Equal(map[string]interface{}{"log_type": "error", "error": "sample error"}))
 		})
 
+		It("with error context", func() {
+			notice := handler.logMessage(logrus.ERROR, "test_err", errors.New("sample error"), nil)
+			ErrorContext{Vin: "VIN42", TxType: "V", Datastore: "kafka"}.addParams(notice)
+			Expect(notice.Params).Should(Equal(map[string]interface{}{"log_type": "error", "error": "sample error", "vin": "VIN42", "txtype": "V", "datastore": "kafka"}))
+		})
+
 		It("for info", func() {
 			notice := handler.logMessage(logrus.INFO, "test_info", nil, logrus.LogInfo{"key1": "value1", "key2": "value2"})
 			Expect(len(notice.Errors)).Should(Equal(1))
@@ -0,0 +1,79 @@
+package airbrake
+
+import (
+	"sync"
+	"time"
+)
+
+// Options controls how many notices are sent to airbrake
+type Options struct {
+	// SampleRate reports 1 in SampleRate occurrences of an error type, every occurrence is reported if <= 1
+	SampleRate int
+
+	// RateLimit is the max number of notices per error type sent in Window, unlimited if <= 0
+	RateLimit int
+
+	// Window over which RateLimit applies and identical errors are coalesced
+	Window time.Duration
+}
+
+type throttleState struct {
+	windowStart time.Time
+	seen        int
+	sent        int
+	suppressed  int
+}
+
+// throttle decides whether a notice should be sent, it is shared by all the producer goroutines
+type throttle struct {
+	options Options
+	now     func() time.Time
+
+	lock   sync.Mutex
+	states map[string]*throttleState
+}
+
+func newThrottle(options Options) *throttle {
+	if options.SampleRate <= 1 && options.RateLimit <= 0 {
+		return nil
+	}
+	return &throttle{
+		options: options,
+		now:     time.Now,
+		states:  make(map[string]*throttleState),
+	}
+}
+
+// allow returns whether a notice for errorType should be sent along with the number of
+// occurrences it accounts for, including the ones suppressed since the last notice
+func (t *throttle) allow(errorType string) (bool, int) {
+	if t == nil {
+		return true, 1
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	state, ok := t.states[errorType]
+	if !ok {
+		state = &throttleState{windowStart: now}
+		t.states[errorType] = state
+	}
+	if t.options.Window > 0 && now.Sub(state.windowStart) >= t.options.Window {
+		state.windowStart = now
+		state.sent = 0
+	}
+
+	state.seen++
+	sampled := t.options.SampleRate <= 1 || state.seen%t.options.SampleRate == 1
+	limited := t.options.RateLimit > 0 && state.sent >= t.options.RateLimit
+	if !sampled || limited {
+		state.suppressed++
+		return false, 0
+	}
+
+	occurrences := state.suppressed + 1
+	state.suppressed = 0
+	state.sent++
+	return true, occurrences
+}
@@ -0,0 +1,122 @@
+package monitoring
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+)
+
+// DebugVINPattern is the route of the debug endpoint on the profiler port
+const DebugVINPattern = "GET /debug/vin/{vin}"
+
+// redactedValue replaces the values of the redacted fields
+const redactedValue = "[redacted]"
+
+// DebugVINHandler returns the last records received from a vin, with the values of the redacted fields hidden
+type DebugVINHandler struct {
+	token         []byte
+	redactFields  map[string]bool
+	recentRecords *streaming.RecentRecords
+	logger        *logrus.Logger
+}
+
+// DebugRecord is a record returned by the debug endpoint
+type DebugRecord struct {
+	TxType     string          `json:"txtype"`
+	Txid       string          `json:"txid"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// NewDebugVINHandler returns the handler of the debug endpoint
+func NewDebugVINHandler(config *config.DebugVIN, recentRecords *streaming.RecentRecords, logger *logrus.Logger) *DebugVINHandler {
+	redactFields := make(map[string]bool, len(config.RedactFields))
+	for _, field := range config.RedactFields {
+		redactFields[field] = true
+	}
+	return &DebugVINHandler{token: []byte(config.Token), redactFields: redactFields, recentRecords: recentRecords, logger: logger}
+}
+
+// RegisterDebugVIN serves the debug endpoint on the profiler port, the config is expected to be validated
+func RegisterDebugVIN(config *config.Config, recentRecords *streaming.RecentRecords, logger *logrus.Logger) {
+	http.Handle(DebugVINPattern, NewDebugVINHandler(config.DebugVIN, recentRecords, logger))
+	logInfo := logrus.LogInfo{"records": config.DebugVIN.RecordsPerVIN(), "max_vins": config.DebugVIN.MaxTrackedVINs()}
+	if config.Monitoring != nil {
+		logInfo["port"] = config.Monitoring.ProfilerPort
+	}
+	logger.ActivityLog("debug_vin_enabled", logInfo)
+}
+
+// ServeHTTP returns the records of the vin to requests with the token, every request is rejected when the token
+// is empty
+func (h *DebugVINHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(h.token) == 0 || subtle.ConstantTimeCompare([]byte(token), h.token) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vin := r.PathValue("vin")
+	records := h.recentRecords.Get(vin)
+	// requests are logged so record access can be audited
+	h.logger.ActivityLog("debug_vin_request", logrus.LogInfo{"vin": vin, "records": len(records), "remote_addr": r.RemoteAddr})
+	if len(records) == 0 {
+		http.Error(w, "no record received from this vin", http.StatusNotFound)
+		return
+	}
+
+	debugRecords := make([]DebugRecord, 0, len(records))
+	for _, record := range records {
+		debugRecord := DebugRecord{TxType: record.TxType, Txid: record.Txid, ReceivedAt: record.ServerReceivedAt}
+		if payload, err := h.redactedPayload(record.GetJSONPayload()); err != nil {
+			debugRecord.Error = err.Error()
+		} else {
+			debugRecord.Payload = payload
+		}
+		debugRecords = append(debugRecords, debugRecord)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"vin": vin, "records": debugRecords})
+}
+
+func (h *DebugVINHandler) redactedPayload(payload []byte, err error) (json.RawMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(h.redactFields) == 0 {
+		return payload, nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(h.redact(decoded))
+}
+
+// redact hides the values of the redacted keys, and the value of the V record data whose key is redacted:
+// {"key": "Location", "value": {...}}
+func (h *DebugVINHandler) redact(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		datumKey, _ := typed["key"].(string)
+		for key, child := range typed {
+			if h.redactFields[key] || (key == "value" && h.redactFields[datumKey]) {
+				typed[key] = redactedValue
+				continue
+			}
+			typed[key] = h.redact(child)
+		}
+	case []interface{}:
+		for i, child := range typed {
+			typed[i] = h.redact(child)
+		}
+	}
+	return value
+}
@@ -0,0 +1,101 @@
+package monitoring_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/monitoring"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("DebugVINHandler", func() {
+	const token = "0123456789abcdef"
+
+	var (
+		recentRecords *streaming.RecentRecords
+		mux           *http.ServeMux
+	)
+
+	newRecord := func(vin string, data ...*protos.Datum) *telemetry.Record {
+		logger, _ := logrus.NoOpLogger()
+		payload, err := proto.Marshal(&protos.Payload{Vin: vin, Data: data})
+		Expect(err).NotTo(HaveOccurred())
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: vin, SenderID: "vehicle_device." + vin}, map[string][]telemetry.Producer{}, logger)
+		message := messages.StreamMessage{TXID: []byte("txid"), SenderID: []byte("vehicle_device." + vin), MessageTopic: []byte("V"), Payload: payload}
+		messageBytes, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := telemetry.NewRecord(serializer, messageBytes, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		return record
+	}
+
+	get := func(vin string, authorization string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/debug/vin/"+vin, nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		recentRecords = streaming.NewRecentRecords(2, 10)
+		mux = http.NewServeMux()
+		mux.Handle(monitoring.DebugVINPattern, monitoring.NewDebugVINHandler(&config.DebugVIN{Token: token, RedactFields: []string{"Location"}}, recentRecords, logger))
+	})
+
+	It("requires the token", func() {
+		recentRecords.Add(newRecord("VIN42"))
+		Expect(get("VIN42", "").Code).To(Equal(http.StatusUnauthorized))
+		Expect(get("VIN42", "Bearer fedcba9876543210").Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects every request when the token is empty", func() {
+		logger, _ := logrus.NoOpLogger()
+		mux = http.NewServeMux()
+		mux.Handle(monitoring.DebugVINPattern, monitoring.NewDebugVINHandler(&config.DebugVIN{}, recentRecords, logger))
+		recentRecords.Add(newRecord("VIN42"))
+
+		Expect(get("VIN42", "Bearer ").Code).To(Equal(http.StatusUnauthorized))
+		Expect(get("VIN42", "").Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("returns 404 for vins without records", func() {
+		Expect(get("VIN42", "Bearer "+token).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("returns the last records with the redacted fields hidden", func() {
+		location := &protos.Datum{Key: protos.Field_Location, Value: &protos.Value{Value: &protos.Value_LocationValue{LocationValue: &protos.LocationValue{Latitude: 37.412374, Longitude: -122.145867}}}}
+		gear := &protos.Datum{Key: protos.Field_Gear, Value: &protos.Value{Value: &protos.Value_StringValue{StringValue: "D"}}}
+		recentRecords.Add(newRecord("VIN42", gear))
+		recentRecords.Add(newRecord("VIN42", location, gear))
+
+		response := get("VIN42", "Bearer "+token)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		var body struct {
+			VIN     string                   `json:"vin"`
+			Records []monitoring.DebugRecord `json:"records"`
+		}
+		Expect(json.Unmarshal(response.Body.Bytes(), &body)).To(Succeed())
+		Expect(body.VIN).To(Equal("VIN42"))
+		Expect(body.Records).To(HaveLen(2))
+		Expect(body.Records[0].TxType).To(Equal("V"))
+		Expect(string(body.Records[0].Payload)).To(ContainSubstring(`{"key":"Location","value":"[redacted]"}`))
+		Expect(string(body.Records[0].Payload)).NotTo(ContainSubstring("37.412374"))
+		Expect(string(body.Records[0].Payload)).To(ContainSubstring(`"stringValue":"D"`))
+		Expect(string(body.Records[1].Payload)).NotTo(ContainSubstring("Location"))
+	})
+})
@@ -0,0 +1,100 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/teslamotors/fleet-telemetry/protos"
+)
+
+// FieldCatalog lists the fields vehicles can stream and the types their values can take.
+// The proto schema does not bind a field to a value type, any field is sent with one of the value types
+type FieldCatalog struct {
+	Fields     []CatalogField     `json:"fields"`
+	ValueTypes []CatalogValueType `json:"value_types"`
+}
+
+// CatalogField is a protos.Field
+type CatalogField struct {
+	Name   string `json:"name"`
+	Number int32  `json:"number"`
+}
+
+// CatalogValueType is a member of the protos.Value oneof
+type CatalogValueType struct {
+	// Name is the key of the value in json records
+	Name      string `json:"name"`
+	ProtoType string `json:"proto_type"`
+	// JSONType is how protojson encodes the value, 64 bit integers are strings
+	JSONType string   `json:"json_type"`
+	Enum     []string `json:"enum,omitempty"`
+}
+
+// NewFieldCatalog builds the catalog from the protobuf descriptors
+func NewFieldCatalog() *FieldCatalog {
+	catalog := &FieldCatalog{}
+
+	fieldValues := protos.Field(0).Descriptor().Values()
+	for i := 0; i < fieldValues.Len(); i++ {
+		value := fieldValues.Get(i)
+		catalog.Fields = append(catalog.Fields, CatalogField{Name: string(value.Name()), Number: int32(value.Number())})
+	}
+
+	oneof := (&protos.Value{}).ProtoReflect().Descriptor().Oneofs().ByName("value")
+	for i := 0; i < oneof.Fields().Len(); i++ {
+		field := oneof.Fields().Get(i)
+		valueType := CatalogValueType{Name: field.JSONName(), ProtoType: field.Kind().String(), JSONType: jsonType(field)}
+		switch field.Kind() {
+		case protoreflect.EnumKind:
+			valueType.ProtoType = string(field.Enum().Name())
+			enumValues := field.Enum().Values()
+			for j := 0; j < enumValues.Len(); j++ {
+				valueType.Enum = append(valueType.Enum, string(enumValues.Get(j).Name()))
+			}
+		case protoreflect.MessageKind:
+			valueType.ProtoType = string(field.Message().Name())
+		}
+		catalog.ValueTypes = append(catalog.ValueTypes, valueType)
+	}
+	return catalog
+}
+
+// jsonType returns the json type protojson uses for the field
+func jsonType(field protoreflect.FieldDescriptor) string {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return "boolean"
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind, protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.FloatKind, protoreflect.DoubleKind:
+		return "number"
+	case protoreflect.MessageKind:
+		return "object"
+	default:
+		return "string"
+	}
+}
+
+// ServeHTTP writes the catalog as json with ?format=json, or as text tables
+func (c *FieldCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "FIELD\tNUMBER")
+	for _, field := range c.Fields {
+		_, _ = fmt.Fprintf(table, "%s\t%d\n", field.Name, field.Number)
+	}
+	_, _ = fmt.Fprintln(table, "\nVALUE TYPE\tPROTO TYPE\tJSON TYPE")
+	for _, valueType := range c.ValueTypes {
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\n", valueType.Name, valueType.ProtoType, valueType.JSONType)
+	}
+	_ = table.Flush()
+}
@@ -0,0 +1,62 @@
+package monitoring_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/monitoring"
+)
+
+var _ = Describe("FieldCatalog", func() {
+	var catalog *monitoring.FieldCatalog
+
+	BeforeEach(func() {
+		catalog = monitoring.NewFieldCatalog()
+	})
+
+	It("lists every field", func() {
+		Expect(catalog.Fields).To(HaveLen(len(protos.Field_name)))
+		Expect(catalog.Fields).To(ContainElement(monitoring.CatalogField{Name: "VehicleSpeed", Number: int32(protos.Field_VehicleSpeed)}))
+	})
+
+	It("describes the value types", func() {
+		Expect(catalog.ValueTypes).To(ContainElements(
+			monitoring.CatalogValueType{Name: "stringValue", ProtoType: "string", JSONType: "string"},
+			monitoring.CatalogValueType{Name: "intValue", ProtoType: "int32", JSONType: "number"},
+			monitoring.CatalogValueType{Name: "longValue", ProtoType: "int64", JSONType: "string"},
+			monitoring.CatalogValueType{Name: "booleanValue", ProtoType: "bool", JSONType: "boolean"},
+			monitoring.CatalogValueType{Name: "locationValue", ProtoType: "LocationValue", JSONType: "object"},
+		))
+
+		var shiftState monitoring.CatalogValueType
+		for _, valueType := range catalog.ValueTypes {
+			if valueType.Name == "shiftStateValue" {
+				shiftState = valueType
+			}
+		}
+		Expect(shiftState.ProtoType).To(Equal("ShiftState"))
+		Expect(shiftState.Enum).To(ContainElement("ShiftStateD"))
+	})
+
+	It("serves json", func() {
+		recorder := httptest.NewRecorder()
+		catalog.ServeHTTP(recorder, httptest.NewRequest("GET", "/fields?format=json", nil))
+
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+		served := &monitoring.FieldCatalog{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), served)).To(Succeed())
+		Expect(served).To(Equal(catalog))
+	})
+
+	It("serves a table by default", func() {
+		recorder := httptest.NewRecorder()
+		catalog.ServeHTTP(recorder, httptest.NewRequest("GET", "/fields", nil))
+
+		Expect(recorder.Body.String()).To(HavePrefix("FIELD"))
+		Expect(recorder.Body.String()).To(MatchRegexp(`VehicleSpeed\s+4\n`))
+	})
+})
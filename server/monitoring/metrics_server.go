@@ -33,14 +33,22 @@ var (
 func StartServerMetrics(config *config.Config, logger *logrus.Logger, registry *streaming.SocketRegistry) {
 	registerMetricsOnce(config.MetricCollector)
 
-	if config.Monitoring.PrometheusMetricsPort > 0 {
-		promMux := http.NewServeMux()
-		promMux.Handle("/metrics", promhttp.Handler())
-		go func() {
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Monitoring.PrometheusMetricsPort), promMux); err != nil {
-				logger.ErrorLog("metrics_server_err", err, nil)
+	if config.Monitoring.PrometheusEnabled() {
+		if config.Monitoring.PrometheusMetricsPort > 0 {
+			promMux := http.NewServeMux()
+			promMux.Handle("/metrics", promhttp.Handler())
+			go func() {
+				if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Monitoring.PrometheusMetricsPort), promMux); err != nil {
+					logger.ErrorLog("metrics_server_err", err, nil)
+				}
+			}()
+		} else {
+			// served by the profiler server along with pprof
+			http.Handle("/metrics", promhttp.Handler())
+			if config.Monitoring.ProfilerPort == 0 {
+				logger.ErrorLog("metrics_server_port_missing", nil, logrus.LogInfo{"exporter": config.Monitoring.Exporter})
 			}
-		}()
+		}
 	}
 
 	if config.Monitoring.ProfilerPort > 0 {
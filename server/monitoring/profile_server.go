@@ -61,6 +61,7 @@ func StartProfilerServer(config *config.Config, mux *http.ServeMux, logger *logr
 	profileServer := &profileServer{}
 	mux.HandleFunc("/gc_stats", profileServer.gcStats())
 	mux.HandleFunc("/live_profiler", profileServer.liveProfiler(config))
+	mux.Handle("/fields", NewFieldCatalog())
 
 	logger.ActivityLog("profiler_started", logrus.LogInfo{"port": config.Monitoring.ProfilerPort})
 }
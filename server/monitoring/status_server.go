@@ -1,33 +1,92 @@
 package monitoring
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/teslamotors/fleet-telemetry/config"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
 
-type statusServer struct {
+const readinessCheckTimeout = 2 * time.Second
+
+// StatusServer answers the liveness and readiness probes
+type StatusServer struct {
+	readinessChecks atomic.Pointer[map[telemetry.Dispatcher]telemetry.HealthChecker]
+	logger          *logrus.Logger
+}
+
+// NewStatusServer returns a status server which is not ready until SetProducers is called
+func NewStatusServer(logger *logrus.Logger) *StatusServer {
+	return &StatusServer{logger: logger}
 }
 
 // Status API
-func (s *statusServer) Status() func(w http.ResponseWriter, _ *http.Request) {
+func (s *StatusServer) Status() func(w http.ResponseWriter, _ *http.Request) {
 	return func(w http.ResponseWriter, _ *http.Request) {
 		_, _ = fmt.Fprint(w, "ok")
 	}
 }
 
+// SetProducers checks the connectivity of the given dispatchers on readiness probes,
+// producers unable to report their health are considered ready
+func (s *StatusServer) SetProducers(producers map[telemetry.Dispatcher]telemetry.Producer, dispatchers []telemetry.Dispatcher) {
+	checks := make(map[telemetry.Dispatcher]telemetry.HealthChecker)
+	for _, dispatcher := range dispatchers {
+		if checker, ok := producers[dispatcher].(telemetry.HealthChecker); ok {
+			checks[dispatcher] = checker
+		}
+	}
+	s.readinessChecks.Store(&checks)
+}
+
+// Ready API responds with 503 until the producers are set and while one of the checked datastores is unreachable
+func (s *StatusServer) Ready() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := s.readinessChecks.Load()
+		if checks == nil {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+		defer cancel()
+		ready := true
+		statuses := make(map[telemetry.Dispatcher]string, len(*checks))
+		for dispatcher, checker := range *checks {
+			statuses[dispatcher] = "ok"
+			if err := checker.CheckHealth(ctx); err != nil {
+				ready = false
+				statuses[dispatcher] = err.Error()
+				s.logger.ErrorLog("readiness_check_failed", err, logrus.LogInfo{"dispatcher": dispatcher})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(statuses)
+	}
+}
+
 // StartStatusServer initializes the status server on http
-func StartStatusServer(config *config.Config, logger *logrus.Logger, airbrakeHandler *airbrake.Handler) {
-	statusServer := &statusServer{}
+func StartStatusServer(config *config.Config, logger *logrus.Logger, airbrakeHandler *airbrake.Handler) *StatusServer {
+	statusServer := NewStatusServer(logger)
 	mux := http.NewServeMux()
 	mux.Handle("/status", airbrakeHandler.WithReporting(http.HandlerFunc(statusServer.Status())))
+	mux.Handle("/ready", airbrakeHandler.WithReporting(http.HandlerFunc(statusServer.Ready())))
 	go func() {
 		if err := http.ListenAndServe(fmt.Sprintf(":%d", config.StatusPort), mux); err != nil {
 			logger.ErrorLog("status", err, nil)
 		}
 	}()
 	logger.ActivityLog("status_server_configured", nil)
+	return statusServer
 }
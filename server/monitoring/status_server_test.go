@@ -0,0 +1,79 @@
+package monitoring_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/server/monitoring"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type healthCheckProducer struct {
+	err error
+}
+
+func (p *healthCheckProducer) Close() error                                    { return nil }
+func (p *healthCheckProducer) Produce(_ *telemetry.Record) error               { return nil }
+func (p *healthCheckProducer) ProcessReliableAck(_ *telemetry.Record)          {}
+func (p *healthCheckProducer) ReportError(_ string, _ error, _ logrus.LogInfo) {}
+func (p *healthCheckProducer) CheckHealth(_ context.Context) error             { return p.err }
+
+var _ = Describe("StatusServer", func() {
+	var (
+		statusServer *monitoring.StatusServer
+		kafka        *healthCheckProducer
+		producers    map[telemetry.Dispatcher]telemetry.Producer
+	)
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		statusServer = monitoring.NewStatusServer(logger)
+		kafka = &healthCheckProducer{}
+		producers = map[telemetry.Dispatcher]telemetry.Producer{
+			telemetry.Kafka:  kafka,
+			telemetry.NATS:   &healthCheckProducer{err: errors.New("nats connection CLOSED")},
+			telemetry.Logger: &healthCheckProducer{},
+		}
+	})
+
+	ready := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		statusServer.Ready()(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return recorder
+	}
+
+	It("is not ready before the producers are set", func() {
+		Expect(ready().Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("is ready when the checked datastores are reachable", func() {
+		statusServer.SetProducers(producers, []telemetry.Dispatcher{telemetry.Kafka})
+
+		recorder := ready()
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var statuses map[string]string
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &statuses)).To(Succeed())
+		Expect(statuses).To(Equal(map[string]string{"kafka": "ok"}))
+	})
+
+	It("is not ready while a checked datastore is unreachable", func() {
+		statusServer.SetProducers(producers, []telemetry.Dispatcher{telemetry.Kafka, telemetry.NATS})
+
+		recorder := ready()
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		var statuses map[string]string
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &statuses)).To(Succeed())
+		Expect(statuses).To(Equal(map[string]string{"kafka": "ok", "nats": "nats connection CLOSED"}))
+
+		kafka.err = errors.New("all brokers down")
+		statusServer.SetProducers(producers, []telemetry.Dispatcher{telemetry.Kafka})
+		Expect(ready().Code).To(Equal(http.StatusServiceUnavailable))
+	})
+})
@@ -0,0 +1,120 @@
+package streaming
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+const (
+	// FlowControlTopic is the topic of flow control messages sent to vehicles
+	FlowControlTopic = "flow_control"
+	// FlowControlPause asks the vehicle to pause sending records
+	FlowControlPause = "pause"
+	// FlowControlResume lets the vehicle resume sending records
+	FlowControlResume = "resume"
+
+	backpressureCheckInterval = 500 * time.Millisecond
+)
+
+// BackpressureMonitor watches the producer queues and asks connected vehicles to pause while they are saturated
+type BackpressureMonitor struct {
+	highWater    int
+	lowWater     int
+	queues       []telemetry.QueueSizer
+	registry     *SocketRegistry
+	logger       *logrus.Logger
+	active       bool
+	lastActiveAt time.Time
+}
+
+// NewBackpressureMonitor returns a monitor over the producers exposing their queue size
+func NewBackpressureMonitor(c *config.Config, producers map[telemetry.Dispatcher]telemetry.Producer, registry *SocketRegistry, logger *logrus.Logger) (*BackpressureMonitor, error) {
+	registerMetricsOnce(c.MetricCollector)
+	if c.Backpressure.LowWater >= c.Backpressure.HighWater {
+		return nil, fmt.Errorf("backpressure low_water (%d) must be lower than high_water (%d)", c.Backpressure.LowWater, c.Backpressure.HighWater)
+	}
+
+	var queues []telemetry.QueueSizer
+	for _, producer := range producers {
+		if queue, ok := producer.(telemetry.QueueSizer); ok {
+			queues = append(queues, queue)
+		}
+	}
+	return &BackpressureMonitor{
+		highWater: c.Backpressure.HighWater,
+		lowWater:  c.Backpressure.LowWater,
+		queues:    queues,
+		registry:  registry,
+		logger:    logger,
+	}, nil
+}
+
+// Start checks the producer queues periodically
+func (b *BackpressureMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(backpressureCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			b.Check()
+		}
+	}()
+}
+
+// Check updates the backpressure state from the producer queues, notifies the sockets and returns the state
+func (b *BackpressureMonitor) Check() bool {
+	queueSize := 0
+	for _, queue := range b.queues {
+		queueSize += queue.QueueSize()
+	}
+
+	now := time.Now()
+	if b.active {
+		metricsRegistry.backpressureDurationMs.Add(now.Sub(b.lastActiveAt).Milliseconds(), map[string]string{})
+		b.lastActiveAt = now
+	}
+	switch {
+	case !b.active && queueSize > b.highWater:
+		b.active = true
+		b.lastActiveAt = now
+		b.logger.ActivityLog("backpressure_started", logrus.LogInfo{"queue_size": queueSize})
+	case b.active && queueSize < b.lowWater:
+		b.active = false
+		b.logger.ActivityLog("backpressure_stopped", logrus.LogInfo{"queue_size": queueSize})
+	}
+
+	for _, socket := range b.registry.Sockets() {
+		socket.notifyBackpressure(b.active)
+	}
+	return b.active
+}
+
+// notifyBackpressure sends a flow control message if the vehicle is not aware of the backpressure state.
+// It never blocks, the notification is retried on the next check if the write channel is full
+func (sm *SocketManager) notifyBackpressure(active bool) {
+	// gRPC streams rely on the flow control of HTTP/2
+	if sm.paused == active || sm.respond != nil {
+		return
+	}
+	payload := FlowControlResume
+	if active {
+		payload = FlowControlPause
+	}
+	message := messages.StreamMessage{TXID: []byte(uuid.New().String()), MessageTopic: []byte(FlowControlTopic), Payload: []byte(payload)}
+	msg, err := message.ToBytes()
+	if err != nil {
+		sm.logger.ErrorLog("flow_control_message_error", err, nil)
+		return
+	}
+	select {
+	case sm.writeChan <- SocketMessage{sm.MsgType, msg}:
+		sm.paused = active
+	default:
+	}
+}
@@ -0,0 +1,75 @@
+package streaming_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type QueuedProducer struct {
+	telemetry.Producer
+	size int
+}
+
+func (q *QueuedProducer) QueueSize() int {
+	return q.size
+}
+
+var _ = Describe("BackpressureMonitor", func() {
+	var (
+		conf     *config.Config
+		logger   *logrus.Logger
+		registry *streaming.SocketRegistry
+		producer *QueuedProducer
+		sm       *streaming.SocketManager
+	)
+
+	flowControlPayload := func() string {
+		msg := sm.ListenToWriteChannel()
+		streamMessage, err := messages.StreamMessageFromBytes(msg.Msg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(streamMessage.Topic()).To(Equal(streaming.FlowControlTopic))
+		return string(streamMessage.Payload)
+	}
+
+	BeforeEach(func() {
+		conf = CreateTestConfig()
+		conf.Backpressure = &config.Backpressure{HighWater: 10, LowWater: 5}
+		logger, _ = logrus.NoOpLogger()
+		registry = streaming.NewSocketRegistry()
+		producer = &QueuedProducer{}
+		sm = streaming.NewSocketManager(context.Background(), &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, nil, conf, logger)
+		registry.RegisterSocket(sm)
+	})
+
+	It("pauses above high water and resumes below low water", func() {
+		monitor, err := streaming.NewBackpressureMonitor(conf, map[telemetry.Dispatcher]telemetry.Producer{telemetry.Kafka: producer}, registry, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(monitor.Check()).To(BeFalse())
+
+		producer.size = 11
+		Expect(monitor.Check()).To(BeTrue())
+		Expect(flowControlPayload()).To(Equal(streaming.FlowControlPause))
+
+		producer.size = 7
+		Expect(monitor.Check()).To(BeTrue())
+
+		producer.size = 4
+		Expect(monitor.Check()).To(BeFalse())
+		Expect(flowControlPayload()).To(Equal(streaming.FlowControlResume))
+	})
+
+	It("rejects low water above high water", func() {
+		conf.Backpressure = &config.Backpressure{HighWater: 5, LowWater: 10}
+		_, err := streaming.NewBackpressureMonitor(conf, nil, registry, logger)
+		Expect(err).To(MatchError("backpressure low_water (10) must be lower than high_water (5)"))
+	})
+})
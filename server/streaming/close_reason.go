@@ -0,0 +1,42 @@
+package streaming
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseReason is sent in the close frame of the websockets the server closes, the text of the frame is the name of
+// the reason so firmware can pick a backoff before reconnecting
+type CloseReason struct {
+	Code int
+	Name string
+}
+
+var (
+	// CloseRateLimited closes vehicles exceeding the message rate limit, they should back off before reconnecting
+	CloseRateLimited = CloseReason{Code: 4429, Name: "rate_limited"}
+	// CloseUnauthorized closes vehicles whose client certificate doesn't identify a device, reconnecting won't help
+	CloseUnauthorized = CloseReason{Code: 4401, Name: "unauthorized"}
+	// CloseInvalidPayload closes vehicles sending records which can't be decoded, with invalid_payload_action close
+	CloseInvalidPayload = CloseReason{Code: websocket.CloseInvalidFramePayloadData, Name: "invalid_payload"}
+	// CloseShuttingDown closes vehicles while the server drains, they can reconnect to another server right away
+	CloseShuttingDown = CloseReason{Code: websocket.CloseGoingAway, Name: "shutting_down"}
+	// CloseMaxLifetime closes connections reaching their max lifetime, they can reconnect right away
+	CloseMaxLifetime = CloseReason{Code: websocket.CloseServiceRestart, Name: "max_lifetime"}
+	// CloseDuplicateVIN closes the connections of a vin above its connection limit
+	CloseDuplicateVIN = CloseReason{Code: websocket.ClosePolicyViolation, Name: "duplicate_vin"}
+	// CloseUnsupportedProtocol closes vehicles requesting only subprotocols the server doesn't speak
+	CloseUnsupportedProtocol = CloseReason{Code: websocket.CloseProtocolError, Name: "unsupported_protocol"}
+)
+
+// message returns the close frame of the reason and counts it in socket_close_sent_total
+func (r CloseReason) message() []byte {
+	metricsRegistry.closeSentCount.Inc(map[string]string{"reason": r.Name})
+	return websocket.FormatCloseMessage(r.Code, r.Name)
+}
+
+// writeClose sends the close frame of the reason right away, ahead of the messages queued for the vehicle
+func writeClose(ws *websocket.Conn, reason CloseReason, timeout time.Duration) {
+	_ = ws.WriteControl(websocket.CloseMessage, reason.message(), time.Now().Add(timeout))
+}
@@ -0,0 +1,73 @@
+package streaming
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// countingConn counts the bytes read from the network, which are compressed when permessage-deflate is negotiated
+type countingConn struct {
+	net.Conn
+	bytesRead atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter hands a countingConn to the websocket upgrader when it hijacks the connection.
+// The upgrader reads from the hijacked connection directly as its read buffer size is set
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+// Hijack implements http.Hijacker
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, rw, nil
+}
+
+// offersPerMessageDeflate checks whether the client advertised the permessage-deflate extension
+func offersPerMessageDeflate(r *http.Request) bool {
+	for _, extensions := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(extensions, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reportCompressionSavings compares the size of a message once inflated with the bytes read from the network since
+// the previous one. Reads are buffered and small messages can grow once compressed, the difference is carried over to
+// the next message so the counter only moves forward. The transport only inflates its own frames, gzip payloads sent by
+// the vehicle reach the serializer unchanged and are decompressed there
+func (sm *SocketManager) reportCompressionSavings(messageSize int) {
+	if sm.compressedConn == nil {
+		return
+	}
+	wireBytes := sm.compressedConn.bytesRead.Load()
+	sm.bytesSaved += int64(messageSize) - (wireBytes - sm.wireBytesRead)
+	sm.wireBytesRead = wireBytes
+	if sm.bytesSaved > 0 {
+		metricsRegistry.compressionBytesSaved.Add(sm.bytesSaved, map[string]string{})
+		sm.bytesSaved = 0
+	}
+}
@@ -0,0 +1,94 @@
+package streaming
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// defaultDedupCacheSize is the number of records remembered when the cache size is not configured
+const defaultDedupCacheSize = 100000
+
+// Deduplicator remembers the records written within a time window, shared across connections
+// since a vehicle resends unacked records after reconnecting
+type Deduplicator struct {
+	mutex      sync.Mutex
+	window     time.Duration
+	maxEntries int
+	seed       maphash.Seed
+	entries    map[uint64]*list.Element
+	// order holds the dedupEntry values from the oldest to the most recent
+	order *list.List
+}
+
+type dedupEntry struct {
+	hash   uint64
+	seenAt time.Time
+}
+
+// NewDeduplicator returns a deduplicator remembering at most maxEntries records for window
+func NewDeduplicator(window time.Duration, maxEntries int) *Deduplicator {
+	return &Deduplicator{
+		window:     window,
+		maxEntries: maxEntries,
+		seed:       maphash.MakeSeed(),
+		entries:    make(map[uint64]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Seen returns true if a record with the same vin, type and payload was remembered within the window.
+// The payload is hashed as received, without being decoded
+func (d *Deduplicator) Seen(record *telemetry.Record) bool {
+	hash := d.hash(record)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.evictExpired(time.Now())
+	_, ok := d.entries[hash]
+	return ok
+}
+
+// Remember records the record once it was written, so copies the vehicle sends again are detected. Records failing
+// to be written are not remembered and their copies are dispatched again
+func (d *Deduplicator) Remember(record *telemetry.Record) {
+	hash := d.hash(record)
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.evictExpired(now)
+	if element, ok := d.entries[hash]; ok {
+		d.remove(element)
+	}
+	d.entries[hash] = d.order.PushBack(&dedupEntry{hash: hash, seenAt: now})
+	if d.order.Len() > d.maxEntries {
+		d.remove(d.order.Front())
+	}
+}
+
+func (d *Deduplicator) hash(record *telemetry.Record) uint64 {
+	var h maphash.Hash
+	h.SetSeed(d.seed)
+	_, _ = h.WriteString(record.Vin)
+	_ = h.WriteByte(0)
+	_, _ = h.WriteString(record.TxType)
+	_ = h.WriteByte(0)
+	_, _ = h.Write(record.PayloadBytes)
+	return h.Sum64()
+}
+
+// evictExpired removes the entries older than the window, d.mutex must be held
+func (d *Deduplicator) evictExpired(now time.Time) {
+	for front := d.order.Front(); front != nil && now.Sub(front.Value.(*dedupEntry).seenAt) > d.window; front = d.order.Front() {
+		d.remove(front)
+	}
+}
+
+func (d *Deduplicator) remove(element *list.Element) {
+	delete(d.entries, element.Value.(*dedupEntry).hash)
+	d.order.Remove(element)
+}
@@ -0,0 +1,55 @@
+package streaming_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Deduplicator", func() {
+	record := func(vin, txType, payload string) *telemetry.Record {
+		return &telemetry.Record{Vin: vin, TxType: txType, PayloadBytes: []byte(payload)}
+	}
+
+	It("detects records remembered within the window", func() {
+		deduplicator := streaming.NewDeduplicator(time.Minute, 10)
+
+		Expect(deduplicator.Seen(record("VIN1", "V", "data"))).To(BeFalse())
+		deduplicator.Remember(record("VIN1", "V", "data"))
+		Expect(deduplicator.Seen(record("VIN1", "V", "data"))).To(BeTrue())
+
+		Expect(deduplicator.Seen(record("VIN2", "V", "data"))).To(BeFalse())
+		Expect(deduplicator.Seen(record("VIN1", "alerts", "data"))).To(BeFalse())
+		Expect(deduplicator.Seen(record("VIN1", "V", "other"))).To(BeFalse())
+	})
+
+	It("does not detect records which were only checked", func() {
+		deduplicator := streaming.NewDeduplicator(time.Minute, 10)
+
+		Expect(deduplicator.Seen(record("VIN1", "V", "data"))).To(BeFalse())
+		Expect(deduplicator.Seen(record("VIN1", "V", "data"))).To(BeFalse())
+	})
+
+	It("forgets records once the window elapsed", func() {
+		deduplicator := streaming.NewDeduplicator(20*time.Millisecond, 10)
+
+		deduplicator.Remember(record("VIN1", "V", "data"))
+		time.Sleep(30 * time.Millisecond)
+		Expect(deduplicator.Seen(record("VIN1", "V", "data"))).To(BeFalse())
+	})
+
+	It("evicts the oldest records when full", func() {
+		deduplicator := streaming.NewDeduplicator(time.Minute, 2)
+
+		deduplicator.Remember(record("VIN1", "V", "1"))
+		deduplicator.Remember(record("VIN1", "V", "2"))
+		deduplicator.Remember(record("VIN1", "V", "3"))
+
+		Expect(deduplicator.Seen(record("VIN1", "V", "3"))).To(BeTrue())
+		Expect(deduplicator.Seen(record("VIN1", "V", "1"))).To(BeFalse())
+	})
+})
@@ -0,0 +1,388 @@
+package streaming
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// GRPCIngestMethod is the full name of the streaming method vehicles send their payloads to
+const GRPCIngestMethod = protos.VehicleIngest_Stream_FullMethodName
+
+// GRPCCloseReasonTrailer is the trailer telling clients why the server ended their stream
+const GRPCCloseReasonTrailer = "close-reason"
+
+// grpcIngest serves the VehicleIngest service, it processes the payloads streamed over gRPC like the V records
+// of websocket connections
+type grpcIngest struct {
+	protos.UnimplementedVehicleIngestServer
+	server *Server
+	config *config.Config
+}
+
+// NewGRPCServer returns the server of the gRPC ingest endpoint. It serves the server certificate of the config, requires
+// client certificates verified by tlsConfig and shares the dispatch rules and limits of the websocket server. Drain stops it
+func (s *Server) NewGRPCServer(c *config.Config, tlsConfig *tls.Config) (*grpc.Server, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLS.ServerCert, c.TLS.ServerKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	options := []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig)), grpc.InTapHandle(cancelableStream)}
+	if c.MaxMessageBytes > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(int(c.MaxMessageBytes)))
+	}
+	s.grpcServer = grpc.NewServer(options...)
+	protos.RegisterVehicleIngestServer(s.grpcServer, &grpcIngest{server: s, config: c})
+	return s.grpcServer, nil
+}
+
+// streamCancelKey is the context key of the function cancelling the context of a stream
+type streamCancelKey struct{}
+
+// cancelableStream makes the context of each stream cancelable by its handler. Cancelling it ends the Recv and
+// Send calls of the stream, which otherwise only return once the client is gone or the handler returned
+func cancelableStream(ctx context.Context, _ *tap.Info) (context.Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	return context.WithValue(ctx, streamCancelKey{}, cancel), nil
+}
+
+// streamContext returns the context of a stream and the function cancelling it
+func streamContext(stream protos.VehicleIngest_StreamServer) (context.Context, context.CancelFunc) {
+	if cancel, ok := stream.Context().Value(streamCancelKey{}).(context.CancelFunc); ok {
+		return stream.Context(), cancel
+	}
+	return context.WithCancel(stream.Context())
+}
+
+// Stream processes the payloads of a vehicle until the client or the server ends the stream
+func (g *grpcIngest) Stream(stream protos.VehicleIngest_StreamServer) error {
+	s := g.server
+	if s.draining.Load() {
+		return status.Error(codes.Unavailable, "server shutting down")
+	}
+	requestIdentity, err := grpcIdentity(stream.Context())
+	if err != nil {
+		s.logger.ErrorLog("extract_sender_id_err", err, nil)
+		return status.Error(codes.Unauthenticated, "invalid client certificate")
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		requestIdentity.SourceIP = addressHost(p.Addr.String())
+	}
+
+	serializer := s.newSerializer(requestIdentity, g.config)
+	socketManager := s.newSocketManager(context.Background(), requestIdentity, nil, g.config)
+	socketManager.requestInfo["method"] = GRPCIngestMethod
+	socketManager.requestInfo["txid"] = socketManager.UUID
+	socketManager.requestInfo["client_id"] = requestIdentity.DeviceID
+
+	// the responder is set before registering the socket, which exposes it to the reliable ack goroutine
+	ctx, cancelStream := streamContext(stream)
+	defer cancelStream()
+	// the stream ends with CANCELLED once its context is cancelled, the trailer keeps the reason of the server
+	var endOnce sync.Once
+	cancel := func() {
+		endOnce.Do(func() {
+			stream.SetTrailer(metadata.Pairs(GRPCCloseReasonTrailer, socketManager.streamCloseReason(nil)))
+			cancelStream()
+		})
+	}
+	acks := make(chan *protos.VehicleIngestAck, cap(socketManager.writeChan))
+	socketManager.respond = func(record *telemetry.Record, err error) {
+		if !socketManager.enqueueAck(acks, grpcAck(record, err)) {
+			cancel()
+		}
+	}
+	socketManager.cancelStream = cancel
+	if !s.registerSocket(socketManager, serializer) {
+		return status.Error(codes.AlreadyExists, "duplicate vin connection")
+	}
+	defer s.deregisterSocket(socketManager, serializer)
+	s.lookupMetadata(socketManager)
+
+	serverMetricsRegistry.grpcStreams.Add(1, map[string]string{})
+	defer serverMetricsRegistry.grpcStreams.Sub(1, map[string]string{})
+
+	return socketManager.processPayloadStream(ctx, cancel, stream, serializer, acks)
+}
+
+// processPayloadStream dispatches the payloads of a gRPC stream until the client closes it or ctx is done. Each payload
+// is acked with its position in the stream, acks of reliable datastores can arrive after the acks of the following payloads.
+// cancel must cancel the context of the stream, it returns once the goroutines using the stream are done
+func (sm *SocketManager) processPayloadStream(ctx context.Context, cancel context.CancelFunc, stream protos.VehicleIngest_StreamServer, serializer *telemetry.BinarySerializer, acks chan *protos.VehicleIngestAck) (err error) {
+	sm.reportConnected()
+	defer sm.reportDisconnected()
+
+	received := make(chan error, 1)
+	go func() { received <- sm.receivePayloads(ctx, stream, serializer) }()
+	flush := make(chan struct{})
+	sent := make(chan error, 1)
+	sender := newAckSender(stream, sm.config.GRPC)
+	go func() { sent <- sender.sendAcks(ctx, acks, flush) }()
+
+	select {
+	case err = <-received:
+		// the acks of the payloads received before the client closed the stream are still sent
+		close(flush)
+		if sendErr := <-sent; err == io.EOF {
+			err = sendErr
+		}
+	case err = <-sent:
+		cancel()
+		<-received
+	case <-ctx.Done():
+		<-received
+		<-sent
+	}
+
+	sm.closeReason = sm.streamCloseReason(err)
+	switch sm.closeReason {
+	case closeReasonClient:
+		return nil
+	case closeReasonInvalidPayload:
+		return status.Error(codes.InvalidArgument, "invalid payload")
+	case closeReasonWriteTimeout:
+		return status.Error(codes.DeadlineExceeded, "acks not read within the write timeout")
+	case closeReasonShutdown:
+		return status.Error(codes.Unavailable, "server shutting down")
+	case closeReasonDuplicateVIN:
+		return status.Error(codes.Aborted, "replaced by a newer connection")
+	case closeReasonRateLimited:
+		return status.Error(codes.ResourceExhausted, "rate limited")
+	case closeReasonMessageTooBig:
+		metricsRegistry.messageTooBigCount.Inc(map[string]string{})
+	}
+	return err
+}
+
+// receivePayloads processes the payloads of the stream as V records, until the client closes the stream or ctx is done
+func (sm *SocketManager) receivePayloads(ctx context.Context, stream protos.VehicleIngest_StreamServer, serializer *telemetry.BinarySerializer) error {
+	limiter := newConnectionRateLimiter(sm.rateLimit.Load())
+	for sequence := uint64(1); ; sequence++ {
+		payload, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		message, err := sm.payloadMessage(payload, sequence)
+		if err != nil {
+			return err
+		}
+		if !sm.admit(serializer, message, limiter) {
+			continue
+		}
+		sm.ParseAndProcessRecord(serializer, message)
+		if sm.closeRequested.Load() {
+			return nil
+		}
+	}
+}
+
+// payloadMessage wraps a payload in the stream message vehicles send over websockets, the txid ends with the sequence
+func (sm *SocketManager) payloadMessage(payload *protos.Payload, sequence uint64) ([]byte, error) {
+	payloadBytes, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	createdAt := time.Now()
+	if payload.GetCreatedAt() != nil {
+		createdAt = payload.GetCreatedAt().AsTime()
+	}
+	streamMessage := messages.StreamMessage{
+		TXID:         []byte(fmt.Sprintf("%s-%d", sm.UUID, sequence)),
+		SenderID:     []byte(sm.requestIdentity.SenderID),
+		DeviceID:     []byte(sm.requestIdentity.DeviceID),
+		DeviceType:   []byte("vehicle_device"),
+		MessageTopic: []byte("V"),
+		Payload:      payloadBytes,
+		CreatedAt:    uint32(createdAt.Unix()),
+	}
+	return streamMessage.ToBytes()
+}
+
+// grpcAck returns the ack of a record received on a gRPC stream
+func grpcAck(record *telemetry.Record, err error) *protos.VehicleIngestAck {
+	ack := &protos.VehicleIngestAck{}
+	if i := strings.LastIndexByte(record.Txid, '-'); i >= 0 {
+		ack.Sequence, _ = strconv.ParseUint(record.Txid[i+1:], 10, 64)
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	return ack
+}
+
+// enqueueAck hands an ack to the goroutine sending them, it returns false if the client did not read
+// its acks within the write timeout
+func (sm *SocketManager) enqueueAck(acks chan<- *protos.VehicleIngestAck, ack *protos.VehicleIngestAck) bool {
+	select {
+	case acks <- ack:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(sm.writeTimeout)
+	defer timer.Stop()
+	select {
+	case acks <- ack:
+	case <-sm.stopChan:
+	case <-timer.C:
+		sm.reportWriteTimeout()
+		return false
+	}
+	return true
+}
+
+// ackSender sends the acks of a stream. When acks are batched, the sequences of the accepted payloads are sent
+// together once the batch is full or its oldest ack waited for the batch interval
+type ackSender struct {
+	stream   protos.VehicleIngest_StreamServer
+	maxAcks  int
+	interval time.Duration
+	timer    *time.Timer
+	pending  []uint64
+}
+
+// newAckSender returns the ack sender of a stream, acks are only batched when c configures it
+func newAckSender(stream protos.VehicleIngest_StreamServer, c *config.GRPC) *ackSender {
+	sender := &ackSender{stream: stream}
+	if c != nil && c.AckBatch != nil {
+		sender.maxAcks, sender.interval = c.AckBatch.Limits()
+		sender.timer = time.NewTimer(sender.interval)
+		sender.timer.Stop()
+	}
+	return sender
+}
+
+// sendAcks sends the acks to the client until ctx is done, the acks already queued are sent once flush is closed
+func (a *ackSender) sendAcks(ctx context.Context, acks <-chan *protos.VehicleIngestAck, flush <-chan struct{}) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ack := <-acks:
+			if err := a.send(ack); err != nil {
+				return err
+			}
+		case <-a.batchExpired():
+			if err := a.sendBatch(); err != nil {
+				return err
+			}
+		case <-flush:
+			for {
+				select {
+				case ack := <-acks:
+					if err := a.send(ack); err != nil {
+						return err
+					}
+				default:
+					return a.sendBatch()
+				}
+			}
+		}
+	}
+}
+
+// send sends the ack right away, or adds it to the batch if it acks an accepted payload
+func (a *ackSender) send(ack *protos.VehicleIngestAck) error {
+	if a.maxAcks == 0 || ack.GetError() != "" {
+		return a.stream.Send(ack)
+	}
+	if len(a.pending) == 0 {
+		a.timer.Reset(a.interval)
+	}
+	a.pending = append(a.pending, ack.GetSequence())
+	if len(a.pending) >= a.maxAcks {
+		return a.sendBatch()
+	}
+	return nil
+}
+
+// sendBatch sends a single ack listing the sequences of the batch, if any
+func (a *ackSender) sendBatch() error {
+	if len(a.pending) == 0 {
+		return nil
+	}
+	a.timer.Stop()
+	sequences := a.pending
+	a.pending = nil
+	return a.stream.Send(&protos.VehicleIngestAck{Sequences: sequences})
+}
+
+// batchExpired fires once the oldest ack of the batch waited for the batch interval, it never fires without pending acks
+func (a *ackSender) batchExpired() <-chan time.Time {
+	if len(a.pending) == 0 {
+		return nil
+	}
+	return a.timer.C
+}
+
+// streamCloseReason classifies the error which ended a gRPC stream
+func (sm *SocketManager) streamCloseReason(err error) string {
+	switch {
+	case sm.draining.Load():
+		return closeReasonShutdown
+	case sm.closeRequested.Load():
+		return closeReasonInvalidPayload
+	case sm.writeTimedOut.Load():
+		return closeReasonWriteTimeout
+	case sm.replaced.Load():
+		return closeReasonDuplicateVIN
+	case sm.rateLimitClosed.Load():
+		return closeReasonRateLimited
+	case err == nil || errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled:
+		return closeReasonClient
+	case status.Code(err) == codes.ResourceExhausted:
+		return closeReasonMessageTooBig
+	default:
+		return closeReasonReadError
+	}
+}
+
+// grpcIdentity returns the identity of the client certificate of a gRPC stream
+func grpcIdentity(ctx context.Context) (*telemetry.RequestIdentity, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, errors.New("missing_peer_error")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil, errors.New("missing_certificate_error")
+	}
+	certs := tlsInfo.State.PeerCertificates
+	return identityFromCert(certs[len(certs)-1])
+}
+
+// addressHost returns the host of a host:port address
+func addressHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -0,0 +1,387 @@
+package streaming_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// ChannelProducer forwards the records it produces to a channel and returns err
+type ChannelProducer struct {
+	telemetry.Producer
+	records chan *telemetry.Record
+	err     error
+}
+
+func (c *ChannelProducer) Produce(record *telemetry.Record) error {
+	c.records <- record
+	return c.err
+}
+
+// testCertificate issues a certificate signed by parent, or a self signed CA when parent is nil
+func testCertificate(commonName string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	issuer, signer := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	Expect(err).NotTo(HaveOccurred())
+	leaf, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+var _ = Describe("gRPC ingest", func() {
+	var (
+		conf       *config.Config
+		producer   *ChannelProducer
+		produceErr error
+		server     *streaming.Server
+		registry   *streaming.SocketRegistry
+		ca         tls.Certificate
+		otherCA    tls.Certificate
+		address    string
+	)
+
+	BeforeEach(func() {
+		ca = testCertificate("TeslaMotors", nil)
+		otherCA = testCertificate("Other CA", nil)
+		serverCert := testCertificate("fleet-telemetry", &ca)
+		dir := GinkgoT().TempDir()
+		keyBytes, err := x509.MarshalECPrivateKey(serverCert.PrivateKey.(*ecdsa.PrivateKey))
+		Expect(err).NotTo(HaveOccurred())
+		certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+		Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Certificate[0]}), 0o600)).To(Succeed())
+		Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0o600)).To(Succeed())
+
+		conf = &config.Config{
+			TLS:             &config.TLS{ServerCert: certFile, ServerKey: keyFile},
+			GRPC:            &config.GRPC{Enabled: true},
+			MetricCollector: noop.NewCollector(),
+		}
+		produceErr = nil
+	})
+
+	JustBeforeEach(func() {
+		producer = &ChannelProducer{records: make(chan *telemetry.Record, 10), err: produceErr}
+		var routed telemetry.Producer = producer
+		if conf.AckChan != nil {
+			nacker := telemetry.NewNacker(telemetry.Kafka, conf.AckChan, map[string]interface{}{"V": true}, conf.MetricCollector)
+			routed = telemetry.NewNackProducer(producer, nacker)
+		}
+		logger, _ := logrus.NoOpLogger()
+		registry = streaming.NewSocketRegistry()
+		_, s, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{"V": {routed}}, logger, registry)
+		Expect(err).NotTo(HaveOccurred())
+		server = s
+
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.Leaf)
+		clientCAs.AddCert(otherCA.Leaf)
+		grpcServer, err := s.NewGRPCServer(conf, &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert})
+		Expect(err).NotTo(HaveOccurred())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		address = listener.Addr().String()
+		go func() { _ = grpcServer.Serve(listener) }()
+		DeferCleanup(grpcServer.Stop)
+	})
+
+	openStreamContext := func(ctx context.Context, clientCert tls.Certificate) protos.VehicleIngest_StreamClient {
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(ca.Leaf)
+		creds := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: rootCAs})
+		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+
+		stream, err := protos.NewVehicleIngestClient(conn).Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return stream
+	}
+
+	openStream := func(clientCert tls.Certificate) protos.VehicleIngest_StreamClient {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		DeferCleanup(cancel)
+		return openStreamContext(ctx, clientCert)
+	}
+
+	It("dispatches the streamed payloads as V records and acks them in order", func() {
+		stream := openStream(testCertificate("device-42", &ca))
+
+		for i := 0; i < 2; i++ {
+			payload := &protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now(), Data: []*protos.Datum{
+				{Key: protos.Field_VehicleName, Value: &protos.Value{Value: &protos.Value_StringValue{StringValue: "cybertruck"}}},
+			}}
+			Expect(stream.SendMsg(payload)).To(Succeed())
+		}
+		Expect(stream.CloseSend()).To(Succeed())
+
+		for sequence := uint64(1); sequence <= 2; sequence++ {
+			ack := &protos.VehicleIngestAck{}
+			Expect(stream.RecvMsg(ack)).To(Succeed())
+			Expect(ack.GetSequence()).To(Equal(sequence))
+			Expect(ack.GetError()).To(BeEmpty())
+
+			var record *telemetry.Record
+			Eventually(producer.records).Should(Receive(&record))
+			Expect(record.TxType).To(Equal("V"))
+			Expect(record.Vin).To(Equal("device-42"))
+			data := &protos.Payload{}
+			Expect(proto.Unmarshal(record.Payload(), data)).To(Succeed())
+			Expect(data.GetData()).To(HaveLen(1))
+		}
+	})
+
+	Context("with batched acks", func() {
+		BeforeEach(func() {
+			conf.GRPC.AckBatch = &config.AckBatch{MaxAcks: 2, Interval: 60000}
+		})
+
+		It("acks the accepted payloads together", func() {
+			stream := openStream(testCertificate("device-42", &ca))
+			for i := 0; i < 3; i++ {
+				Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+			}
+			Expect(stream.CloseSend()).To(Succeed())
+
+			ack := &protos.VehicleIngestAck{}
+			Expect(stream.RecvMsg(ack)).To(Succeed())
+			Expect(ack.GetSequence()).To(BeZero())
+			Expect(ack.GetSequences()).To(Equal([]uint64{1, 2}))
+
+			// the rest of the batch is sent once the client closed the stream
+			ack = &protos.VehicleIngestAck{}
+			Expect(stream.RecvMsg(ack)).To(Succeed())
+			Expect(ack.GetSequences()).To(Equal([]uint64{3}))
+		})
+	})
+
+	Context("with a metadata lookup", func() {
+		var (
+			lookupStatus int
+			lookups      *atomic.Int32
+		)
+
+		BeforeEach(func() {
+			lookupStatus = http.StatusOK
+			lookups = &atomic.Int32{}
+			lookup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				lookups.Add(1)
+				w.WriteHeader(lookupStatus)
+				_, _ = w.Write([]byte(`{"fleet":"north","vin":"spoofed"}`))
+			}))
+			DeferCleanup(lookup.Close)
+			conf.MetadataLookup = &config.MetadataLookup{URL: lookup.URL + "/{vin}"}
+		})
+
+		It("adds the metadata to the records of the connection", func() {
+			stream := openStream(testCertificate("device-42", &ca))
+			Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+
+			var record *telemetry.Record
+			Eventually(producer.records).Should(Receive(&record))
+			Expect(record.Metadata()).To(HaveKeyWithValue("fleet", "north"))
+			Expect(record.Metadata()).To(HaveKeyWithValue("vin", "device-42"))
+		})
+
+		It("accepts the vehicle without metadata when the lookup fails", func() {
+			lookupStatus = http.StatusInternalServerError
+			stream := openStream(testCertificate("device-42", &ca))
+			Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+
+			var record *telemetry.Record
+			Eventually(producer.records).Should(Receive(&record))
+			Expect(record.Metadata()).NotTo(HaveKey("fleet"))
+		})
+
+		It("reuses the metadata of a vin for its next connections", func() {
+			for i := 0; i < 2; i++ {
+				stream := openStream(testCertificate("device-42", &ca))
+				Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+				Expect(stream.CloseSend()).To(Succeed())
+				Expect(stream.RecvMsg(&protos.VehicleIngestAck{})).To(Succeed())
+
+				var record *telemetry.Record
+				Eventually(producer.records).Should(Receive(&record))
+				Expect(record.Metadata()).To(HaveKeyWithValue("fleet", "north"))
+			}
+			Expect(lookups.Load()).To(BeEquivalentTo(1))
+		})
+
+		It("looks up the metadata again once a lookup failed", func() {
+			lookupStatus = http.StatusInternalServerError
+			for i := 0; i < 2; i++ {
+				stream := openStream(testCertificate("device-42", &ca))
+				Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+				Expect(stream.CloseSend()).To(Succeed())
+				Expect(stream.RecvMsg(&protos.VehicleIngestAck{})).To(Succeed())
+				Eventually(producer.records).Should(Receive())
+			}
+			Expect(lookups.Load()).To(BeEquivalentTo(2))
+		})
+
+		Context("when the vin is denied", func() {
+			BeforeEach(func() {
+				conf.VINDenylist = filepath.Join(GinkgoT().TempDir(), "denylist.txt")
+				Expect(os.WriteFile(conf.VINDenylist, []byte("device-42\n"), 0o600)).To(Succeed())
+			})
+
+			It("does not look up the metadata", func() {
+				stream := openStream(testCertificate("device-42", &ca))
+				Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+				Expect(stream.CloseSend()).To(Succeed())
+				Expect(stream.RecvMsg(&protos.VehicleIngestAck{})).To(Succeed())
+
+				Expect(lookups.Load()).To(BeZero())
+				Consistently(producer.records).ShouldNot(Receive())
+			})
+		})
+	})
+
+	Context("with a reliable ack datastore failing to write", func() {
+		BeforeEach(func() {
+			conf.Records = map[string][]telemetry.Dispatcher{"V": {telemetry.Kafka}}
+			conf.ReliableAckSources = map[string]telemetry.Dispatcher{"V": telemetry.Kafka}
+			conf.AckChan = make(chan *telemetry.Record, 10)
+			produceErr = errors.New("broker down")
+		})
+
+		It("responds with an error and stops counting the record as in flight", func() {
+			stream := openStream(testCertificate("device-42", &ca))
+			Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+
+			ack := &protos.VehicleIngestAck{}
+			Expect(stream.RecvMsg(ack)).To(Succeed())
+			Expect(ack.GetSequence()).To(Equal(uint64(1)))
+			Expect(ack.GetError()).NotTo(BeEmpty())
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, dropped := server.Drain(ctx, nil)
+			Expect(dropped).To(BeZero())
+		})
+
+		Context("with dedup", func() {
+			BeforeEach(func() {
+				conf.Dedup = &config.Dedup{Window: 60000}
+			})
+
+			It("dispatches the payload sent again after the write failed", func() {
+				stream := openStream(testCertificate("device-42", &ca))
+				payload := &protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()}
+				for attempt := 0; attempt < 2; attempt++ {
+					Expect(stream.SendMsg(payload)).To(Succeed())
+					ack := &protos.VehicleIngestAck{}
+					Expect(stream.RecvMsg(ack)).To(Succeed())
+					Expect(ack.GetError()).NotTo(BeEmpty())
+					Eventually(producer.records).Should(Receive())
+				}
+			})
+		})
+	})
+
+	Context("with dedup", func() {
+		BeforeEach(func() {
+			conf.Dedup = &config.Dedup{Window: 60000}
+		})
+
+		It("acks the payload sent again without dispatching it", func() {
+			stream := openStream(testCertificate("device-42", &ca))
+			payload := &protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()}
+			for attempt := 0; attempt < 2; attempt++ {
+				Expect(stream.SendMsg(payload)).To(Succeed())
+				ack := &protos.VehicleIngestAck{}
+				Expect(stream.RecvMsg(ack)).To(Succeed())
+				Expect(ack.GetError()).To(BeEmpty())
+			}
+			Expect(producer.records).To(HaveLen(1))
+		})
+	})
+
+	Context("with a vin connection limit", func() {
+		BeforeEach(func() {
+			conf.VINConnectionLimit = &config.VINConnectionLimit{}
+		})
+
+		It("ends the stream replaced by a newer connection while it waits for payloads", func() {
+			stream := openStream(testCertificate("device-42", &ca))
+			Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+			Expect(stream.RecvMsg(&protos.VehicleIngestAck{})).To(Succeed())
+
+			newer := openStream(testCertificate("device-42", &ca))
+			Expect(newer.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+			Expect(newer.RecvMsg(&protos.VehicleIngestAck{})).To(Succeed())
+
+			err := stream.RecvMsg(&protos.VehicleIngestAck{})
+			Expect(status.Code(err)).To(Equal(codes.Canceled))
+			Expect(stream.Trailer().Get(streaming.GRPCCloseReasonTrailer)).To(Equal([]string{"duplicate_vin"}))
+			Eventually(registry.NumConnectedSockets).Should(Equal(1))
+		})
+	})
+
+	It("deregisters the stream once the client cancelled it", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := openStreamContext(ctx, testCertificate("device-42", &ca))
+		Expect(stream.SendMsg(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})).To(Succeed())
+		Expect(stream.RecvMsg(&protos.VehicleIngestAck{})).To(Succeed())
+		Expect(registry.NumConnectedSockets()).To(Equal(1))
+
+		cancel()
+		Eventually(registry.NumConnectedSockets).Should(BeZero())
+	})
+
+	It("rejects clients whose certificate is not issued to a device", func() {
+		stream := openStream(testCertificate("device-42", &otherCA))
+		Expect(stream.SendMsg(&protos.Payload{})).To(Succeed())
+		err := stream.RecvMsg(&protos.VehicleIngestAck{})
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+		Consistently(producer.records).ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,82 @@
+package streaming
+
+import (
+	"github.com/teslamotors/fleet-telemetry/config"
+)
+
+// inboundQueue buffers the messages read from a vehicle until they are dispatched by the goroutine of the connection,
+// so a slow dispatch stops or drops the reads of this vehicle only
+type inboundQueue struct {
+	messages chan []byte
+	overflow config.QueueOverflowPolicy
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newInboundQueue(c *config.InboundQueue) *inboundQueue {
+	overflow := c.Overflow
+	if overflow == "" {
+		overflow = config.QueueOverflowBlock
+	}
+	return &inboundQueue{
+		messages: make(chan []byte, c.Depth),
+		overflow: overflow,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// push queues a message read from the vehicle, applying the overflow policy when the queue is full.
+// It must only be called by the read loop
+func (q *inboundQueue) push(message []byte) {
+	metricsRegistry.inboundQueueDepth.Add(1, map[string]string{})
+	switch q.overflow {
+	case config.QueueOverflowDropNewest:
+		select {
+		case q.messages <- message:
+		default:
+			q.dropped()
+		}
+	case config.QueueOverflowDropOldest:
+		for {
+			select {
+			case q.messages <- message:
+				return
+			default:
+			}
+			select {
+			case <-q.messages:
+				q.dropped()
+			default:
+			}
+		}
+	default:
+		q.messages <- message
+	}
+}
+
+// consume dispatches the queued messages until the queue is stopped
+func (q *inboundQueue) consume(dispatch func(message []byte)) {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.stop:
+			return
+		case message := <-q.messages:
+			metricsRegistry.inboundQueueDepth.Sub(1, map[string]string{})
+			dispatch(message)
+		}
+	}
+}
+
+// close waits for the message being dispatched and drops the queued ones, they were not acked to the vehicle
+func (q *inboundQueue) close() {
+	close(q.stop)
+	<-q.done
+	metricsRegistry.inboundQueueDepth.Sub(int64(len(q.messages)), map[string]string{})
+}
+
+func (q *inboundQueue) dropped() {
+	metricsRegistry.inboundQueueDepth.Sub(1, map[string]string{})
+	metricsRegistry.inboundQueueDroppedCount.Inc(map[string]string{"policy": string(q.overflow)})
+}
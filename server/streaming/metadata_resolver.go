@@ -0,0 +1,202 @@
+package streaming
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// maxMetadataResponseBytes bounds the responses of the metadata lookup service
+const maxMetadataResponseBytes = 64 * 1024
+
+// maxCachedMetadata bounds the number of vins whose metadata is cached
+const maxCachedMetadata = 100000
+
+var errMetadataLookupsLimited = errors.New("too many metadata lookups in flight")
+
+// MetadataResolver returns the metadata added to the records of a vehicle, such as its fleet or owner.
+// It is called when the vehicle connects, the metadata is kept for the lifetime of the connection and reused for the
+// next connections of the vehicle within the cache ttl
+type MetadataResolver interface {
+	Resolve(ctx context.Context, vin string) (map[string]string, error)
+}
+
+// HTTPMetadataResolver requests the metadata of a vehicle from the metadata_lookup url
+type HTTPMetadataResolver struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewHTTPMetadataResolver returns a resolver requesting the url of the config, config is expected to be validated
+func NewHTTPMetadataResolver(config *config.MetadataLookup) *HTTPMetadataResolver {
+	return &HTTPMetadataResolver{
+		url:     config.URL,
+		headers: config.Headers,
+		client:  &http.Client{Timeout: config.TimeoutDuration()},
+	}
+}
+
+// Resolve returns the json object the service responds with for the vin
+func (r *HTTPMetadataResolver) Resolve(ctx context.Context, vin string) (map[string]string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(r.url, "{vin}", url.PathEscape(vin)), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range r.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata lookup responded %s", response.Status)
+	}
+
+	metadata := make(map[string]string)
+	if err := json.NewDecoder(io.LimitReader(response.Body, maxMetadataResponseBytes)).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata lookup response: %w", err)
+	}
+	return metadata, nil
+}
+
+// SetMetadataResolver replaces the resolver of the metadata_lookup config, so custom builds can look up the metadata
+// of vehicles from another source. It applies to the next connections
+func (s *Server) SetMetadataResolver(resolver MetadataResolver) {
+	s.metadataResolver.Store(&resolver)
+	s.metadataCache.reset()
+}
+
+// lookupMetadata sets the metadata of a connection once it is registered, so connections rejected as duplicates
+// don't trigger a lookup. Vehicles rejected by the vin filter are not looked up either, their records are dropped
+func (s *Server) lookupMetadata(sm *SocketManager) {
+	if allowed, _ := s.vinFilter.Load().Check(sm.requestIdentity.DeviceID); !allowed {
+		return
+	}
+	sm.connectionMetadata = s.resolveMetadata(sm.requestIdentity.DeviceID)
+}
+
+// resolveMetadata returns the metadata of the vin, failures are logged and the vehicle is accepted without metadata.
+// Keys set by the server, like vin or txid, are dropped. The metadata is shared by the connections of the vin within
+// the cache ttl and must not be modified
+func (s *Server) resolveMetadata(vin string) map[string]string {
+	resolver := s.metadataResolver.Load()
+	if resolver == nil || *resolver == nil {
+		return nil
+	}
+	if metadata, ok := s.metadataCache.get(vin); ok {
+		serverMetricsRegistry.metadataLookupCount.Inc(map[string]string{"result": "cached"})
+		return metadata
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.metadataTimeout)
+	defer cancel()
+
+	select {
+	case s.metadataLookups <- struct{}{}:
+		defer func() { <-s.metadataLookups }()
+	case <-ctx.Done():
+		serverMetricsRegistry.metadataLookupCount.Inc(map[string]string{"result": "limited"})
+		s.logger.ErrorLog("metadata_lookup_error", errMetadataLookupsLimited, logrus.LogInfo{"vin": vin})
+		return nil
+	}
+
+	metadata, err := (*resolver).Resolve(ctx, vin)
+	if err != nil {
+		serverMetricsRegistry.metadataLookupCount.Inc(map[string]string{"result": "error"})
+		s.logger.ErrorLog("metadata_lookup_error", err, logrus.LogInfo{"vin": vin})
+		return nil
+	}
+	serverMetricsRegistry.metadataLookupCount.Inc(map[string]string{"result": "ok"})
+	for key := range metadata {
+		if telemetry.IsReservedMetadataKey(key) {
+			delete(metadata, key)
+		}
+	}
+	s.metadataCache.set(vin, metadata)
+	return metadata
+}
+
+// metadataCache keeps the metadata of the vins looked up within the ttl, failed lookups are not cached
+type metadataCache struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	// order holds the cachedMetadata values from the oldest to the most recent
+	order *list.List
+}
+
+type cachedMetadata struct {
+	vin      string
+	metadata map[string]string
+	cachedAt time.Time
+}
+
+func newMetadataCache(ttl time.Duration, maxEntries int) *metadataCache {
+	return &metadataCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func (c *metadataCache) get(vin string) (map[string]string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evictExpired(time.Now())
+	element, ok := c.entries[vin]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*cachedMetadata).metadata, true
+}
+
+func (c *metadataCache) set(vin string, metadata map[string]string) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evictExpired(now)
+	if element, ok := c.entries[vin]; ok {
+		c.remove(element)
+	}
+	c.entries[vin] = c.order.PushBack(&cachedMetadata{vin: vin, metadata: metadata, cachedAt: now})
+	if c.order.Len() > c.maxEntries {
+		c.remove(c.order.Front())
+	}
+}
+
+// reset forgets the metadata of all the vins
+func (c *metadataCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// evictExpired removes the entries older than the ttl, c.mutex must be held
+func (c *metadataCache) evictExpired(now time.Time) {
+	for front := c.order.Front(); front != nil && now.Sub(front.Value.(*cachedMetadata).cachedAt) > c.ttl; front = c.order.Front() {
+		c.remove(front)
+	}
+}
+
+func (c *metadataCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*cachedMetadata).vin)
+	c.order.Remove(element)
+}
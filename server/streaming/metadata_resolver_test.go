@@ -0,0 +1,74 @@
+package streaming_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+)
+
+var _ = Describe("HTTPMetadataResolver", func() {
+	var (
+		handler http.HandlerFunc
+		lookup  *config.MetadataLookup
+	)
+
+	BeforeEach(func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/vehicles/device-42/tags"))
+			Expect(r.Header.Get("Authorization")).To(Equal("Bearer token"))
+			_, _ = w.Write([]byte(`{"fleet":"north","owner":"acme"}`))
+		}
+	})
+
+	JustBeforeEach(func() {
+		server := httptest.NewServer(handler)
+		DeferCleanup(server.Close)
+		lookup = &config.MetadataLookup{
+			URL:     server.URL + "/vehicles/{vin}/tags",
+			Timeout: 100,
+			Headers: map[string]string{"Authorization": "Bearer token"},
+		}
+	})
+
+	It("returns the metadata of the vin", func() {
+		metadata, err := streaming.NewHTTPMetadataResolver(lookup).Resolve(context.Background(), "device-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metadata).To(Equal(map[string]string{"fleet": "north", "owner": "acme"}))
+	})
+
+	Context("when the service fails", func() {
+		BeforeEach(func() {
+			handler = func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})
+
+		It("returns an error", func() {
+			_, err := streaming.NewHTTPMetadataResolver(lookup).Resolve(context.Background(), "device-42")
+			Expect(err).To(MatchError("metadata lookup responded 503 Service Unavailable"))
+		})
+	})
+
+	Context("when the service is slower than the timeout", func() {
+		BeforeEach(func() {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			}
+		})
+
+		It("returns an error", func() {
+			_, err := streaming.NewHTTPMetadataResolver(lookup).Resolve(context.Background(), "device-42")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
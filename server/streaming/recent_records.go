@@ -0,0 +1,88 @@
+package streaming
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// RecentRecords keeps the last records received from each vin for the debug endpoint. The vins which sent no record
+// for the longest time are forgotten first once maxVINs are tracked
+type RecentRecords struct {
+	mutex   sync.Mutex
+	perVIN  int
+	maxVINs int
+	vins    map[string]*list.Element
+	// order holds the recentVIN values from the most to the least recently updated
+	order *list.List
+}
+
+// recentVIN is a ring buffer of the last records of a vin
+type recentVIN struct {
+	vin     string
+	records []*telemetry.Record
+	next    int
+}
+
+// NewRecentRecords returns an empty buffer of perVIN records for at most maxVINs vins
+func NewRecentRecords(perVIN int, maxVINs int) *RecentRecords {
+	return &RecentRecords{
+		perVIN:  perVIN,
+		maxVINs: maxVINs,
+		vins:    make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Add keeps a copy of the record, replacing the oldest record of its vin when full
+func (r *RecentRecords) Add(record *telemetry.Record) {
+	clone := record.Clone()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	element, ok := r.vins[record.Vin]
+	if ok {
+		r.order.MoveToFront(element)
+	} else {
+		element = r.order.PushFront(&recentVIN{vin: record.Vin, records: make([]*telemetry.Record, 0, r.perVIN)})
+		r.vins[record.Vin] = element
+		if r.order.Len() > r.maxVINs {
+			oldest := r.order.Back()
+			delete(r.vins, oldest.Value.(*recentVIN).vin)
+			r.order.Remove(oldest)
+		}
+	}
+
+	buffer := element.Value.(*recentVIN)
+	if len(buffer.records) < r.perVIN {
+		buffer.records = append(buffer.records, clone)
+		return
+	}
+	buffer.records[buffer.next] = clone
+	buffer.next = (buffer.next + 1) % r.perVIN
+}
+
+// Get returns the records kept for the vin, the most recent first
+func (r *RecentRecords) Get(vin string) []*telemetry.Record {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	element, ok := r.vins[vin]
+	if !ok {
+		return nil
+	}
+
+	buffer := element.Value.(*recentVIN)
+	records := make([]*telemetry.Record, 0, len(buffer.records))
+	for i := len(buffer.records) - 1; i >= 0; i-- {
+		records = append(records, buffer.records[(buffer.next+i)%len(buffer.records)])
+	}
+	return records
+}
+
+// NumVINs returns the number of vins whose records are kept
+func (r *RecentRecords) NumVINs() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.order.Len()
+}
@@ -0,0 +1,44 @@
+package streaming_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("RecentRecords", func() {
+	txids := func(records []*telemetry.Record) []string {
+		var ids []string
+		for _, record := range records {
+			ids = append(ids, record.Txid)
+		}
+		return ids
+	}
+
+	It("keeps the last records of each vin, the most recent first", func() {
+		recentRecords := streaming.NewRecentRecords(2, 10)
+		Expect(recentRecords.Get("VIN42")).To(BeEmpty())
+
+		recentRecords.Add(&telemetry.Record{Vin: "VIN42", Txid: "1"})
+		Expect(txids(recentRecords.Get("VIN42"))).To(Equal([]string{"1"}))
+		recentRecords.Add(&telemetry.Record{Vin: "VIN42", Txid: "2"})
+		recentRecords.Add(&telemetry.Record{Vin: "VIN42", Txid: "3"})
+		recentRecords.Add(&telemetry.Record{Vin: "VIN43", Txid: "4"})
+		Expect(txids(recentRecords.Get("VIN42"))).To(Equal([]string{"3", "2"}))
+		Expect(txids(recentRecords.Get("VIN43"))).To(Equal([]string{"4"}))
+	})
+
+	It("forgets the vins which sent no record for the longest time", func() {
+		recentRecords := streaming.NewRecentRecords(2, 2)
+		recentRecords.Add(&telemetry.Record{Vin: "VIN1", Txid: "1"})
+		recentRecords.Add(&telemetry.Record{Vin: "VIN2", Txid: "2"})
+		recentRecords.Add(&telemetry.Record{Vin: "VIN1", Txid: "3"})
+		recentRecords.Add(&telemetry.Record{Vin: "VIN3", Txid: "4"})
+
+		Expect(recentRecords.NumVINs()).To(Equal(2))
+		Expect(recentRecords.Get("VIN2")).To(BeEmpty())
+		Expect(txids(recentRecords.Get("VIN1"))).To(Equal([]string{"3", "1"}))
+	})
+})
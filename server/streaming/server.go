@@ -1,15 +1,20 @@
 package streaming
 
 import (
+	"compress/flate"
 	"context"
 	"crypto/x509"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
@@ -29,6 +34,7 @@ var (
 		CheckOrigin:     func(_ *http.Request) bool { return true },
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    telemetry.SupportedProtocols(),
 	}
 
 	serverMetricsRegistry ServerMetrics
@@ -37,18 +43,28 @@ var (
 
 const (
 	connectitivityTopic = "connectivity"
+
+	// drainPollInterval is how often pending records are counted while draining
+	drainPollInterval = 50 * time.Millisecond
+	// drainSocketCloseTimeout is the time given to vehicle connections to close once drained
+	drainSocketCloseTimeout = time.Second
 )
 
 // ServerMetrics stores metrics reported from this package
 type ServerMetrics struct {
-	reliableAckCount     adapter.Counter
-	reliableAckMissCount adapter.Counter
+	reliableAckCount          adapter.Counter
+	reliableAckMissCount      adapter.Counter
+	configReloadCount         adapter.Counter
+	compressionNegotiateCount adapter.Counter
+	protocolConnections       adapter.Gauge
+	grpcStreams               adapter.Gauge
+	metadataLookupCount       adapter.Counter
 }
 
 // Server stores server resources
 type Server struct {
-	// DispatchRules is a mapping of topics (records type) to their dispatching methods (loaded from Records json)
-	DispatchRules map[string][]telemetry.Producer
+	// router maps topics (records type) to their dispatching methods (loaded from Records json)
+	router *telemetry.Router
 
 	logger *logrus.Logger
 	// Metrics collects metrics for the application
@@ -61,21 +77,109 @@ type Server struct {
 	ackChan chan (*telemetry.Record)
 
 	reliableAckSources map[string]telemetry.Dispatcher
+
+	vinRateLimiter *VinRateLimiter
+
+	deduplicator *Deduplicator
+
+	// recentRecords keeps the last records of each vin for the debug endpoint, nil when disabled
+	recentRecords *RecentRecords
+
+	rateLimit atomic.Pointer[config.RateLimit]
+	// vinFilter is read from the allowlist and denylist files again on config reload
+	vinFilter atomic.Pointer[VINFilter]
+
+	upgrader websocket.Upgrader
+
+	draining atomic.Bool
+	// inFlight counts the records waiting for datastore acks
+	inFlight atomic.Int64
+
+	compressionLevel int
+
+	// grpcServer serves the gRPC ingest endpoint when enabled
+	grpcServer *grpc.Server
+
+	// metadataResolver looks up the metadata added to the records of each connection, nil when disabled
+	metadataResolver atomic.Pointer[MetadataResolver]
+	metadataTimeout  time.Duration
+	metadataCache    *metadataCache
+	// metadataLookups holds a slot per lookup in flight
+	metadataLookups chan struct{}
 }
 
 // InitServer initializes the main server
 func InitServer(c *config.Config, airbrakeHandler *airbrake.Handler, producerRules map[string][]telemetry.Producer, logger *logrus.Logger, registry *SocketRegistry) (*http.Server, *Server, error) {
+	switch c.InvalidPayloadAction {
+	case "", config.InvalidPayloadNack, config.InvalidPayloadClose:
+	default:
+		return nil, nil, fmt.Errorf("invalid invalid_payload_action: %s", c.InvalidPayloadAction)
+	}
+	if c.CompressionLevel < 0 || c.CompressionLevel > flate.BestCompression {
+		return nil, nil, fmt.Errorf("invalid compression_level: %d", c.CompressionLevel)
+	}
+	if c.InboundQueue != nil {
+		if err := c.InboundQueue.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.Dedup != nil {
+		if err := c.Dedup.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.MetadataLookup != nil {
+		if err := c.MetadataLookup.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	socketServer := &Server{
-		DispatchRules:      producerRules,
+		router:             c.NewRouter(producerRules),
 		metricsCollector:   c.MetricCollector,
 		logger:             logger,
 		airbrakeHandler:    airbrakeHandler,
 		registry:           registry,
 		ackChan:            c.AckChan,
 		reliableAckSources: c.ReliableAckSources,
+		upgrader:           upgrader,
+		compressionLevel:   c.CompressionLevel,
 	}
+	socketServer.upgrader.EnableCompression = c.CompressionEnabled
 	registerServerMetricsOnce(socketServer.metricsCollector)
+	// close frames can be sent before the socket manager of the connection is created
+	registerMetricsOnce(socketServer.metricsCollector)
+	socketServer.rateLimit.Store(c.RateLimit)
+	vinFilter, err := LoadVINFilter(c.VINAllowlist, c.VINDenylist)
+	if err != nil {
+		return nil, nil, err
+	}
+	socketServer.vinFilter.Store(vinFilter)
+
+	if c.RateLimit != nil && c.RateLimit.PerVIN != nil {
+		socketServer.vinRateLimiter = NewVinRateLimiter(c.RateLimit.PerVIN.Limit, c.RateLimit.PerVIN.Burst)
+	}
+	if c.Dedup != nil {
+		cacheSize := c.Dedup.CacheSize
+		if cacheSize == 0 {
+			cacheSize = defaultDedupCacheSize
+		}
+		socketServer.deduplicator = NewDeduplicator(time.Duration(c.Dedup.Window)*time.Millisecond, cacheSize)
+	}
+	if c.DebugVIN != nil {
+		socketServer.recentRecords = NewRecentRecords(c.DebugVIN.RecordsPerVIN(), c.DebugVIN.MaxTrackedVINs())
+	}
+	socketServer.metadataTimeout = config.DefaultMetadataLookupTimeout
+	metadataCacheTTL, maxMetadataLookups := config.DefaultMetadataCacheTTL, config.DefaultMaxConcurrentMetadataLookups
+	if c.MetadataLookup != nil {
+		socketServer.metadataTimeout = c.MetadataLookup.TimeoutDuration()
+		metadataCacheTTL, maxMetadataLookups = c.MetadataLookup.CacheTTLDuration(), c.MetadataLookup.MaxLookups()
+	}
+	socketServer.metadataCache = newMetadataCache(metadataCacheTTL, maxCachedMetadata)
+	socketServer.metadataLookups = make(chan struct{}, maxMetadataLookups)
+	if c.MetadataLookup != nil {
+		socketServer.SetMetadataResolver(NewHTTPMetadataResolver(c.MetadataLookup))
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", socketServer.ServeBinaryWs(c))
@@ -88,11 +192,29 @@ func InitServer(c *config.Config, airbrakeHandler *airbrake.Handler, producerRul
 
 func (s *Server) handleAcks() {
 	for record := range s.ackChan {
+		if !record.ReleaseAck() {
+			continue
+		}
+		awaitsAcks := record.AwaitsAcks()
+		if awaitsAcks {
+			s.inFlight.Add(-1)
+		}
+		// the vehicle resends the record if its connection closed before the ack, even to another connection
+		if s.deduplicator != nil && record.AckError() == nil {
+			s.deduplicator.Remember(record)
+		}
 		reliableAckSource := string(s.reliableAckSources[record.TxType])
 		if record.Serializer != nil {
 			if socket := s.registry.GetSocket(record.SocketID); socket != nil {
-				serverMetricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
-				socket.respondToVehicle(record, nil)
+				if awaitsAcks {
+					socket.pendingAcks.Add(-1)
+				}
+				// a datastore which failed to write the record nacks it, so the vehicle sends it again
+				ackErr := record.AckError()
+				if ackErr == nil {
+					serverMetricsRegistry.reliableAckCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
+				}
+				socket.respondToVehicle(record, ackErr)
 			} else {
 				serverMetricsRegistry.reliableAckMissCount.Inc(map[string]string{"record_type": record.TxType, "dispatcher": reliableAckSource})
 			}
@@ -127,25 +249,73 @@ func (s *Server) Status() func(w http.ResponseWriter, r *http.Request) {
 // ServeBinaryWs serves a http query and upgrades it to a websocket -- only serves binary data coming from the ws
 func (s *Server) ServeBinaryWs(config *config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if ws := s.promoteToWebsocket(w, r); ws != nil {
+		if s.draining.Load() {
+			http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		ws, wireConn := s.promoteToWebsocket(w, r)
+		if ws != nil {
 			ctx := context.WithValue(context.Background(), SocketContext, map[string]interface{}{"request": r})
 			requestIdentity, err := extractIdentityFromConnection(r)
 			if err != nil {
 				s.logger.ErrorLog("extract_sender_id_err", err, nil)
+				writeClose(ws, CloseUnauthorized, time.Second)
+				_ = ws.Close()
+				return
+			}
+			requestIdentity.SourceIP = sourceIP(r, config.TrustedProxyHeader)
+
+			binarySerializer := s.newSerializer(requestIdentity, config)
+			binarySerializer.Protocol = ws.Subprotocol()
+			socketManager := s.newSocketManager(ctx, requestIdentity, ws, config)
+			socketManager.compressedConn = wireConn
+			if !s.registerSocket(socketManager, binarySerializer) {
+				writeClose(ws, CloseDuplicateVIN, time.Second)
+				_ = ws.Close()
+				return
 			}
-
-			binarySerializer := telemetry.NewBinarySerializer(requestIdentity, s.DispatchRules, s.logger)
-			socketManager := NewSocketManager(ctx, requestIdentity, ws, config, s.logger)
-			s.registerSocket(socketManager, binarySerializer)
 			defer s.deregisterSocket(socketManager, binarySerializer)
+			s.lookupMetadata(socketManager)
+
+			protocolLabels := map[string]string{"protocol": protocolLabel(ws.Subprotocol())}
+			serverMetricsRegistry.protocolConnections.Add(1, protocolLabels)
+			defer serverMetricsRegistry.protocolConnections.Sub(1, protocolLabels)
 
 			socketManager.ProcessTelemetry(binarySerializer)
 		}
 	}
 }
 
+// RecentRecords returns the last records received from each vin, nil unless debug_vin is configured
+func (s *Server) RecentRecords() *RecentRecords {
+	return s.recentRecords
+}
+
+// newSerializer returns the serializer of a vehicle connection
+func (s *Server) newSerializer(requestIdentity *telemetry.RequestIdentity, config *config.Config) *telemetry.BinarySerializer {
+	binarySerializer := telemetry.NewBinarySerializer(requestIdentity, nil, s.logger)
+	binarySerializer.Router = s.router
+	binarySerializer.MaxDecompressedSize = config.MaxDecompressedSize
+	binarySerializer.EnforceVINCertMatch = config.EnforceVINCertMatch
+	binarySerializer.JSON = config.JSONSerializer()
+	return binarySerializer
+}
+
+// newSocketManager returns the manager of a vehicle connection, sharing the limits and state of the server
+func (s *Server) newSocketManager(ctx context.Context, requestIdentity *telemetry.RequestIdentity, ws *websocket.Conn, config *config.Config) *SocketManager {
+	socketManager := NewSocketManager(ctx, requestIdentity, ws, config, s.logger)
+	socketManager.vinRateLimiter = s.vinRateLimiter
+	socketManager.deduplicator = s.deduplicator
+	socketManager.recentRecords = s.recentRecords
+	socketManager.rateLimit = &s.rateLimit
+	socketManager.vinFilter = &s.vinFilter
+	socketManager.draining = &s.draining
+	socketManager.inFlight = &s.inFlight
+	return socketManager
+}
+
 func (s *Server) dispatchConnectivityEvent(sm *SocketManager, serializer *telemetry.BinarySerializer, event protos.ConnectivityEvent) error {
-	connectivityDispatcher, ok := s.DispatchRules[connectitivityTopic]
+	connectivityDispatcher, ok := s.router.Rules()[connectitivityTopic]
 	if !ok {
 		return nil
 	}
@@ -179,18 +349,129 @@ func (s *Server) dispatchConnectivityEvent(sm *SocketManager, serializer *teleme
 	}
 	record, _ := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
 	for _, dispatcher := range connectivityDispatcher {
-		dispatcher.Produce(record)
+		_ = dispatcher.Produce(record)
 	}
 	return nil
 }
 
-func (s *Server) registerSocket(sm *SocketManager, serializer *telemetry.BinarySerializer) {
-	s.registry.RegisterSocket(sm)
+// Reload swaps the dispatch rules, rate limits and vin filter of the server with the ones of newConfig, active connections
+// are kept. Settings which differ from the running config c and need a restart are only logged
+func (s *Server) Reload(c *config.Config, newConfig *config.Config, producers map[telemetry.Dispatcher]telemetry.Producer) error {
+	restartRequired, err := c.ReloadChanges(newConfig)
+	if err != nil {
+		return err
+	}
+	for _, dispatchers := range newConfig.Records {
+		for _, dispatcher := range dispatchers {
+			if _, ok := producers[dispatcher]; !ok {
+				return fmt.Errorf("dispatcher %s is not running, requires restart", dispatcher)
+			}
+		}
+	}
+	rules, err := newConfig.DispatchRules(producers, s.logger)
+	if err != nil {
+		return err
+	}
+	vinFilter, err := LoadVINFilter(newConfig.VINAllowlist, newConfig.VINDenylist)
+	if err != nil {
+		return err
+	}
+
+	for _, setting := range restartRequired {
+		s.logger.ActivityLog("config_reload_requires_restart", logrus.LogInfo{"setting": setting})
+	}
+	s.router.Swap(rules)
+	s.rateLimit.Store(newConfig.RateLimit)
+	s.vinFilter.Store(vinFilter)
+	if s.vinRateLimiter != nil {
+		s.vinRateLimiter.SetLimit(newConfig.RateLimit.PerVIN.Limit, newConfig.RateLimit.PerVIN.Burst)
+	}
+	serverMetricsRegistry.configReloadCount.Inc(map[string]string{})
+	s.logger.ActivityLog("config_reloaded", logrus.LogInfo{"records": len(rules)})
+	return nil
+}
+
+// Drain stops processing the records sent by vehicles and waits until the records being produced are written and
+// acked, or until ctx is done. Vehicle connections are closed afterwards. It returns the number of records which
+// were drained and the number still in flight
+func (s *Server) Drain(ctx context.Context, producers map[telemetry.Dispatcher]telemetry.Producer) (drained int, dropped int) {
+	start := time.Now()
+	s.draining.Store(true)
+
+	var queues []telemetry.QueueSizer
+	for _, producer := range producers {
+		if queue, ok := producer.(telemetry.QueueSizer); ok {
+			queues = append(queues, queue)
+		}
+	}
+	initial := s.pendingRecords(queues)
+	s.logger.ActivityLog("drain_started", logrus.LogInfo{"in_flight": initial, "connections": s.registry.NumConnectedSockets()})
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	remaining := initial
+drain:
+	for remaining > 0 {
+		select {
+		case <-ctx.Done():
+			break drain
+		case <-ticker.C:
+			remaining = s.pendingRecords(queues)
+		}
+	}
+
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	for _, socket := range s.registry.Sockets() {
+		if socket.Ws == nil {
+			continue
+		}
+		writeClose(socket.Ws, CloseShuttingDown, ReadWriteExitDeadline)
+		_ = socket.Ws.SetReadDeadline(time.Now())
+	}
+	deadline := time.Now().Add(drainSocketCloseTimeout)
+	for s.registry.NumConnectedSockets() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+
+	drained, dropped = max(initial-remaining, 0), remaining
+	s.logger.ActivityLog("drain_complete", logrus.LogInfo{"drained": drained, "dropped": dropped, "duration_ms": time.Since(start).Milliseconds()})
+	return drained, dropped
+}
+
+// pendingRecords returns the number of records waiting for datastore acks or queued by producers. Records
+// awaiting acks are usually also queued, the larger count is used so they are not counted twice
+func (s *Server) pendingRecords(queues []telemetry.QueueSizer) int {
+	queued := 0
+	for _, queue := range queues {
+		queued += queue.QueueSize()
+	}
+	return max(int(s.inFlight.Load()), queued)
+}
+
+// registerSocket returns false when the connection is refused because its vin reached its max connections
+func (s *Server) registerSocket(sm *SocketManager, serializer *telemetry.BinarySerializer) bool {
+	if limit := sm.config.VINConnectionLimit; limit != nil {
+		evicted, ok := s.registry.RegisterVINSocket(sm, limit.Max(), limit.Policy != config.DuplicateVINReject)
+		if !ok {
+			metricsRegistry.duplicateVINCount.Inc(map[string]string{"action": "rejected"})
+			s.logger.ActivityLog("duplicate_vin_connection_rejected", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "connection_id": sm.UUID})
+			return false
+		}
+		for _, replaced := range evicted {
+			metricsRegistry.duplicateVINCount.Inc(map[string]string{"action": "closed_oldest"})
+			// the close frame is queued behind the pending writes of the replaced connection
+			go replaced.closeReplaced()
+		}
+	} else {
+		s.registry.RegisterSocket(sm)
+	}
 	event := protos.ConnectivityEvent_CONNECTED
 	if err := s.dispatchConnectivityEvent(sm, serializer, event); err != nil {
 		s.logger.ErrorLog("connectivity_registeration_error", err, logrus.LogInfo{"deviceID": sm.requestIdentity.DeviceID, "event": event})
 	}
-
+	return true
 }
 
 func (s *Server) deregisterSocket(sm *SocketManager, serializer *telemetry.BinarySerializer) {
@@ -201,17 +482,47 @@ func (s *Server) deregisterSocket(sm *SocketManager, serializer *telemetry.Binar
 	}
 }
 
-func (s *Server) promoteToWebsocket(w http.ResponseWriter, r *http.Request) *websocket.Conn {
-	ws, err := upgrader.Upgrade(w, r, nil)
+// promoteToWebsocket upgrades the request, the returned countingConn is only set when permessage-deflate was negotiated
+func (s *Server) promoteToWebsocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, *countingConn) {
+	compressed := s.upgrader.EnableCompression && offersPerMessageDeflate(r)
+	var countingWriter *countingResponseWriter
+	if compressed {
+		countingWriter = &countingResponseWriter{ResponseWriter: w}
+		w = countingWriter
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.airbrakeHandler.ReportError(r, err)
 		if _, ok := err.(websocket.HandshakeError); !ok {
 			s.logger.ErrorLog("websocket_promotion_error", err, nil)
 		}
-		return nil
+		return nil, nil
+	}
+	// the upgrade succeeds without subprotocol when none of the requested ones is supported
+	if requested := websocket.Subprotocols(r); len(requested) > 0 && ws.Subprotocol() == "" {
+		s.logger.ActivityLog("unsupported_subprotocol", logrus.LogInfo{"requested_protocols": strings.Join(requested, ",")})
+		writeClose(ws, CloseUnsupportedProtocol, time.Second)
+		_ = ws.Close()
+		return nil, nil
+	}
+	if !compressed {
+		return ws, nil
 	}
 
-	return ws
+	serverMetricsRegistry.compressionNegotiateCount.Inc(map[string]string{})
+	if s.compressionLevel != 0 {
+		_ = ws.SetCompressionLevel(s.compressionLevel)
+	}
+	return ws, countingWriter.conn
+}
+
+// protocolLabel labels the connections of vehicles which did not request a subprotocol
+func protocolLabel(protocol string) string {
+	if protocol == "" {
+		return "none"
+	}
+	return protocol
 }
 
 func extractIdentityFromConnection(r *http.Request) (*telemetry.RequestIdentity, error) {
@@ -219,7 +530,11 @@ func extractIdentityFromConnection(r *http.Request) (*telemetry.RequestIdentity,
 	if err != nil {
 		return nil, err
 	}
+	return identityFromCert(cert)
+}
 
+// identityFromCert returns the identity of the device the client certificate was issued to
+func identityFromCert(cert *x509.Certificate) (*telemetry.RequestIdentity, error) {
 	clientType, deviceID, err := messages.CreateIdentityFromCert(cert)
 	if err != nil {
 		return nil, fmt.Errorf("create_identity issuer: %s, common_name: %s, err: %v", cert.Issuer.CommonName, cert.Subject.CommonName, err)
@@ -230,7 +545,28 @@ func extractIdentityFromConnection(r *http.Request) (*telemetry.RequestIdentity,
 	}, nil
 }
 
+// sourceIP returns the address of the vehicle. Behind a load balancer, the last address of trustedProxyHeader
+// is the one the load balancer received the connection from, the previous ones are provided by the client
+func sourceIP(r *http.Request, trustedProxyHeader string) string {
+	if trustedProxyHeader != "" {
+		if values := r.Header.Values(trustedProxyHeader); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			if address := strings.TrimSpace(addresses[len(addresses)-1]); address != "" {
+				return address
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func extractCertFromHeaders(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil {
+		return nil, fmt.Errorf("missing_certificate_error")
+	}
 	nbCerts := len(r.TLS.PeerCertificates)
 	if nbCerts == 0 {
 		return nil, fmt.Errorf("missing_certificate_error")
@@ -256,4 +592,34 @@ func registerServerMetrics(metricsCollector metrics.MetricCollector) {
 		Help:   "The number of missing reliable acknowledgements.",
 		Labels: []string{"record_type", "dispatcher"},
 	})
+
+	serverMetricsRegistry.configReloadCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "config_reload_total",
+		Help:   "The number of successful config reloads.",
+		Labels: []string{},
+	})
+
+	serverMetricsRegistry.compressionNegotiateCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "websocket_compression_negotiated_total",
+		Help:   "The number of connections which negotiated permessage-deflate.",
+		Labels: []string{},
+	})
+
+	serverMetricsRegistry.protocolConnections = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "websocket_protocol_connections",
+		Help:   "The number of vehicles currently connected per negotiated subprotocol.",
+		Labels: []string{"protocol"},
+	})
+
+	serverMetricsRegistry.grpcStreams = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "grpc_ingest_streams",
+		Help:   "The number of gRPC ingest streams currently open.",
+		Labels: []string{},
+	})
+
+	serverMetricsRegistry.metadataLookupCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "metadata_lookup_total",
+		Help:   "The number of connection metadata lookups.",
+		Labels: []string{"result"},
+	})
 }
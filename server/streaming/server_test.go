@@ -1,24 +1,46 @@
 package streaming_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/datastore/simple"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
 	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
 	"github.com/teslamotors/fleet-telemetry/server/airbrake"
 	"github.com/teslamotors/fleet-telemetry/server/streaming"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
 
+// DrainingProducer has a queue size which can change while the server drains
+type DrainingProducer struct {
+	telemetry.Producer
+	size atomic.Int64
+}
+
+func (d *DrainingProducer) QueueSize() int {
+	return int(d.size.Load())
+}
+
 var _ = Describe("Socket handler test", func() {
 
 	var producerRules map[string][]telemetry.Producer
@@ -69,9 +91,268 @@ var _ = Describe("Socket handler test", func() {
 		err = conn.WriteMessage(websocket.BinaryMessage, []byte(""))
 		Expect(err).NotTo(HaveOccurred())
 
-		_, _, _ = conn.ReadMessage()
+		_, _, err = conn.ReadMessage()
+		Expect(websocket.IsCloseError(err, streaming.CloseUnauthorized.Code)).To(BeTrue())
 		_ = conn.Close()
 
-		Expect(hook.AllEntries()).To(BeEmpty())
+		Expect(hook.AllEntries()).To(HaveLen(1))
+		Expect(hook.LastEntry().Message).To(Equal("extract_sender_id_err"))
+	})
+
+	Context("Compression", func() {
+		dial := func(conf *config.Config, enableCompression bool) *http.Response {
+			logger, _ := logrus.NoOpLogger()
+			_, s, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{}, logger, streaming.NewSocketRegistry())
+			Expect(err).NotTo(HaveOccurred())
+
+			srv := httptest.NewServer(http.HandlerFunc(s.ServeBinaryWs(conf)))
+			DeferCleanup(srv.Close)
+
+			dialer := &websocket.Dialer{HandshakeTimeout: 1 * time.Second, EnableCompression: enableCompression}
+			conn, resp, err := dialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			_ = conn.Close()
+			return resp
+		}
+
+		It("negotiates permessage-deflate when the client supports it", func() {
+			conf := &config.Config{CompressionEnabled: true, CompressionLevel: 6, MetricCollector: noop.NewCollector()}
+			resp := dial(conf, true)
+			Expect(resp.Header.Get("Sec-Websocket-Extensions")).To(ContainSubstring("permessage-deflate"))
+		})
+
+		It("does not compress when the client does not advertise support", func() {
+			conf := &config.Config{CompressionEnabled: true, MetricCollector: noop.NewCollector()}
+			resp := dial(conf, false)
+			Expect(resp.Header.Get("Sec-Websocket-Extensions")).To(BeEmpty())
+		})
+
+		It("does not compress when disabled", func() {
+			conf := &config.Config{MetricCollector: noop.NewCollector()}
+			resp := dial(conf, true)
+			Expect(resp.Header.Get("Sec-Websocket-Extensions")).To(BeEmpty())
+		})
+
+		It("rejects invalid compression levels", func() {
+			logger, _ := logrus.NoOpLogger()
+			conf := &config.Config{CompressionEnabled: true, CompressionLevel: 12, MetricCollector: noop.NewCollector()}
+			_, _, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{}, logger, streaming.NewSocketRegistry())
+			Expect(err).To(MatchError("invalid compression_level: 12"))
+		})
+	})
+
+	It("rejects invalid metadata lookups", func() {
+		logger, _ := logrus.NoOpLogger()
+		conf := &config.Config{MetricCollector: noop.NewCollector(), MetadataLookup: &config.MetadataLookup{URL: "http://metadata/{vin}", MaxConcurrentLookups: -1}}
+		_, _, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{}, logger, streaming.NewSocketRegistry())
+		Expect(err).To(MatchError("metadata_lookup max_concurrent_lookups must be positive, got -1"))
+	})
+
+	Context("Subprotocols", func() {
+		dial := func(protocols []string) (*websocket.Conn, *http.Response) {
+			logger, _ := logrus.NoOpLogger()
+			conf := &config.Config{MetricCollector: noop.NewCollector()}
+			_, s, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{}, logger, streaming.NewSocketRegistry())
+			Expect(err).NotTo(HaveOccurred())
+
+			srv := httptest.NewServer(http.HandlerFunc(s.ServeBinaryWs(conf)))
+			DeferCleanup(srv.Close)
+
+			dialer := &websocket.Dialer{HandshakeTimeout: 1 * time.Second, Subprotocols: protocols}
+			conn, resp, err := dialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+			return conn, resp
+		}
+
+		It("negotiates a supported subprotocol", func() {
+			conn, _ := dial([]string{"v99.telemetry.tesla.com", telemetry.ProtocolV1})
+			Expect(conn.Subprotocol()).To(Equal(telemetry.ProtocolV1))
+		})
+
+		It("accepts vehicles which do not request a subprotocol", func() {
+			conn, _ := dial(nil)
+			Expect(conn.Subprotocol()).To(BeEmpty())
+
+			Expect(conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+			_, _, err := conn.ReadMessage()
+			Expect(websocket.IsCloseError(err, websocket.CloseProtocolError)).To(BeFalse())
+		})
+
+		It("closes connections requesting only unknown subprotocols", func() {
+			conn, _ := dial([]string{"v99.telemetry.tesla.com"})
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			_, _, err := conn.ReadMessage()
+			Expect(websocket.IsCloseError(err, websocket.CloseProtocolError)).To(BeTrue())
+		})
+
+		It("closes connections without client certificate as unauthorized", func() {
+			conn, _ := dial([]string{telemetry.ProtocolV1})
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			_, _, err := conn.ReadMessage()
+			var closeErr *websocket.CloseError
+			Expect(errors.As(err, &closeErr)).To(BeTrue())
+			Expect(*closeErr).To(Equal(websocket.CloseError{Code: streaming.CloseUnauthorized.Code, Text: "unauthorized"}))
+		})
+	})
+
+	Context("Drain", func() {
+		var s *streaming.Server
+
+		BeforeEach(func() {
+			logger, _ := logrus.NoOpLogger()
+			conf := &config.Config{MetricCollector: noop.NewCollector()}
+			var err error
+			_, s, err = streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{}, logger, streaming.NewSocketRegistry())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("waits for the queued records to be written", func() {
+			queue := &DrainingProducer{}
+			queue.size.Store(5)
+			go func() {
+				for queue.size.Load() > 0 {
+					time.Sleep(10 * time.Millisecond)
+					queue.size.Add(-1)
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			drained, dropped := s.Drain(ctx, map[telemetry.Dispatcher]telemetry.Producer{telemetry.Kafka: queue})
+			Expect(drained).To(Equal(5))
+			Expect(dropped).To(Equal(0))
+		})
+
+		It("reports the records still queued at the timeout", func() {
+			queue := &DrainingProducer{}
+			queue.size.Store(3)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			drained, dropped := s.Drain(ctx, map[telemetry.Dispatcher]telemetry.Producer{telemetry.Kafka: queue})
+			Expect(drained).To(Equal(0))
+			Expect(dropped).To(Equal(3))
+		})
+
+		It("rejects new connections", func() {
+			s.Drain(context.Background(), nil)
+
+			conf := &config.Config{MetricCollector: noop.NewCollector()}
+			srv := httptest.NewServer(http.HandlerFunc(s.ServeBinaryWs(conf)))
+			DeferCleanup(srv.Close)
+
+			_, resp, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).To(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+	})
+
+	Context("Max connection lifetime", func() {
+		It("closes the connection once a record failing to be written is nacked", func() {
+			logger, _ := logrus.NoOpLogger()
+			ackChan := make(chan *telemetry.Record, 10)
+			conf := &config.Config{
+				Records:               map[string][]telemetry.Dispatcher{"V": {telemetry.Kafka}},
+				ReliableAckSources:    map[string]telemetry.Dispatcher{"V": telemetry.Kafka},
+				AckChan:               ackChan,
+				MaxConnectionLifetime: 200,
+				ShutdownDrainTimeout:  30000,
+				MetricCollector:       noop.NewCollector(),
+			}
+			// the write fails once the lifetime of the connection expired, while the socket waits for its ack
+			producer := &ChannelProducer{records: make(chan *telemetry.Record), err: errors.New("broker down")}
+			nacker := telemetry.NewNacker(telemetry.Kafka, ackChan, map[string]interface{}{"V": true}, conf.MetricCollector)
+			_, s, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{"V": {telemetry.NewNackProducer(producer, nacker)}}, logger, streaming.NewSocketRegistry())
+			Expect(err).NotTo(HaveOccurred())
+
+			ca := testCertificate("TeslaMotors", nil)
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(ca.Leaf)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(s.ServeBinaryWs(conf)))
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{testCertificate("fleet-telemetry", &ca)}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+			srv.StartTLS()
+			DeferCleanup(srv.Close)
+
+			dialer := &websocket.Dialer{HandshakeTimeout: time.Second, TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate("device-42", &ca)}, RootCAs: clientCAs}}
+			conn, _, err := dialer.Dial(strings.Replace(srv.URL, "https", "wss", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			payload, err := proto.Marshal(&protos.Payload{Vin: "device-42", CreatedAt: timestamppb.Now()})
+			Expect(err).NotTo(HaveOccurred())
+			message, err := (&messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.device-42"), MessageTopic: []byte("V"), Payload: payload}).ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.WriteMessage(websocket.BinaryMessage, message)).To(Succeed())
+
+			time.Sleep(400 * time.Millisecond)
+			Eventually(producer.records).Should(Receive())
+
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			_, response, err := conn.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			streamMessage, err := messages.StreamMessageFromBytes(response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(streamMessage.Payload)).To(Equal("incorrect message format"))
+
+			_, _, err = conn.ReadMessage()
+			Expect(websocket.IsCloseError(err, websocket.CloseServiceRestart)).To(BeTrue())
+		})
+	})
+
+	Context("Reload", func() {
+		var (
+			conf      *config.Config
+			s         *streaming.Server
+			producers map[telemetry.Dispatcher]telemetry.Producer
+			hook      *test.Hook
+		)
+
+		BeforeEach(func() {
+			var logger *logrus.Logger
+			logger, hook = logrus.NoOpLogger()
+			conf = &config.Config{
+				Records:         map[string][]telemetry.Dispatcher{"V": {telemetry.Logger}},
+				MetricCollector: noop.NewCollector(),
+			}
+			producers = map[telemetry.Dispatcher]telemetry.Producer{telemetry.Logger: simple.NewProtoLogger(&simple.Config{}, logger)}
+
+			var err error
+			_, s, err = streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{}, logger, streaming.NewSocketRegistry())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("swaps the routing and logs settings requiring a restart", func() {
+			newConfig := &config.Config{
+				Port:            4443,
+				Records:         map[string][]telemetry.Dispatcher{"V": {telemetry.Logger}, "alerts": {telemetry.Logger}},
+				RateLimit:       &config.RateLimit{Enabled: true, MessageLimit: 10},
+				MetricCollector: conf.MetricCollector,
+			}
+			Expect(s.Reload(conf, newConfig, producers)).To(Succeed())
+
+			var messages []string
+			for _, entry := range hook.AllEntries() {
+				messages = append(messages, entry.Message)
+			}
+			Expect(messages).To(ContainElements("config_reload_requires_restart", "config_reloaded"))
+		})
+
+		It("fails when the vin filter cannot be read", func() {
+			newConfig := &config.Config{
+				Records:         conf.Records,
+				VINDenylist:     "/nonexistent/denylist.txt",
+				MetricCollector: conf.MetricCollector,
+			}
+			Expect(s.Reload(conf, newConfig, producers)).To(HaveOccurred())
+		})
+
+		It("fails when a dispatcher is not running", func() {
+			newConfig := &config.Config{
+				Records:         map[string][]telemetry.Dispatcher{"V": {telemetry.Kafka}},
+				MetricCollector: conf.MetricCollector,
+			}
+			Expect(s.Reload(conf, newConfig, producers)).To(MatchError("dispatcher kafka is not running, requires restart"))
+		})
 	})
 })
@@ -4,14 +4,18 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/beefsack/go-rate"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/teslamotors/fleet-telemetry/config"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
@@ -31,6 +35,21 @@ const ReadWriteExitDeadline = 50 * time.Millisecond
 // WriteLoopDeadline is the read/write deadline in the main loop
 const WriteLoopDeadline = 10 * time.Second
 
+const (
+	// recordAgeClockSkew is how far in the future records can be created before the clock of the vehicle is considered wrong
+	recordAgeClockSkew = time.Minute
+	// maxRecordAge is the oldest record age observed in record_age_sec
+	maxRecordAge = 7 * 24 * time.Hour
+
+	// lifetimeJitter is the max fraction of the max connection lifetime removed at random, so the vehicles
+	// connected at the same time don't all reconnect at once
+	lifetimeJitter = 0.1
+	// lifetimeFlushPollInterval is how often pending acks are checked before closing a connection at its max lifetime
+	lifetimeFlushPollInterval = 50 * time.Millisecond
+	// lifetimeCloseTimeout is how long the vehicle has to answer the close frame sent at the max lifetime
+	lifetimeCloseTimeout = time.Second
+)
+
 // SocketManager is a struct responsible for managing the socket connection with the clients
 type SocketManager struct {
 	Ws           *websocket.Conn
@@ -47,8 +66,74 @@ type SocketManager struct {
 	stopChan               chan struct{}
 	writeChan              chan SocketMessage
 	transmitDecodedRecords bool
+	vinRateLimiter         *VinRateLimiter
+	deduplicator           *Deduplicator
+	recentRecords          *RecentRecords
+	rateLimit              *atomic.Pointer[config.RateLimit]
+	vinFilter              *atomic.Pointer[VINFilter]
+	vinFiltered            bool
+	// firmwareVersion is the last firmware version reported by the vehicle, added to records which don't carry it
+	firmwareVersion string
+	// connectionMetadata is resolved by the metadata lookup when the vehicle connects and added to each record
+	connectionMetadata map[string]string
+	pingInterval       time.Duration
+	pongTimeout        time.Duration
+	idleTimeout        time.Duration
+	maxLifetime        time.Duration
+	// lastMessageAt is only accessed by the read loop, to close idle connections
+	lastMessageAt   time.Time
+	lifetimeExpired atomic.Bool
+	// replaced is set when a newer connection of the vin closes this one
+	replaced atomic.Bool
+	// rateLimitClosed is set when the connection is closed for exceeding the rate limit
+	rateLimitClosed atomic.Bool
+	// cancelStream ends the gRPC stream of the connection, nil for websockets
+	cancelStream context.CancelFunc
+	// pendingAcks counts the records of the connection waiting for datastore acks
+	pendingAcks     atomic.Int64
+	maxMessageBytes int64
+	writeTimeout    time.Duration
+	writerStopped   atomic.Bool
+	writeTimedOut   atomic.Bool
+	draining        *atomic.Bool
+	inFlight        *atomic.Int64
+	closeRequested  atomic.Bool
+	inboundQueue    *inboundQueue
+	closeReason     string
+	// respond sends the responses of connections which are not websockets, such as gRPC streams
+	respond func(record *telemetry.Record, err error)
+	// compressedConn counts the bytes read from the network when permessage-deflate was negotiated
+	compressedConn *countingConn
+	wireBytesRead  int64
+	bytesSaved     int64
+	// paused is only accessed by the BackpressureMonitor
+	paused bool
 }
 
+// Close reasons reported in the socket_disconnect_total metric
+const (
+	closeReasonClient         = "client_closed"
+	closeReasonReadError      = "read_error"
+	closeReasonUnexpectedType = "unexpected_message_type"
+	closeReasonPongTimeout    = "pong_timeout"
+	closeReasonInvalidPayload = "invalid_payload"
+	closeReasonMessageTooBig  = "message_too_big"
+	closeReasonWriteTimeout   = "write_timeout"
+	closeReasonShutdown       = "server_shutdown"
+	closeReasonPanic          = "panic"
+	closeReasonIdleTimeout    = "idle_timeout"
+	closeReasonMaxLifetime    = "max_lifetime"
+	closeReasonDuplicateVIN   = "duplicate_vin"
+	closeReasonRateLimited    = "rate_limited"
+)
+
+var (
+	// errVinRateLimited is sent back to the vehicle when throttle hints are enabled
+	errVinRateLimited = errors.New("rate limit exceeded")
+	// errIncorrectMessageFormat is sent back to the vehicle for the records which cannot be processed
+	errIncorrectMessageFormat = errors.New("incorrect message format")
+)
+
 // SocketMessage represents incoming socket connection
 type SocketMessage struct {
 	MsgType int
@@ -58,12 +143,35 @@ type SocketMessage struct {
 // Metrics stores metrics reported from this package
 type Metrics struct {
 	rateLimitExceededCount       adapter.Counter
+	rateLimitPerVinDroppedCount  adapter.Counter
+	backpressureDurationMs       adapter.Counter
 	recordTooBigCount            adapter.Counter
+	decompressedTooBigCount      adapter.Counter
 	unauthorizedSenderCount      adapter.Counter
+	vinCertMismatchCount         adapter.Counter
+	vinFilteredCount             adapter.Counter
 	unknownMessageTypeErrorCount adapter.Counter
+	payloadDecodeErrorCount      adapter.Counter
 	dispatchCount                adapter.Counter
+	dedupDroppedCount            adapter.Counter
+	firmwareRecordCount          adapter.Counter
+	recordAgeSec                 adapter.Histogram
+	recordAgeOutOfRangeCount     adapter.Counter
 	unexpectedRecordErrorCount   adapter.Counter
+	compressionBytesSaved        adapter.Counter
 	socketErrorCount             adapter.Counter
+	pongTimeoutCount             adapter.Counter
+	messageTooBigCount           adapter.Counter
+	writeTimeoutCount            adapter.Counter
+	drainRejectedCount           adapter.Counter
+	duplicateVINCount            adapter.Counter
+	inboundQueueDepth            adapter.Gauge
+	inboundQueueDroppedCount     adapter.Counter
+	activeConnections            adapter.Gauge
+	connectCount                 adapter.Counter
+	disconnectCount              adapter.Counter
+	closeSentCount               adapter.Counter
+	connectionLifetimeSec        adapter.Timer
 	recordSizeBytesTotal         adapter.Counter
 	recordCount                  adapter.Counter
 }
@@ -79,7 +187,7 @@ func NewSocketManager(ctx context.Context, requestIdentity *telemetry.RequestIde
 
 	requestLogInfo, socketUUID := buildRequestContext(ctx)
 
-	return &SocketManager{
+	sm := &SocketManager{
 		Ws:           ws,
 		MsgType:      websocket.BinaryMessage,
 		RecordsStats: make(map[string]int),
@@ -94,7 +202,30 @@ func NewSocketManager(ctx context.Context, requestIdentity *telemetry.RequestIde
 		stopChan:               make(chan struct{}),
 		requestIdentity:        requestIdentity,
 		transmitDecodedRecords: config.TransmitDecodedRecords,
+		rateLimit:              staticRateLimit(config.RateLimit),
+		vinFilter:              &atomic.Pointer[VINFilter]{},
+		maxMessageBytes:        config.MaxMessageBytes,
+		writeTimeout:           WriteLoopDeadline,
+		draining:               &atomic.Bool{},
+		inFlight:               &atomic.Int64{},
+	}
+	if config.InboundQueue != nil {
+		sm.inboundQueue = newInboundQueue(config.InboundQueue)
 	}
+	if config.SocketWriteTimeout > 0 {
+		sm.writeTimeout = time.Duration(config.SocketWriteTimeout) * time.Millisecond
+	}
+
+	if config.Keepalive != nil && config.Keepalive.PingInterval > 0 {
+		sm.pingInterval = time.Duration(config.Keepalive.PingInterval) * time.Millisecond
+		sm.pongTimeout = sm.pingInterval
+		if config.Keepalive.PongTimeout > 0 {
+			sm.pongTimeout = time.Duration(config.Keepalive.PongTimeout) * time.Millisecond
+		}
+	}
+	sm.idleTimeout = time.Duration(config.IdleTimeout) * time.Millisecond
+	sm.maxLifetime = time.Duration(config.MaxConnectionLifetime) * time.Millisecond
+	return sm
 }
 
 func buildRequestContext(ctx context.Context) (logInfo map[string]interface{}, socketUUID uuid.UUID) {
@@ -140,12 +271,15 @@ func (sm *SocketManager) ListenToWriteChannel() SocketMessage {
 
 // Close shuts down a socket connection for a single client and log metrics
 func (sm *SocketManager) Close() {
-	if err := sm.Ws.Close(); err != nil {
-		sm.logger.ErrorLog("websocket_close_err", err, nil)
+	if sm.Ws != nil {
+		if err := sm.Ws.Close(); err != nil {
+			sm.logger.ErrorLog("websocket_close_err", err, nil)
+		}
 	}
 
 	socketMetrics := sm.RecordsStatsToLogInfo()
 	socketMetrics["duration_sec"] = int(time.Since(sm.StartTime) / time.Second) // Result is in nanosecond, converting it to seconds
+	socketMetrics["close_reason"] = sm.closeReason
 	sm.logger.ActivityLog("socket_disconnected", socketMetrics)
 }
 
@@ -163,60 +297,330 @@ func (sm *SocketManager) RecordsStatsToLogInfo() map[string]interface{} {
 
 // ProcessTelemetry uses the serializer to dispatch telemetry records
 func (sm *SocketManager) ProcessTelemetry(serializer *telemetry.BinarySerializer) {
+	sm.reportConnected()
 	defer func() {
-		sm.Close()
-		close(sm.stopChan)
+		if r := recover(); r != nil {
+			sm.closeReason = closeReasonPanic
+			defer panic(r)
+		}
+		if sm.inboundQueue != nil {
+			sm.inboundQueue.close()
+		}
+		sm.reportDisconnected()
 	}()
 
-	sm.logger.ActivityLog("socket_connected", sm.requestInfo)
 	go sm.writer()
-	var rl *rate.RateLimiter
-
-	if sm.config.RateLimit != nil && sm.config.RateLimit.Enabled {
-		rl = rate.New(sm.config.RateLimit.MessageLimit, sm.config.RateLimit.MessageIntervalTimeSecond)
-	} else {
-		rl = rate.New(100, 60*time.Second)
+	if sm.inboundQueue != nil {
+		go sm.inboundQueue.consume(func(message []byte) { sm.dispatchQueued(serializer, message) })
 	}
+	limiter := newConnectionRateLimiter(sm.rateLimit.Load())
 
-	var rateLimitStartTime time.Time
-	messagesRateLimited := 0
+	if sm.maxMessageBytes > 0 {
+		sm.Ws.SetReadLimit(sm.maxMessageBytes)
+	}
+	if sm.pingInterval > 0 || sm.idleTimeout > 0 {
+		sm.lastMessageAt = time.Now()
+		sm.extendReadDeadline()
+		sm.Ws.SetPongHandler(func(string) error {
+			sm.extendReadDeadline()
+			return nil
+		})
+	}
+	if sm.maxLifetime > 0 {
+		lifetime := sm.maxLifetime - time.Duration(rand.Float64()*lifetimeJitter*float64(sm.maxLifetime))
+		lifetimeTimer := time.AfterFunc(lifetime, sm.closeAtMaxLifetime)
+		defer lifetimeTimer.Stop()
+	}
 
 	// infinite loop until the client disconnects (keep accepting new messages)
 	for {
 		msgType, message, err := sm.Ws.ReadMessage()
 		if err != nil || msgType != sm.MsgType {
+			sm.closeReason = sm.readCloseReason(err)
+			switch sm.closeReason {
+			case closeReasonPongTimeout:
+				metricsRegistry.pongTimeoutCount.Inc(map[string]string{})
+				sm.logger.ActivityLog("socket_pong_timeout", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "pong_timeout_ms": sm.pongTimeout.Milliseconds()})
+			case closeReasonMessageTooBig:
+				metricsRegistry.messageTooBigCount.Inc(map[string]string{})
+				sm.logger.ActivityLog("socket_message_too_big", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "max_message_bytes": sm.maxMessageBytes})
+			case closeReasonIdleTimeout:
+				sm.logger.ActivityLog("socket_idle_timeout", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "idle_timeout_ms": sm.idleTimeout.Milliseconds()})
+			}
 			return
 		}
+		if sm.pingInterval > 0 || sm.idleTimeout > 0 {
+			sm.lastMessageAt = time.Now()
+			sm.extendReadDeadline()
+		}
+		sm.reportCompressionSavings(len(message))
+		if !sm.admit(serializer, message, limiter) {
+			continue
+		}
+		if sm.inboundQueue != nil {
+			sm.inboundQueue.push(message)
+			continue
+		}
+		sm.ParseAndProcessRecord(serializer, message)
+		if sm.closeRequested.Load() {
+			sm.closeReason = closeReasonInvalidPayload
+			return
+		}
+	}
+}
 
-		// check rate limit
-		if ok, _ := rl.Try(); !ok {
-			if messagesRateLimited == 0 {
-				rateLimitStartTime = time.Now()
-			}
-			// client exceeded the rate limit
-			messagesRateLimited++
-			record, _ := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
-			metricsRegistry.rateLimitExceededCount.Inc(map[string]string{"device_id": sm.requestIdentity.DeviceID, "txtype": record.TxType})
-			if sm.config.RateLimit != nil && sm.config.RateLimit.Enabled {
-				continue
+// reportConnected counts and logs the new connection
+func (sm *SocketManager) reportConnected() {
+	metricsRegistry.connectCount.Inc(map[string]string{})
+	metricsRegistry.activeConnections.Add(1, map[string]string{})
+	sm.logger.ActivityLog("socket_connected", sm.requestInfo)
+}
+
+// reportDisconnected closes the connection and reports it with its close reason
+func (sm *SocketManager) reportDisconnected() {
+	sm.Close()
+	close(sm.stopChan)
+	metricsRegistry.activeConnections.Sub(1, map[string]string{})
+	metricsRegistry.disconnectCount.Inc(map[string]string{"reason": sm.closeReason})
+	metricsRegistry.connectionLifetimeSec.Observe(int64(time.Since(sm.StartTime)/time.Second), map[string]string{})
+}
+
+// connectionRateLimiter limits the messages of a connection, it is rebuilt when the rate limit settings are reloaded
+type connectionRateLimiter struct {
+	rateLimit           *config.RateLimit
+	limiter             *rate.RateLimiter
+	limitedSince        time.Time
+	messagesRateLimited int
+}
+
+func newConnectionRateLimiter(rateLimit *config.RateLimit) *connectionRateLimiter {
+	return &connectionRateLimiter{rateLimit: rateLimit, limiter: newMessageRateLimiter(rateLimit)}
+}
+
+// admit applies the drain state, vin filter and rate limits to a message read from the vehicle,
+// it returns false if the message must not be processed
+func (sm *SocketManager) admit(serializer *telemetry.BinarySerializer, message []byte, rl *connectionRateLimiter) bool {
+	// the vehicle sends the records again to another server once disconnected
+	if sm.draining.Load() {
+		metricsRegistry.drainRejectedCount.Inc(map[string]string{})
+		return false
+	}
+	// the connection is closing, the vehicle sends the message again once reconnected
+	if sm.lifetimeExpired.Load() || sm.replaced.Load() || sm.rateLimitClosed.Load() {
+		return false
+	}
+
+	if allowed, list := sm.vinFilter.Load().Check(sm.requestIdentity.DeviceID); !allowed {
+		sm.dropFilteredVIN(serializer, message, list)
+		return false
+	}
+
+	// the rate limit settings are swapped on config reload
+	if current := sm.rateLimit.Load(); current != rl.rateLimit {
+		rl.rateLimit = current
+		rl.limiter = newMessageRateLimiter(current)
+	}
+
+	// check rate limit
+	if ok, _ := rl.limiter.Try(); !ok {
+		if rl.messagesRateLimited == 0 {
+			rl.limitedSince = time.Now()
+		}
+		// client exceeded the rate limit
+		rl.messagesRateLimited++
+		record, _ := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
+		metricsRegistry.rateLimitExceededCount.Inc(map[string]string{"device_id": sm.requestIdentity.DeviceID, "txtype": record.TxType})
+		if rl.rateLimit != nil && rl.rateLimit.Enabled {
+			if rl.rateLimit.CloseOnExceeded {
+				sm.closeRateLimited()
 			}
+			return false
 		}
-		if messagesRateLimited > 0 {
-			parts := bytes.Split(message, []byte(","))
-			if len(parts) > 2 {
-				duration := time.Since(rateLimitStartTime) / time.Second
+	}
+	if rl.messagesRateLimited > 0 {
+		parts := bytes.Split(message, []byte(","))
+		if len(parts) > 2 {
+			duration := time.Since(rl.limitedSince) / time.Second
 
-				sm.logger.ErrorLog("rate_limit_exceeded", nil, logrus.LogInfo{"txid": parts[2], "duration_sec": duration, "messages_rate_limited": messagesRateLimited})
-			}
-			messagesRateLimited = 0
+			sm.logger.ErrorLog("rate_limit_exceeded", nil, logrus.LogInfo{"txid": parts[2], "duration_sec": duration, "messages_rate_limited": rl.messagesRateLimited})
 		}
-		sm.ParseAndProcessRecord(serializer, message)
+		rl.messagesRateLimited = 0
+	}
+	if sm.vinRateLimiter != nil && !sm.vinRateLimiter.Allow(sm.requestIdentity.DeviceID) {
+		sm.dropVinRateLimited(serializer, message)
+		return false
+	}
+	return true
+}
+
+// dispatchQueued processes a message of the inbound queue, the read loop is unblocked if the connection must be closed
+func (sm *SocketManager) dispatchQueued(serializer *telemetry.BinarySerializer, message []byte) {
+	sm.ParseAndProcessRecord(serializer, message)
+	if sm.closeRequested.Load() {
+		_ = sm.Ws.SetReadDeadline(time.Now())
+	}
+}
+
+// readCloseReason classifies the error which ended the read loop
+func (sm *SocketManager) readCloseReason(err error) string {
+	var closeErr *websocket.CloseError
+	switch {
+	case sm.draining.Load():
+		return closeReasonShutdown
+	case sm.closeRequested.Load():
+		return closeReasonInvalidPayload
+	case sm.lifetimeExpired.Load():
+		return closeReasonMaxLifetime
+	case sm.replaced.Load():
+		return closeReasonDuplicateVIN
+	case sm.rateLimitClosed.Load():
+		return closeReasonRateLimited
+	case sm.writeTimedOut.Load():
+		return closeReasonWriteTimeout
+	case err == nil:
+		return closeReasonUnexpectedType
+	case errors.Is(err, websocket.ErrReadLimit):
+		return closeReasonMessageTooBig
+	case sm.isIdleTimeout(err):
+		return closeReasonIdleTimeout
+	case sm.isPongTimeout(err):
+		return closeReasonPongTimeout
+	case errors.As(err, &closeErr):
+		return closeReasonClient
+	default:
+		return closeReasonReadError
+	}
+}
+
+// extendReadDeadline gives the vehicle until the next ping plus the pong timeout to show signs of life, and
+// until the idle timeout after its last message. Pongs don't delay the idle timeout
+func (sm *SocketManager) extendReadDeadline() {
+	// the deadline was set to close the connection at its max lifetime, because it was replaced or rate limited
+	if sm.lifetimeExpired.Load() || sm.replaced.Load() || sm.rateLimitClosed.Load() {
+		return
+	}
+	var deadline time.Time
+	if sm.pingInterval > 0 {
+		deadline = time.Now().Add(sm.pingInterval + sm.pongTimeout)
+	}
+	if sm.idleTimeout > 0 {
+		if idleDeadline := sm.lastMessageAt.Add(sm.idleTimeout); deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+	_ = sm.Ws.SetReadDeadline(deadline)
+}
+
+// isIdleTimeout checks whether the read failed because the vehicle sent no message for the idle timeout
+func (sm *SocketManager) isIdleTimeout(err error) bool {
+	if sm.idleTimeout == 0 || sm.writerStopped.Load() || time.Since(sm.lastMessageAt) < sm.idleTimeout {
+		return false
 	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// closeAtMaxLifetime stops accepting messages from the vehicle and waits, up to the drain timeout, for the acks
+// of the records it already sent. The close frame is then queued after the acks with the code 1012, so the
+// vehicle reconnects
+func (sm *SocketManager) closeAtMaxLifetime() {
+	sm.lifetimeExpired.Store(true)
+	deadline := time.Now().Add(sm.config.DrainTimeout())
+	for sm.pendingAcks.Load() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-sm.stopChan:
+			return
+		case <-time.After(lifetimeFlushPollInterval):
+		}
+	}
+
+	sm.logger.ActivityLog("socket_max_lifetime", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "lifetime_sec": int(time.Since(sm.StartTime) / time.Second), "pending_acks": sm.pendingAcks.Load()})
+	sm.enqueueWrite(SocketMessage{websocket.CloseMessage, CloseMaxLifetime.message()})
+	_ = sm.Ws.SetReadDeadline(time.Now().Add(lifetimeCloseTimeout))
+}
+
+// closeReplaced closes a connection replaced by a newer connection of the same vin. Websockets are sent the close
+// code 1008, the messages read until then are still processed
+func (sm *SocketManager) closeReplaced() {
+	sm.replaced.Store(true)
+	sm.logger.ActivityLog("socket_replaced", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "connection_id": sm.UUID, "lifetime_sec": int(time.Since(sm.StartTime) / time.Second)})
+	if sm.Ws == nil {
+		sm.cancelStream()
+		return
+	}
+	sm.enqueueWrite(SocketMessage{websocket.CloseMessage, CloseDuplicateVIN.message()})
+	_ = sm.Ws.SetReadDeadline(time.Now().Add(lifetimeCloseTimeout))
+}
+
+// closeRateLimited closes a connection exceeding the message rate limit with close_on_exceeded. Websockets are sent
+// the close code 4429 so the vehicle backs off, gRPC streams end with ResourceExhausted
+func (sm *SocketManager) closeRateLimited() {
+	if sm.rateLimitClosed.Swap(true) {
+		return
+	}
+	sm.logger.ActivityLog("socket_rate_limited_close", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "connection_id": sm.UUID})
+	if sm.Ws == nil {
+		sm.cancelStream()
+		return
+	}
+	writeClose(sm.Ws, CloseRateLimited, sm.writeTimeout)
+	_ = sm.Ws.SetReadDeadline(time.Now())
+}
+
+// isPongTimeout checks whether the read failed because the vehicle stopped answering pings,
+// the writer also sets a read deadline when it exits
+func (sm *SocketManager) isPongTimeout(err error) bool {
+	if sm.pingInterval == 0 || sm.writerStopped.Load() {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// staticRateLimit returns rate limit settings which are not reloaded
+func staticRateLimit(rateLimit *config.RateLimit) *atomic.Pointer[config.RateLimit] {
+	pointer := &atomic.Pointer[config.RateLimit]{}
+	pointer.Store(rateLimit)
+	return pointer
+}
+
+func newMessageRateLimiter(rateLimit *config.RateLimit) *rate.RateLimiter {
+	if rateLimit != nil && rateLimit.Enabled {
+		return rate.New(rateLimit.MessageLimit, rateLimit.MessageIntervalTimeSecond)
+	}
+	return rate.New(100, 60*time.Second)
+}
+
+// dropVinRateLimited drops a message exceeding the per vin limit, optionally notifying the vehicle
+func (sm *SocketManager) dropVinRateLimited(serializer *telemetry.BinarySerializer, message []byte) {
+	metricsRegistry.rateLimitPerVinDroppedCount.Inc(map[string]string{})
+	if rateLimit := sm.rateLimit.Load(); rateLimit == nil || rateLimit.PerVIN == nil || !rateLimit.PerVIN.ThrottleHint {
+		return
+	}
+	record, _ := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
+	sm.sendResponse(record, errVinRateLimited)
+}
+
+// dropFilteredVIN drops a message of a vehicle rejected by the vin filter. It is acked so the vehicle does not send it again
+func (sm *SocketManager) dropFilteredVIN(serializer *telemetry.BinarySerializer, message []byte, list string) {
+	metricsRegistry.vinFilteredCount.Inc(map[string]string{"list": list})
+	if !sm.vinFiltered {
+		sm.vinFiltered = true
+		sm.logger.ActivityLog("vin_filtered", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "list": list})
+	}
+	record, _ := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
+	sm.respondToVehicle(record, nil)
 }
 
 // ParseAndProcessRecord reads incoming client message and dispatches to relevant producer
 func (sm *SocketManager) ParseAndProcessRecord(serializer *telemetry.BinarySerializer, message []byte) {
+	ctx, span := telemetry.StartSpan(context.Background(), "record.ingest")
+	defer span.End()
+	_, decodeSpan := telemetry.StartSpan(ctx, "record.decode")
 	record, err := telemetry.NewRecord(serializer, message, sm.UUID, sm.transmitDecodedRecords)
+	telemetry.EndSpan(decodeSpan, err)
+	span.SetAttributes(attribute.String("record_type", record.TxType), attribute.String("txid", record.Txid))
+	record.InjectTraceContext(ctx)
 	logInfo := logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType}
 
 	if err != nil {
@@ -225,6 +629,11 @@ func (sm *SocketManager) ParseAndProcessRecord(serializer *telemetry.BinarySeria
 			metricsRegistry.recordTooBigCount.Inc(map[string]string{})
 			return
 		}
+		if err == telemetry.ErrDecompressedMessageTooBig {
+			sm.respondToVehicle(record, err)
+			metricsRegistry.decompressedTooBigCount.Inc(map[string]string{"record_type": record.TxType})
+			return
+		}
 
 		switch typedError := err.(type) {
 		case *telemetry.UnauthorizedSenderIDError:
@@ -234,41 +643,134 @@ func (sm *SocketManager) ParseAndProcessRecord(serializer *telemetry.BinarySeria
 			metricsRegistry.unauthorizedSenderCount.Inc(map[string]string{})
 			sm.respondToVehicle(record, nil) // respond to the client message was accepted so they are not resending it over and over
 			return
+		case *telemetry.VINMismatchError:
+			logInfo["client_id"] = typedError.CertVIN
+			logInfo["received_vin"] = typedError.ReceivedVIN
+			logInfo["source_ip"] = sm.requestIdentity.SourceIP
+			sm.logger.ErrorLog("vin_cert_mismatch", nil, logInfo)
+			metricsRegistry.vinCertMismatchCount.Inc(map[string]string{"record_type": record.TxType})
+			sm.respondToVehicle(record, err)
+			return
 		case *telemetry.UnknownMessageType:
 			logInfo["msg_txid"] = typedError.Txid
 			logInfo["msg_type"] = string(typedError.GuessedType)
 			sm.logger.ErrorLog("unknown_message_type_error", err, logInfo)
 			metricsRegistry.unknownMessageTypeErrorCount.Inc(map[string]string{"msg_type": string(typedError.GuessedType)})
 			sm.respondToVehicle(record, nil) // respond to the client message was accepted so they are not resending it over and over
+		case *telemetry.PayloadDecodeError:
+			if sm.config.ValidatePayloads {
+				sm.rejectInvalidPayload(record, typedError)
+				return
+			}
+			sm.respondToVehicle(record, err)
+			return
 		default:
 			sm.respondToVehicle(record, err)
 			return
 		}
 	}
 
+	sm.trackFirmwareVersion(record)
+	for key, value := range sm.connectionMetadata {
+		record.AddMetadata(key, value)
+	}
+	reportRecordAge(record, time.Now())
+
+	// the vehicle resends records it did not get an ack for, the duplicate of a written record is acked so it stops
+	if sm.deduplicator != nil && sm.deduplicator.Seen(record) {
+		metricsRegistry.dedupDroppedCount.Inc(map[string]string{"record_type": record.TxType})
+		sm.respondToVehicle(record, nil)
+		return
+	}
+
+	// copied before dispatching, datastores can update the record concurrently once dispatched
+	if sm.recentRecords != nil {
+		sm.recentRecords.Add(record)
+	}
+
+	// the pending acks need to be set before dispatching as datastores can ack right away
+	requiredAcks := sm.config.RequiredAcks(record.TxType)
+	if requiredAcks > 0 {
+		record.SetPendingAcks(requiredAcks)
+		sm.inFlight.Add(1)
+		sm.pendingAcks.Add(1)
+	}
+
 	// write the record out to kafka
 	sm.ReportMetricBytesPerRecords(record.TxType, record.Length())
-	sm.processRecord(record)
+	if err := sm.processRecord(record); err != nil {
+		// the record was not handed to the datastores, none of them will ack it
+		if requiredAcks > 0 {
+			sm.inFlight.Add(-1)
+			sm.pendingAcks.Add(-1)
+		}
+		sm.respondToVehicle(record, err)
+		return
+	}
 
-	// respond instantly to the client if we are not doing reliable ACKs
-	if !sm.reliableAck(record) {
+	// respond instantly to the client if we are not doing reliable ACKs, records waiting for acks are remembered
+	// by the deduplicator once acked
+	if requiredAcks == 0 {
+		if sm.deduplicator != nil {
+			sm.deduplicator.Remember(record)
+		}
 		sm.respondToVehicle(record, nil)
 	}
 }
 
-func (sm *SocketManager) reliableAck(record *telemetry.Record) bool {
-	_, ok := sm.config.ReliableAckSources[record.TxType]
-	return ok
+// trackFirmwareVersion remembers the firmware version reported by the vehicle and adds it to the
+// records which don't carry it, since vehicles only send the Version field when it changes
+func (sm *SocketManager) trackFirmwareVersion(record *telemetry.Record) {
+	if version := record.FirmwareVersion(); version != "" {
+		sm.firmwareVersion = version
+	} else if sm.firmwareVersion != "" {
+		record.AddMetadata(telemetry.FirmwareMetadataKey, sm.firmwareVersion)
+	}
+	metricsRegistry.firmwareRecordCount.Inc(map[string]string{"record_type": record.TxType, "firmware": telemetry.FirmwareBucket(sm.firmwareVersion)})
+}
+
+// reportRecordAge observes how long ago the vehicle created the record. Ages from a clock in the future or
+// older than maxRecordAge are counted apart, so vehicles with a wrong clock don't skew the histogram
+func reportRecordAge(record *telemetry.Record, now time.Time) {
+	createdAt, ok := record.CreatedAt()
+	if !ok {
+		return
+	}
+	age := now.Sub(createdAt)
+	switch {
+	case age < -recordAgeClockSkew:
+		metricsRegistry.recordAgeOutOfRangeCount.Inc(map[string]string{"record_type": record.TxType, "range": "future"})
+	case age > maxRecordAge:
+		metricsRegistry.recordAgeOutOfRangeCount.Inc(map[string]string{"record_type": record.TxType, "range": "stale"})
+	default:
+		metricsRegistry.recordAgeSec.Observe(int64(max(age, 0)/time.Second), map[string]string{"record_type": record.TxType})
+	}
+}
+
+// rejectInvalidPayload applies the configured action to a record whose payload failed to decode
+func (sm *SocketManager) rejectInvalidPayload(record *telemetry.Record, err *telemetry.PayloadDecodeError) {
+	metricsRegistry.payloadDecodeErrorCount.Inc(map[string]string{"txtype": err.TxType})
+	if sm.config.InvalidPayloadAction != config.InvalidPayloadClose {
+		sm.respondToVehicle(record, err)
+		return
+	}
+
+	sm.logger.ErrorLog("invalid_payload_close", err, logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType, "client_id": sm.requestIdentity.DeviceID})
+	if sm.Ws != nil {
+		writeClose(sm.Ws, CloseInvalidPayload, sm.writeTimeout)
+	}
+	sm.closeRequested.Store(true)
 }
 
-func (sm *SocketManager) processRecord(record *telemetry.Record) {
-	record.Dispatch()
+func (sm *SocketManager) processRecord(record *telemetry.Record) error {
+	err := record.Dispatch()
 	metricsRegistry.dispatchCount.Inc(map[string]string{"record_type": record.TxType})
+	return err
 }
 
 // respondToVehicle sends an ack message to the client to acknowledge that the records have been transmitted
 func (sm *SocketManager) respondToVehicle(record *telemetry.Record, err error) {
-	var response []byte
+	var responseErr error
 
 	logInfo := logrus.LogInfo{"txid": record.Txid, "record_type": record.TxType}
 
@@ -276,34 +778,99 @@ func (sm *SocketManager) respondToVehicle(record *telemetry.Record, err error) {
 		logInfo["client_id"] = sm.requestIdentity.DeviceID
 		sm.logger.ErrorLog("unexpected_record", err, logInfo)
 		metricsRegistry.unexpectedRecordErrorCount.Inc(map[string]string{})
-		response = record.Error(errors.New("incorrect message format"))
+		responseErr = errIncorrectMessageFormat
 		logInfo["response_type"] = "error"
 	} else {
 		logInfo["response_type"] = "ack"
-		response = record.Ack()
 	}
 
 	sm.logger.Log(logrus.DEBUG, "message_respond", logInfo)
-	sm.writeChan <- SocketMessage{sm.MsgType, response}
+	_, span := record.StartSpan("record.ack", attribute.Bool("error", err != nil))
+	sm.sendResponse(record, responseErr)
+	span.End()
+}
+
+// sendResponse acks the record, or responds with err when set
+func (sm *SocketManager) sendResponse(record *telemetry.Record, err error) {
+	if sm.respond != nil {
+		sm.respond(record, err)
+		return
+	}
+	response := record.Ack()
+	if err != nil {
+		response = record.Error(err)
+	}
+	sm.enqueueWrite(SocketMessage{sm.MsgType, response})
+}
+
+// enqueueWrite hands a message to the writer. Acks are also sent from the reliable ack goroutine shared by all
+// connections, so a vehicle which stops reading cannot block it longer than the write timeout: it is disconnected
+func (sm *SocketManager) enqueueWrite(msg SocketMessage) {
+	select {
+	case sm.writeChan <- msg:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(sm.writeTimeout)
+	defer timer.Stop()
+	select {
+	case sm.writeChan <- msg:
+	case <-sm.stopChan:
+	case <-timer.C:
+		if sm.reportWriteTimeout() {
+			// unblocks the read loop which closes the connection
+			_ = sm.Ws.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// reportWriteTimeout flags the connection as closed for being a slow reader, it returns false if it already was
+func (sm *SocketManager) reportWriteTimeout() bool {
+	if sm.writeTimedOut.Swap(true) {
+		return false
+	}
+	metricsRegistry.writeTimeoutCount.Inc(map[string]string{})
+	sm.logger.ActivityLog("socket_write_timeout", logrus.LogInfo{"client_id": sm.requestIdentity.DeviceID, "write_timeout_ms": sm.writeTimeout.Milliseconds()})
+	return true
 }
 
 func (sm *SocketManager) writer() {
 	defer func() {
 
 		sm.logger.Log(logrus.DEBUG, "writer_done", nil)
+		sm.writerStopped.Store(true)
 		_ = sm.Ws.SetReadDeadline(time.Now().Add(ReadWriteExitDeadline))
 	}()
 
+	var pingChan <-chan time.Time
+	if sm.pingInterval > 0 {
+		pingTicker := time.NewTicker(sm.pingInterval)
+		defer pingTicker.Stop()
+		pingChan = pingTicker.C
+	}
+
 	for {
 		select {
 		case <-sm.stopChan:
 			sm.logger.Log(logrus.DEBUG, "return_stop_chan", nil)
 			return
+		case <-pingChan:
+			err := sm.Ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(sm.writeTimeout))
+			if err != nil {
+				metricsRegistry.socketErrorCount.Inc(map[string]string{})
+				sm.logger.ErrorLog("socket_ping_err", err, nil)
+				return
+			}
 		case msg := <-sm.writeChan:
 			err := sm.writeMessage(msg.MsgType, msg.Msg)
 			if err != nil {
 				metricsRegistry.socketErrorCount.Inc(map[string]string{})
 				sm.logger.ErrorLog("socket_err", err, nil)
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					sm.reportWriteTimeout()
+				}
 				return
 			}
 		}
@@ -311,12 +878,12 @@ func (sm *SocketManager) writer() {
 }
 
 func (sm *SocketManager) writeMessage(msgType int, msg []byte) error {
-	_ = sm.Ws.SetWriteDeadline(time.Now().Add(WriteLoopDeadline))
+	_ = sm.Ws.SetWriteDeadline(time.Now().Add(sm.writeTimeout))
 	return sm.Ws.WriteMessage(msgType, msg)
 }
 
 // ReportMetricBytesPerRecords records metrics for metric size
-func (sm SocketManager) ReportMetricBytesPerRecords(recordType string, byteSize int) {
+func (sm *SocketManager) ReportMetricBytesPerRecords(recordType string, byteSize int) {
 	sm.RecordsStats[recordType] += byteSize
 
 	metricsRegistry.recordSizeBytesTotal.Add(int64(byteSize), map[string]string{"record_type": recordType})
@@ -334,42 +901,181 @@ func registerMetrics(metricsCollector metrics.MetricCollector) {
 		Labels: []string{"device_id", "txtype"},
 	})
 
+	metricsRegistry.rateLimitPerVinDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "rate_limit_per_vin_dropped",
+		Help:   "The number of messages dropped because a vehicle exceeded its per vin rate limit.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.backpressureDurationMs = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "backpressure_duration_ms",
+		Help:   "The time spent asking vehicles to pause because the datastore queues were saturated.",
+		Labels: []string{},
+	})
+
 	metricsRegistry.recordTooBigCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "record_too_big_total",
 		Help:   "The number of times the record was too large.",
 		Labels: []string{},
 	})
 
+	metricsRegistry.decompressedTooBigCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "record_decompressed_too_big_total",
+		Help:   "The number of compressed records rejected because they exceeded the max decompressed size.",
+		Labels: []string{"record_type"},
+	})
+
 	metricsRegistry.unauthorizedSenderCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "unauthorized_sender_id_total",
 		Help:   "The number of times the sender was not authorized.",
 		Labels: []string{},
 	})
 
+	metricsRegistry.vinCertMismatchCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "vin_cert_mismatch_total",
+		Help:   "The number of records rejected because their vin differed from the one of the client certificate.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.vinFilteredCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "vin_filtered_total",
+		Help:   "The number of records dropped because their vin is in the denylist or missing from the allowlist.",
+		Labels: []string{"list"},
+	})
+
 	metricsRegistry.unknownMessageTypeErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "unknown_message_type_error_total",
 		Help:   "The number of times the message type was not known.",
 		Labels: []string{"msg_type"},
 	})
 
+	metricsRegistry.payloadDecodeErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "payload_decode_error",
+		Help:   "The number of records rejected because their payload could not be decoded.",
+		Labels: []string{"txtype"},
+	})
+
 	metricsRegistry.dispatchCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "dispatch_total",
 		Help:   "The number of records dispatched.",
 		Labels: []string{"record_type"},
 	})
 
+	metricsRegistry.dedupDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "dedup_dropped",
+		Help:   "The number of records dropped because the same record was received within the dedup window.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.firmwareRecordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "record_firmware_total",
+		Help:   "The number of records per firmware version of the vehicle, bucketed by year and week.",
+		Labels: []string{"record_type", "firmware"},
+	})
+
+	metricsRegistry.recordAgeSec = metricsCollector.RegisterHistogram(adapter.CollectorOptions{
+		Name:    "record_age_sec",
+		Help:    "The time in seconds between the creation of records by the vehicle and their reception.",
+		Labels:  []string{"record_type"},
+		Buckets: []float64{1, 5, 15, 60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600},
+	})
+
+	metricsRegistry.recordAgeOutOfRangeCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "record_age_out_of_range_total",
+		Help:   "The number of records left out of record_age_sec because they were created in the future or more than 7 days ago.",
+		Labels: []string{"record_type", "range"},
+	})
+
 	metricsRegistry.unexpectedRecordErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "unexpected_record_err_total",
 		Help:   "The number of unexpected records received.",
 		Labels: []string{},
 	})
 
+	metricsRegistry.compressionBytesSaved = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "websocket_compression_bytes_saved_total",
+		Help:   "The number of bytes permessage-deflate saved on messages received from vehicles.",
+		Labels: []string{},
+	})
+
 	metricsRegistry.socketErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "socket_err_total",
 		Help:   "The number of socket errors.",
 		Labels: []string{},
 	})
 
+	metricsRegistry.pongTimeoutCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_pong_timeout_total",
+		Help:   "The number of connections closed because the vehicle did not answer a ping in time.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.messageTooBigCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_message_too_big_total",
+		Help:   "The number of connections closed because the vehicle sent a message above max_message_bytes.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.writeTimeoutCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_write_timeout_total",
+		Help:   "The number of connections closed because the vehicle did not read the messages sent to it in time.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.drainRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_drain_rejected_total",
+		Help:   "The number of messages ignored because the server was shutting down.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.duplicateVINCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "duplicate_vin_connections_total",
+		Help:   "The number of connections of vins already at their max connections, by action: rejected or closed_oldest.",
+		Labels: []string{"action"},
+	})
+
+	metricsRegistry.inboundQueueDepth = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "socket_inbound_queue_depth",
+		Help:   "The number of messages waiting in the inbound queues of all connections.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.inboundQueueDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_inbound_queue_dropped_total",
+		Help:   "The number of messages dropped because the inbound queue of their connection was full.",
+		Labels: []string{"policy"},
+	})
+
+	metricsRegistry.activeConnections = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "socket_active_connections",
+		Help:   "The number of vehicles currently connected.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.connectCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_connect_total",
+		Help:   "The number of vehicle connections.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.disconnectCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_disconnect_total",
+		Help:   "The number of vehicle disconnections by close reason.",
+		Labels: []string{"reason"},
+	})
+
+	metricsRegistry.closeSentCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "socket_close_sent_total",
+		Help:   "The number of close frames sent to vehicles by reason: rate_limited, unauthorized, invalid_payload, shutting_down, max_lifetime, duplicate_vin or unsupported_protocol.",
+		Labels: []string{"reason"},
+	})
+
+	metricsRegistry.connectionLifetimeSec = metricsCollector.RegisterTimer(adapter.CollectorOptions{
+		Name:   "socket_connection_lifetime_sec",
+		Help:   "The duration of vehicle connections in seconds.",
+		Labels: []string{},
+	})
+
 	metricsRegistry.recordSizeBytesTotal = metricsCollector.RegisterCounter(adapter.CollectorOptions{
 		Name:   "record_size_bytes_total",
 		Help:   "The total number of record bytes processed.",
@@ -6,6 +6,8 @@ import "sync"
 type SocketRegistry struct {
 	mutex   sync.RWMutex
 	sockets map[string]*SocketManager
+	// vins lists the sockets of each vin, from the oldest to the newest
+	vins    map[string][]*SocketManager
 	counter int
 }
 
@@ -13,6 +15,7 @@ type SocketRegistry struct {
 func NewSocketRegistry() *SocketRegistry {
 	return &SocketRegistry{
 		sockets: make(map[string]*SocketManager),
+		vins:    make(map[string][]*SocketManager),
 	}
 }
 
@@ -21,7 +24,35 @@ func (s *SocketRegistry) RegisterSocket(socket *SocketManager) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	s.register(socket)
+}
+
+// RegisterVINSocket registers a new socket unless its vin already has maxConnections sockets. With closeOldest,
+// the oldest sockets of the vin are returned instead of refusing the new one: they are no longer counted for the
+// vin and must be closed by the caller
+func (s *SocketRegistry) RegisterVINSocket(socket *SocketManager, maxConnections int, closeOldest bool) ([]*SocketManager, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var evicted []*SocketManager
+	vin := socketVIN(socket)
+	if connected := s.vins[vin]; vin != "" && len(connected) >= maxConnections {
+		if !closeOldest {
+			return nil, false
+		}
+		excess := len(connected) - maxConnections + 1
+		evicted = append(evicted, connected[:excess]...)
+		s.vins[vin] = append([]*SocketManager(nil), connected[excess:]...)
+	}
+	s.register(socket)
+	return evicted, true
+}
+
+func (s *SocketRegistry) register(socket *SocketManager) {
 	s.sockets[socket.UUID] = socket
+	if vin := socketVIN(socket); vin != "" {
+		s.vins[vin] = append(s.vins[vin], socket)
+	}
 	s.counter++
 }
 
@@ -31,6 +62,20 @@ func (s *SocketRegistry) DeregisterSocket(socket *SocketManager) {
 	defer s.mutex.Unlock()
 
 	delete(s.sockets, socket.UUID)
+	if vin := socketVIN(socket); vin != "" {
+		connected := s.vins[vin]
+		for i, other := range connected {
+			if other == socket {
+				connected = append(connected[:i:i], connected[i+1:]...)
+				break
+			}
+		}
+		if len(connected) == 0 {
+			delete(s.vins, vin)
+		} else {
+			s.vins[vin] = connected
+		}
+	}
 	if s.counter > 0 {
 		s.counter--
 	}
@@ -44,6 +89,18 @@ func (s *SocketRegistry) GetSocket(uuid string) *SocketManager {
 	return s.sockets[uuid]
 }
 
+// Sockets returns the connected sockets
+func (s *SocketRegistry) Sockets() []*SocketManager {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sockets := make([]*SocketManager, 0, len(s.sockets))
+	for _, socket := range s.sockets {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
 // NumConnectedSockets returns the number of connected sockets
 func (s *SocketRegistry) NumConnectedSockets() int {
 	s.mutex.RLock()
@@ -51,3 +108,19 @@ func (s *SocketRegistry) NumConnectedSockets() int {
 
 	return s.counter
 }
+
+// NumVINSockets returns the number of sockets counted for a vin
+func (s *SocketRegistry) NumVINSockets(vin string) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.vins[vin])
+}
+
+// socketVIN returns the vin of the socket, empty when its identity could not be extracted
+func socketVIN(socket *SocketManager) string {
+	if socket.requestIdentity == nil {
+		return ""
+	}
+	return socket.requestIdentity.DeviceID
+}
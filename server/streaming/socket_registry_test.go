@@ -0,0 +1,65 @@
+package streaming_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("SocketRegistry", func() {
+	var registry *streaming.SocketRegistry
+
+	newSocket := func(vin string) *streaming.SocketManager {
+		logger, _ := logrus.NoOpLogger()
+		requestIdentity := &telemetry.RequestIdentity{DeviceID: vin, SenderID: "vehicle_device." + vin}
+		return streaming.NewSocketManager(context.Background(), requestIdentity, nil, CreateTestConfig(), logger)
+	}
+
+	BeforeEach(func() {
+		registry = streaming.NewSocketRegistry()
+	})
+
+	It("rejects the connections of a vin at its max connections", func() {
+		first := newSocket("VIN42")
+		evicted, ok := registry.RegisterVINSocket(first, 1, false)
+		Expect(ok).To(BeTrue())
+		Expect(evicted).To(BeEmpty())
+
+		_, ok = registry.RegisterVINSocket(newSocket("VIN42"), 1, false)
+		Expect(ok).To(BeFalse())
+		_, ok = registry.RegisterVINSocket(newSocket("VIN43"), 1, false)
+		Expect(ok).To(BeTrue())
+		Expect(registry.NumConnectedSockets()).To(Equal(2))
+
+		registry.DeregisterSocket(first)
+		_, ok = registry.RegisterVINSocket(newSocket("VIN42"), 1, false)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("returns the oldest connections of the vin to close", func() {
+		first, second, third := newSocket("VIN42"), newSocket("VIN42"), newSocket("VIN42")
+		for _, socket := range []*streaming.SocketManager{first, second} {
+			_, ok := registry.RegisterVINSocket(socket, 2, true)
+			Expect(ok).To(BeTrue())
+		}
+
+		evicted, ok := registry.RegisterVINSocket(third, 2, true)
+		Expect(ok).To(BeTrue())
+		Expect(evicted).To(ConsistOf(first))
+		Expect(registry.NumVINSockets("VIN42")).To(Equal(2))
+		Expect(registry.NumConnectedSockets()).To(Equal(3))
+
+		// the evicted connection deregisters once closed
+		registry.DeregisterSocket(first)
+		Expect(registry.NumVINSockets("VIN42")).To(Equal(2))
+		registry.DeregisterSocket(second)
+		registry.DeregisterSocket(third)
+		Expect(registry.NumVINSockets("VIN42")).To(Equal(0))
+		Expect(registry.NumConnectedSockets()).To(Equal(0))
+	})
+})
@@ -2,16 +2,24 @@ package streaming_test
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus/hooks/test"
 
 	"github.com/teslamotors/fleet-telemetry/config"
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/messages"
 	"github.com/teslamotors/fleet-telemetry/messages/tesla"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
 	"github.com/teslamotors/fleet-telemetry/server/streaming"
 	"github.com/teslamotors/fleet-telemetry/telemetry"
 )
@@ -111,6 +119,21 @@ var _ = Describe("Socket test", func() {
 			Expect(hook.Entries).To(HaveLen(0))
 		})
 
+		It("nacks payloads failing validation", func() {
+			conf.ValidatePayloads = true
+			record := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: []byte{0xff, 0xff}}
+			recordMsg, err := record.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			sm.ParseAndProcessRecord(serializer, recordMsg)
+
+			msg := sm.ListenToWriteChannel()
+			streamMessage, err := messages.StreamMessageFromBytes(msg.Msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(streamMessage.Payload)).To(Equal("incorrect message format"))
+			Expect(hook.LastEntry().Message).To(Equal("unexpected_record"))
+		})
+
 		It("topic is not verified, but sender matches", func() {
 			record := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("canlogs"), Payload: []byte("data")}
 			recordMsg, err := record.ToBytes()
@@ -127,5 +150,304 @@ var _ = Describe("Socket test", func() {
 
 			Expect(string(streamMessage.MessageTopic)).To(Equal("canlogs"))
 		})
+
+		It("responds with an error to unrouted records with the error policy", func() {
+			serializer.Router = telemetry.NewRouter(map[string][]telemetry.Producer{"D4": nil}, noop.NewCollector())
+			serializer.Router.HandleUnrouted(telemetry.UnroutedError, nil)
+			record := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("canlogs"), Payload: []byte("data")}
+			recordMsg, err := record.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			sm.ParseAndProcessRecord(serializer, recordMsg)
+
+			msg := sm.ListenToWriteChannel()
+			streamMessage, err := messages.StreamMessageFromBytes(msg.Msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(streamMessage.Payload)).To(Equal("incorrect message format"))
+			Expect(hook.LastEntry().Data["error"]).To(MatchError(telemetry.ErrUnroutedRecord))
+		})
+	})
+
+	var _ = Describe("Keepalive", func() {
+		var conn *websocket.Conn
+
+		BeforeEach(func() {
+			conf.Keepalive = &config.Keepalive{PingInterval: 50, PongTimeout: 50}
+			upgrader := websocket.Upgrader{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				Expect(err).NotTo(HaveOccurred())
+				requestIdentity := &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}
+				streaming.NewSocketManager(context.Background(), requestIdentity, ws, conf, logger).ProcessTelemetry(serializer)
+			}))
+			DeferCleanup(srv.Close)
+
+			var err error
+			conn, _, err = websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+		})
+
+		It("keeps connections answering pings open", func() {
+			pings := 0
+			conn.SetPingHandler(func(data string) error {
+				pings++
+				return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+
+			Expect(conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))).To(Succeed())
+			_, _, err := conn.ReadMessage()
+
+			var netErr net.Error
+			Expect(errors.As(err, &netErr)).To(BeTrue())
+			Expect(netErr.Timeout()).To(BeTrue())
+			Expect(pings).To(BeNumerically(">", 1))
+		})
+
+		It("closes connections which stop answering pings", func() {
+			conn.SetPingHandler(func(string) error { return nil })
+
+			Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			_, _, err := conn.ReadMessage()
+
+			var netErr net.Error
+			Expect(err).To(HaveOccurred())
+			Expect(errors.As(err, &netErr)).To(BeFalse())
+			Eventually(func() []string {
+				var messages []string
+				for _, entry := range hook.AllEntries() {
+					messages = append(messages, entry.Message)
+				}
+				return messages
+			}).Should(ContainElement("socket_pong_timeout"))
+		})
+	})
+
+	var _ = Describe("Close reasons", func() {
+		var conn *websocket.Conn
+
+		BeforeEach(func() {
+			upgrader := websocket.Upgrader{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				Expect(err).NotTo(HaveOccurred())
+				requestIdentity := &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}
+				streaming.NewSocketManager(context.Background(), requestIdentity, ws, conf, logger).ProcessTelemetry(serializer)
+			}))
+			DeferCleanup(srv.Close)
+
+			var err error
+			conn, _, err = websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+		})
+
+		closeReason := func() interface{} {
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "socket_disconnected" {
+					return entry.Data["close_reason"]
+				}
+			}
+			return nil
+		}
+
+		It("reports connections closed by the vehicle", func() {
+			Expect(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))).To(Succeed())
+			Eventually(closeReason).Should(Equal("client_closed"))
+		})
+
+		It("reports unexpected message types", func() {
+			Expect(conn.WriteMessage(websocket.TextMessage, []byte("hello"))).To(Succeed())
+			Eventually(closeReason).Should(Equal("unexpected_message_type"))
+		})
+	})
+
+	var _ = Describe("Connection limits", func() {
+		var conn *websocket.Conn
+
+		JustBeforeEach(func() {
+			upgrader := websocket.Upgrader{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				Expect(err).NotTo(HaveOccurred())
+				requestIdentity := &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}
+				streaming.NewSocketManager(context.Background(), requestIdentity, ws, conf, logger).ProcessTelemetry(serializer)
+			}))
+			DeferCleanup(srv.Close)
+
+			var err error
+			conn, _, err = websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+		})
+
+		closeReason := func() interface{} {
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "socket_disconnected" {
+					return entry.Data["close_reason"]
+				}
+			}
+			return nil
+		}
+
+		Context("with an idle timeout", func() {
+			BeforeEach(func() {
+				conf.IdleTimeout = 200
+				conf.Keepalive = &config.Keepalive{PingInterval: 50, PongTimeout: 50}
+			})
+
+			It("closes connections which only answer pings", func() {
+				Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+				_, _, err := conn.ReadMessage()
+
+				// the server closes the connection before the read deadline, the pongs it did not read can reset it
+				var netErr net.Error
+				Expect(err).To(HaveOccurred())
+				Expect(errors.As(err, &netErr) && netErr.Timeout()).To(BeFalse())
+				Eventually(closeReason).Should(Equal("idle_timeout"))
+			})
+		})
+
+		Context("with a max lifetime", func() {
+			BeforeEach(func() {
+				conf.MaxConnectionLifetime = 100
+			})
+
+			It("asks the vehicle to reconnect", func() {
+				Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+				_, _, err := conn.ReadMessage()
+
+				Expect(websocket.IsCloseError(err, websocket.CloseServiceRestart)).To(BeTrue())
+				Eventually(closeReason).Should(Equal("max_lifetime"))
+			})
+		})
+	})
+
+	var _ = Describe("Inbound queue", func() {
+		DescribeTable("acks the records dispatched from the queue",
+			func(overflow config.QueueOverflowPolicy) {
+				conf.InboundQueue = &config.InboundQueue{Depth: 2, Overflow: overflow}
+				upgrader := websocket.Upgrader{}
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ws, err := upgrader.Upgrade(w, r, nil)
+					Expect(err).NotTo(HaveOccurred())
+					requestIdentity := &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}
+					streaming.NewSocketManager(context.Background(), requestIdentity, ws, conf, logger).ProcessTelemetry(serializer)
+				}))
+				DeferCleanup(srv.Close)
+
+				conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(conn.Close)
+
+				record := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("canlogs"), Payload: []byte("data")}
+				recordMsg, err := record.ToBytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.WriteMessage(websocket.BinaryMessage, recordMsg)).To(Succeed())
+
+				Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+				_, msg, err := conn.ReadMessage()
+				Expect(err).NotTo(HaveOccurred())
+				ack, err := messages.StreamAckMessageFromBytes(msg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(ack.MessageTopic)).To(Equal("canlogs"))
+			},
+			Entry("block", config.QueueOverflowBlock),
+			Entry("drop_newest", config.QueueOverflowDropNewest),
+			Entry("drop_oldest", config.QueueOverflowDropOldest),
+		)
+	})
+
+	var _ = Describe("Limits", func() {
+		logMessages := func() []string {
+			var messages []string
+			for _, entry := range hook.AllEntries() {
+				messages = append(messages, entry.Message)
+			}
+			return messages
+		}
+
+		It("closes connections sending messages above max_message_bytes", func() {
+			conf.MaxMessageBytes = 16
+			upgrader := websocket.Upgrader{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				Expect(err).NotTo(HaveOccurred())
+				requestIdentity := &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}
+				streaming.NewSocketManager(context.Background(), requestIdentity, ws, conf, logger).ProcessTelemetry(serializer)
+			}))
+			DeferCleanup(srv.Close)
+
+			conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			Expect(conn.WriteMessage(websocket.BinaryMessage, make([]byte, 17))).To(Succeed())
+			Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			_, _, err = conn.ReadMessage()
+			Expect(websocket.IsCloseError(err, websocket.CloseMessageTooBig)).To(BeTrue())
+			Eventually(logMessages).Should(ContainElement("socket_message_too_big"))
+		})
+
+		It("closes connections exceeding the rate limit with close_on_exceeded", func() {
+			conf.RateLimit = &config.RateLimit{Enabled: true, MessageLimit: 1, MessageIntervalTimeSecond: time.Minute, CloseOnExceeded: true}
+			upgrader := websocket.Upgrader{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				Expect(err).NotTo(HaveOccurred())
+				requestIdentity := &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}
+				streaming.NewSocketManager(context.Background(), requestIdentity, ws, conf, logger).ProcessTelemetry(serializer)
+			}))
+			DeferCleanup(srv.Close)
+
+			conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			Expect(conn.WriteMessage(websocket.BinaryMessage, []byte("first"))).To(Succeed())
+			Expect(conn.WriteMessage(websocket.BinaryMessage, []byte("second"))).To(Succeed())
+			Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			for err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			var closeErr *websocket.CloseError
+			Expect(errors.As(err, &closeErr)).To(BeTrue())
+			Expect(closeErr.Code).To(Equal(streaming.CloseRateLimited.Code))
+			Expect(closeErr.Text).To(Equal("rate_limited"))
+			Eventually(logMessages).Should(ContainElement("socket_rate_limited_close"))
+		})
+
+		It("disconnects vehicles which stop reading their acks", func() {
+			conf.SocketWriteTimeout = 50
+			upgrader := websocket.Upgrader{}
+			managers := make(chan *streaming.SocketManager, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				Expect(err).NotTo(HaveOccurred())
+				requestIdentity := &telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}
+				// the writer is not started, as if the vehicle stopped reading
+				managers <- streaming.NewSocketManager(context.Background(), requestIdentity, ws, conf, logger)
+			}))
+			DeferCleanup(srv.Close)
+
+			conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+
+			slowReader := <-managers
+			record := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("canlogs"), Payload: []byte("data")}
+			recordMsg, err := record.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i <= 1000; i++ {
+					slowReader.ParseAndProcessRecord(serializer, recordMsg)
+				}
+			}()
+			Eventually(done).Should(BeClosed())
+			Expect(logMessages()).To(ContainElement("socket_write_timeout"))
+		})
 	})
 })
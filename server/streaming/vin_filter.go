@@ -0,0 +1,100 @@
+package streaming
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+const (
+	// vinFilterDenied labels records of vins matching the denylist
+	vinFilterDenied = "denylist"
+	// vinFilterNotAllowed labels records of vins missing from the allowlist
+	vinFilterNotAllowed = "allowlist"
+)
+
+// VINFilter decides which vehicles records are accepted from. The denylist takes precedence over the allowlist,
+// every vin is allowed when there is no allowlist
+type VINFilter struct {
+	allowlist *vinList
+	denylist  *vinList
+}
+
+// vinList matches vins exactly or by prefix
+type vinList struct {
+	vins     map[string]struct{}
+	prefixes []string
+}
+
+// LoadVINFilter reads the allowlist and denylist files, either can be empty. Files contain a vin per line,
+// entries ending with * match vins by prefix, empty lines and lines starting with # are ignored.
+// It returns nil when no file is configured
+func LoadVINFilter(allowlistFile string, denylistFile string) (*VINFilter, error) {
+	if allowlistFile == "" && denylistFile == "" {
+		return nil, nil
+	}
+	filter := &VINFilter{}
+	var err error
+	if filter.allowlist, err = loadVINList(allowlistFile); err != nil {
+		return nil, err
+	}
+	if filter.denylist, err = loadVINList(denylistFile); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// Check returns whether records of the vin are accepted, and the list rejecting them otherwise
+func (f *VINFilter) Check(vin string) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	if f.denylist.matches(vin) {
+		return false, vinFilterDenied
+	}
+	if f.allowlist != nil && !f.allowlist.matches(vin) {
+		return false, vinFilterNotAllowed
+	}
+	return true, ""
+}
+
+func loadVINList(path string) (*vinList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &vinList{vins: make(map[string]struct{})}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			list.prefixes = append(list.prefixes, prefix)
+			continue
+		}
+		list.vins[entry] = struct{}{}
+	}
+	return list, scanner.Err()
+}
+
+func (l *vinList) matches(vin string) bool {
+	if l == nil {
+		return false
+	}
+	if _, ok := l.vins[vin]; ok {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(vin, prefix) {
+			return true
+		}
+	}
+	return false
+}
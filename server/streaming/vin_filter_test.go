@@ -0,0 +1,59 @@
+package streaming_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+)
+
+var _ = Describe("VINFilter", func() {
+	writeList := func(content string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "vins.txt")
+		Expect(os.WriteFile(path, []byte(content), 0o644)).To(Succeed())
+		return path
+	}
+
+	It("accepts every vin without files", func() {
+		filter, err := streaming.LoadVINFilter("", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filter).To(BeNil())
+		allowed, _ := filter.Check("VIN42")
+		Expect(allowed).To(BeTrue())
+	})
+
+	It("drops vins of the denylist by exact match or prefix", func() {
+		filter, err := streaming.LoadVINFilter("", writeList("# incident 42\nVIN42\n\n5YJ3*\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		allowed, list := filter.Check("VIN42")
+		Expect(allowed).To(BeFalse())
+		Expect(list).To(Equal("denylist"))
+		allowed, _ = filter.Check("5YJ3E1EA7JF000001")
+		Expect(allowed).To(BeFalse())
+		allowed, _ = filter.Check("VIN43")
+		Expect(allowed).To(BeTrue())
+	})
+
+	It("only accepts vins of the allowlist, unless denied", func() {
+		filter, err := streaming.LoadVINFilter(writeList("VIN4*\n"), writeList("VIN43\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		allowed, _ := filter.Check("VIN42")
+		Expect(allowed).To(BeTrue())
+		allowed, list := filter.Check("VIN43")
+		Expect(allowed).To(BeFalse())
+		Expect(list).To(Equal("denylist"))
+		allowed, list = filter.Check("VIN52")
+		Expect(allowed).To(BeFalse())
+		Expect(list).To(Equal("allowlist"))
+	})
+
+	It("fails on missing files", func() {
+		_, err := streaming.LoadVINFilter(filepath.Join(GinkgoT().TempDir(), "missing.txt"), "")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,78 @@
+package streaming
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// vinLimiterIdleTimeout is the duration after which the bucket of an inactive vin is released
+const vinLimiterIdleTimeout = 10 * time.Minute
+
+// VinRateLimiter keeps a token bucket per vin, shared across the connections of a vehicle
+type VinRateLimiter struct {
+	mutex     sync.Mutex
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*vinLimiter
+	lastPrune time.Time
+}
+
+type vinLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewVinRateLimiter returns a rate limiter allowing limit messages per second per vin with the given burst
+func NewVinRateLimiter(limit float64, burst int) *VinRateLimiter {
+	return &VinRateLimiter{
+		limit:     rate.Limit(limit),
+		burst:     burst,
+		limiters:  make(map[string]*vinLimiter),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow consumes a token from the bucket of the vin, returns false if the bucket is empty
+func (v *VinRateLimiter) Allow(vin string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := time.Now()
+	v.prune(now)
+
+	entry, ok := v.limiters[vin]
+	if !ok {
+		entry = &vinLimiter{limiter: rate.NewLimiter(v.limit, v.burst)}
+		v.limiters[vin] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// SetLimit updates the limit and burst of every vin, including the ones already tracked
+func (v *VinRateLimiter) SetLimit(limit float64, burst int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.limit = rate.Limit(limit)
+	v.burst = burst
+	for _, entry := range v.limiters {
+		entry.limiter.SetLimit(v.limit)
+		entry.limiter.SetBurst(burst)
+	}
+}
+
+// prune releases the buckets of vins which have been inactive for vinLimiterIdleTimeout
+func (v *VinRateLimiter) prune(now time.Time) {
+	if now.Sub(v.lastPrune) < vinLimiterIdleTimeout {
+		return
+	}
+	for vin, entry := range v.limiters {
+		if now.Sub(entry.lastSeen) >= vinLimiterIdleTimeout {
+			delete(v.limiters, vin)
+		}
+	}
+	v.lastPrune = now
+}
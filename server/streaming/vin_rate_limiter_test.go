@@ -0,0 +1,20 @@
+package streaming_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+)
+
+var _ = Describe("VinRateLimiter", func() {
+	It("limits each vin independently", func() {
+		limiter := streaming.NewVinRateLimiter(0.001, 2)
+
+		Expect(limiter.Allow("VIN1")).To(BeTrue())
+		Expect(limiter.Allow("VIN1")).To(BeTrue())
+		Expect(limiter.Allow("VIN1")).To(BeFalse())
+
+		Expect(limiter.Allow("VIN2")).To(BeTrue())
+	})
+})
@@ -0,0 +1,225 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// timestampName is the full name of the well-known timestamp message, encoded as an avro timestamp-micros
+const timestampName protoreflect.FullName = "google.protobuf.Timestamp"
+
+// AvroSchema is the avro schema derived from the proto message of a record.
+// Records of the same message type share the same *AvroSchema
+type AvroSchema struct {
+	// Name is the full name of the proto message
+	Name string
+
+	// JSON is the avro schema definition
+	JSON string
+}
+
+// avroSchemas caches the *AvroSchema of each message type
+var avroSchemas sync.Map
+
+// AvroSchema returns the avro schema of the record message, the payload is encoded with it when
+// the datastore serializer is avro
+func (record *Record) AvroSchema() (*AvroSchema, error) {
+	if record.protoMessage == nil {
+		return nil, errors.New("avro schema requires a decoded record")
+	}
+	return avroSchemaOf(record.protoMessage.ProtoReflect().Descriptor())
+}
+
+func avroSchemaOf(descriptor protoreflect.MessageDescriptor) (*AvroSchema, error) {
+	if schema, ok := avroSchemas.Load(descriptor.FullName()); ok {
+		return schema.(*AvroSchema), nil
+	}
+	definition, err := json.Marshal(avroRecordType(descriptor, map[protoreflect.FullName]bool{}))
+	if err != nil {
+		return nil, err
+	}
+	schema, _ := avroSchemas.LoadOrStore(descriptor.FullName(), &AvroSchema{Name: string(descriptor.FullName()), JSON: string(definition)})
+	return schema.(*AvroSchema), nil
+}
+
+// avroRecordType maps a message to an avro record. Records already defined in the schema are referenced by name.
+// Message fields and fields with presence are nullable, enums are strings holding the value name like in json
+func avroRecordType(descriptor protoreflect.MessageDescriptor, defined map[protoreflect.FullName]bool) interface{} {
+	if defined[descriptor.FullName()] {
+		return string(descriptor.FullName())
+	}
+	defined[descriptor.FullName()] = true
+
+	fields := make([]map[string]interface{}, 0, descriptor.Fields().Len())
+	for i := 0; i < descriptor.Fields().Len(); i++ {
+		field := descriptor.Fields().Get(i)
+		avroField := map[string]interface{}{"name": string(field.Name())}
+		switch {
+		case field.IsMap():
+			avroField["type"] = map[string]interface{}{"type": "map", "values": avroValueType(field.MapValue(), defined)}
+			avroField["default"] = map[string]interface{}{}
+		case field.IsList():
+			avroField["type"] = map[string]interface{}{"type": "array", "items": avroValueType(field, defined)}
+			avroField["default"] = []interface{}{}
+		case field.HasPresence():
+			avroField["type"] = []interface{}{"null", avroValueType(field, defined)}
+			avroField["default"] = nil
+		default:
+			avroField["type"] = avroValueType(field, defined)
+			avroField["default"] = avroDefault(field)
+		}
+		fields = append(fields, avroField)
+	}
+	return map[string]interface{}{"type": "record", "name": string(descriptor.FullName()), "fields": fields}
+}
+
+func avroValueType(field protoreflect.FieldDescriptor, defined map[protoreflect.FullName]bool) interface{} {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return "boolean"
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return "int"
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return "long"
+	case protoreflect.FloatKind:
+		return "float"
+	case protoreflect.DoubleKind:
+		return "double"
+	case protoreflect.BytesKind:
+		return "bytes"
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if field.Message().FullName() == timestampName {
+			return map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}
+		}
+		return avroRecordType(field.Message(), defined)
+	default:
+		// strings and enums
+		return "string"
+	}
+}
+
+func avroDefault(field protoreflect.FieldDescriptor) interface{} {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return false
+	case protoreflect.StringKind:
+		return ""
+	case protoreflect.EnumKind:
+		return string(field.Enum().Values().Get(0).Name())
+	case protoreflect.BytesKind:
+		return ""
+	default:
+		return 0
+	}
+}
+
+// encodeAvro encodes the message with the avro binary encoding of its schema
+func encodeAvro(message proto.Message) []byte {
+	return appendAvroMessage(nil, message.ProtoReflect())
+}
+
+func appendAvroMessage(buf []byte, message protoreflect.Message) []byte {
+	fields := message.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		switch {
+		case field.IsMap():
+			buf = appendAvroMap(buf, field, message.Get(field).Map())
+		case field.IsList():
+			list := message.Get(field).List()
+			if list.Len() > 0 {
+				buf = appendAvroLong(buf, int64(list.Len()))
+				for j := 0; j < list.Len(); j++ {
+					buf = appendAvroValue(buf, field, list.Get(j))
+				}
+			}
+			buf = appendAvroLong(buf, 0)
+		case field.HasPresence():
+			if !message.Has(field) {
+				buf = appendAvroLong(buf, 0)
+				continue
+			}
+			buf = appendAvroLong(buf, 1)
+			buf = appendAvroValue(buf, field, message.Get(field))
+		default:
+			buf = appendAvroValue(buf, field, message.Get(field))
+		}
+	}
+	return buf
+}
+
+// appendAvroMap writes the entries sorted by key so the encoding of a message is stable
+func appendAvroMap(buf []byte, field protoreflect.FieldDescriptor, entries protoreflect.Map) []byte {
+	keys := make([]protoreflect.MapKey, 0, entries.Len())
+	entries.Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	if len(keys) > 0 {
+		buf = appendAvroLong(buf, int64(len(keys)))
+		for _, key := range keys {
+			buf = appendAvroString(buf, key.String())
+			buf = appendAvroValue(buf, field.MapValue(), entries.Get(key))
+		}
+	}
+	return appendAvroLong(buf, 0)
+}
+
+func appendAvroValue(buf []byte, field protoreflect.FieldDescriptor, value protoreflect.Value) []byte {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		if value.Bool() {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind, protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind:
+		return appendAvroLong(buf, value.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		// avro has no unsigned types, uint64 values above math.MaxInt64 wrap around
+		return appendAvroLong(buf, int64(value.Uint()))
+	case protoreflect.FloatKind:
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(value.Float())))
+	case protoreflect.DoubleKind:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(value.Float()))
+	case protoreflect.StringKind:
+		return appendAvroString(buf, value.String())
+	case protoreflect.BytesKind:
+		buf = appendAvroLong(buf, int64(len(value.Bytes())))
+		return append(buf, value.Bytes()...)
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByNumber(value.Enum()); enumValue != nil {
+			return appendAvroString(buf, string(enumValue.Name()))
+		}
+		return appendAvroString(buf, strconv.Itoa(int(value.Enum())))
+	default:
+		message := value.Message()
+		if message.Descriptor().FullName() == timestampName {
+			fields := message.Descriptor().Fields()
+			seconds := message.Get(fields.ByName("seconds")).Int()
+			nanos := message.Get(fields.ByName("nanos")).Int()
+			return appendAvroLong(buf, seconds*1000000+nanos/1000)
+		}
+		return appendAvroMessage(buf, message)
+	}
+}
+
+func appendAvroString(buf []byte, value string) []byte {
+	buf = appendAvroLong(buf, int64(len(value)))
+	return append(buf, value...)
+}
+
+// appendAvroLong writes the zig-zag varint encoding avro uses for int and long
+func appendAvroLong(buf []byte, value int64) []byte {
+	return binary.AppendUvarint(buf, uint64((value<<1)^(value>>63)))
+}
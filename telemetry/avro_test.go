@@ -0,0 +1,87 @@
+package telemetry_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Avro", func() {
+	var record *telemetry.Record
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{}, logger)
+		createdAt := timestamppb.New(time.UnixMilli(1700000000000))
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", createdAt)}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		record, err = telemetry.NewRecord(serializer, recordMsg, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("derives the schema from the proto message", func() {
+		schema, err := record.AvroSchema()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(schema.Name).To(Equal("telemetry.vehicle_data.Payload"))
+
+		var definition struct {
+			Name   string
+			Fields []struct {
+				Name string
+				Type interface{}
+			}
+		}
+		Expect(json.Unmarshal([]byte(schema.JSON), &definition)).To(Succeed())
+		Expect(definition.Name).To(Equal("telemetry.vehicle_data.Payload"))
+		Expect(definition.Fields).To(HaveLen(3))
+		Expect(definition.Fields[1].Name).To(Equal("created_at"))
+		Expect(definition.Fields[1].Type).To(Equal([]interface{}{"null", map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}}))
+		Expect(definition.Fields[2].Type).To(Equal("string"))
+
+		other, err := record.AvroSchema()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).To(BeIdenticalTo(schema))
+	})
+
+	It("encodes the payload in the order of the schema fields", func() {
+		producer := &RecordingProducer{}
+		wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{Serializer: telemetry.AvroFormat}, noop.NewCollector())
+		Expect(wrapped.Produce(record)).To(Succeed())
+		Expect(producer.records[0].Encoding()).To(Equal(telemetry.AvroFormat))
+
+		var expected bytes.Buffer
+		// one datum: its key as a string, then the string_value branch of the value followed by the empty branches
+		expected.Write([]byte{0x02, byte(2 * len("VehicleName"))})
+		expected.WriteString("VehicleName")
+		expected.Write([]byte{0x02, 0x02, byte(2 * len("cybertruck"))})
+		expected.WriteString("cybertruck")
+		expected.Write(make([]byte, (&protos.Value{}).ProtoReflect().Descriptor().Fields().Len()-1))
+		expected.WriteByte(0x00)
+		// created_at in microseconds, then the vin
+		expected.WriteByte(0x02)
+		expected.Write(binary.AppendUvarint(nil, 2*1700000000000000))
+		expected.Write([]byte{0x04, '4', '2'})
+
+		Expect(producer.records[0].Payload()).To(Equal(expected.Bytes()))
+		Expect(record.Encoding()).To(Equal(telemetry.ProtobufFormat))
+	})
+
+	It("rejects undecoded records", func() {
+		_, err := (&telemetry.Record{}).AvroSchema()
+		Expect(err).To(MatchError("avro schema requires a decoded record"))
+	})
+})
@@ -0,0 +1,263 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+const (
+	defaultBatchMaxRecords    = 500
+	defaultBatchFlushInterval = 100 * time.Millisecond
+)
+
+// ErrBatchingProducerClosed is returned for records dispatched after the batching producer was closed
+var ErrBatchingProducerClosed = errors.New("batching producer closed")
+
+// BatchProducer is implemented by producers able to write several records in a single request
+type BatchProducer interface {
+	ProduceBatch(entries []*Record) error
+}
+
+// BatchError is returned by batch writes in which some records failed, the other records were written
+type BatchError struct {
+	// Failed maps the correlation id of the records which were not written to their error
+	Failed map[uint64]error
+}
+
+// NewBatchError returns a BatchError without failed records
+func NewBatchError() *BatchError {
+	return &BatchError{Failed: make(map[uint64]error)}
+}
+
+// Add marks the record as failed
+func (e *BatchError) Add(entry *Record, err error) {
+	e.Failed[entry.CorrelationID()] = err
+}
+
+// ErrorOrNil returns e if a record failed, nil otherwise
+func (e *BatchError) ErrorOrNil() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *BatchError) Error() string {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return fmt.Sprintf("%d records of the batch failed: %v", len(e.Failed), errors.Join(errs...))
+}
+
+// ProduceBatch writes entries with the batch method of producer, or one at a time if it doesn't implement BatchProducer.
+// If some records fail, the error is a *BatchError listing them
+func ProduceBatch(producer Producer, entries []*Record) error {
+	if batchProducer, ok := producer.(BatchProducer); ok {
+		return batchProducer.ProduceBatch(entries)
+	}
+	batchErr := NewBatchError()
+	for _, entry := range entries {
+		if err := producer.Produce(entry); err != nil {
+			batchErr.Add(entry, err)
+		}
+	}
+	return batchErr.ErrorOrNil()
+}
+
+// failedRecords returns the entries which failed according to err and their error,
+// every entry failed unless err is a *BatchError
+func failedRecords(entries []*Record, err error) map[*Record]error {
+	failed := make(map[*Record]error)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		for _, entry := range entries {
+			failed[entry] = err
+		}
+		return failed
+	}
+	for _, entry := range entries {
+		if recordErr, ok := batchErr.Failed[entry.CorrelationID()]; ok {
+			failed[entry] = recordErr
+		}
+	}
+	return failed
+}
+
+// BatchConfig accumulates the records dispatched to a datastore and writes them together
+type BatchConfig struct {
+	// MaxRecords writes the batch as soon as it holds this many records, defaults to 500
+	MaxRecords int `json:"max_records,omitempty"`
+
+	// FlushInterval is the max time in milliseconds records wait in the batch, defaults to 100
+	FlushInterval int `json:"flush_interval,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *BatchConfig) Validate() error {
+	if c.MaxRecords < 0 {
+		return fmt.Errorf("invalid batch max_records: %d", c.MaxRecords)
+	}
+	if c.FlushInterval < 0 {
+		return fmt.Errorf("invalid batch flush_interval: %d", c.FlushInterval)
+	}
+	return nil
+}
+
+// BatchingProducer wraps a producer and writes the records dispatched to it with ProduceBatch every flush interval
+// or once the batch is full. Produce only fails once the producer is closed: records which fail to be written
+// are nacked and forwarded to the dead letter producer, if any
+type BatchingProducer struct {
+	Producer
+	dispatcher    Dispatcher
+	deadLetter    Producer
+	nacker        *Nacker
+	maxRecords    int
+	flushInterval time.Duration
+	logger        *logrus.Logger
+
+	mu      sync.Mutex
+	pending []*Record
+	closed  bool
+	done    chan struct{}
+	flushWg sync.WaitGroup
+}
+
+// NewBatchingProducer starts batching the records sent to producer, config is expected to be validated.
+// deadLetter and nacker can be nil
+func NewBatchingProducer(producer Producer, dispatcher Dispatcher, config *BatchConfig, deadLetter Producer, nacker *Nacker, metricsCollector metrics.MetricCollector, logger *logrus.Logger) *BatchingProducer {
+	registerMetricsOnce(metricsCollector)
+
+	p := &BatchingProducer{
+		Producer:      producer,
+		dispatcher:    dispatcher,
+		deadLetter:    deadLetter,
+		nacker:        nacker,
+		maxRecords:    config.MaxRecords,
+		flushInterval: time.Duration(config.FlushInterval) * time.Millisecond,
+		logger:        logger,
+		done:          make(chan struct{}),
+	}
+	if p.maxRecords == 0 {
+		p.maxRecords = defaultBatchMaxRecords
+	}
+	if p.flushInterval == 0 {
+		p.flushInterval = defaultBatchFlushInterval
+	}
+
+	p.flushWg.Add(1)
+	go p.flushPeriodically()
+	return p
+}
+
+// Produce adds the record to the pending batch, the batch is written by the caller once full
+func (p *BatchingProducer) Produce(entry *Record) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrBatchingProducerClosed
+	}
+	p.pending = append(p.pending, entry)
+	var full []*Record
+	if len(p.pending) >= p.maxRecords {
+		full = p.takePending()
+	}
+	p.mu.Unlock()
+
+	if full != nil {
+		p.write(full)
+	}
+	return nil
+}
+
+// QueueSize returns the number of records waiting in the batch and in the queue of the wrapped producer
+func (p *BatchingProducer) QueueSize() int {
+	p.mu.Lock()
+	size := len(p.pending)
+	p.mu.Unlock()
+
+	if queue, ok := p.Producer.(QueueSizer); ok {
+		size += queue.QueueSize()
+	}
+	return size
+}
+
+// CheckHealth checks the wrapped producer, which is considered healthy if it cannot report its health
+func (p *BatchingProducer) CheckHealth(ctx context.Context) error {
+	if checker, ok := p.Producer.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+// Close writes the pending records and closes the wrapped producer
+func (p *BatchingProducer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	close(p.done)
+	p.flushWg.Wait()
+	p.flush()
+	return p.Producer.Close()
+}
+
+func (p *BatchingProducer) flushPeriodically() {
+	defer p.flushWg.Done()
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.flush()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *BatchingProducer) flush() {
+	p.mu.Lock()
+	entries := p.takePending()
+	p.mu.Unlock()
+
+	if len(entries) > 0 {
+		p.write(entries)
+	}
+}
+
+// takePending returns the pending records and starts a new batch, p.mu must be held
+func (p *BatchingProducer) takePending() []*Record {
+	entries := p.pending
+	p.pending = nil
+	return entries
+}
+
+func (p *BatchingProducer) write(entries []*Record) {
+	metricsRegistry.batchSizeCount.Add(int64(len(entries)), map[string]string{"dispatcher": string(p.dispatcher)})
+	metricsRegistry.batchWriteCount.Inc(map[string]string{"dispatcher": string(p.dispatcher)})
+	err := ProduceBatch(p.Producer, entries)
+	if err == nil {
+		return
+	}
+
+	failed := failedRecords(entries, err)
+	metricsRegistry.batchFailedCount.Add(int64(len(failed)), map[string]string{"dispatcher": string(p.dispatcher)})
+	p.logger.ErrorLog("batch_write_error", err, logrus.LogInfo{"dispatcher": p.dispatcher, "record_count": len(entries), "failed_count": len(failed)})
+	for entry, recordErr := range failed {
+		if p.deadLetter != nil {
+			forwardToDeadLetter(p.deadLetter, entry, p.dispatcher, recordErr, p.logger)
+		}
+		p.nacker.Nack(entry, recordErr)
+	}
+}
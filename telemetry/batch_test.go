@@ -0,0 +1,133 @@
+package telemetry_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type BatchRecordingProducer struct {
+	CallbackTester
+	mu          sync.Mutex
+	batches     [][]*telemetry.Record
+	closed      bool
+	failedTxids map[string]bool
+}
+
+func (b *BatchRecordingProducer) ProduceBatch(entries []*telemetry.Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(b.batches, entries)
+	batchErr := telemetry.NewBatchError()
+	for _, entry := range entries {
+		if b.failedTxids[entry.Txid] {
+			batchErr.Add(entry, errors.New("throttled"))
+		}
+	}
+	return batchErr.ErrorOrNil()
+}
+
+func (b *BatchRecordingProducer) Batches() [][]*telemetry.Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.batches
+}
+
+func (b *BatchRecordingProducer) Close() error {
+	b.closed = true
+	return nil
+}
+
+var _ = Describe("BatchingProducer", func() {
+	var (
+		producer *BatchRecordingProducer
+		batcher  *telemetry.BatchingProducer
+		logger   *logrus.Logger
+	)
+
+	BeforeEach(func() {
+		logger, _ = logrus.NoOpLogger()
+		producer = &BatchRecordingProducer{}
+	})
+
+	newRecords := func(count int) []*telemetry.Record {
+		records := make([]*telemetry.Record, 0, count)
+		for i := 0; i < count; i++ {
+			records = append(records, &telemetry.Record{TxType: "V", Vin: "VIN42"})
+		}
+		return records
+	}
+
+	It("writes the batch once full", func() {
+		batcher = telemetry.NewBatchingProducer(producer, telemetry.Kinesis, &telemetry.BatchConfig{MaxRecords: 3, FlushInterval: 60000}, nil, nil, noop.NewCollector(), logger)
+		DeferCleanup(batcher.Close)
+
+		records := newRecords(4)
+		for _, record := range records {
+			Expect(batcher.Produce(record)).To(Succeed())
+		}
+		Expect(producer.Batches()).To(Equal([][]*telemetry.Record{records[:3]}))
+		Expect(batcher.QueueSize()).To(Equal(1))
+	})
+
+	It("writes pending records every flush interval", func() {
+		batcher = telemetry.NewBatchingProducer(producer, telemetry.Kinesis, &telemetry.BatchConfig{FlushInterval: 10}, nil, nil, noop.NewCollector(), logger)
+		DeferCleanup(batcher.Close)
+
+		records := newRecords(2)
+		for _, record := range records {
+			Expect(batcher.Produce(record)).To(Succeed())
+		}
+		Eventually(producer.Batches).Should(Equal([][]*telemetry.Record{records}))
+		Expect(batcher.QueueSize()).To(Equal(0))
+	})
+
+	It("writes pending records when closed", func() {
+		batcher = telemetry.NewBatchingProducer(producer, telemetry.Kinesis, &telemetry.BatchConfig{FlushInterval: 60000}, nil, nil, noop.NewCollector(), logger)
+
+		records := newRecords(2)
+		for _, record := range records {
+			Expect(batcher.Produce(record)).To(Succeed())
+		}
+		Expect(batcher.Close()).To(Succeed())
+		Expect(producer.Batches()).To(Equal([][]*telemetry.Record{records}))
+		Expect(producer.closed).To(BeTrue())
+		Expect(batcher.Produce(records[0])).To(MatchError(telemetry.ErrBatchingProducerClosed))
+	})
+
+	It("forwards the failed records of a batch to the dead letter producer", func() {
+		deadLetter := &RecordingProducer{}
+		producer.failedTxids = map[string]bool{"txid-1": true}
+		batcher = telemetry.NewBatchingProducer(producer, telemetry.Kinesis, &telemetry.BatchConfig{MaxRecords: 3, FlushInterval: 60000}, deadLetter, nil, noop.NewCollector(), logger)
+		DeferCleanup(batcher.Close)
+
+		records := newRecords(3)
+		for i, record := range records {
+			record.Txid = fmt.Sprintf("txid-%d", i)
+			Expect(batcher.Produce(record)).To(Succeed())
+		}
+		Expect(deadLetter.records).To(HaveLen(1))
+		Expect(deadLetter.records[0].Txid).To(Equal("txid-1"))
+		Expect(deadLetter.records[0].TxType).To(Equal(telemetry.DeadLetterTxType))
+		Expect(deadLetter.records[0].Metadata()).To(HaveKeyWithValue("failure_reason", "throttled"))
+	})
+
+	It("produces records one at a time to producers without batch support", func() {
+		recording := &RecordingProducer{err: errors.New("throttled")}
+		records := newRecords(2)
+		err := telemetry.ProduceBatch(recording, records)
+		Expect(recording.records).To(HaveLen(2))
+
+		var batchErr *telemetry.BatchError
+		Expect(errors.As(err, &batchErr)).To(BeTrue())
+		Expect(batchErr.Failed).To(HaveKey(records[0].CorrelationID()))
+		Expect(batchErr.Failed).To(HaveKey(records[1].CorrelationID()))
+	})
+})
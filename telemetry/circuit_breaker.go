@@ -0,0 +1,182 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+const (
+	defaultBreakerErrorThreshold = 5
+	defaultBreakerCooldown       = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned for records not sent to a datastore because its circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerConfig stops sending records to a datastore after consecutive errors, giving it time to recover
+type CircuitBreakerConfig struct {
+	// ErrorThreshold is the number of consecutive errors opening the breaker, defaults to 5
+	ErrorThreshold int `json:"error_threshold,omitempty"`
+
+	// Cooldown is the time in milliseconds the breaker stays open before letting a record through, defaults to 30000
+	Cooldown int `json:"cooldown,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *CircuitBreakerConfig) Validate() error {
+	if c.ErrorThreshold < 0 {
+		return fmt.Errorf("invalid circuit_breaker error_threshold: %d", c.ErrorThreshold)
+	}
+	if c.Cooldown < 0 {
+		return fmt.Errorf("invalid circuit_breaker cooldown: %d", c.Cooldown)
+	}
+	return nil
+}
+
+// BreakerState is the state of a circuit breaker, reported by the datastore_circuit_breaker_state gauge
+type BreakerState int64
+
+const (
+	// BreakerClosed sends every record to the datastore
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects records until the cooldown elapsed
+	BreakerOpen
+	// BreakerHalfOpen sends a single record to probe the datastore, its result closes or opens the breaker again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerProducer wraps a producer and rejects records with ErrCircuitOpen while the datastore is failing.
+// Only errors returned by Produce are counted, asynchronous delivery failures don't trip the breaker
+type CircuitBreakerProducer struct {
+	Producer
+	dispatcher     Dispatcher
+	errorThreshold int
+	cooldown       time.Duration
+	logger         *logrus.Logger
+
+	mu                sync.Mutex
+	state             BreakerState
+	consecutiveErrors int
+	openedAt          time.Time
+	probing           bool
+}
+
+// NewCircuitBreakerProducer returns a producer guarding the dispatcher with a circuit breaker, config is expected to be validated
+func NewCircuitBreakerProducer(producer Producer, dispatcher Dispatcher, config *CircuitBreakerConfig, metricsCollector metrics.MetricCollector, logger *logrus.Logger) *CircuitBreakerProducer {
+	registerMetricsOnce(metricsCollector)
+
+	p := &CircuitBreakerProducer{
+		Producer:       producer,
+		dispatcher:     dispatcher,
+		errorThreshold: config.ErrorThreshold,
+		cooldown:       time.Duration(config.Cooldown) * time.Millisecond,
+		logger:         logger,
+	}
+	if p.errorThreshold == 0 {
+		p.errorThreshold = defaultBreakerErrorThreshold
+	}
+	if p.cooldown == 0 {
+		p.cooldown = defaultBreakerCooldown
+	}
+	metricsRegistry.breakerState.Set(int64(BreakerClosed), map[string]string{"dispatcher": string(dispatcher)})
+	return p
+}
+
+// Produce sends the record to the wrapped producer unless the breaker is open
+func (p *CircuitBreakerProducer) Produce(entry *Record) error {
+	return p.ProduceContext(context.Background(), entry)
+}
+
+// ProduceContext sends the record to the wrapped producer unless the breaker is open,
+// ctx is ignored by producers which don't implement ContextProducer
+func (p *CircuitBreakerProducer) ProduceContext(ctx context.Context, entry *Record) error {
+	if !p.allow() {
+		metricsRegistry.breakerRejectedCount.Inc(map[string]string{"dispatcher": string(p.dispatcher), "record_type": entry.TxType})
+		return ErrCircuitOpen
+	}
+
+	var err error
+	if contextProducer, ok := p.Producer.(ContextProducer); ok {
+		err = contextProducer.ProduceContext(ctx, entry)
+	} else {
+		err = p.Producer.Produce(entry)
+	}
+	p.record(err)
+	return err
+}
+
+// State returns the current state of the breaker
+func (p *CircuitBreakerProducer) State() BreakerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// allow checks whether a record can be sent, moving an open breaker to half open once the cooldown elapsed
+func (p *CircuitBreakerProducer) allow() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.state {
+	case BreakerOpen:
+		if time.Since(p.openedAt) < p.cooldown {
+			return false
+		}
+		p.setState(BreakerHalfOpen)
+		p.probing = true
+		return true
+	case BreakerHalfOpen:
+		// a single record probes the datastore at a time
+		if p.probing {
+			return false
+		}
+		p.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the result of a write
+func (p *CircuitBreakerProducer) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probing = false
+	if err == nil {
+		p.consecutiveErrors = 0
+		if p.state != BreakerClosed {
+			p.setState(BreakerClosed)
+		}
+		return
+	}
+
+	p.consecutiveErrors++
+	if p.state == BreakerHalfOpen || (p.state == BreakerClosed && p.consecutiveErrors >= p.errorThreshold) {
+		p.openedAt = time.Now()
+		p.setState(BreakerOpen)
+	}
+}
+
+func (p *CircuitBreakerProducer) setState(state BreakerState) {
+	p.state = state
+	metricsRegistry.breakerState.Set(int64(state), map[string]string{"dispatcher": string(p.dispatcher)})
+	p.logger.ActivityLog("circuit_breaker_state_change", logrus.LogInfo{"dispatcher": p.dispatcher, "state": state.String(), "consecutive_errors": p.consecutiveErrors})
+}
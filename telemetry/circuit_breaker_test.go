@@ -0,0 +1,103 @@
+package telemetry_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("CircuitBreakerProducer", func() {
+	var (
+		producer *RecordingProducer
+		breaker  *telemetry.CircuitBreakerProducer
+		record   *telemetry.Record
+	)
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		producer = &RecordingProducer{}
+		breaker = telemetry.NewCircuitBreakerProducer(producer, telemetry.Kinesis, &telemetry.CircuitBreakerConfig{ErrorThreshold: 2, Cooldown: 50}, noop.NewCollector(), logger)
+		record = &telemetry.Record{TxType: "V", Vin: "VIN42"}
+	})
+
+	It("opens after consecutive errors", func() {
+		producer.err = errors.New("throttled")
+		Expect(breaker.Produce(record)).To(MatchError("throttled"))
+		Expect(breaker.State()).To(Equal(telemetry.BreakerClosed))
+		Expect(breaker.Produce(record)).To(MatchError("throttled"))
+		Expect(breaker.State()).To(Equal(telemetry.BreakerOpen))
+
+		Expect(breaker.Produce(record)).To(MatchError(telemetry.ErrCircuitOpen))
+		Expect(producer.records).To(HaveLen(2))
+	})
+
+	It("resets the error count on success", func() {
+		producer.err = errors.New("throttled")
+		Expect(breaker.Produce(record)).NotTo(Succeed())
+		producer.err = nil
+		Expect(breaker.Produce(record)).To(Succeed())
+		producer.err = errors.New("throttled")
+		Expect(breaker.Produce(record)).NotTo(Succeed())
+		Expect(breaker.State()).To(Equal(telemetry.BreakerClosed))
+	})
+
+	It("closes once a probe succeeds after the cooldown", func() {
+		producer.err = errors.New("throttled")
+		Expect(breaker.Produce(record)).NotTo(Succeed())
+		Expect(breaker.Produce(record)).NotTo(Succeed())
+		Expect(breaker.State()).To(Equal(telemetry.BreakerOpen))
+
+		time.Sleep(60 * time.Millisecond)
+		producer.err = nil
+		Expect(breaker.Produce(record)).To(Succeed())
+		Expect(breaker.State()).To(Equal(telemetry.BreakerClosed))
+		Expect(producer.records).To(HaveLen(3))
+	})
+
+	It("opens again when the probe fails", func() {
+		producer.err = errors.New("throttled")
+		Expect(breaker.Produce(record)).NotTo(Succeed())
+		Expect(breaker.Produce(record)).NotTo(Succeed())
+
+		time.Sleep(60 * time.Millisecond)
+		Expect(breaker.Produce(record)).To(MatchError("throttled"))
+		Expect(breaker.State()).To(Equal(telemetry.BreakerOpen))
+		Expect(breaker.Produce(record)).To(MatchError(telemetry.ErrCircuitOpen))
+	})
+
+	It("passes the context to context producers", func() {
+		slow := &SlowProducer{}
+		logger, _ := logrus.NoOpLogger()
+		breaker = telemetry.NewCircuitBreakerProducer(slow, telemetry.Pubsub, &telemetry.CircuitBreakerConfig{}, noop.NewCollector(), logger)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		Expect(breaker.ProduceContext(ctx, record)).To(MatchError(context.DeadlineExceeded))
+		Expect(slow.deadline).NotTo(BeZero())
+	})
+
+	It("routes rejected records to the dead letter datastore", func() {
+		logger, _ := logrus.NoOpLogger()
+		deadLetter := &RecordingProducer{}
+		wrapped := telemetry.NewDeadLetterProducer(breaker, telemetry.Kinesis, deadLetter, logger)
+
+		producer.err = errors.New("throttled")
+		Expect(wrapped.Produce(record)).NotTo(Succeed())
+		Expect(wrapped.Produce(record)).NotTo(Succeed())
+		Expect(wrapped.Produce(record)).To(MatchError(telemetry.ErrCircuitOpen))
+		Expect(deadLetter.records).To(HaveLen(3))
+		Expect(deadLetter.records[2].Metadata()).To(HaveKeyWithValue("failure_reason", "circuit breaker open"))
+	})
+
+	It("validates the config", func() {
+		Expect((&telemetry.DatastoreConfig{CircuitBreaker: &telemetry.CircuitBreakerConfig{ErrorThreshold: -1}}).Validate()).To(MatchError("invalid circuit_breaker error_threshold: -1"))
+		Expect((&telemetry.DatastoreConfig{CircuitBreaker: &telemetry.CircuitBreakerConfig{Cooldown: -1}}).Validate()).To(MatchError("invalid circuit_breaker cooldown: -1"))
+	})
+})
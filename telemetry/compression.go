@@ -0,0 +1,33 @@
+package telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipMagic starts every gzip stream, protobuf payloads cannot start with it as 0x1f uses the invalid wire type 7
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip checks whether the payload is gzip compressed
+func isGzip(payload []byte) bool {
+	return bytes.HasPrefix(payload, gzipMagic)
+}
+
+// gunzip decompresses the payload, failing with ErrDecompressedMessageTooBig above maxSize bytes
+func gunzip(payload []byte, maxSize int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxSize {
+		return nil, ErrDecompressedMessageTooBig
+	}
+	return decompressed, nil
+}
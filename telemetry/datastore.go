@@ -0,0 +1,397 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter"
+	"github.com/teslamotors/fleet-telemetry/protos"
+)
+
+// PayloadFormat is the encoding of the record payload sent to a datastore
+type PayloadFormat string
+
+const (
+	// ProtobufFormat sends the payload as protobuf bytes
+	ProtobufFormat PayloadFormat = "protobuf"
+	// JSONFormat sends the payload as protojson bytes
+	JSONFormat PayloadFormat = "json"
+	// AvroFormat sends the payload with the avro binary encoding, the schema is derived from the proto message.
+	// Only kafka supports it, prefixing payloads with the id of their schema in the schema registry
+	AvroFormat PayloadFormat = "avro"
+)
+
+// DatastoreConfig contains options applied to records before they are produced to a given datastore
+type DatastoreConfig struct {
+	// Serializer overrides the payload format for the datastore: protobuf, json or avro.
+	// When empty, transmit_decoded_records decides the format
+	Serializer PayloadFormat `json:"serializer,omitempty"`
+
+	// IncludeFields only keeps these fields in V records, all fields are kept when empty
+	IncludeFields []string `json:"include_fields,omitempty"`
+
+	// ExcludeFields removes these fields from V records, it takes precedence over IncludeFields
+	ExcludeFields []string `json:"exclude_fields,omitempty"`
+
+	// Transforms are names of functions registered with RegisterTransform, applied in order to V records
+	Transforms []string `json:"transforms,omitempty"`
+
+	// RequiredForAck delays the vehicle ack of the records sent to the datastore until it confirms the write
+	RequiredForAck bool `json:"required_for_ack,omitempty"`
+
+	// WriteTimeout is the max time in milliseconds a write can take before failing, only
+	// applied to datastores implementing ContextProducer
+	WriteTimeout int `json:"write_timeout,omitempty"`
+
+	// SampleRate is the fraction of vehicles whose records are sent to the datastore, between 0 and 1.
+	// Vehicles are sampled per record type from a hash of their vin, 0 and 1 disable sampling
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// OrderByVIN produces the records of a vehicle in order when dispatching from the pool of UnorderedDispatch
+	OrderByVIN bool `json:"order_by_vin,omitempty"`
+
+	// CircuitBreaker stops sending records to the datastore after consecutive errors, disabled when nil
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// Batch writes the records of the datastore in batches, records are written one at a time when nil.
+	// Changes require a restart
+	Batch *BatchConfig `json:"batch,omitempty"`
+
+	// MaxRecordBytes overrides the max payload size of the records sent to the datastore, larger records
+	// are rejected before being produced. Defaults to the limit of the datastore, see MaxRecordBytes
+	MaxRecordBytes int `json:"max_record_bytes,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *DatastoreConfig) Validate() error {
+	switch c.Serializer {
+	case "", ProtobufFormat, JSONFormat, AvroFormat:
+	default:
+		return fmt.Errorf("invalid serializer: %s", c.Serializer)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("invalid write_timeout: %d", c.WriteTimeout)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("invalid sample_rate: %v", c.SampleRate)
+	}
+	if c.MaxRecordBytes < 0 {
+		return fmt.Errorf("invalid max_record_bytes: %d", c.MaxRecordBytes)
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Batch != nil {
+		if err := c.Batch.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, name := range c.Transforms {
+		if _, ok := lookupTransform(name); !ok {
+			return fmt.Errorf("unknown transform: %s", name)
+		}
+	}
+	if _, err := parseFields(c.IncludeFields); err != nil {
+		return err
+	}
+	_, err := parseFields(c.ExcludeFields)
+	return err
+}
+
+// DatastoreProducer wraps a producer and applies the datastore options to records before producing them
+type DatastoreProducer struct {
+	Producer
+	dispatcher     Dispatcher
+	config         *DatastoreConfig
+	transforms     []TransformFunc
+	transformNames []string
+	includeFields  map[protos.Field]struct{}
+	excludeFields  map[protos.Field]struct{}
+	writeTimeout   time.Duration
+}
+
+// Metrics stores metrics reported from this package
+type Metrics struct {
+	transformErrorCount        adapter.Counter
+	writeTimeoutErrorCount     adapter.Counter
+	sampledOutCount            adapter.Counter
+	breakerState               adapter.Gauge
+	breakerRejectedCount       adapter.Counter
+	dispatchReceivedCount      adapter.Counter
+	dispatchProducedCount      adapter.Counter
+	unroutedCount              adapter.Counter
+	dispatchDroppedCount       adapter.Counter
+	batchWriteCount            adapter.Counter
+	batchSizeCount             adapter.Counter
+	batchFailedCount           adapter.Counter
+	dispatchPoolQueued         adapter.Gauge
+	dispatchPoolBusyWorkers    adapter.Gauge
+	dispatchPoolSaturatedCount adapter.Counter
+	produceErrorCount          adapter.Counter
+	oversizedRecordCount       adapter.Counter
+	nackCount                  adapter.Counter
+}
+
+var (
+	metricsRegistry Metrics
+	metricsOnce     sync.Once
+)
+
+// NewDatastoreProducer returns a producer applying config to records sent to producer,
+// config is expected to be validated
+func NewDatastoreProducer(producer Producer, dispatcher Dispatcher, config *DatastoreConfig, metricsCollector metrics.MetricCollector) Producer {
+	registerMetricsOnce(metricsCollector)
+
+	var transforms []TransformFunc
+	var transformNames []string
+	for _, name := range config.Transforms {
+		if transform, ok := lookupTransform(name); ok {
+			transforms = append(transforms, transform)
+			transformNames = append(transformNames, name)
+		}
+	}
+	includeFields, _ := parseFields(config.IncludeFields)
+	excludeFields, _ := parseFields(config.ExcludeFields)
+	return &DatastoreProducer{
+		Producer:       producer,
+		dispatcher:     dispatcher,
+		config:         config,
+		transforms:     transforms,
+		transformNames: transformNames,
+		includeFields:  includeFields,
+		excludeFields:  excludeFields,
+		writeTimeout:   time.Duration(config.WriteTimeout) * time.Millisecond,
+	}
+}
+
+// Produce transforms a copy of the record according to the datastore options and sends it to the wrapped producer
+func (p *DatastoreProducer) Produce(entry *Record) error {
+	if !p.sampled(entry) {
+		metricsRegistry.sampledOutCount.Inc(map[string]string{"dispatcher": string(p.dispatcher), "record_type": entry.TxType})
+		// the record is dropped on purpose, acks waiting on the datastore are released
+		p.Producer.ProcessReliableAck(entry)
+		return nil
+	}
+	record, err := p.transform(entry)
+	if err != nil {
+		return err
+	}
+	contextProducer, ok := p.Producer.(ContextProducer)
+	if p.writeTimeout == 0 || !ok {
+		return p.Producer.Produce(record)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.writeTimeout)
+	defer cancel()
+	err = contextProducer.ProduceContext(ctx, record)
+	// some clients wrap the context error without exposing it
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		metricsRegistry.writeTimeoutErrorCount.Inc(map[string]string{"dispatcher": string(p.dispatcher), "record_type": entry.TxType})
+	}
+	return err
+}
+
+// sampled checks whether the vehicle of the record is part of the sample sent to the datastore. The decision only
+// depends on the vin and record type so a vehicle is consistently kept or dropped
+func (p *DatastoreProducer) sampled(entry *Record) bool {
+	if p.config.SampleRate <= 0 || p.config.SampleRate >= 1 {
+		return true
+	}
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(entry.Vin))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write([]byte(entry.TxType))
+	return float64(hash.Sum64())/math.MaxUint64 < p.config.SampleRate
+}
+
+func (p *DatastoreProducer) transform(entry *Record) (*Record, error) {
+	payload, editPayload := entry.protoMessage.(*protos.Payload)
+	editPayload = editPayload && (len(p.transforms) > 0 || len(p.includeFields) > 0 || len(p.excludeFields) > 0)
+	if p.config.Serializer == "" && !editPayload {
+		return entry, nil
+	}
+
+	record := entry.Clone()
+	if editPayload {
+		edited := proto.Clone(payload).(*protos.Payload)
+		for i, transform := range p.transforms {
+			var err error
+			if edited, err = transform(edited); err == nil && edited == nil {
+				err = errors.New("no payload returned")
+			}
+			if err != nil {
+				metricsRegistry.transformErrorCount.Inc(map[string]string{"dispatcher": string(p.dispatcher), "transform": p.transformNames[i], "record_type": entry.TxType})
+				return nil, fmt.Errorf("transform %s: %w", p.transformNames[i], err)
+			}
+		}
+		edited.Data = p.filterData(edited.Data)
+		record.protoMessage = edited
+	}
+
+	format := p.config.Serializer
+	if format == "" {
+		format = record.payloadFormat()
+	}
+	var err error
+	if record.PayloadBytes, err = record.EncodePayload(format); err != nil {
+		return nil, err
+	}
+	if record.protoMessage != nil {
+		record.encoding = format
+	}
+	return record, nil
+}
+
+func (p *DatastoreProducer) filterData(data []*protos.Datum) []*protos.Datum {
+	filtered := make([]*protos.Datum, 0, len(data))
+	for _, datum := range data {
+		if _, excluded := p.excludeFields[datum.GetKey()]; excluded {
+			continue
+		}
+		if _, included := p.includeFields[datum.GetKey()]; len(p.includeFields) > 0 && !included {
+			continue
+		}
+		filtered = append(filtered, datum)
+	}
+	return filtered
+}
+
+// parseFields converts field names to protos.Field, failing on unknown names
+func parseFields(names []string) (map[protos.Field]struct{}, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	fields := make(map[protos.Field]struct{}, len(names))
+	for _, name := range names {
+		value, ok := protos.Field_value[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown field: %s", name)
+		}
+		fields[protos.Field(value)] = struct{}{}
+	}
+	return fields, nil
+}
+
+func registerMetricsOnce(metricsCollector metrics.MetricCollector) {
+	metricsOnce.Do(func() { registerMetrics(metricsCollector) })
+}
+
+func registerMetrics(metricsCollector metrics.MetricCollector) {
+	metricsRegistry.produceErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_produce_errors_total",
+		Help:   "The number of errors of a datastore by class: timeout, auth, serialization, connection or other.",
+		Labels: []string{"datastore", "error_class"},
+	})
+
+	metricsRegistry.oversizedRecordCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "oversized_records_total",
+		Help:   "The number of records rejected before being produced because their payload exceeds the limit of the datastore.",
+		Labels: []string{"datastore", "record_type"},
+	})
+
+	metricsRegistry.nackCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_nacked_records_total",
+		Help:   "The number of records a datastore required to ack them failed to write, they are nacked to the vehicle.",
+		Labels: []string{"datastore", "record_type"},
+	})
+
+	metricsRegistry.transformErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_transform_error_total",
+		Help:   "The number of records dropped for a datastore because one of its transforms failed.",
+		Labels: []string{"dispatcher", "transform", "record_type"},
+	})
+
+	metricsRegistry.writeTimeoutErrorCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_write_timeout_total",
+		Help:   "The number of records which failed to be written to a datastore within its write timeout.",
+		Labels: []string{"dispatcher", "record_type"},
+	})
+
+	metricsRegistry.sampledOutCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_sampled_out_total",
+		Help:   "The number of records not sent to a datastore because their vehicle is not part of its sample.",
+		Labels: []string{"dispatcher", "record_type"},
+	})
+
+	metricsRegistry.breakerState = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "datastore_circuit_breaker_state",
+		Help:   "The state of the circuit breaker of a datastore: 0 closed, 1 open, 2 half open.",
+		Labels: []string{"dispatcher"},
+	})
+
+	metricsRegistry.breakerRejectedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_circuit_open_total",
+		Help:   "The number of records not sent to a datastore because its circuit breaker was open.",
+		Labels: []string{"dispatcher", "record_type"},
+	})
+
+	metricsRegistry.dispatchReceivedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "dispatch_received_total",
+		Help:   "The number of records received for dispatch, record types without dispatch rule are labeled unrouted.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.dispatchProducedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "dispatch_produced_total",
+		Help:   "The number of records accepted by a datastore, counted once per datastore of the record type.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.dispatchDroppedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "dispatch_dropped_total",
+		Help:   "The number of records rejected by a datastore, or not dispatched because no datastore is configured for their type.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.unroutedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "unrouted_records_total",
+		Help:   "The number of records whose type has no dispatch rule, types not sent by vehicles are labeled unknown.",
+		Labels: []string{"record_type"},
+	})
+
+	metricsRegistry.batchWriteCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_batch_write_total",
+		Help:   "The number of batches written to a datastore.",
+		Labels: []string{"dispatcher"},
+	})
+
+	metricsRegistry.batchSizeCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_batch_records_total",
+		Help:   "The number of records written to a datastore in batches, divided by datastore_batch_write_total gives the average batch size.",
+		Labels: []string{"dispatcher"},
+	})
+
+	metricsRegistry.batchFailedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "datastore_batch_failed_records_total",
+		Help:   "The number of records of batches which failed to be written to a datastore.",
+		Labels: []string{"dispatcher"},
+	})
+
+	metricsRegistry.dispatchPoolQueued = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "dispatch_pool_queued",
+		Help:   "The number of records waiting for a worker of the dispatch pool, counted once per datastore.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.dispatchPoolBusyWorkers = metricsCollector.RegisterGauge(adapter.CollectorOptions{
+		Name:   "dispatch_pool_busy_workers",
+		Help:   "The number of workers of the dispatch pool producing a record.",
+		Labels: []string{},
+	})
+
+	metricsRegistry.dispatchPoolSaturatedCount = metricsCollector.RegisterCounter(adapter.CollectorOptions{
+		Name:   "dispatch_pool_saturated_total",
+		Help:   "The number of records whose dispatch waited because the queue of the dispatch pool was full.",
+		Labels: []string{},
+	})
+}
@@ -0,0 +1,227 @@
+package telemetry_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/protobuf/proto"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// SlowProducer blocks writes until their context is done
+type SlowProducer struct {
+	CallbackTester
+	deadline time.Time
+}
+
+func (s *SlowProducer) ProduceContext(ctx context.Context, _ *telemetry.Record) error {
+	s.deadline, _ = ctx.Deadline()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+var _ = Describe("DatastoreProducer", func() {
+	var (
+		producer *RecordingProducer
+		record   *telemetry.Record
+	)
+
+	newRecord := func(transmitDecodedRecords bool) *telemetry.Record {
+		logger, _ := logrus.NoOpLogger()
+		serializer := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42", SenderID: "vehicle_device.42"}, map[string][]telemetry.Producer{}, logger)
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil, stringDatum(protos.Field_Gear, "D"), stringDatum(protos.Field_Location, "(37.412374 N, 122.145867 W)"))}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		rec, err := telemetry.NewRecord(serializer, recordMsg, "1", transmitDecodedRecords)
+		Expect(err).NotTo(HaveOccurred())
+		return rec
+	}
+
+	BeforeEach(func() {
+		producer = &RecordingProducer{}
+		record = newRecord(false)
+	})
+
+	It("passes records through without options", func() {
+		wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{}, noop.NewCollector())
+		Expect(wrapped.Produce(record)).To(Succeed())
+		Expect(producer.records).To(HaveLen(1))
+		Expect(producer.records[0]).To(BeIdenticalTo(record))
+	})
+
+	It("serializes the payload to json", func() {
+		wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{Serializer: telemetry.JSONFormat}, noop.NewCollector())
+		Expect(wrapped.Produce(record)).To(Succeed())
+		Expect(producer.records).To(HaveLen(1))
+
+		var payload map[string]interface{}
+		Expect(json.Unmarshal(producer.records[0].Payload(), &payload)).To(Succeed())
+		Expect(payload).To(HaveKeyWithValue("vin", "42"))
+
+		data := &protos.Payload{}
+		Expect(proto.Unmarshal(record.Payload(), data)).To(Succeed())
+	})
+
+	It("keeps the idempotency key of the payload received", func() {
+		wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{Serializer: telemetry.JSONFormat}, noop.NewCollector())
+		Expect(wrapped.Produce(record)).To(Succeed())
+		Expect(producer.records).To(HaveLen(1))
+		Expect(producer.records[0].IdempotencyKey()).To(Equal(record.IdempotencyKey()))
+		Expect(producer.records[0].Metadata()).To(HaveKeyWithValue(telemetry.IdempotencyKeyMetadataKey, record.IdempotencyKey()))
+	})
+
+	It("serializes the payload to protobuf when records are decoded", func() {
+		record = newRecord(true)
+		wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{Serializer: telemetry.ProtobufFormat}, noop.NewCollector())
+		Expect(wrapped.Produce(record)).To(Succeed())
+
+		data := &protos.Payload{}
+		Expect(proto.Unmarshal(producer.records[0].Payload(), data)).To(Succeed())
+		Expect(data.Vin).To(Equal("42"))
+	})
+
+	DescribeTable("filters fields",
+		func(config *telemetry.DatastoreConfig, expectedFields []protos.Field) {
+			wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, config, noop.NewCollector())
+			Expect(wrapped.Produce(record)).To(Succeed())
+
+			data := &protos.Payload{}
+			Expect(proto.Unmarshal(producer.records[0].Payload(), data)).To(Succeed())
+			var fields []protos.Field
+			for _, datum := range data.Data {
+				fields = append(fields, datum.Key)
+			}
+			Expect(fields).To(Equal(expectedFields))
+
+			original, ok := record.GetProtoMessage().(*protos.Payload)
+			Expect(ok).To(BeTrue())
+			Expect(original.Data).To(HaveLen(3))
+		},
+		Entry("include", &telemetry.DatastoreConfig{IncludeFields: []string{"Gear", "Location"}}, []protos.Field{protos.Field_Gear, protos.Field_Location}),
+		Entry("exclude", &telemetry.DatastoreConfig{ExcludeFields: []string{"Location"}}, []protos.Field{protos.Field_VehicleName, protos.Field_Gear}),
+		Entry("exclude wins over include", &telemetry.DatastoreConfig{IncludeFields: []string{"Gear", "Location"}, ExcludeFields: []string{"Location"}}, []protos.Field{protos.Field_Gear}),
+	)
+
+	It("filters fields before serializing to json", func() {
+		wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{Serializer: telemetry.JSONFormat, ExcludeFields: []string{"Location", "Gear"}}, noop.NewCollector())
+		Expect(wrapped.Produce(record)).To(Succeed())
+
+		var payload map[string]interface{}
+		Expect(json.Unmarshal(producer.records[0].Payload(), &payload)).To(Succeed())
+		Expect(payload["data"]).To(HaveLen(1))
+	})
+
+	Describe("transforms", func() {
+		BeforeEach(func() {
+			telemetry.RegisterTransform("rename", func(payload *protos.Payload) (*protos.Payload, error) {
+				payload.Data = append(payload.Data, stringDatum(protos.Field_VehicleName, "renamed"))
+				return payload, nil
+			})
+			telemetry.RegisterTransform("fail", func(_ *protos.Payload) (*protos.Payload, error) {
+				return nil, errors.New("no range")
+			})
+		})
+
+		It("applies transforms before filtering", func() {
+			config := &telemetry.DatastoreConfig{Transforms: []string{"rename"}, ExcludeFields: []string{"Gear", "Location"}}
+			Expect(config.Validate()).To(Succeed())
+			wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, config, noop.NewCollector())
+			Expect(wrapped.Produce(record)).To(Succeed())
+
+			data := &protos.Payload{}
+			Expect(proto.Unmarshal(producer.records[0].Payload(), data)).To(Succeed())
+			Expect(data.Data).To(HaveLen(2))
+			Expect(data.Data[1].GetValue().GetStringValue()).To(Equal("renamed"))
+
+			original, ok := record.GetProtoMessage().(*protos.Payload)
+			Expect(ok).To(BeTrue())
+			Expect(original.Data).To(HaveLen(3))
+		})
+
+		It("drops the record when a transform fails", func() {
+			config := &telemetry.DatastoreConfig{Transforms: []string{"rename", "fail"}}
+			wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, config, noop.NewCollector())
+			Expect(wrapped.Produce(record)).To(MatchError("transform fail: no range"))
+			Expect(producer.records).To(BeEmpty())
+		})
+
+		It("rejects unknown transforms", func() {
+			config := &telemetry.DatastoreConfig{Transforms: []string{"unregistered"}}
+			Expect(config.Validate()).To(MatchError("unknown transform: unregistered"))
+		})
+	})
+
+	Describe("write timeout", func() {
+		It("cancels writes exceeding the timeout", func() {
+			slowProducer := &SlowProducer{}
+			wrapped := telemetry.NewDatastoreProducer(slowProducer, telemetry.Pubsub, &telemetry.DatastoreConfig{WriteTimeout: 10}, noop.NewCollector())
+			Expect(wrapped.Produce(record)).To(MatchError(context.DeadlineExceeded))
+			Expect(slowProducer.deadline).To(BeTemporally("~", time.Now(), time.Second))
+		})
+
+		It("produces without a context when the datastore does not support it", func() {
+			wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{WriteTimeout: 10}, noop.NewCollector())
+			Expect(wrapped.Produce(record)).To(Succeed())
+			Expect(producer.records).To(HaveLen(1))
+		})
+
+		It("rejects negative timeouts", func() {
+			config := &telemetry.DatastoreConfig{WriteTimeout: -1}
+			Expect(config.Validate()).To(MatchError("invalid write_timeout: -1"))
+		})
+	})
+
+	Describe("sample rate", func() {
+		It("consistently keeps or drops the records of a vehicle", func() {
+			wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{SampleRate: 0.5}, noop.NewCollector())
+			for i := 0; i < 10; i++ {
+				Expect(wrapped.Produce(&telemetry.Record{TxType: "V", Vin: "VIN42"})).To(Succeed())
+			}
+			Expect(len(producer.records)).To(BeElementOf(0, 10))
+		})
+
+		It("keeps the configured fraction of vehicles", func() {
+			wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{SampleRate: 0.25}, noop.NewCollector())
+			for i := 0; i < 10000; i++ {
+				Expect(wrapped.Produce(&telemetry.Record{TxType: "V", Vin: fmt.Sprintf("5YJ3E1EA%09d", i)})).To(Succeed())
+			}
+			Expect(len(producer.records)).To(BeNumerically("~", 2500, 250))
+			Expect(producer.reliableAck).To(Equal(10000 - len(producer.records)))
+		})
+
+		It("does not sample at a rate of 1", func() {
+			wrapped := telemetry.NewDatastoreProducer(producer, telemetry.Kafka, &telemetry.DatastoreConfig{SampleRate: 1}, noop.NewCollector())
+			for i := 0; i < 100; i++ {
+				Expect(wrapped.Produce(&telemetry.Record{TxType: "V", Vin: fmt.Sprintf("VIN%d", i)})).To(Succeed())
+			}
+			Expect(producer.records).To(HaveLen(100))
+		})
+
+		It("rejects rates above 1", func() {
+			config := &telemetry.DatastoreConfig{SampleRate: 1.5}
+			Expect(config.Validate()).To(MatchError("invalid sample_rate: 1.5"))
+		})
+	})
+
+	It("rejects unknown fields", func() {
+		config := &telemetry.DatastoreConfig{ExcludeFields: []string{"Locaiton"}}
+		Expect(config.Validate()).To(MatchError("unknown field: Locaiton"))
+	})
+
+	It("rejects unknown serializers", func() {
+		config := &telemetry.DatastoreConfig{Serializer: "xml"}
+		Expect(config.Validate()).To(MatchError("invalid serializer: xml"))
+	})
+})
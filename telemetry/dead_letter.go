@@ -0,0 +1,51 @@
+package telemetry
+
+import (
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+)
+
+// DeadLetterTxType is the record type of records forwarded to the dead letter datastore
+const DeadLetterTxType = "dead_letter"
+
+// DeadLetterProducer wraps a producer and forwards the records it fails to produce to a dead letter producer
+type DeadLetterProducer struct {
+	Producer
+	dispatcher Dispatcher
+	deadLetter Producer
+	logger     *logrus.Logger
+}
+
+// NewDeadLetterProducer returns a producer forwarding failed records of the dispatcher to deadLetter
+func NewDeadLetterProducer(producer Producer, dispatcher Dispatcher, deadLetter Producer, logger *logrus.Logger) Producer {
+	return &DeadLetterProducer{
+		Producer:   producer,
+		dispatcher: dispatcher,
+		deadLetter: deadLetter,
+		logger:     logger,
+	}
+}
+
+// Produce sends the record to the wrapped producer, and to the dead letter producer if it fails.
+// Failed records are forwarded with the record type dead_letter and metadata describing the failure
+func (p *DeadLetterProducer) Produce(entry *Record) error {
+	err := p.Producer.Produce(entry)
+	if err == nil {
+		return nil
+	}
+
+	forwardToDeadLetter(p.deadLetter, entry, p.dispatcher, err, p.logger)
+	return err
+}
+
+// forwardToDeadLetter produces a copy of the record which failed to be written to dispatcher to the dead letter producer,
+// with the record type dead_letter and metadata describing the failure
+func forwardToDeadLetter(deadLetter Producer, entry *Record, dispatcher Dispatcher, err error, logger *logrus.Logger) {
+	deadLetterRecord := entry.Clone()
+	deadLetterRecord.TxType = DeadLetterTxType
+	deadLetterRecord.AddMetadata("original_txtype", entry.TxType)
+	deadLetterRecord.AddMetadata("failed_datastore", string(dispatcher))
+	deadLetterRecord.AddMetadata("failure_reason", err.Error())
+	if deadLetterErr := deadLetter.Produce(deadLetterRecord); deadLetterErr != nil {
+		logger.ErrorLog("dead_letter_produce_error", deadLetterErr, logrus.LogInfo{"vin": entry.Vin, "txid": entry.Txid, "record_type": entry.TxType, "failed_datastore": dispatcher})
+	}
+}
@@ -0,0 +1,63 @@
+package telemetry_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+type RecordingProducer struct {
+	CallbackTester
+	err     error
+	records []*telemetry.Record
+}
+
+func (r *RecordingProducer) Produce(entry *telemetry.Record) error {
+	r.records = append(r.records, entry)
+	return r.err
+}
+
+var _ = Describe("DeadLetterProducer", func() {
+	var (
+		producer   *RecordingProducer
+		deadLetter *RecordingProducer
+		wrapped    telemetry.Producer
+		record     *telemetry.Record
+	)
+
+	BeforeEach(func() {
+		logger, _ := logrus.NoOpLogger()
+		producer = &RecordingProducer{}
+		deadLetter = &RecordingProducer{}
+		wrapped = telemetry.NewDeadLetterProducer(producer, telemetry.Kafka, deadLetter, logger)
+		record = &telemetry.Record{TxType: "V", Vin: "VIN42", Txid: "txid-42"}
+	})
+
+	It("does not forward successful records", func() {
+		Expect(wrapped.Produce(record)).To(Succeed())
+		Expect(producer.records).To(HaveLen(1))
+		Expect(deadLetter.records).To(BeEmpty())
+	})
+
+	It("forwards failed records with failure metadata", func() {
+		producer.err = errors.New("broker down")
+
+		Expect(wrapped.Produce(record)).To(MatchError("broker down"))
+		Expect(deadLetter.records).To(HaveLen(1))
+
+		deadLetterRecord := deadLetter.records[0]
+		Expect(deadLetterRecord.TxType).To(Equal(telemetry.DeadLetterTxType))
+		Expect(deadLetterRecord.Metadata()).To(HaveKeyWithValue("original_txtype", "V"))
+		Expect(deadLetterRecord.Metadata()).To(HaveKeyWithValue("failed_datastore", "kafka"))
+		Expect(deadLetterRecord.Metadata()).To(HaveKeyWithValue("failure_reason", "broker down"))
+		Expect(deadLetterRecord.Metadata()).To(HaveKeyWithValue("vin", "VIN42"))
+		Expect(deadLetterRecord.IdempotencyKey()).To(Equal(record.IdempotencyKey()))
+
+		Expect(record.TxType).To(Equal("V"))
+		Expect(record.Metadata()).NotTo(HaveKey("failure_reason"))
+	})
+})
@@ -0,0 +1,143 @@
+package telemetry
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+const (
+	// DefaultDispatchWorkers is the number of workers of the dispatch pool when not configured
+	DefaultDispatchWorkers = 32
+
+	// dispatchQueuePerWorker is the number of jobs each worker can have waiting before submitting blocks
+	dispatchQueuePerWorker = 16
+)
+
+// ErrDispatchPoolClosed is returned for records dispatched after the dispatch pool was closed
+var ErrDispatchPoolClosed = errors.New("dispatch pool closed")
+
+// DispatchPool produces records from a fixed set of workers, so a slow datastore doesn't delay the records
+// dispatched after it. Jobs are picked by any idle worker, or by the worker of their vin when they need
+// to stay in order
+type DispatchPool struct {
+	shared  chan func()
+	ordered []chan func()
+
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// NewDispatchPool starts a pool of workers, workers is expected to be positive
+func NewDispatchPool(workers int, metricsCollector metrics.MetricCollector) *DispatchPool {
+	registerMetricsOnce(metricsCollector)
+
+	pool := &DispatchPool{
+		shared:  make(chan func(), workers*dispatchQueuePerWorker),
+		ordered: make([]chan func(), workers),
+	}
+	for i := range pool.ordered {
+		pool.ordered[i] = make(chan func(), dispatchQueuePerWorker)
+	}
+	pool.workers.Add(workers)
+	for _, ordered := range pool.ordered {
+		go pool.work(ordered)
+	}
+	return pool
+}
+
+// Submit queues job for any worker. It blocks while the pool is saturated
+func (pool *DispatchPool) Submit(job func()) error {
+	return pool.submit(pool.shared, job)
+}
+
+// SubmitOrdered queues job for the worker of vin, jobs of a vin run in the order they were submitted
+func (pool *DispatchPool) SubmitOrdered(vin string, job func()) error {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(vin))
+	return pool.submit(pool.ordered[hash.Sum32()%uint32(len(pool.ordered))], job)
+}
+
+func (pool *DispatchPool) submit(queue chan func(), job func()) error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if pool.closed {
+		return ErrDispatchPoolClosed
+	}
+
+	metricsRegistry.dispatchPoolQueued.Inc(map[string]string{})
+	select {
+	case queue <- job:
+	default:
+		metricsRegistry.dispatchPoolSaturatedCount.Inc(map[string]string{})
+		queue <- job
+	}
+	return nil
+}
+
+func (pool *DispatchPool) work(ordered chan func()) {
+	defer pool.workers.Done()
+	shared := pool.shared
+	for shared != nil || ordered != nil {
+		var job func()
+		var ok bool
+		select {
+		case job, ok = <-shared:
+			if !ok {
+				shared = nil
+				continue
+			}
+		case job, ok = <-ordered:
+			if !ok {
+				ordered = nil
+				continue
+			}
+		}
+		metricsRegistry.dispatchPoolQueued.Sub(1, map[string]string{})
+		metricsRegistry.dispatchPoolBusyWorkers.Inc(map[string]string{})
+		job()
+		metricsRegistry.dispatchPoolBusyWorkers.Sub(1, map[string]string{})
+	}
+}
+
+// Close waits for the queued jobs to run, jobs submitted afterwards are rejected with ErrDispatchPoolClosed
+func (pool *DispatchPool) Close() {
+	pool.mu.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.shared)
+		for _, ordered := range pool.ordered {
+			close(ordered)
+		}
+	}
+	pool.mu.Unlock()
+	pool.workers.Wait()
+}
+
+// PooledProducer hands the records dispatched to a producer to a dispatch pool, Produce returns once the
+// record is queued and errors of the wrapped producer are only reported by its own metrics
+type PooledProducer struct {
+	Producer
+	pool       *DispatchPool
+	orderByVIN bool
+}
+
+// NewPooledProducer returns a producer writing records to producer from the workers of pool. When orderByVIN
+// is set, the records of a vin are produced in the order they were dispatched
+func NewPooledProducer(producer Producer, pool *DispatchPool, orderByVIN bool) *PooledProducer {
+	return &PooledProducer{Producer: producer, pool: pool, orderByVIN: orderByVIN}
+}
+
+// Produce queues a copy of the record for the wrapped producer, since the other datastores of the record can
+// produce it concurrently
+func (p *PooledProducer) Produce(entry *Record) error {
+	clone := entry.Clone()
+	job := func() { _ = p.Producer.Produce(clone) }
+	if p.orderByVIN {
+		return p.pool.SubmitOrdered(entry.Vin, job)
+	}
+	return p.pool.Submit(job)
+}
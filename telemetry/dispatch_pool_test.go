@@ -0,0 +1,122 @@
+package telemetry_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+// BlockingProducer records the txids it produced, records of blockedVin wait until release is closed
+type BlockingProducer struct {
+	CallbackTester
+	blockedVin string
+	release    chan struct{}
+	mu         sync.Mutex
+	txids      []string
+}
+
+func (b *BlockingProducer) Produce(entry *telemetry.Record) error {
+	if entry.Vin == b.blockedVin {
+		<-b.release
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.txids = append(b.txids, entry.Txid)
+	return nil
+}
+
+func (b *BlockingProducer) Txids() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.txids...)
+}
+
+// StampingProducer updates the records it produces like datastores do
+type StampingProducer struct {
+	CallbackTester
+	name    string
+	records chan *telemetry.Record
+}
+
+func (s *StampingProducer) Produce(entry *telemetry.Record) error {
+	entry.ProduceTime = time.Now()
+	entry.AddMetadata("datastore", s.name)
+	s.records <- entry
+	return nil
+}
+
+var _ = Describe("DispatchPool", func() {
+	var (
+		pool     *telemetry.DispatchPool
+		producer *BlockingProducer
+	)
+
+	BeforeEach(func() {
+		pool = telemetry.NewDispatchPool(4, noop.NewCollector())
+		producer = &BlockingProducer{blockedVin: "slow-vin", release: make(chan struct{})}
+	})
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	It("produces records while a previous record is blocked", func() {
+		pooled := telemetry.NewPooledProducer(producer, pool, false)
+		Expect(pooled.Produce(&telemetry.Record{Vin: "slow-vin", Txid: "slow"})).To(Succeed())
+		Expect(pooled.Produce(&telemetry.Record{Vin: "other-vin", Txid: "fast"})).To(Succeed())
+
+		Eventually(producer.Txids).Should(Equal([]string{"fast"}))
+		close(producer.release)
+		Eventually(producer.Txids).Should(Equal([]string{"fast", "slow"}))
+	})
+
+	It("keeps the records of a vin in order", func() {
+		close(producer.release)
+		pooled := telemetry.NewPooledProducer(producer, pool, true)
+		var expected []string
+		for i := 0; i < 100; i++ {
+			txid := fmt.Sprintf("txid-%d", i)
+			expected = append(expected, txid)
+			Expect(pooled.Produce(&telemetry.Record{Vin: "ordered-vin", Txid: txid})).To(Succeed())
+		}
+		Eventually(producer.Txids).Should(Equal(expected))
+	})
+
+	It("gives each datastore its own copy of the record", func() {
+		records := make(chan *telemetry.Record, 200)
+		kafka := telemetry.NewPooledProducer(&StampingProducer{name: "kafka", records: records}, pool, false)
+		nats := telemetry.NewPooledProducer(&StampingProducer{name: "nats", records: records}, pool, false)
+
+		var dispatched []*telemetry.Record
+		for i := 0; i < 100; i++ {
+			record := &telemetry.Record{Vin: "vin", Txid: fmt.Sprintf("txid-%d", i)}
+			dispatched = append(dispatched, record)
+			Expect(kafka.Produce(record)).To(Succeed())
+			Expect(nats.Produce(record)).To(Succeed())
+		}
+		pool.Close()
+
+		Expect(records).To(HaveLen(200))
+		for _, record := range dispatched {
+			Expect(record.ProduceTime.IsZero()).To(BeTrue())
+			Expect(record.Metadata()).NotTo(HaveKey("datastore"))
+		}
+	})
+
+	It("produces the queued records on close and rejects the next ones", func() {
+		close(producer.release)
+		pooled := telemetry.NewPooledProducer(producer, pool, false)
+		for i := 0; i < 10; i++ {
+			Expect(pooled.Produce(&telemetry.Record{Vin: "vin", Txid: fmt.Sprintf("txid-%d", i)})).To(Succeed())
+		}
+		pool.Close()
+		Expect(producer.Txids()).To(HaveLen(10))
+		Expect(pooled.Produce(&telemetry.Record{Vin: "vin"})).To(MatchError(telemetry.ErrDispatchPoolClosed))
+	})
+})
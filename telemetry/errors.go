@@ -5,6 +5,9 @@ import "fmt"
 // ErrMessageTooBig handles error when incoming payload is too large
 var ErrMessageTooBig = fmt.Errorf("can't process message, size above 1mb")
 
+// ErrDecompressedMessageTooBig handles error when a compressed payload inflates above the configured limit
+var ErrDecompressedMessageTooBig = fmt.Errorf("can't process message, decompressed size above limit")
+
 // UnauthorizedSenderIDError is an error struct representing mismatch ID
 type UnauthorizedSenderIDError struct {
 	ExpectedSenderID string
@@ -16,6 +19,17 @@ func (e *UnauthorizedSenderIDError) Error() string {
 	return fmt.Sprintf("Sender ID mismatch %s - %s", e.ExpectedSenderID, e.ReceivedSenderID)
 }
 
+// VINMismatchError is an error struct representing a record claiming a vin other than the one of the client certificate
+type VINMismatchError struct {
+	CertVIN     string
+	ReceivedVIN string
+}
+
+// Error returns an error string implementing the error interface
+func (e *VINMismatchError) Error() string {
+	return fmt.Sprintf("VIN mismatch %s - %s", e.CertVIN, e.ReceivedVIN)
+}
+
 // NonAnonymizedError is an error struct representing mismatch ID
 type NonAnonymizedError struct {
 }
@@ -36,3 +50,19 @@ type UnknownMessageType struct {
 func (e *UnknownMessageType) Error() string {
 	return fmt.Sprintf("Unknown message Type for %s - %v", e.Txid, e.GuessedType)
 }
+
+// PayloadDecodeError is an error struct representing a payload which does not decode to the message of its record type
+type PayloadDecodeError struct {
+	TxType string
+	Err    error
+}
+
+// Error returns an error string implementing the error interface
+func (e *PayloadDecodeError) Error() string {
+	return fmt.Sprintf("invalid %s payload: %v", e.TxType, e.Err)
+}
+
+// Unwrap returns the decoding error
+func (e *PayloadDecodeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,47 @@
+package telemetry
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// IdempotencyKeyMetadataKey is the record metadata key holding the idempotency key of the record, exposed as a
+// kafka and nats header and a pubsub attribute
+const IdempotencyKeyMetadataKey = "idempotency_key"
+
+// idempotencyKeyBytes is the number of bytes of the hash kept in the key, 128 bits
+const idempotencyKeyBytes = 16
+
+// IdempotencyKey returns a key identifying a record by its vin, type, creation time in milliseconds and payload, so
+// consumers can drop records produced twice, like replayed records. The key only depends on its inputs: it is the
+// same across runs and servers.
+//
+// The key is the first 128 bits of the SHA-256 of the length prefixed inputs, in hex. Distinct records collide with
+// a probability of about n²/2¹²⁹ for n records, under 10⁻¹⁴ for a trillion records. Records which are identical,
+// such as a record the vehicle sent again, share the same key by design. Since vehicles report the creation time in
+// seconds, records with the same payload created within the same second share it as well
+func IdempotencyKey(vin, txType string, createdAt int64, payload []byte) string {
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64+len(vin)+len(txType)+8)
+	buf = binary.AppendUvarint(buf, uint64(len(vin)))
+	buf = append(buf, vin...)
+	buf = binary.AppendUvarint(buf, uint64(len(txType)))
+	buf = append(buf, txType...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(createdAt))
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+
+	hash := sha256.New()
+	hash.Write(buf)
+	hash.Write(payload)
+	return hex.EncodeToString(hash.Sum(nil)[:idempotencyKeyBytes])
+}
+
+// IdempotencyKey returns the idempotency key of the record. Records received from vehicles store the key when they
+// are created, records rebuilt from messages carrying the key keep it, and records whose payload is edited or encoded
+// again for a datastore keep the key of the payload received. Other records hash their fields on each call
+func (record *Record) IdempotencyKey() string {
+	if key, ok := record.extraMetadata[IdempotencyKeyMetadataKey]; ok {
+		return key
+	}
+	return IdempotencyKey(record.Vin, record.TxType, record.Timestamp, record.PayloadBytes)
+}
@@ -0,0 +1,42 @@
+package telemetry_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("IdempotencyKey", func() {
+	It("is stable across runs", func() {
+		Expect(telemetry.IdempotencyKey("5YJ3E1EA7JF000001", "V", 1700000000000, []byte("data"))).To(Equal("09113e7a6b0d342107ef95d16c33bddc"))
+	})
+
+	It("differs when any input differs", func() {
+		keys := map[string]bool{}
+		for _, key := range []string{
+			telemetry.IdempotencyKey("VIN42", "V", 1700000000000, []byte("data")),
+			telemetry.IdempotencyKey("VIN43", "V", 1700000000000, []byte("data")),
+			telemetry.IdempotencyKey("VIN42", "alerts", 1700000000000, []byte("data")),
+			telemetry.IdempotencyKey("VIN42", "V", 1700000001000, []byte("data")),
+			telemetry.IdempotencyKey("VIN42", "V", 1700000000000, []byte("date")),
+			// the inputs are length prefixed, moving bytes from one input to the next changes the key
+			telemetry.IdempotencyKey("VIN4", "2V", 1700000000000, []byte("data")),
+		} {
+			Expect(key).To(HaveLen(32))
+			keys[key] = true
+		}
+		Expect(keys).To(HaveLen(6))
+	})
+
+	It("is exposed in the record metadata", func() {
+		record := &telemetry.Record{Vin: "VIN42", TxType: "V", Timestamp: 1700000000000, PayloadBytes: []byte("data")}
+		Expect(record.Metadata()).To(HaveKeyWithValue(telemetry.IdempotencyKeyMetadataKey, telemetry.IdempotencyKey("VIN42", "V", 1700000000000, []byte("data"))))
+	})
+
+	It("is kept by records rebuilt with the key", func() {
+		record := &telemetry.Record{Vin: "VIN42", TxType: "V", PayloadBytes: []byte("edited")}
+		record.AddMetadata(telemetry.IdempotencyKeyMetadataKey, "original")
+		Expect(record.IdempotencyKey()).To(Equal("original"))
+	})
+})
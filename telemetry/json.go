@@ -0,0 +1,25 @@
+package telemetry
+
+import (
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultJSONSerializer encodes the records of serializers without json options, enums are rendered as names
+var DefaultJSONSerializer = &JSONSerializer{EnumsAsStrings: true}
+
+// JSONSerializer encodes decoded payloads to json. It is shared by transmit_decoded_records, the json serializer of
+// datastores and the debug endpoints, so they render payloads the same way
+type JSONSerializer struct {
+	// EnumsAsStrings renders enums with their proto names, ex.: "DetailedChargeStateCharging", instead of their numbers
+	EnumsAsStrings bool
+}
+
+// Marshal returns the json of the message, unpopulated fields included
+func (s *JSONSerializer) Marshal(message proto.Message) ([]byte, error) {
+	options := protojson.MarshalOptions{
+		UseEnumNumbers:  !s.EnumsAsStrings,
+		EmitUnpopulated: true,
+	}
+	return options.Marshal(message)
+}
@@ -0,0 +1,84 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+// Nacker releases the records a datastore failed to write when the datastore is required to ack them, so the
+// vehicle receives an error instead of waiting for an ack which never comes and the records stop counting as in flight
+type Nacker struct {
+	dispatcher Dispatcher
+	ackChan    chan (*Record)
+	txTypes    map[string]interface{}
+}
+
+// nackedError marks the errors of records which were nacked already, see MarkNacked
+type nackedError struct {
+	error
+}
+
+func (e nackedError) Unwrap() error {
+	return e.error
+}
+
+// MarkNacked returns err marked as nacked, so the nacker of the datastore doesn't nack the record again. Datastores
+// writing copies of a record to other datastores, like the tee, return it when those datastores nacked the copies
+func MarkNacked(err error) error {
+	if err == nil {
+		return nil
+	}
+	return nackedError{err}
+}
+
+// NewNacker returns a nacker for the dispatcher acking the record types txTypes on ackChan
+func NewNacker(dispatcher Dispatcher, ackChan chan (*Record), txTypes map[string]interface{}, metricsCollector metrics.MetricCollector) *Nacker {
+	registerMetricsOnce(metricsCollector)
+	return &Nacker{dispatcher: dispatcher, ackChan: ackChan, txTypes: txTypes}
+}
+
+// Nack releases the record with err if it waits for an ack of the datastore, it is a no-op on a nil nacker
+func (n *Nacker) Nack(entry *Record, err error) {
+	if n == nil || n.ackChan == nil || !entry.AwaitsAcks() || errors.As(err, &nackedError{}) {
+		return
+	}
+	if _, ok := n.txTypes[entry.TxType]; !ok {
+		return
+	}
+	metricsRegistry.nackCount.Inc(map[string]string{"datastore": string(n.dispatcher), "record_type": entry.TxType})
+	entry.FailAck(err)
+	n.ackChan <- entry
+}
+
+// NackProducer wraps the producer of a datastore and nacks the records it fails to produce
+type NackProducer struct {
+	Producer
+	nacker *Nacker
+}
+
+// NewNackProducer returns a producer nacking the records producer fails to produce
+func NewNackProducer(producer Producer, nacker *Nacker) *NackProducer {
+	return &NackProducer{Producer: producer, nacker: nacker}
+}
+
+// Produce sends the record to the wrapped producer and nacks it if it fails
+func (p *NackProducer) Produce(entry *Record) error {
+	return p.ProduceContext(context.Background(), entry)
+}
+
+// ProduceContext sends the record to the wrapped producer and nacks it if it fails,
+// ctx is ignored by producers which don't implement ContextProducer
+func (p *NackProducer) ProduceContext(ctx context.Context, entry *Record) error {
+	var err error
+	if contextProducer, ok := p.Producer.(ContextProducer); ok {
+		err = contextProducer.ProduceContext(ctx, entry)
+	} else {
+		err = p.Producer.Produce(entry)
+	}
+	if err != nil {
+		p.nacker.Nack(entry, err)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package telemetry_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("NackProducer", func() {
+	var (
+		producer *RecordingProducer
+		ackChan  chan (*telemetry.Record)
+		wrapped  telemetry.Producer
+		record   *telemetry.Record
+	)
+
+	BeforeEach(func() {
+		producer = &RecordingProducer{}
+		ackChan = make(chan *telemetry.Record, 1)
+		nacker := telemetry.NewNacker(telemetry.Kafka, ackChan, map[string]interface{}{"V": true}, noop.NewCollector())
+		wrapped = telemetry.NewNackProducer(producer, nacker)
+		record = &telemetry.Record{TxType: "V", Vin: "VIN42", Txid: "txid-42"}
+		record.SetPendingAcks(2)
+	})
+
+	It("does not release successful records", func() {
+		Expect(wrapped.Produce(record)).To(Succeed())
+		Expect(ackChan).NotTo(Receive())
+	})
+
+	It("releases failed records with the error", func() {
+		producer.err = errors.New("broker down")
+
+		Expect(wrapped.Produce(record)).To(MatchError("broker down"))
+		Expect(ackChan).To(Receive(Equal(record)))
+		Expect(record.AckError()).To(MatchError("broker down"))
+	})
+
+	It("keeps the first error of the datastores", func() {
+		producer.err = errors.New("broker down")
+		Expect(wrapped.Produce(record)).To(HaveOccurred())
+		Expect(ackChan).To(Receive())
+
+		record.FailAck(errors.New("stream throttled"))
+		Expect(record.AckError()).To(MatchError("broker down"))
+	})
+
+	It("ignores record types the datastore does not ack", func() {
+		producer.err = errors.New("broker down")
+		record.TxType = "alerts"
+
+		Expect(wrapped.Produce(record)).To(HaveOccurred())
+		Expect(ackChan).NotTo(Receive())
+		Expect(record.AckError()).NotTo(HaveOccurred())
+	})
+
+	It("ignores errors of records which were nacked already", func() {
+		producer.err = telemetry.MarkNacked(errors.New("broker down"))
+
+		Expect(wrapped.Produce(record)).To(MatchError("broker down"))
+		Expect(ackChan).NotTo(Receive())
+		Expect(record.AckError()).NotTo(HaveOccurred())
+	})
+
+	It("ignores records which do not wait for acks", func() {
+		producer.err = errors.New("broker down")
+		record = &telemetry.Record{TxType: "V", Vin: "VIN42"}
+
+		Expect(wrapped.Produce(record)).To(HaveOccurred())
+		Expect(ackChan).NotTo(Receive())
+	})
+})
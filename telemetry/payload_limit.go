@@ -0,0 +1,89 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+// Payload limits of the datastores rejecting large records, in bytes
+const (
+	// KinesisMaxRecordBytes is the max size of the data of a kinesis record
+	KinesisMaxRecordBytes = 1 << 20
+	// PubsubMaxRecordBytes is the max size of a pubsub message
+	PubsubMaxRecordBytes = 10_000_000
+	// KafkaMaxRecordBytes is the default message.max.bytes of librdkafka and the brokers
+	KafkaMaxRecordBytes = 1_000_000
+	// NATSMaxRecordBytes is the default max_payload of the nats server
+	NATSMaxRecordBytes = 1 << 20
+	// RedisMaxRecordBytes is the max size of a redis string
+	RedisMaxRecordBytes = 512 << 20
+)
+
+// defaultMaxRecordBytes are the limits applied when the datastore config doesn't set max_record_bytes,
+// other datastores accept records of any size
+var defaultMaxRecordBytes = map[Dispatcher]int{
+	Kinesis: KinesisMaxRecordBytes,
+	Pubsub:  PubsubMaxRecordBytes,
+	Kafka:   KafkaMaxRecordBytes,
+	NATS:    NATSMaxRecordBytes,
+	Redis:   RedisMaxRecordBytes,
+}
+
+// MaxRecordBytes returns the max payload size of the records sent to the dispatcher, 0 when unlimited.
+// config may be nil
+func MaxRecordBytes(dispatcher Dispatcher, config *DatastoreConfig) int {
+	if config != nil && config.MaxRecordBytes > 0 {
+		return config.MaxRecordBytes
+	}
+	return defaultMaxRecordBytes[dispatcher]
+}
+
+// OversizedRecordError is returned for records whose payload exceeds the limit of the datastore, they are
+// rejected before being produced
+type OversizedRecordError struct {
+	Dispatcher Dispatcher
+	Size       int
+	Limit      int
+}
+
+func (e *OversizedRecordError) Error() string {
+	return fmt.Sprintf("record payload of %d bytes exceeds the %d bytes limit of %s", e.Size, e.Limit, e.Dispatcher)
+}
+
+// PayloadLimitProducer wraps a producer and rejects records whose payload is larger than the datastore accepts,
+// so they fail without a round trip and reach the dead letter datastore
+type PayloadLimitProducer struct {
+	Producer
+	dispatcher Dispatcher
+	limit      int
+}
+
+// NewPayloadLimitProducer returns a producer rejecting the records of the dispatcher larger than limit bytes
+func NewPayloadLimitProducer(producer Producer, dispatcher Dispatcher, limit int, metricsCollector metrics.MetricCollector) *PayloadLimitProducer {
+	registerMetricsOnce(metricsCollector)
+	return &PayloadLimitProducer{
+		Producer:   producer,
+		dispatcher: dispatcher,
+		limit:      limit,
+	}
+}
+
+// Produce sends the record to the wrapped producer unless its payload is too large
+func (p *PayloadLimitProducer) Produce(entry *Record) error {
+	return p.ProduceContext(context.Background(), entry)
+}
+
+// ProduceContext sends the record to the wrapped producer unless its payload is too large,
+// ctx is ignored by producers which don't implement ContextProducer
+func (p *PayloadLimitProducer) ProduceContext(ctx context.Context, entry *Record) error {
+	if size := len(entry.Payload()); size > p.limit {
+		metricsRegistry.oversizedRecordCount.Inc(map[string]string{"datastore": string(p.dispatcher), "record_type": entry.TxType})
+		return &OversizedRecordError{Dispatcher: p.dispatcher, Size: size, Limit: p.limit}
+	}
+	if contextProducer, ok := p.Producer.(ContextProducer); ok {
+		return contextProducer.ProduceContext(ctx, entry)
+	}
+	return p.Producer.Produce(entry)
+}
@@ -0,0 +1,70 @@
+package telemetry_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("PayloadLimitProducer", func() {
+	var producer *RecordingProducer
+
+	BeforeEach(func() {
+		producer = &RecordingProducer{}
+	})
+
+	It("produces records within the limit", func() {
+		wrapped := telemetry.NewPayloadLimitProducer(producer, telemetry.Kinesis, 4, noop.NewCollector())
+		Expect(wrapped.Produce(&telemetry.Record{TxType: "V", PayloadBytes: []byte("1234")})).To(Succeed())
+		Expect(producer.records).To(HaveLen(1))
+	})
+
+	It("rejects oversized records without producing them", func() {
+		wrapped := telemetry.NewPayloadLimitProducer(producer, telemetry.Kinesis, 4, noop.NewCollector())
+		err := wrapped.Produce(&telemetry.Record{TxType: "V", PayloadBytes: []byte("12345")})
+		Expect(err).To(MatchError("record payload of 5 bytes exceeds the 4 bytes limit of kinesis"))
+		Expect(err).To(BeAssignableToTypeOf(&telemetry.OversizedRecordError{}))
+		Expect(producer.records).To(BeEmpty())
+	})
+
+	It("forwards oversized records to the dead letter datastore", func() {
+		logger, _ := logrus.NoOpLogger()
+		deadLetter := &RecordingProducer{}
+		limited := telemetry.NewPayloadLimitProducer(producer, telemetry.NATS, 1, noop.NewCollector())
+		wrapped := telemetry.NewDeadLetterProducer(limited, telemetry.NATS, deadLetter, logger)
+
+		Expect(wrapped.Produce(&telemetry.Record{TxType: "V", Vin: "VIN42", PayloadBytes: []byte("12")})).NotTo(Succeed())
+		Expect(deadLetter.records).To(HaveLen(1))
+		Expect(deadLetter.records[0].Metadata()).To(HaveKeyWithValue("failure_reason", "record payload of 2 bytes exceeds the 1 bytes limit of nats"))
+	})
+
+	It("keeps the context of the write timeout", func() {
+		slowProducer := &SlowProducer{}
+		limited := telemetry.NewPayloadLimitProducer(slowProducer, telemetry.Pubsub, 4, noop.NewCollector())
+		wrapped := telemetry.NewDatastoreProducer(limited, telemetry.Pubsub, &telemetry.DatastoreConfig{WriteTimeout: 10}, noop.NewCollector())
+		Expect(wrapped.Produce(&telemetry.Record{TxType: "V"})).To(MatchError(context.DeadlineExceeded))
+		Expect(slowProducer.deadline).To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	DescribeTable("max record bytes",
+		func(dispatcher telemetry.Dispatcher, config *telemetry.DatastoreConfig, expected int) {
+			Expect(telemetry.MaxRecordBytes(dispatcher, config)).To(Equal(expected))
+		},
+		Entry("kinesis", telemetry.Kinesis, nil, telemetry.KinesisMaxRecordBytes),
+		Entry("pubsub", telemetry.Pubsub, &telemetry.DatastoreConfig{}, telemetry.PubsubMaxRecordBytes),
+		Entry("kafka override", telemetry.Kafka, &telemetry.DatastoreConfig{MaxRecordBytes: 5 << 20}, 5<<20),
+		Entry("unlimited file", telemetry.File, nil, 0),
+		Entry("file override", telemetry.File, &telemetry.DatastoreConfig{MaxRecordBytes: 1024}, 1024),
+	)
+
+	It("rejects negative limits", func() {
+		config := &telemetry.DatastoreConfig{MaxRecordBytes: -1}
+		Expect(config.Validate()).To(MatchError("invalid max_record_bytes: -1"))
+	})
+})
@@ -0,0 +1,111 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+// ErrorClass is the bounded category of the errors counted in datastore_produce_errors_total
+type ErrorClass string
+
+const (
+	// ErrorClassTimeout is a write which did not complete in time
+	ErrorClassTimeout ErrorClass = "timeout"
+	// ErrorClassAuth is a write rejected because of missing or invalid credentials
+	ErrorClassAuth ErrorClass = "auth"
+	// ErrorClassSerialization is a record which could not be encoded for the datastore
+	ErrorClassSerialization ErrorClass = "serialization"
+	// ErrorClassConnection is a write which failed because the datastore could not be reached
+	ErrorClassConnection ErrorClass = "connection"
+	// ErrorClassOther is any other error
+	ErrorClassOther ErrorClass = "other"
+)
+
+// authErrorCodes are parts of the error codes of the AWS APIs returned for credential problems
+var authErrorCodes = []string{"AccessDenied", "UnrecognizedClient", "InvalidSignature", "SignatureDoesNotMatch", "ExpiredToken", "InvalidAccessKeyId", "NotAuthorized", "InvalidClientTokenId"}
+
+// ClassifyError returns the class of an error returned by a datastore client. Timeouts, connection
+// and serialization errors are recognized from the standard library, gRPC status codes and AWS error codes
+func ClassifyError(err error) ErrorClass {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.Is(err, proto.Error):
+		return ErrorClassSerialization
+	}
+
+	var syntaxErr *json.SyntaxError
+	var unsupportedTypeErr *json.UnsupportedTypeError
+	var unsupportedValueErr *json.UnsupportedValueError
+	var marshalerErr *json.MarshalerError
+	if errors.As(err, &syntaxErr) || errors.As(err, &unsupportedTypeErr) || errors.As(err, &unsupportedValueErr) || errors.As(err, &marshalerErr) {
+		return ErrorClassSerialization
+	}
+
+	if statusErr, ok := status.FromError(err); ok && statusErr.Code() != codes.Unknown {
+		switch statusErr.Code() {
+		case codes.DeadlineExceeded:
+			return ErrorClassTimeout
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return ErrorClassAuth
+		case codes.Unavailable:
+			return ErrorClassConnection
+		}
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		for _, code := range authErrorCodes {
+			if strings.Contains(awsErr.Code(), code) {
+				return ErrorClassAuth
+			}
+		}
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return ErrorClassConnection
+	}
+	return ErrorClassOther
+}
+
+// ProduceErrorCounter counts the errors of a datastore by class in datastore_produce_errors_total,
+// so the errors of every datastore can be compared on the same panel
+type ProduceErrorCounter struct {
+	dispatcher Dispatcher
+}
+
+// NewProduceErrorCounter returns the error counter of the datastore of dispatcher
+func NewProduceErrorCounter(dispatcher Dispatcher, metricsCollector metrics.MetricCollector) *ProduceErrorCounter {
+	registerMetricsOnce(metricsCollector)
+	return &ProduceErrorCounter{dispatcher: dispatcher}
+}
+
+// Inc counts err with the class returned by ClassifyError, it is a no-op on a nil counter
+func (c *ProduceErrorCounter) Inc(err error) {
+	c.IncClass(ClassifyError(err))
+}
+
+// IncClass counts an error of a known class, it is a no-op on a nil counter
+func (c *ProduceErrorCounter) IncClass(class ErrorClass) {
+	if c == nil {
+		return
+	}
+	metricsRegistry.produceErrorCount.Inc(map[string]string{"datastore": string(c.dispatcher), "error_class": string(class)})
+}
@@ -0,0 +1,52 @@
+package telemetry_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/fleet-telemetry/protos"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("ClassifyError", func() {
+	invalidUTF8 := func() error {
+		_, err := proto.Marshal(&protos.Payload{Vin: "\xff"})
+		return err
+	}
+
+	DescribeTable("classes",
+		func(err error, expected telemetry.ErrorClass) {
+			Expect(telemetry.ClassifyError(err)).To(Equal(expected))
+		},
+		Entry("deadline", fmt.Errorf("publish: %w", context.DeadlineExceeded), telemetry.ErrorClassTimeout),
+		Entry("grpc deadline", status.Error(codes.DeadlineExceeded, "slow"), telemetry.ErrorClassTimeout),
+		Entry("grpc permission denied", status.Error(codes.PermissionDenied, "denied"), telemetry.ErrorClassAuth),
+		Entry("aws access denied", awserr.New("AccessDeniedException", "denied", nil), telemetry.ErrorClassAuth),
+		Entry("aws expired token in a request failure", awserr.NewRequestFailure(awserr.New("ExpiredTokenException", "expired", nil), 400, "request-42"), telemetry.ErrorClassAuth),
+		Entry("aws throttling", awserr.New("ProvisionedThroughputExceededException", "slow down", nil), telemetry.ErrorClassOther),
+		Entry("proto", invalidUTF8(), telemetry.ErrorClassSerialization),
+		Entry("json", &json.UnsupportedValueError{Str: "NaN"}, telemetry.ErrorClassSerialization),
+		Entry("grpc unavailable", status.Error(codes.Unavailable, "down"), telemetry.ErrorClassConnection),
+		Entry("connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, telemetry.ErrorClassConnection),
+		Entry("eof", fmt.Errorf("read: %w", io.EOF), telemetry.ErrorClassConnection),
+		Entry("unknown", errors.New("boom"), telemetry.ErrorClassOther),
+	)
+
+	It("ignores nil counters", func() {
+		var counter *telemetry.ProduceErrorCounter
+		Expect(func() { counter.Inc(errors.New("boom")) }).NotTo(Panic())
+	})
+})
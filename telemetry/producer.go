@@ -1,6 +1,7 @@
 package telemetry
 
 import (
+	"context"
 	"fmt"
 
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
@@ -20,6 +21,20 @@ const (
 	Logger Dispatcher = "logger"
 	// ZMQ registers a zmq logger
 	ZMQ Dispatcher = "zmq"
+	// File registers a file writer
+	File Dispatcher = "file"
+	// Redis registers a redis streams producer
+	Redis Dispatcher = "redis"
+	// NATS registers a nats producer
+	NATS Dispatcher = "nats"
+	// S3 registers an s3 archival producer
+	S3 Dispatcher = "s3"
+	// Null registers a producer discarding records, for load tests
+	Null Dispatcher = "null"
+	// Tee registers a producer duplicating records to two other datastores
+	Tee Dispatcher = "tee"
+	// Failover registers a producer writing records to a primary datastore, and to a standby while the primary fails
+	Failover Dispatcher = "failover"
 )
 
 // BuildTopicName creates a topic from a namespace and a recordName
@@ -27,10 +42,31 @@ func BuildTopicName(namespace, recordName string) string {
 	return fmt.Sprintf("%s_%s", namespace, recordName)
 }
 
+// QueueSizer is implemented by producers buffering records before they are written to the datastore
+type QueueSizer interface {
+	QueueSize() int
+}
+
+// ContextProducer is implemented by producers whose writes can be canceled through a context
+type ContextProducer interface {
+	ProduceContext(ctx context.Context, entry *Record) error
+}
+
+// HealthChecker is implemented by producers able to tell whether their datastore is reachable
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// DeliveryReporter is implemented by producers confirming the writes of records asynchronously, like kafka
+type DeliveryReporter interface {
+	// OnDelivery calls report with each record once the datastore confirmed it, or with the error it failed with
+	OnDelivery(report func(entry *Record, err error))
+}
+
 // Producer handles dispatching data received from the vehicle
 type Producer interface {
 	Close() error
-	Produce(entry *Record)
+	Produce(entry *Record) error
 	ProcessReliableAck(entry *Record)
 	ReportError(message string, err error, logInfo logrus.LogInfo)
 }
@@ -0,0 +1,36 @@
+package telemetry
+
+import (
+	"sort"
+
+	"github.com/teslamotors/fleet-telemetry/messages"
+)
+
+// ProtocolV1 is the websocket subprotocol of the flatbuffers stream messages sent by current firmware
+const ProtocolV1 = "v1.telemetry.tesla.com"
+
+// ProtocolMetadataKey is the record metadata key holding the subprotocol negotiated by the vehicle
+const ProtocolMetadataKey = "protocol"
+
+// protocolDecoders decode the messages of each supported subprotocol
+var protocolDecoders = map[string]func(msg []byte) (*messages.StreamMessage, error){
+	ProtocolV1: messages.StreamMessageFromBytes,
+}
+
+// SupportedProtocols returns the websocket subprotocols the server can decode, from the most recent
+func SupportedProtocols() []string {
+	protocols := make([]string, 0, len(protocolDecoders))
+	for protocol := range protocolDecoders {
+		protocols = append(protocols, protocol)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(protocols)))
+	return protocols
+}
+
+// decodeStreamMessage decodes msg according to the negotiated subprotocol, vehicles which did not request one use v1
+func (bs *BinarySerializer) decodeStreamMessage(msg []byte) (*messages.StreamMessage, error) {
+	if decode, ok := protocolDecoders[bs.Protocol]; ok {
+		return decode(msg)
+	}
+	return messages.StreamMessageFromBytes(msg)
+}
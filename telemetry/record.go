@@ -5,12 +5,12 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	logrus "github.com/teslamotors/fleet-telemetry/logger"
 	"github.com/teslamotors/fleet-telemetry/protos"
 
-	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -20,13 +20,11 @@ const (
 	SizeLimit = 1000000 // 1mb
 	// https://github.com/protocolbuffers/protobuf-go/blob/6d0a5dbd95005b70501b4cc2c5124dab07a1f4a0/encoding/protojson/well_known_types.go#L591
 	maxSecondsInDuration = 315576000000
+	// FirmwareMetadataKey is the record metadata key holding the firmware version of the vehicle, when known
+	FirmwareMetadataKey = "firmware"
 )
 
 var (
-	jsonOptions = protojson.MarshalOptions{
-		UseEnumNumbers:  false,
-		EmitUnpopulated: true,
-		Indent:          ""}
 	scientificNotationFloatRegex = regexp.MustCompile(`^[+-]?(\d*\.\d+|\d+\.\d*)([eE][+-]?\d+)$`)
 )
 
@@ -35,6 +33,8 @@ var (
 type Record struct {
 	ProduceTime            time.Time
 	ReceivedTimestamp      int64
+	ServerReceivedAt       time.Time
+	SourceIP               string
 	Serializer             *BinarySerializer
 	SocketID               string
 	Timestamp              int64
@@ -46,9 +46,16 @@ type Record struct {
 	PayloadBytes           []byte
 	RawBytes               []byte
 	transmitDecodedRecords bool
+	encoding               PayloadFormat
 	protoMessage           proto.Message
+	extraMetadata          map[string]string
+	pendingAcks            *pendingAcks
+	correlationID          uint64
 }
 
+// lastCorrelationID is the correlation id given to the last record
+var lastCorrelationID atomic.Uint64
+
 // NewRecord Sanitizes and instantiates a Record from a message
 // !! caller expect *Record to not be nil !!
 func NewRecord(ts *BinarySerializer, msg []byte, socketID string, transmitDecodedRecords bool) (*Record, error) {
@@ -61,8 +68,12 @@ func NewRecord(ts *BinarySerializer, msg []byte, socketID string, transmitDecode
 	if err != nil {
 		return rec, err
 	}
-	err = rec.applyRecordTransforms()
-	return rec, err
+	if err = rec.applyRecordTransforms(); err != nil {
+		return rec, err
+	}
+	// hashed once, the metadata of the record is built for each datastore
+	rec.AddMetadata(IdempotencyKeyMetadataKey, rec.IdempotencyKey())
+	return rec, nil
 }
 
 // Ack returns an ack response from the serializer
@@ -84,9 +95,159 @@ func (record *Record) Metadata() map[string]string {
 	metadata["txid"] = record.Txid
 	metadata["txtype"] = record.TxType
 	metadata["version"] = fmt.Sprint(record.Version)
+	if !record.ServerReceivedAt.IsZero() {
+		metadata["serverreceivedat"] = fmt.Sprint(record.ServerReceivedAt.UnixMilli())
+	}
+	if record.SourceIP != "" {
+		metadata["sourceip"] = record.SourceIP
+	}
+	for key, value := range record.extraMetadata {
+		metadata[key] = value
+	}
+	// records created by the server store their key, only records built by hand are hashed here
+	if _, ok := metadata[IdempotencyKeyMetadataKey]; !ok {
+		metadata[IdempotencyKeyMetadataKey] = record.IdempotencyKey()
+	}
 	return metadata
 }
 
+// IsReservedMetadataKey reports whether the server sets the key in the metadata of records, metadata coming from
+// other sources must not override it
+func IsReservedMetadataKey(key string) bool {
+	switch key {
+	case "vin", "receivedat", "timestamp", "txid", "txtype", "version", "serverreceivedat", "sourceip", "traceparent", "tracestate",
+		IdempotencyKeyMetadataKey, FirmwareMetadataKey, ProtocolMetadataKey:
+		return true
+	}
+	return false
+}
+
+// AddMetadata adds a key to the record metadata, it overrides built-in keys with the same name
+func (record *Record) AddMetadata(key, value string) {
+	if record.extraMetadata == nil {
+		record.extraMetadata = make(map[string]string)
+	}
+	record.extraMetadata[key] = value
+}
+
+// CorrelationID identifies the record within the process, for instance in the results of a batch write.
+// The id is assigned on first use and shared by clones
+func (record *Record) CorrelationID() uint64 {
+	if id := atomic.LoadUint64(&record.correlationID); id != 0 {
+		return id
+	}
+	atomic.CompareAndSwapUint64(&record.correlationID, 0, lastCorrelationID.Add(1))
+	return atomic.LoadUint64(&record.correlationID)
+}
+
+// pendingAcks counts the datastores which didn't ack or fail a record yet, and keeps the first failure
+type pendingAcks struct {
+	count   atomic.Int32
+	failure atomic.Pointer[error]
+	// group is set on the acks of the copies a datastore like the tee writes on behalf of the record
+	group *ackGroup
+}
+
+// ackGroup releases one ack of its parent once all the copies of a record are acked or failed, it fails the parent
+// when more than maxFailures copies failed
+type ackGroup struct {
+	parent      *pendingAcks
+	failures    atomic.Int32
+	maxFailures int32
+}
+
+func (acks *pendingAcks) fail(err error) {
+	acks.failure.CompareAndSwap(nil, &err)
+	if acks.group != nil {
+		acks.group.failures.Add(1)
+	}
+}
+
+func (acks *pendingAcks) release() bool {
+	if acks.count.Add(-1) != 0 {
+		return false
+	}
+	if acks.group == nil {
+		return true
+	}
+	if acks.group.failures.Load() > acks.group.maxFailures {
+		acks.group.parent.fail(*acks.failure.Load())
+	}
+	return acks.group.parent.release()
+}
+
+// SetPendingAcks sets the number of datastore acks required before acking the record to the vehicle.
+// Clones share the counter
+func (record *Record) SetPendingAcks(count int) {
+	record.pendingAcks = &pendingAcks{}
+	record.pendingAcks.count.Store(int32(count))
+}
+
+// AwaitsAcks returns true if the record is only acked to the vehicle once datastores confirmed it
+func (record *Record) AwaitsAcks() bool {
+	return record.pendingAcks != nil
+}
+
+// ReleaseAck records an ack from a datastore and returns true once all the required acks are received
+func (record *Record) ReleaseAck() bool {
+	if record.pendingAcks == nil {
+		return true
+	}
+	return record.pendingAcks.release()
+}
+
+// FailAck records the failure of a datastore required to ack the record, it still has to be released with
+// ReleaseAck so the record stops waiting for that datastore
+func (record *Record) FailAck(err error) {
+	if record.pendingAcks != nil {
+		record.pendingAcks.fail(err)
+	}
+}
+
+// AckError returns the first failure of the datastores required to ack the record, nil if they all acked it.
+// The failures of copies returned by SplitAcks only count once they exceed the failures their group allows
+func (record *Record) AckError() error {
+	acks := record.pendingAcks
+	if acks == nil {
+		return nil
+	}
+	for acks.group != nil {
+		acks = acks.group.parent
+	}
+	if failure := acks.failure.Load(); failure != nil {
+		return *failure
+	}
+	return nil
+}
+
+// SplitAcks returns copies of a record awaiting acks, which datastores ack on its behalf like a datastore of its own.
+// The record receives one ack once all the copies are acked or failed, it fails unless required copies were written
+func (record *Record) SplitAcks(copies int, required int) []*Record {
+	acks := &pendingAcks{group: &ackGroup{parent: record.pendingAcks, maxFailures: int32(copies - required)}}
+	acks.count.Store(int32(copies))
+	records := make([]*Record, copies)
+	for i := range records {
+		records[i] = record.Clone()
+		records[i].pendingAcks = acks
+	}
+	return records
+}
+
+// Clone returns a shallow copy of the record with its own metadata, payload bytes are shared
+func (record *Record) Clone() *Record {
+	record.CorrelationID()
+	clone := *record
+	clone.extraMetadata = make(map[string]string, len(record.extraMetadata)+1)
+	for key, value := range record.extraMetadata {
+		clone.extraMetadata[key] = value
+	}
+	// the clone keeps the key of the record once its type or payload is changed
+	if _, ok := clone.extraMetadata[IdempotencyKeyMetadataKey]; !ok {
+		clone.extraMetadata[IdempotencyKeyMetadataKey] = record.IdempotencyKey()
+	}
+	return &clone
+}
+
 // Payload returns the bytes of the telemetry record gdata
 func (record *Record) Payload() []byte {
 	return record.PayloadBytes
@@ -100,6 +261,45 @@ func (record *Record) GetJSONPayload() ([]byte, error) {
 	return record.toJSON()
 }
 
+// EncodePayload encodes the decoded record message in the given format.
+// Records without a decoded message return their payload unchanged
+func (record *Record) EncodePayload(format PayloadFormat) ([]byte, error) {
+	if record.protoMessage == nil {
+		return record.Payload(), nil
+	}
+	switch format {
+	case JSONFormat:
+		return record.toJSON()
+	case ProtobufFormat:
+		return proto.Marshal(record.protoMessage)
+	case AvroFormat:
+		return encodeAvro(record.protoMessage), nil
+	default:
+		return nil, fmt.Errorf("invalid payload format: %s", format)
+	}
+}
+
+// Encoding returns the format of the record payload, set by the serializer of the datastore it is sent to
+func (record *Record) Encoding() PayloadFormat {
+	if record.encoding != "" {
+		return record.encoding
+	}
+	return record.payloadFormat()
+}
+
+// SetEncoding sets the format of the payload of a record read back from a datastore, such as a replayed file
+func (record *Record) SetEncoding(format PayloadFormat) {
+	record.encoding = format
+}
+
+// payloadFormat returns the format of the record payload
+func (record *Record) payloadFormat() PayloadFormat {
+	if record.transmitDecodedRecords {
+		return JSONFormat
+	}
+	return ProtobufFormat
+}
+
 // Raw returns the raw telemetry record
 func (record *Record) Raw() []byte {
 	return record.RawBytes
@@ -122,11 +322,12 @@ func (record *Record) Encode() ([]byte, error) {
 	return record.RawBytes, nil
 }
 
-// Dispatch uses the configuration to send records to the list of backends/data stores they belong
-func (record *Record) Dispatch() {
+// Dispatch uses the configuration to send records to the list of backends/data stores they belong,
+// it returns ErrUnroutedRecord for records without dispatch rule when the unrouted policy is error
+func (record *Record) Dispatch() error {
 	logger := record.Serializer.Logger()
 	logger.Log(logrus.DEBUG, "dispatching_message", logrus.LogInfo{"socket_id": record.SocketID, "payload": record.Raw()})
-	record.Serializer.Dispatch(record)
+	return record.Serializer.Dispatch(record)
 }
 
 func (record *Record) ensureEncoded() {
@@ -141,6 +342,9 @@ func (record *Record) applyProtoRecordTransforms() error {
 		message := &protos.VehicleAlerts{}
 		err := proto.Unmarshal(record.Payload(), message)
 		if err != nil {
+			return &PayloadDecodeError{TxType: record.TxType, Err: err}
+		}
+		if err := record.verifyVIN(message.Vin); err != nil {
 			return err
 		}
 		message.Vin = record.Vin
@@ -152,6 +356,9 @@ func (record *Record) applyProtoRecordTransforms() error {
 		message := &protos.VehicleErrors{}
 		err := proto.Unmarshal(record.Payload(), message)
 		if err != nil {
+			return &PayloadDecodeError{TxType: record.TxType, Err: err}
+		}
+		if err := record.verifyVIN(message.Vin); err != nil {
 			return err
 		}
 		message.Vin = record.Vin
@@ -162,9 +369,15 @@ func (record *Record) applyProtoRecordTransforms() error {
 		message := &protos.Payload{}
 		err := proto.Unmarshal(record.Payload(), message)
 		if err != nil {
+			return &PayloadDecodeError{TxType: record.TxType, Err: err}
+		}
+		if err := record.verifyVIN(message.Vin); err != nil {
 			return err
 		}
 		message.Vin = record.Vin
+		if version := firmwareVersion(message); version != "" {
+			record.AddMetadata(FirmwareMetadataKey, version)
+		}
 		transformLocation(message)
 		transformScientificNotation(message)
 		record.PayloadBytes, err = proto.Marshal(message)
@@ -174,7 +387,7 @@ func (record *Record) applyProtoRecordTransforms() error {
 		message := &protos.VehicleConnectivity{}
 		err := proto.Unmarshal(record.Payload(), message)
 		if err != nil {
-			return err
+			return &PayloadDecodeError{TxType: record.TxType, Err: err}
 		}
 		record.PayloadBytes, err = proto.Marshal(message)
 		record.protoMessage = message
@@ -184,6 +397,14 @@ func (record *Record) applyProtoRecordTransforms() error {
 	}
 }
 
+// verifyVIN checks the vin of the payload before it is replaced by the one of the certificate
+func (record *Record) verifyVIN(vin string) error {
+	if record.Serializer == nil {
+		return nil
+	}
+	return record.Serializer.verifyVIN(vin)
+}
+
 func (record *Record) applyRecordTransforms() error {
 	var err error
 	if err = record.applyProtoRecordTransforms(); err != nil {
@@ -201,9 +422,62 @@ func (record *Record) GetProtoMessage() proto.Message {
 	return record.protoMessage
 }
 
-// ToJSON serializes the record to a JSON data in bytes
+// ToJSON serializes the record to a JSON data in bytes, with the json options of its serializer
 func (record *Record) toJSON() ([]byte, error) {
-	return jsonOptions.Marshal(record.protoMessage)
+	if record.Serializer != nil && record.Serializer.JSON != nil {
+		return record.Serializer.JSON.Marshal(record.protoMessage)
+	}
+	return DefaultJSONSerializer.Marshal(record.protoMessage)
+}
+
+// CreatedAt returns the time the vehicle created the payload, false if the payload was not decoded or has no created_at
+func (record *Record) CreatedAt() (time.Time, bool) {
+	message, ok := record.protoMessage.(interface{ GetCreatedAt() *timestamppb.Timestamp })
+	if !ok || message.GetCreatedAt() == nil {
+		return time.Time{}, false
+	}
+	return message.GetCreatedAt().AsTime(), true
+}
+
+// FirmwareVersion returns the firmware version of the vehicle, empty if the record didn't carry it
+func (record *Record) FirmwareVersion() string {
+	return record.extraMetadata[FirmwareMetadataKey]
+}
+
+// firmwareVersion returns the value of the Version field of the payload, vehicles only send it when it is configured
+func firmwareVersion(message *protos.Payload) string {
+	for _, datum := range message.Data {
+		if datum.GetKey() == protos.Field_Version {
+			return datum.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
+
+// minFirmwareYear is the oldest year of the firmware versions counted in their own bucket
+const minFirmwareYear = 2018
+
+// FirmwareBucket keeps the year and week of firmware versions such as "2024.14.3 abcd" to bound the
+// cardinality of metrics, "unknown" stands for absent versions and "other" for unexpected formats. Versions are
+// sent by the vehicles, so years outside of 2018 to next year and weeks outside of 1 to 53 are "other" too
+func FirmwareBucket(version string) string {
+	fields := strings.Fields(version)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	parts := strings.SplitN(fields[0], ".", 3)
+	if len(parts) < 2 {
+		return "other"
+	}
+	year, err := strconv.Atoi(parts[0])
+	if err != nil || year < minFirmwareYear || year > time.Now().Year()+1 {
+		return "other"
+	}
+	week, err := strconv.Atoi(parts[1])
+	if err != nil || week < 1 || week > 53 {
+		return "other"
+	}
+	return fmt.Sprintf("%d.%d", year, week)
 }
 
 // transformLocation does a best-effort attempt to convert the Location field to a proper protos.Location
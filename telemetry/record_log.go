@@ -0,0 +1,58 @@
+package telemetry
+
+import (
+	"hash/maphash"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+)
+
+// RecordLogProducer wraps a producer and logs a sample of the records produced to the dispatcher with the
+// outcome of the produce call. Records are sampled by txid, so a sampled record is logged for each of its routes
+type RecordLogProducer struct {
+	Producer
+	dispatcher Dispatcher
+	sampleRate float64
+	logger     *logrus.Logger
+}
+
+// recordLogSeed is shared by the producers of every dispatcher, so they sample the same records
+var recordLogSeed = maphash.MakeSeed()
+
+// NewRecordLogProducer returns a producer logging the fraction sampleRate, between 0 and 1, of the records sent to producer
+func NewRecordLogProducer(producer Producer, dispatcher Dispatcher, sampleRate float64, logger *logrus.Logger) Producer {
+	return &RecordLogProducer{
+		Producer:   producer,
+		dispatcher: dispatcher,
+		sampleRate: sampleRate,
+		logger:     logger,
+	}
+}
+
+// Produce sends the record to the wrapped producer and logs it if sampled. Only the identifiers and
+// size of the record are logged, its payload is never decoded
+func (p *RecordLogProducer) Produce(entry *Record) error {
+	err := p.Producer.Produce(entry)
+	if !p.sampled(entry) {
+		return err
+	}
+
+	logInfo := logrus.LogInfo{
+		"vin":         entry.Vin,
+		"txid":        entry.Txid,
+		"record_type": entry.TxType,
+		"size":        entry.Length(),
+		"dispatcher":  string(p.dispatcher),
+		"result":      "produced",
+	}
+	if err != nil {
+		logInfo["result"] = "error"
+		logInfo["error"] = err.Error()
+	}
+	p.logger.Log(logrus.INFO, "record_sampled", logInfo)
+	return err
+}
+
+func (p *RecordLogProducer) sampled(entry *Record) bool {
+	hash := maphash.String(recordLogSeed, entry.Vin+entry.Txid)
+	return float64(hash>>11)/(1<<53) < p.sampleRate
+}
@@ -0,0 +1,79 @@
+package telemetry_test
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("RecordLogProducer", func() {
+	var (
+		logger *logrus.Logger
+		hook   *test.Hook
+	)
+
+	BeforeEach(func() {
+		logger, hook = logrus.NoOpLogger()
+	})
+
+	produce := func(producer telemetry.Producer, count int) {
+		for i := 0; i < count; i++ {
+			_ = producer.Produce(&telemetry.Record{Vin: "vin", Txid: fmt.Sprintf("txid-%d", i), TxType: "V", PayloadBytes: []byte("data")})
+		}
+	}
+
+	It("logs every record produced with a sample rate of 1", func() {
+		producer := telemetry.NewRecordLogProducer(&RecordingProducer{}, telemetry.Kafka, 1, logger)
+		produce(producer, 10)
+
+		Expect(hook.AllEntries()).To(HaveLen(10))
+		entry := hook.LastEntry()
+		Expect(entry.Message).To(Equal("record_sampled"))
+		Expect(entry.Data).To(HaveKeyWithValue("vin", "vin"))
+		Expect(entry.Data).To(HaveKeyWithValue("txid", "txid-9"))
+		Expect(entry.Data).To(HaveKeyWithValue("record_type", "V"))
+		Expect(entry.Data).To(HaveKeyWithValue("size", 4))
+		Expect(entry.Data).To(HaveKeyWithValue("dispatcher", "kafka"))
+		Expect(entry.Data).To(HaveKeyWithValue("result", "produced"))
+	})
+
+	It("logs the produce error", func() {
+		producer := telemetry.NewRecordLogProducer(&RecordingProducer{err: errors.New("throttled")}, telemetry.Kinesis, 1, logger)
+		produce(producer, 1)
+
+		Expect(hook.LastEntry().Data).To(HaveKeyWithValue("result", "error"))
+		Expect(hook.LastEntry().Data).To(HaveKeyWithValue("error", "throttled"))
+	})
+
+	It("logs nothing with a sample rate of 0", func() {
+		producer := telemetry.NewRecordLogProducer(&RecordingProducer{}, telemetry.Kafka, 0, logger)
+		produce(producer, 100)
+
+		Expect(hook.AllEntries()).To(BeEmpty())
+	})
+
+	It("logs about the sample rate of the records", func() {
+		producer := telemetry.NewRecordLogProducer(&RecordingProducer{}, telemetry.Kafka, 0.1, logger)
+		produce(producer, 10000)
+
+		Expect(len(hook.AllEntries())).To(BeNumerically("~", 1000, 150))
+	})
+
+	It("samples the same records for each dispatcher", func() {
+		produce(telemetry.NewRecordLogProducer(&RecordingProducer{}, telemetry.Kafka, 0.1, logger), 1000)
+		kafkaEntries := hook.AllEntries()
+		hook.Reset()
+		produce(telemetry.NewRecordLogProducer(&RecordingProducer{}, telemetry.Kinesis, 0.1, logger), 1000)
+
+		Expect(hook.AllEntries()).To(HaveLen(len(kafkaEntries)))
+		for i, entry := range hook.AllEntries() {
+			Expect(entry.Data["txid"]).To(Equal(kafkaEntries[i].Data["txid"]))
+		}
+	})
+})
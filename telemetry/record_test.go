@@ -1,7 +1,10 @@
 package telemetry_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"sort"
 	"time"
@@ -36,6 +39,50 @@ var _ = Describe("Socket handler test", func() {
 		)
 	})
 
+	It("releases the ack once all datastores acked", func() {
+		record := &telemetry.Record{TxType: "V"}
+		Expect(record.ReleaseAck()).To(BeTrue())
+
+		record.SetPendingAcks(2)
+		clone := record.Clone()
+		Expect(clone.ReleaseAck()).To(BeFalse())
+		Expect(record.ReleaseAck()).To(BeTrue())
+	})
+
+	It("releases one ack once all the copies of a split record are released", func() {
+		record := &telemetry.Record{TxType: "V"}
+		record.SetPendingAcks(2)
+		copies := record.SplitAcks(2, 1)
+		Expect(copies).To(HaveLen(2))
+		Expect(copies[0].CorrelationID()).To(Equal(record.CorrelationID()))
+
+		copies[0].FailAck(errors.New("broker down"))
+		Expect(copies[0].ReleaseAck()).To(BeFalse())
+		Expect(copies[1].ReleaseAck()).To(BeFalse())
+		Expect(record.AckError()).NotTo(HaveOccurred())
+		Expect(record.ReleaseAck()).To(BeTrue())
+	})
+
+	It("fails a split record once more copies failed than allowed", func() {
+		record := &telemetry.Record{TxType: "V"}
+		record.SetPendingAcks(1)
+		copies := record.SplitAcks(2, 2)
+
+		copies[1].FailAck(errors.New("no responders"))
+		Expect(copies[1].ReleaseAck()).To(BeFalse())
+		Expect(copies[0].ReleaseAck()).To(BeTrue())
+		Expect(record.AckError()).To(MatchError("no responders"))
+		Expect(copies[0].AckError()).To(MatchError("no responders"))
+	})
+
+	It("identifies records with a correlation id shared by clones", func() {
+		record := &telemetry.Record{TxType: "V"}
+		other := &telemetry.Record{TxType: "V"}
+		Expect(record.CorrelationID()).NotTo(BeZero())
+		Expect(record.CorrelationID()).NotTo(Equal(other.CorrelationID()))
+		Expect(record.Clone().CorrelationID()).To(Equal(record.CorrelationID()))
+	})
+
 	It("validates the message size", func() {
 		raw := make([]byte, telemetry.SizeLimit+1)
 		_, _ = rand.Read(raw)
@@ -46,6 +93,47 @@ var _ = Describe("Socket handler test", func() {
 		Expect(record.Serializer).NotTo(BeNil())
 	})
 
+	It("returns a decode error for invalid payloads", func() {
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: []byte{0xff, 0xff}}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = telemetry.NewRecord(serializer, recordMsg, "1", false)
+		var decodeErr *telemetry.PayloadDecodeError
+		Expect(errors.As(err, &decodeErr)).To(BeTrue())
+		Expect(decodeErr.TxType).To(Equal("V"))
+	})
+
+	Describe("gzip payloads", func() {
+		gzipRecord := func(payload []byte) []byte {
+			var buffer bytes.Buffer
+			writer := gzip.NewWriter(&buffer)
+			_, err := writer.Write(payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+
+			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: buffer.Bytes()}
+			recordMsg, err := message.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			return recordMsg
+		}
+
+		It("decompresses the payload", func() {
+			record, err := telemetry.NewRecord(serializer, gzipRecord(generatePayload("cybertruck", "42", nil)), "1", false)
+			Expect(err).NotTo(HaveOccurred())
+
+			data, ok := record.GetProtoMessage().(*protos.Payload)
+			Expect(ok).To(BeTrue())
+			Expect(data.Data[0].GetValue().GetStringValue()).To(Equal("cybertruck"))
+		})
+
+		It("rejects payloads above the max decompressed size", func() {
+			serializer.MaxDecompressedSize = 1000
+			_, err := telemetry.NewRecord(serializer, gzipRecord(make([]byte, 1001)), "1", false)
+			Expect(err).To(MatchError(telemetry.ErrDecompressedMessageTooBig))
+		})
+	})
+
 	It("includes vin in body", func() {
 		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil)}
 		recordMsg, err := message.ToBytes()
@@ -62,6 +150,119 @@ var _ = Describe("Socket handler test", func() {
 		Expect(data.Vin).To(Equal("42"))
 	})
 
+	It("computes the idempotency key once created", func() {
+		message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil)}
+		recordMsg, err := message.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+		Expect(err).NotTo(HaveOccurred())
+		key := telemetry.IdempotencyKey(record.Vin, record.TxType, record.Timestamp, record.Payload())
+		Expect(record.IdempotencyKey()).To(Equal(key))
+
+		record.PayloadBytes = []byte("edited")
+		Expect(record.IdempotencyKey()).To(Equal(key))
+		Expect(record.Metadata()).To(HaveKeyWithValue(telemetry.IdempotencyKeyMetadataKey, key))
+	})
+
+	Describe("vin enforcement", func() {
+		vinRecord := func(vin string) []byte {
+			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", vin, nil)}
+			recordMsg, err := message.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			return recordMsg
+		}
+
+		It("overwrites a mismatched payload vin when not enforced", func() {
+			record, err := telemetry.NewRecord(serializer, vinRecord("43"), "1", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.GetProtoMessage().(*protos.Payload).Vin).To(Equal("42"))
+		})
+
+		It("rejects a mismatched payload vin when enforced", func() {
+			serializer.EnforceVINCertMatch = true
+			_, err := telemetry.NewRecord(serializer, vinRecord("43"), "1", false)
+			var mismatchErr *telemetry.VINMismatchError
+			Expect(errors.As(err, &mismatchErr)).To(BeTrue())
+			Expect(mismatchErr.CertVIN).To(Equal("42"))
+			Expect(mismatchErr.ReceivedVIN).To(Equal("43"))
+		})
+
+		It("accepts a matching or empty payload vin when enforced", func() {
+			serializer.EnforceVINCertMatch = true
+			_, err := telemetry.NewRecord(serializer, vinRecord("42"), "1", false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = telemetry.NewRecord(serializer, vinRecord(""), "1", false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("firmware version", func() {
+		firmwareRecord := func(extraData ...*protos.Datum) *telemetry.Record {
+			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil, extraData...)}
+			recordMsg, err := message.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+			Expect(err).NotTo(HaveOccurred())
+			return record
+		}
+
+		It("adds the version of the payload to the metadata", func() {
+			record := firmwareRecord(stringDatum(protos.Field_Version, "2024.14.3 abcdef"))
+			Expect(record.FirmwareVersion()).To(Equal("2024.14.3 abcdef"))
+			Expect(record.Metadata()).To(HaveKeyWithValue(telemetry.FirmwareMetadataKey, "2024.14.3 abcdef"))
+		})
+
+		It("leaves the metadata alone without a version", func() {
+			record := firmwareRecord()
+			Expect(record.FirmwareVersion()).To(BeEmpty())
+			Expect(record.Metadata()).NotTo(HaveKey(telemetry.FirmwareMetadataKey))
+		})
+
+		DescribeTable("FirmwareBucket",
+			func(version string, expected string) {
+				Expect(telemetry.FirmwareBucket(version)).To(Equal(expected))
+			},
+			Entry("full version", "2024.14.3 abcdef", "2024.14"),
+			Entry("short version", "2024.8", "2024.8"),
+			Entry("absent version", "", "unknown"),
+			Entry("blank version", "  ", "unknown"),
+			Entry("unexpected format", "develop", "other"),
+			Entry("non numeric components", "v11.x", "other"),
+			Entry("leading zeros", "2024.08.1", "2024.8"),
+			Entry("year before the known versions", "11.2", "other"),
+			Entry("year in the future", "9999.1", "other"),
+			Entry("week out of range", "2024.99", "other"),
+			Entry("negative week", "2024.-1", "other"),
+		)
+	})
+
+	Describe("CreatedAt", func() {
+		It("returns the creation time of the payload", func() {
+			createdAt := time.Unix(1700000000, 0)
+			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", timestamppb.New(createdAt))}
+			recordMsg, err := message.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+			Expect(err).NotTo(HaveOccurred())
+
+			recordCreatedAt, ok := record.CreatedAt()
+			Expect(ok).To(BeTrue())
+			Expect(recordCreatedAt).To(BeTemporally("==", createdAt))
+		})
+
+		It("reports payloads without creation time", func() {
+			message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil)}
+			recordMsg, err := message.ToBytes()
+			Expect(err).NotTo(HaveOccurred())
+			record, err := telemetry.NewRecord(serializer, recordMsg, "1", false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, ok := record.CreatedAt()
+			Expect(ok).To(BeFalse())
+		})
+	})
+
 	It("transforms a valid string location", func() {
 		loc := stringDatum(protos.Field_Location, "(37.412374 N, 122.145867 W)")
 		expected := &protos.LocationValue{Latitude: 37.412374, Longitude: -122.145867}
@@ -344,6 +545,30 @@ var _ = Describe("Socket handler test", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(record.Payload()).To(Equal(data))
 		})
+
+		Describe("enums", func() {
+			chargeState := &protos.Datum{Key: protos.Field_DetailedChargeState, Value: &protos.Value{Value: &protos.Value_DetailedChargeStateValue{
+				DetailedChargeStateValue: protos.DetailedChargeStateValue_DetailedChargeStateCharging,
+			}}}
+
+			encodeChargeState := func() string {
+				message := messages.StreamMessage{TXID: []byte("1234"), SenderID: []byte("vehicle_device.42"), MessageTopic: []byte("V"), Payload: generatePayload("cybertruck", "42", nil, chargeState)}
+				recordMsg, err := message.ToBytes()
+				Expect(err).NotTo(HaveOccurred())
+				record, err := telemetry.NewRecord(serializer, recordMsg, "1", true)
+				Expect(err).NotTo(HaveOccurred())
+				return string(record.Payload())
+			}
+
+			It("renders enums as names by default", func() {
+				Expect(encodeChargeState()).To(MatchJSON(`{"data":[{"key":"VehicleName","value":{"stringValue":"cybertruck"}},{"key":"DetailedChargeState","value":{"detailedChargeStateValue":"DetailedChargeStateCharging"}}],"createdAt":null,"vin":"42"}`))
+			})
+
+			It("renders enums, field keys included, as numbers unless enums as strings is set", func() {
+				serializer.JSON = &telemetry.JSONSerializer{EnumsAsStrings: false}
+				Expect(encodeChargeState()).To(MatchJSON(`{"data":[{"key":64,"value":{"stringValue":"cybertruck"}},{"key":179,"value":{"detailedChargeStateValue":4}}],"createdAt":null,"vin":"42"}`))
+			})
+		})
 	})
 })
 
@@ -0,0 +1,134 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/teslamotors/fleet-telemetry/metrics"
+)
+
+// unroutedRecordType labels the dispatch metrics of records without dispatch rule, their type is set by the vehicle
+const unroutedRecordType = "unrouted"
+
+// UnroutedPolicy decides what happens to the records whose type has no dispatch rule
+type UnroutedPolicy string
+
+const (
+	// UnroutedDrop drops the records, they are only counted in unrouted_records_total
+	UnroutedDrop UnroutedPolicy = "drop"
+	// UnroutedDropMetric drops the records and also counts them in dispatch_dropped_total, it is the default
+	UnroutedDropMetric UnroutedPolicy = "drop+metric"
+	// UnroutedError drops the records and responds to the vehicle with an error
+	UnroutedError UnroutedPolicy = "error"
+	// UnroutedDefaultRoute dispatches the records to a fallback datastore
+	UnroutedDefaultRoute UnroutedPolicy = "default-route"
+)
+
+// Validate returns an error for unknown policies
+func (p UnroutedPolicy) Validate() error {
+	switch p {
+	case "", UnroutedDrop, UnroutedDropMetric, UnroutedError, UnroutedDefaultRoute:
+		return nil
+	default:
+		return fmt.Errorf("invalid unrouted_policy: %s", p)
+	}
+}
+
+// ErrUnroutedRecord is returned when dispatching a record without dispatch rule with the error policy
+var ErrUnroutedRecord = errors.New("no datastore configured for the record type")
+
+// knownRecordTypes are the record types sent by vehicles, unrouted records of other types are counted as unknown
+// since their type is set by the vehicle
+var knownRecordTypes = map[string]bool{"V": true, "alerts": true, "errors": true, "connectivity": true}
+
+// Router holds the dispatch rules of the server, they can be swapped while connections are active
+type Router struct {
+	rules          atomic.Pointer[map[string][]Producer]
+	unroutedPolicy UnroutedPolicy
+	defaultRoute   []Producer
+}
+
+// NewRouter returns a router dispatching with the given rules
+func NewRouter(rules map[string][]Producer, metricsCollector metrics.MetricCollector) *Router {
+	registerMetricsOnce(metricsCollector)
+	router := &Router{}
+	router.Swap(rules)
+	return router
+}
+
+// Rules returns the current dispatch rules
+func (r *Router) Rules() map[string][]Producer {
+	return *r.rules.Load()
+}
+
+// Swap replaces the dispatch rules, records being dispatched keep using the previous rules
+func (r *Router) Swap(rules map[string][]Producer) {
+	r.rules.Store(&rules)
+}
+
+// HandleUnrouted sets the policy applied to records without dispatch rule, defaultRoute are the producers
+// of the default-route policy. It is not safe to call while records are dispatched
+func (r *Router) HandleUnrouted(policy UnroutedPolicy, defaultRoute []Producer) {
+	r.unroutedPolicy = policy
+	r.defaultRoute = defaultRoute
+}
+
+// Dispatch sends the record to the producers of its type. Records are counted per type when received,
+// and for each producer which accepted or rejected them, independently of the datastore metrics.
+// It only returns ErrUnroutedRecord, producer errors are reported by the datastores
+func (r *Router) Dispatch(record *Record) error {
+	_, err := r.dispatch(record)
+	return err
+}
+
+// DispatchWithErrors sends the record like Dispatch and also returns the errors of the producers which rejected it,
+// for callers writing the record again when a datastore failed, such as the kafka consumer mode
+func (r *Router) DispatchWithErrors(record *Record) error {
+	produceErrs, err := r.dispatch(record)
+	if err != nil {
+		return err
+	}
+	return errors.Join(produceErrs...)
+}
+
+// dispatch returns the errors of the producers which rejected the record, and ErrUnroutedRecord
+func (r *Router) dispatch(record *Record) ([]error, error) {
+	producers, ok := r.Rules()[record.TxType]
+	labels := map[string]string{"record_type": record.TxType}
+	if !ok {
+		labels["record_type"] = unroutedRecordType
+		unroutedType := record.TxType
+		if !knownRecordTypes[unroutedType] {
+			unroutedType = "unknown"
+		}
+		metricsRegistry.unroutedCount.Inc(map[string]string{"record_type": unroutedType})
+	}
+	metricsRegistry.dispatchReceivedCount.Inc(labels)
+	if !ok {
+		switch r.unroutedPolicy {
+		case UnroutedDrop:
+			return nil, nil
+		case UnroutedError:
+			metricsRegistry.dispatchDroppedCount.Inc(labels)
+			return nil, ErrUnroutedRecord
+		case UnroutedDefaultRoute:
+			producers = r.defaultRoute
+		}
+	}
+	if len(producers) == 0 {
+		metricsRegistry.dispatchDroppedCount.Inc(labels)
+		return nil, nil
+	}
+
+	var produceErrs []error
+	for _, producer := range producers {
+		if err := producer.Produce(record); err != nil {
+			metricsRegistry.dispatchDroppedCount.Inc(labels)
+			produceErrs = append(produceErrs, err)
+			continue
+		}
+		metricsRegistry.dispatchProducedCount.Inc(labels)
+	}
+	return produceErrs, nil
+}
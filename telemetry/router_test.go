@@ -0,0 +1,73 @@
+package telemetry_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Router", func() {
+	It("dispatches records to every producer of their type", func() {
+		failing := &RecordingProducer{err: errors.New("broker down")}
+		producer := &RecordingProducer{}
+		router := telemetry.NewRouter(map[string][]telemetry.Producer{"V": {failing, producer}}, noop.NewCollector())
+
+		router.Dispatch(&telemetry.Record{TxType: "V"})
+		router.Dispatch(&telemetry.Record{TxType: "unknown"})
+		Expect(failing.records).To(HaveLen(1))
+		Expect(producer.records).To(HaveLen(1))
+	})
+
+	It("returns the producer errors when asked to", func() {
+		failing := &RecordingProducer{err: errors.New("broker down")}
+		producer := &RecordingProducer{}
+		router := telemetry.NewRouter(map[string][]telemetry.Producer{"V": {failing, producer}}, noop.NewCollector())
+
+		Expect(router.Dispatch(&telemetry.Record{TxType: "V"})).To(Succeed())
+		Expect(router.DispatchWithErrors(&telemetry.Record{TxType: "V"})).To(MatchError(ContainSubstring("broker down")))
+		Expect(producer.records).To(HaveLen(2))
+
+		router.HandleUnrouted(telemetry.UnroutedError, nil)
+		Expect(router.DispatchWithErrors(&telemetry.Record{TxType: "alerts"})).To(MatchError(telemetry.ErrUnroutedRecord))
+	})
+
+	DescribeTable("applies the unrouted policy",
+		func(policy telemetry.UnroutedPolicy, expectedErr error, routed int) {
+			defaultRoute := &RecordingProducer{}
+			router := telemetry.NewRouter(map[string][]telemetry.Producer{"V": {&RecordingProducer{}}}, noop.NewCollector())
+			router.HandleUnrouted(policy, []telemetry.Producer{defaultRoute})
+
+			err := router.Dispatch(&telemetry.Record{TxType: "alerts"})
+			if expectedErr != nil {
+				Expect(err).To(MatchError(expectedErr))
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(defaultRoute.records).To(HaveLen(routed))
+			Expect(router.Dispatch(&telemetry.Record{TxType: "V"})).To(Succeed())
+			Expect(defaultRoute.records).To(HaveLen(routed))
+		},
+		Entry("default", telemetry.UnroutedPolicy(""), nil, 0),
+		Entry("drop", telemetry.UnroutedDrop, nil, 0),
+		Entry("drop+metric", telemetry.UnroutedDropMetric, nil, 0),
+		Entry("error", telemetry.UnroutedError, telemetry.ErrUnroutedRecord, 0),
+		Entry("default-route", telemetry.UnroutedDefaultRoute, nil, 1),
+	)
+
+	It("dispatches with the swapped rules", func() {
+		previous := &RecordingProducer{}
+		producer := &RecordingProducer{}
+		router := telemetry.NewRouter(map[string][]telemetry.Producer{"V": {previous}}, noop.NewCollector())
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "42"}, nil, nil)
+		bs.Router = router
+
+		router.Swap(map[string][]telemetry.Producer{"V": {producer}})
+		bs.Dispatch(&telemetry.Record{TxType: "V"})
+		Expect(previous.records).To(BeEmpty())
+		Expect(producer.records).To(HaveLen(1))
+	})
+})
@@ -13,12 +13,24 @@ import (
 type RequestIdentity struct {
 	DeviceID string
 	SenderID string
+	// SourceIP is the address of the vehicle, as seen by the trusted proxy when configured
+	SourceIP string
 }
 
 // BinarySerializer serializes records
 type BinarySerializer struct {
-	DispatchRules   map[string][]Producer
+	DispatchRules map[string][]Producer
+	// Router overrides DispatchRules when set, so the rules can be reloaded during the connection
+	Router          *Router
 	RequestIdentity *RequestIdentity
+	// MaxDecompressedSize is the maximum size in bytes of gzip compressed payloads once decompressed, defaults to SizeLimit
+	MaxDecompressedSize int
+	// EnforceVINCertMatch rejects records whose device id or payload vin differs from the vin of the client certificate
+	EnforceVINCertMatch bool
+	// Protocol is the websocket subprotocol negotiated by the vehicle, empty if it did not request one
+	Protocol string
+	// JSON encodes the payloads of records sent as json, DefaultJSONSerializer is used when nil
+	JSON *JSONSerializer
 
 	logger *logrus.Logger
 }
@@ -41,7 +53,7 @@ func (bs *BinarySerializer) Deserialize(msg []byte, socketID string) (record *Re
 	}()
 
 	record = &Record{Serializer: bs, RawBytes: msg, SocketID: socketID}
-	streamMessage, err := messages.StreamMessageFromBytes(msg)
+	streamMessage, err := bs.decodeStreamMessage(msg)
 	if err != nil {
 		return record, bs.guessError(record, msg)
 	}
@@ -56,9 +68,26 @@ func (bs *BinarySerializer) Deserialize(msg []byte, socketID string) (record *Re
 	record.Txid = string(streamMessage.TXID)
 	record.Vin = string(bs.RequestIdentity.DeviceID)
 	record.PayloadBytes = streamMessage.Payload
-	record.ReceivedTimestamp = time.Now().Unix() * 1000
+	record.ServerReceivedAt = time.Now()
+	record.ReceivedTimestamp = record.ServerReceivedAt.Unix() * 1000
+	record.SourceIP = bs.RequestIdentity.SourceIP
+	if bs.Protocol != "" {
+		record.AddMetadata(ProtocolMetadataKey, bs.Protocol)
+	}
+	if err := bs.verifyVIN(string(streamMessage.DeviceID)); err != nil {
+		return record, err
+	}
+	record.Timestamp = int64(streamMessage.CreatedAt) * 1000
+
+	if isGzip(record.PayloadBytes) {
+		payload, decompressErr := gunzip(record.PayloadBytes, bs.maxDecompressedSize())
+		if decompressErr != nil {
+			return record, decompressErr
+		}
+		record.PayloadBytes = payload
+	}
 
-	if _, ok := bs.DispatchRules[streamMessage.Topic()]; ok {
+	if _, ok := bs.dispatchRules()[streamMessage.Topic()]; ok {
 		return record, nil
 	}
 
@@ -70,6 +99,21 @@ func (bs *BinarySerializer) Deserialize(msg []byte, socketID string) (record *Re
 	return record, err
 }
 
+// verifyVIN checks a vin sent by the vehicle against the one of its certificate when enforced, empty vins are not checked
+func (bs *BinarySerializer) verifyVIN(vin string) error {
+	if !bs.EnforceVINCertMatch || vin == "" || vin == bs.RequestIdentity.DeviceID {
+		return nil
+	}
+	return &VINMismatchError{CertVIN: bs.RequestIdentity.DeviceID, ReceivedVIN: vin}
+}
+
+func (bs *BinarySerializer) maxDecompressedSize() int {
+	if bs.MaxDecompressedSize > 0 {
+		return bs.MaxDecompressedSize
+	}
+	return SizeLimit
+}
+
 // Ack returns an ack response
 func (bs *BinarySerializer) Ack(record *Record) []byte {
 	ackMessage := messages.StreamAckMessage{TXID: []byte(record.Txid), MessageTopic: []byte(record.TxType)}
@@ -84,11 +128,22 @@ func (bs *BinarySerializer) Error(err error, record *Record) []byte {
 	return b
 }
 
-// Dispatch pushes the record to kafka for every rule associated to it
-func (bs *BinarySerializer) Dispatch(record *Record) {
-	for _, producer := range bs.DispatchRules[record.TxType] {
-		producer.Produce(record)
+// Dispatch pushes the record to kafka for every rule associated to it, see Router.Dispatch for the error
+func (bs *BinarySerializer) Dispatch(record *Record) error {
+	if bs.Router != nil {
+		return bs.Router.Dispatch(record)
+	}
+	for _, producer := range bs.dispatchRules()[record.TxType] {
+		_ = producer.Produce(record)
+	}
+	return nil
+}
+
+func (bs *BinarySerializer) dispatchRules() map[string][]Producer {
+	if bs.Router != nil {
+		return bs.Router.Rules()
 	}
+	return bs.DispatchRules
 }
 
 // Logger returns logger for the serializer
@@ -2,7 +2,9 @@ package telemetry_test
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -22,8 +24,9 @@ func (c *CallbackTester) Close() error {
 	return nil
 }
 
-func (c *CallbackTester) Produce(_ *telemetry.Record) {
+func (c *CallbackTester) Produce(_ *telemetry.Record) error {
 	c.counter++
+	return nil
 }
 
 func (c *CallbackTester) ProcessReliableAck(_ *telemetry.Record) {
@@ -181,6 +184,8 @@ var _ = Describe("BinarySerializer", func() {
 			Expect(gotRecord.ReceivedTimestamp).NotTo(Equal(0))
 
 			gotRecord.ReceivedTimestamp = 0
+			Expect(gotRecord.ServerReceivedAt).To(BeTemporally("~", time.Now(), time.Second))
+			gotRecord.ServerReceivedAt = time.Time{}
 			tt.wantRecord.Serializer = bs
 			Expect(gotRecord.RawBytes).NotTo(BeEmpty())
 			Expect(reflect.DeepEqual(gotRecord.RawBytes, msgBytes)).To(BeFalse())
@@ -226,6 +231,78 @@ var _ = Describe("BinarySerializer", func() {
 		Expect(CallbackTester.errors).To(Equal(0))
 	})
 
+	It("Sets the record timestamp from the message creation time", func() {
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "VIN42", SenderID: "client_type.VIN42"}, DispatchRules, nil)
+		msg := messages.StreamMessage{
+			MessageTopic: []byte("T"),
+			TXID:         []byte("test-42"),
+			Payload:      []byte("disiz a test"),
+			SenderID:     []byte("client_type.VIN42"),
+			CreatedAt:    1700000000,
+		}
+
+		msgBytes, err := msg.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Timestamp).To(Equal(int64(1700000000000)))
+		Expect(record.Metadata()).To(HaveKeyWithValue("timestamp", "1700000000000"))
+	})
+
+	It("Stamps the server receive time and source ip in the record metadata", func() {
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "VIN42", SenderID: "client_type.VIN42", SourceIP: "203.0.113.7"}, DispatchRules, nil)
+		msg := messages.StreamMessage{
+			MessageTopic: []byte("T"),
+			TXID:         []byte("test-42"),
+			Payload:      []byte("disiz a test"),
+			SenderID:     []byte("client_type.VIN42"),
+		}
+
+		msgBytes, err := msg.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		record, err := bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.SourceIP).To(Equal("203.0.113.7"))
+		Expect(record.Metadata()).To(HaveKeyWithValue("sourceip", "203.0.113.7"))
+		Expect(record.Metadata()).To(HaveKeyWithValue("serverreceivedat", fmt.Sprint(record.ServerReceivedAt.UnixMilli())))
+	})
+
+	It("Records the negotiated subprotocol in the record metadata", func() {
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "VIN42", SenderID: "client_type.VIN42"}, DispatchRules, nil)
+		msg := messages.StreamMessage{MessageTopic: []byte("T"), TXID: []byte("test-42"), Payload: []byte("disiz a test"), SenderID: []byte("client_type.VIN42")}
+		msgBytes, err := msg.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		record, err := bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Metadata()).NotTo(HaveKey(telemetry.ProtocolMetadataKey))
+
+		bs.Protocol = telemetry.ProtocolV1
+		record, err = bs.Deserialize(msgBytes, "Socket-42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.Payload()).To(Equal([]byte("disiz a test")))
+		Expect(record.Metadata()).To(HaveKeyWithValue(telemetry.ProtocolMetadataKey, telemetry.ProtocolV1))
+	})
+
+	It("Rejects a device id other than the certificate vin when enforced", func() {
+		bs := telemetry.NewBinarySerializer(&telemetry.RequestIdentity{DeviceID: "VIN42", SenderID: "client_type.VIN42"}, DispatchRules, nil)
+		bs.EnforceVINCertMatch = true
+		msg := messages.StreamMessage{
+			MessageTopic: []byte("T"),
+			TXID:         []byte("test-42"),
+			Payload:      []byte("disiz a test"),
+			SenderID:     []byte("client_type.VIN42"),
+			DeviceID:     []byte("VIN43"),
+		}
+
+		msgBytes, err := msg.ToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = bs.Deserialize(msgBytes, "Socket-42")
+		var mismatchErr *telemetry.VINMismatchError
+		Expect(errors.As(err, &mismatchErr)).To(BeTrue())
+		Expect(mismatchErr.ReceivedVIN).To(Equal("VIN43"))
+	})
+
 	It("Detects unknown types", func() {
 		bs := &telemetry.BinarySerializer{DispatchRules: DispatchRules}
 
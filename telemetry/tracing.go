@@ -0,0 +1,78 @@
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/teslamotors/fleet-telemetry"
+
+// StartSpan starts a span which is a child of the span in ctx, if any.
+// Spans are only exported once a tracer provider is registered
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan records err on the span, if any, and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectTraceContext adds the trace context of ctx to the record metadata, so datastores carry it in their headers
+func (record *Record) InjectTraceContext(ctx context.Context) {
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier{record})
+}
+
+// StartSpan starts a span which is a child of the trace context in the record metadata
+func (record *Record) StartSpan(name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), metadataCarrier{record})
+	return StartSpan(ctx, name, attributes...)
+}
+
+// metadataCarrier reads and writes trace context keys in the record metadata
+type metadataCarrier struct {
+	record *Record
+}
+
+func (c metadataCarrier) Get(key string) string {
+	return c.record.extraMetadata[key]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	c.record.AddMetadata(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.record.extraMetadata))
+	for key := range c.record.extraMetadata {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// TracingProducer wraps a producer and records a span around each record produced to the dispatcher
+type TracingProducer struct {
+	Producer
+	dispatcher Dispatcher
+}
+
+// NewTracingProducer returns a producer tracing the records sent to producer
+func NewTracingProducer(producer Producer, dispatcher Dispatcher) Producer {
+	return &TracingProducer{Producer: producer, dispatcher: dispatcher}
+}
+
+// Produce sends the record to the wrapped producer within a span
+func (p *TracingProducer) Produce(entry *Record) error {
+	_, span := entry.StartSpan("datastore.produce", attribute.String("dispatcher", string(p.dispatcher)), attribute.String("record_type", entry.TxType))
+	err := p.Producer.Produce(entry)
+	EndSpan(span, err)
+	return err
+}
@@ -0,0 +1,77 @@
+package telemetry_test
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		recorder *tracetest.SpanRecorder
+		record   *telemetry.Record
+	)
+
+	BeforeEach(func() {
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		DeferCleanup(func() {
+			otel.SetTracerProvider(trace.NewNoopTracerProvider())
+			otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+		})
+		record = &telemetry.Record{TxType: "V", Vin: "VIN42"}
+	})
+
+	It("carries the trace context in the record metadata", func() {
+		ctx, span := telemetry.StartSpan(context.Background(), "record.ingest")
+		record.InjectTraceContext(ctx)
+		span.End()
+
+		Expect(record.Metadata()).To(HaveKey("traceparent"))
+		_, child := record.StartSpan("record.ack")
+		child.End()
+
+		spans := recorder.Ended()
+		Expect(spans).To(HaveLen(2))
+		Expect(spans[1].Name()).To(Equal("record.ack"))
+		Expect(spans[1].Parent().SpanID()).To(Equal(spans[0].SpanContext().SpanID()))
+	})
+
+	It("records a span around each produced record", func() {
+		ctx, span := telemetry.StartSpan(context.Background(), "record.ingest")
+		record.InjectTraceContext(ctx)
+		span.End()
+
+		producer := telemetry.NewTracingProducer(&RecordingProducer{err: errors.New("throttled")}, telemetry.Kinesis)
+		Expect(producer.Produce(record)).To(MatchError("throttled"))
+
+		spans := recorder.Ended()
+		Expect(spans).To(HaveLen(2))
+		produceSpan := spans[1]
+		Expect(produceSpan.Name()).To(Equal("datastore.produce"))
+		Expect(produceSpan.Parent().SpanID()).To(Equal(spans[0].SpanContext().SpanID()))
+		Expect(produceSpan.Attributes()).To(ContainElement(attribute.String("dispatcher", "kinesis")))
+		Expect(produceSpan.Status().Code).To(Equal(codes.Error))
+	})
+
+	It("leaves the metadata untouched without propagator", func() {
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+		ctx, span := telemetry.StartSpan(context.Background(), "record.ingest")
+		record.InjectTraceContext(ctx)
+		span.End()
+
+		Expect(record.Metadata()).NotTo(HaveKey("traceparent"))
+	})
+})
@@ -0,0 +1,31 @@
+package telemetry
+
+import (
+	"sync"
+
+	"github.com/teslamotors/fleet-telemetry/protos"
+)
+
+// TransformFunc modifies a decoded V payload before it is sent to a datastore.
+// The payload is a copy owned by the transform, returning an error drops the record for the datastore
+type TransformFunc func(payload *protos.Payload) (*protos.Payload, error)
+
+var (
+	transforms     = make(map[string]TransformFunc)
+	transformsLock sync.RWMutex
+)
+
+// RegisterTransform makes a transform available to datastore configs under name.
+// It needs to be called before the producers are configured, registering a name twice replaces the transform
+func RegisterTransform(name string, transform TransformFunc) {
+	transformsLock.Lock()
+	defer transformsLock.Unlock()
+	transforms[name] = transform
+}
+
+func lookupTransform(name string) (TransformFunc, bool) {
+	transformsLock.RLock()
+	defer transformsLock.RUnlock()
+	transform, ok := transforms[name]
+	return transform, ok
+}
@@ -0,0 +1,277 @@
+// Package loadtest simulates vehicles streaming records to a fleet-telemetry server over websockets, to benchmark
+// the ingest pipeline. Routing the records to the null datastore isolates the throughput of the server
+package loadtest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/teslamotors/fleet-telemetry/messages"
+	"github.com/teslamotors/fleet-telemetry/messages/tesla"
+	"github.com/teslamotors/fleet-telemetry/protos"
+)
+
+// defaultAckTimeout is how long clients wait for the acks of their last records when not configured
+const defaultAckTimeout = 5 * time.Second
+
+// Config of a load test
+type Config struct {
+	// URL of the websocket server, ex.: wss://localhost:4443
+	URL string
+
+	// TLSConfig holds the client certificate of the simulated vehicles, the vin is the common name of the certificate
+	TLSConfig *tls.Config
+
+	// Clients is the number of simulated vehicles, each with its own connection
+	Clients int
+
+	// Rate is the number of records each client sends per second
+	Rate float64
+
+	// Duration is how long clients send records
+	Duration time.Duration
+
+	// Fields is the number of data fields of the V records sent, at least one
+	Fields int
+
+	// AckTimeout is how long clients wait for the acks of the records they sent, defaults to 5s
+	AckTimeout time.Duration
+}
+
+// Summary reports the records sent during a load test and how long their acks took
+type Summary struct {
+	Clients  int
+	Sent     int64
+	Acked    int64
+	Errors   int64
+	Unacked  int64
+	Duration time.Duration
+
+	// RecordsPerSecond is the number of records acked per second of the test
+	RecordsPerSecond float64
+
+	// P50 and P99 are percentiles of the time between sending a record and receiving its ack
+	P50 time.Duration
+	P99 time.Duration
+}
+
+func (s *Summary) String() string {
+	return fmt.Sprintf("clients=%d sent=%d acked=%d errors=%d unacked=%d duration=%s records_per_sec=%.1f p50=%s p99=%s",
+		s.Clients, s.Sent, s.Acked, s.Errors, s.Unacked, s.Duration.Round(time.Millisecond), s.RecordsPerSecond, s.P50, s.P99)
+}
+
+// Run connects the clients, sends records at the configured rate until the duration elapsed or ctx is done,
+// then waits for the outstanding acks
+func Run(ctx context.Context, config Config) (*Summary, error) {
+	if config.Clients < 1 || config.Rate <= 0 || config.Duration <= 0 {
+		return nil, errors.New("clients, rate and duration must be positive")
+	}
+	if config.TLSConfig == nil || len(config.TLSConfig.Certificates) == 0 {
+		return nil, errors.New("a client certificate is required")
+	}
+	if config.AckTimeout == 0 {
+		config.AckTimeout = defaultAckTimeout
+	}
+	senderID, vin, err := certificateIdentity(config.TLSConfig.Certificates[0])
+	if err != nil {
+		return nil, err
+	}
+	payload, err := generatePayload(vin, config.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &websocket.Dialer{TLSClientConfig: config.TLSConfig, HandshakeTimeout: 10 * time.Second}
+	clients := make([]*client, config.Clients)
+	for i := range clients {
+		conn, _, err := dialer.DialContext(ctx, config.URL, nil)
+		if err != nil {
+			for _, c := range clients[:i] {
+				_ = c.conn.Close()
+			}
+			return nil, fmt.Errorf("client %d: %w", i, err)
+		}
+		clients[i] = &client{id: i, conn: conn, senderID: senderID, payload: payload, sentAt: make(map[string]time.Time)}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			c.run(ctx, config.Rate, config.AckTimeout)
+		}(c)
+	}
+	wg.Wait()
+	return summarize(clients, time.Since(start)), nil
+}
+
+// client is a simulated vehicle
+type client struct {
+	id       int
+	conn     *websocket.Conn
+	senderID string
+	payload  []byte
+
+	mu        sync.Mutex
+	sentAt    map[string]time.Time
+	sent      int64
+	errors    int64
+	latencies []time.Duration
+}
+
+func (c *client) run(ctx context.Context, rate float64, ackTimeout time.Duration) {
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		c.readAcks()
+	}()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for sequence := 0; ; sequence++ {
+		select {
+		case <-ctx.Done():
+			c.awaitAcks(ackTimeout)
+			_ = c.conn.Close()
+			<-received
+			return
+		case <-ticker.C:
+			if err := c.send(fmt.Sprintf("%d-%d", c.id, sequence)); err != nil {
+				_ = c.conn.Close()
+				<-received
+				return
+			}
+		}
+	}
+}
+
+func (c *client) send(txid string) error {
+	message := messages.StreamMessage{
+		TXID:         []byte(txid),
+		SenderID:     []byte(c.senderID),
+		MessageTopic: []byte("V"),
+		Payload:      c.payload,
+		CreatedAt:    uint32(time.Now().Unix()),
+	}
+	data, err := message.ToBytes()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.sentAt[txid] = time.Now()
+	c.sent++
+	c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// readAcks records the latency of each ack until the connection is closed
+func (c *client) readAcks() {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		envelope := tesla.GetRootAsFlatbuffersEnvelope(data, 0)
+		txid := string(envelope.TxidBytes())
+		c.mu.Lock()
+		if sentAt, ok := c.sentAt[txid]; ok {
+			delete(c.sentAt, txid)
+			if envelope.MessageType() == tesla.MessageFlatbuffersStreamAck {
+				c.latencies = append(c.latencies, time.Since(sentAt))
+			} else {
+				c.errors++
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// awaitAcks waits until every record sent was acked, or for timeout
+func (c *client) awaitAcks(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		pending := len(c.sentAt)
+		c.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func summarize(clients []*client, duration time.Duration) *Summary {
+	summary := &Summary{Clients: len(clients), Duration: duration}
+	var latencies []time.Duration
+	for _, c := range clients {
+		c.mu.Lock()
+		summary.Sent += c.sent
+		summary.Errors += c.errors
+		summary.Unacked += int64(len(c.sentAt))
+		latencies = append(latencies, c.latencies...)
+		c.mu.Unlock()
+	}
+	summary.Acked = int64(len(latencies))
+	summary.RecordsPerSecond = float64(summary.Acked) / duration.Seconds()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	summary.P50 = percentile(latencies, 0.5)
+	summary.P99 = percentile(latencies, 0.99)
+	return summary
+}
+
+// percentile returns the value below which the fraction p of the sorted latencies fall
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// certificateIdentity returns the sender id and vin the server derives from the client certificate
+func certificateIdentity(cert tls.Certificate) (string, string, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return "", "", err
+		}
+	}
+	clientType, deviceID, err := messages.CreateIdentityFromCert(leaf)
+	if err != nil {
+		return "", "", err
+	}
+	return messages.BuildClientID(clientType, deviceID), deviceID, nil
+}
+
+// generatePayload returns a V payload with the given number of fields, skipping Unknown and cycling through
+// string, int and location values
+func generatePayload(vin string, fields int) ([]byte, error) {
+	data := make([]*protos.Datum, 0, max(fields, 1))
+	for i := 0; i < max(fields, 1); i++ {
+		datum := &protos.Datum{Key: protos.Field(i%(len(protos.Field_name)-1) + 1)}
+		switch i % 3 {
+		case 0:
+			datum.Value = &protos.Value{Value: &protos.Value_StringValue{StringValue: "load test"}}
+		case 1:
+			datum.Value = &protos.Value{Value: &protos.Value_IntValue{IntValue: int32(i)}}
+		default:
+			datum.Value = &protos.Value{Value: &protos.Value_LocationValue{LocationValue: &protos.LocationValue{Latitude: 37.412374, Longitude: -122.145867}}}
+		}
+		data = append(data, datum)
+	}
+	return proto.Marshal(&protos.Payload{Vin: vin, Data: data, CreatedAt: timestamppb.Now()})
+}
@@ -0,0 +1,13 @@
+package loadtest_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLoadtest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Loadtest Suite Tests")
+}
@@ -0,0 +1,95 @@
+package loadtest_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/config"
+	"github.com/teslamotors/fleet-telemetry/datastore/null"
+	logrus "github.com/teslamotors/fleet-telemetry/logger"
+	"github.com/teslamotors/fleet-telemetry/metrics/adapter/noop"
+	"github.com/teslamotors/fleet-telemetry/server/airbrake"
+	"github.com/teslamotors/fleet-telemetry/server/streaming"
+	"github.com/teslamotors/fleet-telemetry/telemetry"
+	"github.com/teslamotors/fleet-telemetry/test/loadtest"
+	"github.com/teslamotors/fleet-telemetry/tools/lib"
+)
+
+// keyPair loads the certificate generated by lib, its files are removed once the test ends
+func keyPair(certAndKey *lib.TestCertAndKey) tls.Certificate {
+	DeferCleanup(os.Remove, certAndKey.CertFile)
+	DeferCleanup(os.Remove, certAndKey.KeyFile)
+	cert, err := tls.LoadX509KeyPair(certAndKey.CertFile, certAndKey.KeyFile)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+var _ = Describe("Run", func() {
+	var (
+		producer  *null.Producer
+		url       string
+		tlsConfig *tls.Config
+	)
+
+	BeforeEach(func() {
+		ca, err := lib.GenerateRootSigningCert("TeslaMotors", nil)
+		Expect(err).NotTo(HaveOccurred())
+		serverCert, err := lib.GenerateServerTestKeyAndCert("localhost", nil, []string{"127.0.0.1"}, ca)
+		Expect(err).NotTo(HaveOccurred())
+		clientCert, err := lib.GenerateClientTestKeyAndCert("device-1", ca)
+		Expect(err).NotTo(HaveOccurred())
+		keyPair(ca)
+		caPool := x509.NewCertPool()
+		caPool.AddCert(ca.Cert)
+
+		conf := &config.Config{MetricCollector: noop.NewCollector()}
+		producer = null.NewProducer(conf.MetricCollector, nil, nil)
+		logger, _ := logrus.NoOpLogger()
+		_, s, err := streaming.InitServer(conf, airbrake.NewAirbrakeHandler(nil), map[string][]telemetry.Producer{"V": {producer}}, logger, streaming.NewSocketRegistry())
+		Expect(err).NotTo(HaveOccurred())
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(s.ServeBinaryWs(conf)))
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair(serverCert)}, ClientCAs: caPool, ClientAuth: tls.RequireAndVerifyClientCert}
+		srv.StartTLS()
+		DeferCleanup(srv.Close)
+
+		url = strings.Replace(srv.URL, "https", "wss", 1)
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{keyPair(clientCert)}, RootCAs: caPool}
+	})
+
+	It("sends records from every client and reports their acks", func() {
+		summary, err := loadtest.Run(context.Background(), loadtest.Config{
+			URL:       url,
+			TLSConfig: tlsConfig,
+			Clients:   3,
+			Rate:      50,
+			Duration:  300 * time.Millisecond,
+			Fields:    5,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(summary.Clients).To(Equal(3))
+		Expect(summary.Sent).To(BeNumerically(">", 3))
+		Expect(summary.Acked).To(Equal(summary.Sent))
+		Expect(summary.Errors).To(BeZero())
+		Expect(summary.Unacked).To(BeZero())
+		Expect(producer.Records()).To(Equal(summary.Sent))
+		Expect(summary.RecordsPerSecond).To(BeNumerically(">", 0))
+		Expect(summary.P99).To(BeNumerically(">=", summary.P50))
+		Expect(summary.String()).To(ContainSubstring("clients=3"))
+	})
+
+	It("requires a client certificate", func() {
+		_, err := loadtest.Run(context.Background(), loadtest.Config{URL: url, Clients: 1, Rate: 1, Duration: time.Second})
+		Expect(err).To(MatchError("a client certificate is required"))
+	})
+})
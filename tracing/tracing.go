@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+const defaultServiceName = "fleet-telemetry"
+
+// Config exports OpenTelemetry spans of the ingest pipeline to an OTLP collector
+type Config struct {
+	// Endpoint is the host:port of the OTLP http collector
+	Endpoint string `json:"endpoint"`
+
+	// Insecure sends the spans over http instead of https
+	Insecure bool `json:"insecure,omitempty"`
+
+	// SampleRate is the fraction of records traced, between 0 and 1, defaults to 1
+	SampleRate *float64 `json:"sample_rate,omitempty"`
+
+	// ServiceName is reported as the service.name resource attribute, defaults to fleet-telemetry
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+// Validate returns an error if the config contains unsupported values
+func (c *Config) Validate() error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("tracing endpoint is required")
+	}
+	if c.SampleRate != nil && (*c.SampleRate < 0 || *c.SampleRate > 1) {
+		return fmt.Errorf("invalid tracing sample_rate: %v", *c.SampleRate)
+	}
+	return nil
+}
+
+// Init registers the global tracer provider and trace context propagator, spans are not recorded when config is nil.
+// The returned function flushes the pending spans
+func Init(config *Config) (func(context.Context) error, error) {
+	if config == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	sampleRate := 1.0
+	if config.SampleRate != nil {
+		sampleRate = *config.SampleRate
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,29 @@
+package tracing_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/teslamotors/fleet-telemetry/tracing"
+)
+
+var _ = Describe("Tracing", func() {
+	It("is a no-op without config", func() {
+		shutdown, err := tracing.Init(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shutdown(context.Background())).To(Succeed())
+	})
+
+	It("requires an endpoint", func() {
+		_, err := tracing.Init(&tracing.Config{})
+		Expect(err).To(MatchError("tracing endpoint is required"))
+	})
+
+	It("rejects invalid sample rates", func() {
+		sampleRate := 1.5
+		_, err := tracing.Init(&tracing.Config{Endpoint: "localhost:4318", SampleRate: &sampleRate})
+		Expect(err).To(MatchError("invalid tracing sample_rate: 1.5"))
+	})
+})